@@ -0,0 +1,98 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Envelope wraps a signed command.
+type Envelope struct {
+	// the command, usually JSON
+	Payload string `json:"payload"`
+	// when the command was signed, in seconds since the unix epoch
+	Timestamp int64 `json:"timestamp"`
+	// unique per command, so it can't be replayed
+	Nonce string `json:"nonce"`
+	// one of the algorithms of Key
+	Algorithm string `json:"alg"`
+	// the signature of signedData, base64 encoded in JSON
+	Signature []byte `json:"signature"`
+}
+
+// signedData returns the data signed for the envelope, if it's published to
+// topic. The topic is part of it, so commands for one output can't be used
+// on another.
+func (e *Envelope) signedData(topic string) []byte {
+	return []byte(e.Algorithm + "\n" +
+		topic + "\n" +
+		strconv.FormatInt(e.Timestamp, 10) + "\n" +
+		e.Nonce + "\n" +
+		e.Payload)
+}
+
+// verify checks the signature of the envelope, published to topic, with key.
+func (e *Envelope) verify(topic string, key *Key) bool {
+	if e.Algorithm != key.Algorithm {
+		return false
+	}
+
+	switch key.Algorithm {
+	case AlgorithmEd25519:
+		return ed25519.Verify(key.publicKey, e.signedData(topic), e.Signature)
+	case AlgorithmHMACSHA256:
+		return hmac.Equal(e.Signature, hmacSHA256(key.secret, e.signedData(topic)))
+	default:
+		return false
+	}
+}
+
+// SignEd25519 wraps payload into an envelope for topic, signed with key, and
+// returns it JSON-encoded.
+func SignEd25519(key ed25519.PrivateKey, topic string, payload []byte) ([]byte, error) {
+	e, err := newEnvelope(AlgorithmEd25519, payload)
+	if err != nil {
+		return nil, err
+	}
+	e.Signature = ed25519.Sign(key, e.signedData(topic))
+	return json.Marshal(e)
+}
+
+// SignHMACSHA256 wraps payload into an envelope for topic, signed with the
+// shared secret, and returns it JSON-encoded.
+func SignHMACSHA256(secret []byte, topic string, payload []byte) ([]byte, error) {
+	e, err := newEnvelope(AlgorithmHMACSHA256, payload)
+	if err != nil {
+		return nil, err
+	}
+	e.Signature = hmacSHA256(secret, e.signedData(topic))
+	return json.Marshal(e)
+}
+
+// newEnvelope returns an unsigned envelope for payload, with the current time
+// and a random nonce.
+func newEnvelope(algorithm string, payload []byte) (*Envelope, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("unable to generate nonce: %w", err)
+	}
+
+	return &Envelope{
+		Payload:   string(payload),
+		Timestamp: time.Now().Unix(),
+		Nonce:     hex.EncodeToString(nonce),
+		Algorithm: algorithm,
+	}, nil
+}
+
+func hmacSHA256(secret []byte, data []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
@@ -0,0 +1,98 @@
+// Package auth verifies commands signed by trusted keys, so only whoever holds
+// one of them can control the displays, not everybody able to publish to the
+// broker.
+package auth
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Signature algorithms.
+const (
+	// signed with an Ed25519 private key, verified with the public key
+	AlgorithmEd25519 = "ed25519"
+	// signed and verified with the same shared secret
+	AlgorithmHMACSHA256 = "hmac-sha256"
+)
+
+// HMAC secrets shorter than this are rejected.
+const minSecretLength = 16
+
+// Key is a key commands can be verified with.
+type Key struct {
+	// one of the algorithms above
+	Algorithm string
+	// optional, logged whenever a command signed by this key is received
+	Name string
+
+	publicKey ed25519.PublicKey
+	secret    []byte
+}
+
+// ParseKey parses a key in the form `$algorithm:$base64Key`, optionally
+// followed by whitespace and a name.
+// For ed25519 the key is the public key, for hmac-sha256 the shared secret.
+func ParseKey(s string) (*Key, error) {
+	// The key itself is never part of errors, it might be a secret.
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("empty key")
+	}
+	algorithm, encoded, ok := strings.Cut(fields[0], ":")
+	if !ok {
+		return nil, fmt.Errorf("key is missing the algorithm")
+	}
+	b, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode %v key: %w", algorithm, err)
+	}
+
+	k := &Key{
+		Algorithm: algorithm,
+		Name:      strings.Join(fields[1:], " "),
+	}
+	switch algorithm {
+	case AlgorithmEd25519:
+		if len(b) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid ed25519 public key length %v, expected %v", len(b), ed25519.PublicKeySize)
+		}
+		k.publicKey = ed25519.PublicKey(b)
+	case AlgorithmHMACSHA256:
+		if len(b) < minSecretLength {
+			return nil, fmt.Errorf("hmac-sha256 secret too short, needs at least %v bytes", minSecretLength)
+		}
+		k.secret = b
+	default:
+		return nil, fmt.Errorf("unknown algorithm %q", algorithm)
+	}
+	return k, nil
+}
+
+// ParseKeys parses one key per line, in the format of ParseKey.
+// Empty lines and lines starting with # are ignored.
+func ParseKeys(r io.Reader) ([]*Key, error) {
+	var keys []*Key
+
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		k, err := ParseKey(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %w", lineNo, err)
+		}
+		keys = append(keys, k)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
@@ -0,0 +1,111 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// DefaultMaxAge is the default for Verifier.MaxAge.
+const DefaultMaxAge = 5 * time.Minute
+
+// Nonces longer than this are rejected.
+const maxNonceLength = 128
+
+var (
+	// ErrUnsigned is wrapped by errors about commands not wrapped in a signed
+	// envelope.
+	ErrUnsigned = errors.New("unsigned command")
+	// ErrStale is wrapped by errors about commands signed too long ago, or in
+	// the future.
+	ErrStale = errors.New("stale command")
+	// ErrReplayed is wrapped by errors about commands received before.
+	ErrReplayed = errors.New("replayed command")
+	// ErrBadSignature is wrapped by errors about commands not signed by any
+	// of the trusted keys.
+	ErrBadSignature = errors.New("bad signature")
+)
+
+// Verifier checks commands are signed by one of the trusted keys, recently,
+// and weren't received before.
+type Verifier struct {
+	// Commands with timestamps further away from the current time are
+	// rejected. Nonces are remembered for that long.
+	MaxAge time.Duration
+
+	keys []*Key
+	// Nonces are only kept in memory, so commands signed before the verifier
+	// was created are rejected, they might have been received before.
+	started time.Time
+
+	mu sync.Mutex
+	// nonces of all commands received, and when they can be forgotten
+	nonces map[string]time.Time
+}
+
+// NewVerifier returns a Verifier trusting the given keys.
+func NewVerifier(keys []*Key) *Verifier {
+	return &Verifier{
+		MaxAge:  DefaultMaxAge,
+		keys:    keys,
+		started: time.Now(),
+		nonces:  make(map[string]time.Time),
+	}
+}
+
+// Verify checks the envelope in payload, received on topic, and returns the
+// command wrapped in it, as well as the key it's signed with.
+func (v *Verifier) Verify(topic string, payload []byte) ([]byte, *Key, error) {
+	var e Envelope
+	if err := json.Unmarshal(payload, &e); err != nil {
+		return nil, nil, fmt.Errorf("%w: unable to parse envelope: %v", ErrUnsigned, err)
+	}
+	if len(e.Signature) == 0 {
+		return nil, nil, fmt.Errorf("%w: missing signature", ErrUnsigned)
+	}
+	if e.Nonce == "" || len(e.Nonce) > maxNonceLength {
+		return nil, nil, fmt.Errorf("%w: missing or too long nonce", ErrUnsigned)
+	}
+
+	now := time.Now()
+	signed := time.Unix(e.Timestamp, 0)
+	if age := now.Sub(signed); age > v.MaxAge || age < -v.MaxAge {
+		return nil, nil, fmt.Errorf("%w: signed at %v, more than %v from now", ErrStale, signed.UTC().Format(time.RFC3339), v.MaxAge)
+	}
+	// timestamps only have a precision of seconds, commands signed in the
+	// second the agent started are accepted.
+	if signed.Before(v.started.Truncate(time.Second)) {
+		return nil, nil, fmt.Errorf("%w: signed at %v, before the agent started", ErrStale, signed.UTC().Format(time.RFC3339))
+	}
+
+	var key *Key
+	for _, k := range v.keys {
+		if e.verify(topic, k) {
+			key = k
+			break
+		}
+	}
+	if key == nil {
+		return nil, nil, fmt.Errorf("%w: not signed by any trusted %v key for %v", ErrBadSignature, e.Algorithm, topic)
+	}
+
+	// only record nonces of valid commands, so nobody else can fill the
+	// cache.
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	for nonce, expires := range v.nonces {
+		if now.After(expires) {
+			delete(v.nonces, nonce)
+		}
+	}
+	if _, ok := v.nonces[e.Nonce]; ok {
+		return nil, nil, fmt.Errorf("%w: nonce %q was used before", ErrReplayed, e.Nonce)
+	}
+	// once stale, the command is rejected anyways.
+	v.nonces[e.Nonce] = signed.Add(v.MaxAge)
+
+	return []byte(e.Payload), key, nil
+}
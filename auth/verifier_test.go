@@ -0,0 +1,153 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+const testTopic = "screens/HDMI-A-1@machine/set"
+
+// newTestKey returns a private key, and the key verifying it.
+func newTestKey(t *testing.T, name string) (ed25519.PrivateKey, *Key) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("unable to generate key: %v", err)
+	}
+	key, err := ParseKey("ed25519:" + base64.StdEncoding.EncodeToString(pub) + " " + name)
+	if err != nil {
+		t.Fatalf("unable to parse key: %v", err)
+	}
+	return priv, key
+}
+
+// signAt returns an envelope for topic signed with key, at the given time.
+func signAt(t *testing.T, key ed25519.PrivateKey, topic string, payload string, at time.Time) []byte {
+	e, err := newEnvelope(AlgorithmEd25519, []byte(payload))
+	if err != nil {
+		t.Fatalf("unable to create envelope: %v", err)
+	}
+	e.Timestamp = at.Unix()
+	e.Signature = ed25519.Sign(key, e.signedData(topic))
+	b, err := json.Marshal(e)
+	if err != nil {
+		t.Fatalf("unable to marshal envelope: %v", err)
+	}
+	return b
+}
+
+// newTestVerifier returns a verifier trusting key, started a while ago.
+func newTestVerifier(keys ...*Key) *Verifier {
+	v := NewVerifier(keys)
+	v.started = time.Now().Add(-time.Hour)
+	return v
+}
+
+func TestVerifyEd25519(t *testing.T) {
+	priv, key := newTestKey(t, "ops")
+	v := newTestVerifier(key)
+
+	envelope, err := SignEd25519(priv, testTopic, []byte(`{"power": false}`))
+	if err != nil {
+		t.Fatalf("unable to sign: %v", err)
+	}
+	payload, signedBy, err := v.Verify(testTopic, envelope)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(payload) != `{"power": false}` {
+		t.Errorf("unexpected payload %q", payload)
+	}
+	if signedBy.Name != "ops" {
+		t.Errorf("expected the command to be signed by ops, got %q", signedBy.Name)
+	}
+}
+
+func TestVerifyHMACSHA256(t *testing.T) {
+	secret := []byte("secret shared with the sender")
+	key, err := ParseKey("hmac-sha256:" + base64.StdEncoding.EncodeToString(secret))
+	if err != nil {
+		t.Fatalf("unable to parse key: %v", err)
+	}
+	v := newTestVerifier(key)
+
+	envelope, err := SignHMACSHA256(secret, testTopic, []byte(`{"power": true}`))
+	if err != nil {
+		t.Fatalf("unable to sign: %v", err)
+	}
+	if _, _, err := v.Verify(testTopic, envelope); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	envelope, err = SignHMACSHA256([]byte("some other secret"), testTopic, []byte(`{"power": true}`))
+	if err != nil {
+		t.Fatalf("unable to sign: %v", err)
+	}
+	if _, _, err := v.Verify(testTopic, envelope); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("expected a bad signature, got %v", err)
+	}
+}
+
+func TestVerifyRejected(t *testing.T) {
+	priv, key := newTestKey(t, "ops")
+	otherPriv, _ := newTestKey(t, "other")
+	now := time.Now()
+
+	for _, tc := range []struct {
+		name     string
+		topic    string
+		envelope []byte
+		expected error
+	}{
+		{"unsigned", testTopic, []byte(`{"power": false}`), ErrUnsigned},
+		{"not json", testTopic, []byte(`power off`), ErrUnsigned},
+		{"stale", testTopic, signAt(t, priv, testTopic, `{}`, now.Add(-10*time.Minute)), ErrStale},
+		{"future", testTopic, signAt(t, priv, testTopic, `{}`, now.Add(10*time.Minute)), ErrStale},
+		{"wrong topic", "screens/DP-1@machine/set", signAt(t, priv, testTopic, `{}`, now), ErrBadSignature},
+		{"wrong key", testTopic, signAt(t, otherPriv, testTopic, `{}`, now), ErrBadSignature},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			v := newTestVerifier(key)
+			if _, _, err := v.Verify(tc.topic, tc.envelope); !errors.Is(err, tc.expected) {
+				t.Errorf("expected %v, got %v", tc.expected, err)
+			}
+		})
+	}
+}
+
+func TestVerifyReplayed(t *testing.T) {
+	priv, key := newTestKey(t, "ops")
+	v := newTestVerifier(key)
+
+	envelope := signAt(t, priv, testTopic, `{}`, time.Now())
+	if _, _, err := v.Verify(testTopic, envelope); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, _, err := v.Verify(testTopic, envelope); !errors.Is(err, ErrReplayed) {
+		t.Errorf("expected the command to be rejected as replayed, got %v", err)
+	}
+}
+
+// Nonces are lost when restarting, so commands signed before can't be
+// accepted, even if they're recent.
+func TestVerifySignedBeforeStart(t *testing.T) {
+	priv, key := newTestKey(t, "ops")
+	envelope := signAt(t, priv, testTopic, `{}`, time.Now().Add(-time.Minute))
+
+	if _, _, err := NewVerifier([]*Key{key}).Verify(testTopic, envelope); !errors.Is(err, ErrStale) {
+		t.Errorf("expected the command to be rejected as stale, got %v", err)
+	}
+
+	// commands signed in the second the agent started are accepted, even
+	// though their timestamp is truncated to before it.
+	v := NewVerifier([]*Key{key})
+	v.started = time.Now().Truncate(time.Second).Add(500 * time.Millisecond)
+	envelope = signAt(t, priv, testTopic, `{}`, v.started)
+	if _, _, err := v.Verify(testTopic, envelope); err != nil {
+		t.Errorf("expected the command signed when starting to be accepted, got %v", err)
+	}
+}
@@ -0,0 +1,312 @@
+// Package config reads the configuration of the agent from a TOML file, and
+// the environment variables overriding it.
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/flokli/display-agent/auth"
+	"github.com/flokli/display-agent/mqtt"
+	"github.com/flokli/display-agent/outputs"
+	"github.com/flokli/display-agent/scenario"
+	"github.com/flokli/display-agent/schedule"
+	log "github.com/sirupsen/logrus"
+)
+
+// Log formats.
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// Config is the configuration of the agent.
+type Config struct {
+	// If set, Home Assistant discovery configs are published below this
+	// prefix (usually "homeassistant").
+	HomeAssistantDiscoveryPrefix string `toml:"homeassistant_discovery_prefix"`
+	// How often all retained topics are published again, 0 disables it.
+	HeartbeatInterval time.Duration `toml:"heartbeat_interval"`
+	// If set, commands need to be signed by one of the keys in this file.
+	AuthKeysFile string `toml:"auth_keys_file"`
+	// If set, groups are read from this JSON file instead.
+	GroupsFile string `toml:"groups_file"`
+	// If set, the state set by commands is persisted in this file.
+	StateFile string `toml:"state_file"`
+
+	MQTT      MQTT      `toml:"mqtt"`
+	Backend   Backend   `toml:"backend"`
+	Log       Log       `toml:"log"`
+	Reconcile Reconcile `toml:"reconcile"`
+
+	Groups    map[string][]outputs.Match      `toml:"groups"`
+	Outputs   []outputs.OutputConfig          `toml:"outputs"`
+	Scenarios map[string]*scenario.Definition `toml:"scenarios"`
+	Schedule  *schedule.Schedule              `toml:"schedule"`
+
+	// invalid environment variables, reported by Validate
+	envErrs []error
+}
+
+// MQTT configures the connection to the broker.
+type MQTT struct {
+	ServerURL       string `toml:"server_url"`
+	TopicPrefix     string `toml:"topic_prefix"`
+	ProtocolVersion string `toml:"protocol_version"`
+	Username        string `toml:"username"`
+	// the password is read from a file, to keep it out of the config.
+	PasswordFile string `toml:"password_file"`
+	TLS          TLS    `toml:"tls"`
+}
+
+// TLS configures the TLS connection to the broker, see mqtt.TLSOptions.
+type TLS struct {
+	CAFile     string `toml:"ca_file"`
+	CertFile   string `toml:"cert_file"`
+	KeyFile    string `toml:"key_file"`
+	ServerName string `toml:"server_name"`
+}
+
+// Backend selects and configures the backend.
+type Backend struct {
+	Name            string            `toml:"name"`
+	RefreshInterval time.Duration     `toml:"refresh_interval"`
+	Params          map[string]string `toml:"params"`
+}
+
+// Log configures logging.
+type Log struct {
+	// one of the logrus levels
+	Level string `toml:"level"`
+	// one of the log formats above
+	Format string `toml:"format"`
+}
+
+// Reconcile configures how drift from the desired state is handled.
+type Reconcile struct {
+	// how often the observed state is compared, 0 disables it
+	Interval time.Duration `toml:"interval"`
+	// policies by field name, see outputs.ValidatePolicies
+	Policies map[string]string `toml:"policies"`
+}
+
+// Default returns the configuration used without a config file.
+func Default() *Config {
+	return &Config{
+		Backend: Backend{
+			Name:            "sway",
+			RefreshInterval: time.Second,
+		},
+		Log: Log{
+			Level:  log.DebugLevel.String(),
+			Format: LogFormatText,
+		},
+		Reconcile: Reconcile{
+			Interval: 30 * time.Second,
+		},
+	}
+}
+
+// Load reads the TOML file at path into c. Keys missing in the file keep
+// their current values, unknown keys are an error.
+func (c *Config) Load(path string) error {
+	md, err := toml.DecodeFile(path, c)
+	if err != nil {
+		return fmt.Errorf("unable to parse config file: %w", err)
+	}
+	if undecoded := md.Undecoded(); len(undecoded) != 0 {
+		return fmt.Errorf("unknown keys in config file: %v", undecoded)
+	}
+	return nil
+}
+
+// Validate checks the whole configuration, including the files it points to,
+// and returns all problems found, not only the first one.
+func (c *Config) Validate() []error {
+	errs := append([]error(nil), c.envErrs...)
+
+	if c.MQTT.ServerURL == "" {
+		errs = append(errs, fmt.Errorf("mqtt.server_url (MQTT_SERVER_URL) must be set"))
+	}
+	if c.MQTT.TopicPrefix == "" {
+		errs = append(errs, fmt.Errorf("mqtt.topic_prefix (MQTT_TOPIC_PREFIX) must be set"))
+	} else if strings.ContainsAny(c.MQTT.TopicPrefix, "+#") {
+		errs = append(errs, fmt.Errorf("mqtt.topic_prefix can't contain wildcards"))
+	}
+	if err := c.connectOptions().Validate(c.MQTT.ServerURL); err != nil {
+		errs = append(errs, fmt.Errorf("invalid mqtt configuration: %w", err))
+	}
+	if _, err := c.password(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if !slices.Contains(outputs.Backends(), c.Backend.Name) {
+		errs = append(errs, fmt.Errorf("unknown backend %v, available: %v", c.Backend.Name, outputs.Backends()))
+	}
+	if c.Backend.RefreshInterval <= 0 {
+		errs = append(errs, fmt.Errorf("backend.refresh_interval must be positive"))
+	}
+
+	if _, err := log.ParseLevel(c.Log.Level); err != nil {
+		errs = append(errs, fmt.Errorf("invalid log.level: %w", err))
+	}
+	if c.Log.Format != LogFormatText && c.Log.Format != LogFormatJSON {
+		errs = append(errs, fmt.Errorf("invalid log.format %q, must be %v or %v", c.Log.Format, LogFormatText, LogFormatJSON))
+	}
+
+	if c.HeartbeatInterval < 0 {
+		errs = append(errs, fmt.Errorf("heartbeat_interval can't be negative"))
+	}
+	if c.Reconcile.Interval < 0 {
+		errs = append(errs, fmt.Errorf("reconcile.interval can't be negative"))
+	}
+	if err := outputs.ValidatePolicies(c.Reconcile.Policies); err != nil {
+		errs = append(errs, fmt.Errorf("invalid reconcile.policies: %w", err))
+	}
+	if c.AuthKeysFile != "" {
+		if _, err := c.AuthKeys(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if groups, err := c.LoadGroups(); err != nil {
+		errs = append(errs, err)
+	} else if err := outputs.ValidateGroups(groups); err != nil {
+		errs = append(errs, fmt.Errorf("invalid groups: %w", err))
+	}
+
+	for name, d := range c.Scenarios {
+		if err := d.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("invalid scenario %v: %w", name, err))
+		}
+	}
+	if err := outputs.ValidateOutputConfigs(c.Outputs); err != nil {
+		errs = append(errs, fmt.Errorf("invalid outputs: %w", err))
+	}
+	for i, o := range c.Outputs {
+		if o.Scenario == nil {
+			continue
+		}
+		if err := c.validateScenario(o.Scenario); err != nil {
+			errs = append(errs, fmt.Errorf("invalid scenario of output config %v: %w", i, err))
+		}
+	}
+	if c.Schedule != nil {
+		if err := c.Schedule.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("invalid schedule: %w", err))
+		}
+		for _, e := range c.Schedule.Entries {
+			if e == nil || e.State.Scenario == nil {
+				continue
+			}
+			if err := c.validateScenario(e.State.Scenario); err != nil {
+				errs = append(errs, fmt.Errorf("invalid scenario of schedule entry %v: %w", e.Name, err))
+			}
+		}
+	}
+
+	return errs
+}
+
+// validateScenario checks sc is either defined in the config or built in, and
+// accepts its args.
+func (c *Config) validateScenario(sc *outputs.Scenario) error {
+	d, ok := c.Scenarios[sc.Name]
+	if !ok {
+		d, ok = scenario.Lookup(sc.Name)
+	}
+	if !ok {
+		return fmt.Errorf("unknown scenario %q", sc.Name)
+	}
+	if _, err := d.Argv(sc.Args); err != nil {
+		return err
+	}
+	return nil
+}
+
+// MQTTOptions returns the options to connect to the broker with, including
+// the password read from PasswordFile.
+func (c *Config) MQTTOptions() (*mqtt.ConnectOptions, error) {
+	options := c.connectOptions()
+	password, err := c.password()
+	if err != nil {
+		return nil, err
+	}
+	options.Password = password
+	return options, nil
+}
+
+// connectOptions returns the options to connect to the broker with, without
+// the password.
+func (c *Config) connectOptions() *mqtt.ConnectOptions {
+	return &mqtt.ConnectOptions{
+		ProtocolVersion: c.MQTT.ProtocolVersion,
+		TLS: mqtt.TLSOptions{
+			CAFile:     c.MQTT.TLS.CAFile,
+			CertFile:   c.MQTT.TLS.CertFile,
+			KeyFile:    c.MQTT.TLS.KeyFile,
+			ServerName: c.MQTT.TLS.ServerName,
+		},
+		Username: c.MQTT.Username,
+	}
+}
+
+// password reads the password from PasswordFile, if set.
+func (c *Config) password() (string, error) {
+	if c.MQTT.PasswordFile == "" {
+		return "", nil
+	}
+	if c.MQTT.Username == "" {
+		return "", fmt.Errorf("mqtt.password_file is set, but mqtt.username isn't")
+	}
+
+	password, err := os.ReadFile(c.MQTT.PasswordFile)
+	if err != nil {
+		return "", fmt.Errorf("unable to read password file: %w", err)
+	}
+	return strings.TrimRight(string(password), "\r\n"), nil
+}
+
+// LoadGroups returns the groups read from GroupsFile if set, or Groups
+// otherwise.
+func (c *Config) LoadGroups() (map[string][]outputs.Match, error) {
+	if c.GroupsFile == "" {
+		return c.Groups, nil
+	}
+
+	b, err := os.ReadFile(c.GroupsFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read groups file: %w", err)
+	}
+
+	var groups map[string][]outputs.Match
+	if err := json.Unmarshal(b, &groups); err != nil {
+		return nil, fmt.Errorf("unable to parse groups file: %w", err)
+	}
+	return groups, nil
+}
+
+// AuthKeys returns the keys trusted to sign commands, read from AuthKeysFile
+// in the format of auth.ParseKeys.
+func (c *Config) AuthKeys() ([]*auth.Key, error) {
+	f, err := os.Open(c.AuthKeysFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open auth keys file: %w", err)
+	}
+	defer f.Close()
+
+	keys, err := auth.ParseKeys(f)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse auth keys file: %w", err)
+	}
+	// no keys would silently reject all commands.
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("auth keys file %v contains no keys", c.AuthKeysFile)
+	}
+
+	return keys, nil
+}
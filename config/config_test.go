@@ -0,0 +1,241 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	_ "github.com/flokli/display-agent/outputs/sway"
+)
+
+// writeFile writes content to a file named name in a temporary directory, and
+// returns its path.
+func writeFile(t *testing.T, name string, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("unable to write %v: %v", name, err)
+	}
+	return path
+}
+
+// validConfig returns the default configuration, with everything set that
+// needs to be.
+func validConfig() *Config {
+	c := Default()
+	c.MQTT.ServerURL = "tcp://broker:1883"
+	c.MQTT.TopicPrefix = "screens"
+	return c
+}
+
+func TestDefault(t *testing.T) {
+	c := Default()
+	if c.Backend.Name != "sway" || c.Backend.RefreshInterval != time.Second {
+		t.Errorf("unexpected default backend: %+v", c.Backend)
+	}
+	if c.Log.Level != "debug" || c.Log.Format != LogFormatText {
+		t.Errorf("unexpected default log config: %+v", c.Log)
+	}
+	if c.HeartbeatInterval != 0 {
+		t.Errorf("expected the heartbeat to be off, got %v", c.HeartbeatInterval)
+	}
+	if c.Reconcile.Interval != 30*time.Second || c.Reconcile.Policies != nil {
+		t.Errorf("expected reconciling with the default policies, got %+v", c.Reconcile)
+	}
+
+	// only the broker is missing.
+	errs := c.Validate()
+	if len(errs) != 2 {
+		t.Errorf("expected the server url and topic prefix to be missing, got %v", errs)
+	}
+	if errs := validConfig().Validate(); len(errs) != 0 {
+		t.Errorf("unexpected errors: %v", errs)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		content string
+		err     string
+		check   func(*Config) bool
+	}{
+		{
+			name: "valid",
+			content: `
+heartbeat_interval = "1m"
+
+[mqtt]
+server_url = "mqtts://broker:8883"
+
+[backend.params]
+fixture = "outputs.json"
+`,
+			// keys missing in the file keep their defaults.
+			check: func(c *Config) bool {
+				return c.HeartbeatInterval == time.Minute &&
+					c.MQTT.ServerURL == "mqtts://broker:8883" &&
+					c.Backend.Name == "sway" &&
+					c.Backend.Params["fixture"] == "outputs.json"
+			},
+		},
+		{
+			name:    "unknown key",
+			content: "[mqtt]\nserver = \"tcp://broker:1883\"\n",
+			err:     "unknown keys in config file: [mqtt.server]",
+		},
+		{
+			name:    "unknown table",
+			content: "[logging]\nlevel = \"debug\"\n",
+			err:     "unknown keys in config file",
+		},
+		{
+			name:    "invalid toml",
+			content: "[mqtt\n",
+			err:     "unable to parse config file",
+		},
+		{
+			name:    "invalid type",
+			content: "heartbeat_interval = true\n",
+			err:     "unable to parse config file",
+		},
+	} {
+		c := Default()
+		err := c.Load(writeFile(t, "config.toml", tc.content))
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%v: expected an error containing %q, got %v", tc.name, tc.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: unexpected error: %v", tc.name, err)
+			continue
+		}
+		if !tc.check(c) {
+			t.Errorf("%v: unexpected config: %+v", tc.name, c)
+		}
+	}
+
+	if err := Default().Load(filepath.Join(t.TempDir(), "missing.toml")); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
+
+// All problems are reported at once.
+func TestValidate(t *testing.T) {
+	c := Default()
+	c.MQTT.TopicPrefix = "screens/#"
+	c.MQTT.ProtocolVersion = "4"
+	c.MQTT.PasswordFile = "/run/secrets/mqtt-password"
+	c.Backend.Name = "x11"
+	c.Backend.RefreshInterval = 0
+	c.Log.Level = "loud"
+	c.Log.Format = "xml"
+	c.HeartbeatInterval = -time.Second
+	c.Reconcile.Interval = -time.Second
+	c.Reconcile.Policies = map[string]string{"scale": "ignore"}
+	c.AuthKeysFile = filepath.Join(t.TempDir(), "missing")
+	c.ApplyEnv([]string{"HEARTBEAT_INTERVAL=soon"})
+
+	expected := []string{
+		"invalid HEARTBEAT_INTERVAL",
+		"mqtt.server_url (MQTT_SERVER_URL) must be set",
+		"mqtt.topic_prefix can't contain wildcards",
+		"unsupported mqtt protocol version: 4",
+		"mqtt.password_file is set, but mqtt.username isn't",
+		"unknown backend x11",
+		"backend.refresh_interval must be positive",
+		"invalid log.level",
+		"invalid log.format",
+		"heartbeat_interval can't be negative",
+		"reconcile.interval can't be negative",
+		"invalid reconcile.policies",
+		"unable to open auth keys file",
+	}
+	errs := c.Validate()
+	if len(errs) != len(expected) {
+		t.Errorf("expected %v errors, got %v: %v", len(expected), len(errs), errs)
+	}
+	for _, e := range expected {
+		found := false
+		for _, err := range errs {
+			if strings.Contains(err.Error(), e) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("expected an error containing %q, got %v", e, errs)
+		}
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	c := Default()
+	if err := c.Load(writeFile(t, "config.toml", `
+state_file = "/var/lib/display-agent/state.json"
+
+[mqtt]
+server_url = "tcp://broker:1883"
+topic_prefix = "screens"
+
+[backend]
+name = "sway"
+params = { swaysock = "/run/sway.sock", fixture = "outputs.json" }
+`)); err != nil {
+		t.Fatalf("unable to load config: %v", err)
+	}
+
+	c.ApplyEnv([]string{
+		"MQTT_SERVER_URL=mqtts://broker:8883",
+		"MQTT_TLS_SERVER_NAME=broker.example.com",
+		"REFRESH_INTERVAL=10s",
+		// BACKEND_$KEY sets the parameter with the lowercased key.
+		"BACKEND_SWAYSOCK=/run/user/1000/sway.sock",
+		"BACKEND_I3SOCK=/run/i3.sock",
+		// without a key, it's ignored.
+		"BACKEND_=ignored",
+		// empty variables don't override the file.
+		"STATE_FILE=",
+		"LOG_LEVEL=debug",
+		"PATH=/usr/bin",
+	})
+
+	if c.MQTT.ServerURL != "mqtts://broker:8883" || c.MQTT.TLS.ServerName != "broker.example.com" {
+		t.Errorf("expected the mqtt config to be overridden, got %+v", c.MQTT)
+	}
+	if c.MQTT.TopicPrefix != "screens" {
+		t.Errorf("expected the topic prefix of the file to be kept, got %q", c.MQTT.TopicPrefix)
+	}
+	if c.Backend.RefreshInterval != 10*time.Second {
+		t.Errorf("expected the refresh interval to be overridden, got %v", c.Backend.RefreshInterval)
+	}
+	expectedParams := map[string]string{
+		"swaysock": "/run/user/1000/sway.sock",
+		"i3sock":   "/run/i3.sock",
+		"fixture":  "outputs.json",
+	}
+	if !reflect.DeepEqual(c.Backend.Params, expectedParams) {
+		t.Errorf("expected params %v, got %v", expectedParams, c.Backend.Params)
+	}
+	if c.StateFile != "/var/lib/display-agent/state.json" {
+		t.Errorf("expected the state file of the file to be kept, got %q", c.StateFile)
+	}
+	if c.Log.Level != "debug" {
+		t.Errorf("expected the log level to be overridden, got %q", c.Log.Level)
+	}
+	if errs := c.Validate(); len(errs) != 0 {
+		t.Errorf("unexpected errors: %v", errs)
+	}
+
+	// invalid values are reported by Validate, and don't override anything.
+	c.ApplyEnv([]string{"REFRESH_INTERVAL=often"})
+	if c.Backend.RefreshInterval != 10*time.Second {
+		t.Errorf("expected the refresh interval to be kept, got %v", c.Backend.RefreshInterval)
+	}
+	if errs := c.Validate(); len(errs) != 1 || !strings.Contains(errs[0].Error(), "invalid REFRESH_INTERVAL") {
+		t.Errorf("expected the invalid variable to be reported, got %v", errs)
+	}
+}
@@ -0,0 +1,70 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ApplyEnv overrides the configuration with the environment variables set in
+// environ (in the format of os.Environ). Empty variables are ignored, invalid
+// ones are reported by Validate.
+func (c *Config) ApplyEnv(environ []string) {
+	env := make(map[string]string)
+	for _, kv := range environ {
+		k, v, _ := strings.Cut(kv, "=")
+		if v != "" {
+			env[k] = v
+		}
+	}
+
+	setString := func(key string, dst *string) {
+		if v, ok := env[key]; ok {
+			*dst = v
+		}
+	}
+	setDuration := func(key string, dst *time.Duration) {
+		v, ok := env[key]
+		if !ok {
+			return
+		}
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			c.envErrs = append(c.envErrs, fmt.Errorf("invalid %v: %w", key, err))
+			return
+		}
+		*dst = d
+	}
+
+	setString("MQTT_SERVER_URL", &c.MQTT.ServerURL)
+	setString("MQTT_TOPIC_PREFIX", &c.MQTT.TopicPrefix)
+	setString("MQTT_PROTOCOL_VERSION", &c.MQTT.ProtocolVersion)
+	setString("MQTT_USERNAME", &c.MQTT.Username)
+	setString("MQTT_PASSWORD_FILE", &c.MQTT.PasswordFile)
+	setString("MQTT_CA_FILE", &c.MQTT.TLS.CAFile)
+	setString("MQTT_CERT_FILE", &c.MQTT.TLS.CertFile)
+	setString("MQTT_KEY_FILE", &c.MQTT.TLS.KeyFile)
+	setString("MQTT_TLS_SERVER_NAME", &c.MQTT.TLS.ServerName)
+
+	setString("BACKEND", &c.Backend.Name)
+	setDuration("REFRESH_INTERVAL", &c.Backend.RefreshInterval)
+	// BACKEND_$KEY=$value sets the parameter with the lowercased key.
+	for k, v := range env {
+		if key, ok := strings.CutPrefix(k, "BACKEND_"); ok && key != "" {
+			if c.Backend.Params == nil {
+				c.Backend.Params = make(map[string]string)
+			}
+			c.Backend.Params[strings.ToLower(key)] = v
+		}
+	}
+
+	setString("LOG_LEVEL", &c.Log.Level)
+	setString("LOG_FORMAT", &c.Log.Format)
+
+	setString("HOMEASSISTANT_DISCOVERY_PREFIX", &c.HomeAssistantDiscoveryPrefix)
+	setDuration("HEARTBEAT_INTERVAL", &c.HeartbeatInterval)
+	setString("AUTH_KEYS_FILE", &c.AuthKeysFile)
+	setString("GROUPS_FILE", &c.GroupsFile)
+	setString("STATE_FILE", &c.StateFile)
+	setDuration("RECONCILE_INTERVAL", &c.Reconcile.Interval)
+}
@@ -2,18 +2,58 @@ package main
 
 import (
 	"context"
+	"flag"
 	"os"
 	"os/signal"
+	"syscall"
 
+	"github.com/flokli/display-agent/auth"
+	"github.com/flokli/display-agent/config"
+	"github.com/flokli/display-agent/outputs"
+	"github.com/flokli/display-agent/scenario"
 	"github.com/flokli/display-agent/server"
 	log "github.com/sirupsen/logrus"
+
+	// backends register themselves in their init functions.
+	_ "github.com/flokli/display-agent/outputs/hyprland"
+	_ "github.com/flokli/display-agent/outputs/i3"
+	_ "github.com/flokli/display-agent/outputs/simulated"
+	_ "github.com/flokli/display-agent/outputs/sway"
+	_ "github.com/flokli/display-agent/outputs/wlroots"
 )
 
+// version is set at build time, with
+// -ldflags "-X main.version=$version".
+var version = "dev"
+
 func main() {
-	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	configFile := flag.String("config", "", "path to a TOML config file, overridden by environment variables")
+	flag.Parse()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
 
-	log.SetLevel(log.DebugLevel)
+	cfg := config.Default()
+	if *configFile != "" {
+		if err := cfg.Load(*configFile); err != nil {
+			log.WithError(err).Error("Unable to load config")
+			os.Exit(1)
+		}
+	}
+	cfg.ApplyEnv(os.Environ())
+	if errs := cfg.Validate(); len(errs) != 0 {
+		for _, err := range errs {
+			log.WithError(err).Error("Invalid configuration")
+		}
+		os.Exit(1)
+	}
+
+	// validated above.
+	level, _ := log.ParseLevel(cfg.Log.Level)
+	log.SetLevel(level)
+	if cfg.Log.Format == config.LogFormatJSON {
+		log.SetFormatter(&log.JSONFormatter{})
+	}
 
 	// get machine id
 	machineID, err := GetMachineID()
@@ -22,25 +62,60 @@ func main() {
 		os.Exit(1)
 	}
 
-	// MQTT_SERVER_URL
-	mqttServerUrl := os.Getenv("MQTT_SERVER_URL")
-	if mqttServerUrl == "" {
-		panic("MQTT_SERVER_URL must be set")
+	// before the backend is set up, it might use them.
+	for name, d := range cfg.Scenarios {
+		if err := scenario.Define(name, d); err != nil {
+			log.WithError(err).Error("Unable to define scenario")
+			os.Exit(1)
+		}
+	}
+
+	backend, err := outputs.NewBackend(cfg.Backend.Name, outputs.BackendOptions{
+		RefreshInterval: cfg.Backend.RefreshInterval,
+		Params:          cfg.Backend.Params,
+	})
+	if err != nil {
+		log.WithError(err).Error("Unable to set up backend")
+		os.Exit(1)
 	}
 
-	// MQTT_TOPIC_PREFIX
-	mqttTopicPrefix := os.Getenv("MQTT_TOPIC_PREFIX")
-	if mqttTopicPrefix == "" {
-		panic("MQTT_TOPIC_PREFIX must be set")
+	s := server.New(machineID, cfg.MQTT.TopicPrefix, backend)
+	s.Version = version
+	s.BackendName = cfg.Backend.Name
+	s.HomeAssistantDiscoveryPrefix = cfg.HomeAssistantDiscoveryPrefix
+	s.HeartbeatInterval = cfg.HeartbeatInterval
+	s.OutputConfigs = cfg.Outputs
+	s.StateFile = cfg.StateFile
+	s.ReconcileInterval = cfg.Reconcile.Interval
+	s.Policies = cfg.Reconcile.Policies
+	s.Schedule = cfg.Schedule
+
+	// The files were read by Validate already, but might have changed since.
+	if s.Groups, err = cfg.LoadGroups(); err != nil {
+		log.WithError(err).Error("Invalid groups")
+		os.Exit(1)
+	}
+	if cfg.AuthKeysFile != "" {
+		keys, err := cfg.AuthKeys()
+		if err != nil {
+			log.WithError(err).Error("Invalid auth keys")
+			os.Exit(1)
+		}
+		s.Verifier = auth.NewVerifier(keys)
+	}
+	mqttOptions, err := cfg.MQTTOptions()
+	if err != nil {
+		log.WithError(err).Error("Invalid MQTT configuration")
+		os.Exit(1)
 	}
+	s.MQTTOptions = *mqttOptions
 
-	s := server.New(machineID, mqttTopicPrefix)
-	if err := s.Run(ctx, mqttServerUrl); err != nil {
+	if err := s.Run(ctx, cfg.MQTT.ServerURL); err != nil {
 		log.WithError(err).Errorf("Server failed")
 		os.Exit(1)
 	}
 
-	// Listen for the interrupt signal
+	// Listen for the interrupt and termination signals
 	<-ctx.Done()
 	s.Close()
 }
@@ -2,86 +2,225 @@ package mqtt
 
 import (
 	"fmt"
+	"sync"
 	"time"
 
-	mqtt "github.com/eclipse/paho.mqtt.golang"
 	log "github.com/sirupsen/logrus"
 )
 
 const (
 	timeout = 10 * time.Second
+
+	// while disconnected, reconnects are attempted with an exponential backoff
+	// between these delays.
+	minReconnectDelay = 1 * time.Second
+	maxReconnectDelay = 2 * time.Minute
+
+	// how long the broker keeps a persistent session after the connection is
+	// lost (MQTT 5 only, 3.1.1 brokers keep it forever).
+	sessionExpiry = 24 * time.Hour
+)
+
+// Protocol versions understood by Connect.
+const (
+	ProtocolVersion311 = "3.1.1"
+	ProtocolVersion5   = "5"
 )
 
-func Connect(serverURL string) (mqtt.Client, error) {
-	opts := mqtt.NewClientOptions().AddBroker(serverURL)
-	client := mqtt.NewClient(opts)
+// Message is a message published to, or received from the broker.
+// ResponseTopic, CorrelationData, MessageExpiry and UserProperties are MQTT 5
+// properties. They're dropped when publishing with MQTT 3.1.1, and never set on
+// received messages.
+type Message struct {
+	Topic    string
+	Payload  []byte
+	QoS      byte
+	Retained bool
+
+	// the topic a response to this message should be published to
+	ResponseTopic string
+	// sent back as-is in the response
+	CorrelationData []byte
+	// If non-zero, the broker discards the message if it couldn't be delivered
+	// within this duration. Rounded up to full seconds.
+	MessageExpiry time.Duration
+	// arbitrary key/value pairs
+	UserProperties map[string]string
+}
+
+// MessageHandler is called for every message received on a subscribed topic.
+type MessageHandler func(*Message)
+
+// Client is a connection to the broker, speaking one of the protocol versions.
+type Client interface {
+	// Publish sends a message, and waits until it's sent.
+	Publish(m *Message) error
+	// Subscribe subscribes to a topic. Even if it fails (for example while
+	// disconnected), the subscription is kept, and retried after
+	// reconnecting.
+	Subscribe(topic string, qos byte, handler MessageHandler) error
+	Unsubscribe(topics ...string) error
+	// Disconnect cleanly disconnects from the broker, so the will isn't sent.
+	Disconnect()
+}
+
+type subscription struct {
+	qos     byte
+	handler MessageHandler
+}
 
-	token := client.Connect()
-	completed := token.WaitTimeout(timeout)
-	if !completed {
-		return nil, fmt.Errorf("timeout connecting to mqtt")
-	} else {
-		return client, token.Error()
+// subscriptions keeps track of all topics subscribed to, so they can be
+// subscribed to again after reconnecting.
+type subscriptions struct {
+	mu     sync.Mutex
+	topics map[string]subscription
+}
+
+func (s *subscriptions) add(topic string, qos byte, handler MessageHandler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.topics == nil {
+		s.topics = make(map[string]subscription)
+	}
+	s.topics[topic] = subscription{qos: qos, handler: handler}
+}
+
+func (s *subscriptions) remove(topics ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, topic := range topics {
+		delete(s.topics, topic)
+	}
+}
+
+// resubscribe calls subscribe for all topics subscribed to. Brokers not
+// keeping the session forget about them when the connection is lost.
+func (s *subscriptions) resubscribe(subscribe func(topic string, qos byte) error) {
+	s.mu.Lock()
+	topics := make(map[string]subscription, len(s.topics))
+	for topic, sub := range s.topics {
+		topics[topic] = sub
+	}
+	s.mu.Unlock()
+
+	for topic, sub := range topics {
+		l := log.WithField("topic", topic)
+		if err := subscribe(topic, sub.qos); err != nil {
+			l.WithError(err).Warn("unable to resubscribe")
+			continue
+		}
+		l.Debug("resubscribed")
+	}
+}
+
+// ConnectOptions configures the connection to the broker.
+type ConnectOptions struct {
+	// One of ProtocolVersion311, ProtocolVersion5. Defaults to
+	// ProtocolVersion311.
+	ProtocolVersion string
+
+	// If set, a persistent session is used, so the broker keeps the
+	// subscriptions (and queued messages) while disconnected.
+	// It needs to be unique per broker.
+	ClientID string
+
+	TLS TLSOptions
+
+	// credentials, sent if Username is set
+	Username string
+	Password string
+
+	// If set, the broker publishes WillPayload (retained) to WillTopic once
+	// the connection is lost without disconnecting cleanly.
+	WillTopic   string
+	WillPayload string
+
+	// Called whenever the connection is established, including reconnects,
+	// after all topics were subscribed to again.
+	OnConnect func(Client)
+}
+
+// Validate checks the protocol version is supported, and TLS is configured
+// consistently with serverURL, without connecting.
+func (o *ConnectOptions) Validate(serverURL string) error {
+	switch o.ProtocolVersion {
+	case "", ProtocolVersion311, ProtocolVersion5:
+	default:
+		return fmt.Errorf("unsupported mqtt protocol version: %v", o.ProtocolVersion)
+	}
+
+	_, err := tlsConfig(serverURL, *o)
+	return err
+}
+
+func Connect(serverURL string, options ConnectOptions) (Client, error) {
+	switch options.ProtocolVersion {
+	case "", ProtocolVersion311:
+		return connectV311(serverURL, options)
+	case ProtocolVersion5:
+		return connectV5(serverURL, options)
+	default:
+		return nil, fmt.Errorf("unsupported mqtt protocol version: %v", options.ProtocolVersion)
 	}
 }
 
 // Publishes a given value to the the broker at the given topic.
-// Non-strings are converted to their string representations.
-func Publish(mqttClient mqtt.Client, topic string, qos byte, retained bool, value interface{}) error {
-	payload := fmt.Sprintf("%v", value)
+// Byte slices are sent as-is, other non-strings are converted to their string
+// representations.
+func Publish(mqttClient Client, topic string, qos byte, retained bool, value interface{}) error {
+	var payload []byte
+	switch v := value.(type) {
+	case []byte:
+		payload = v
+	default:
+		payload = []byte(fmt.Sprintf("%v", value))
+	}
 
-	l := log.WithFields(log.Fields{
-		"topic":    topic,
-		"qos":      qos,
-		"retained": retained,
-		"value":    value,
-		"payload":  payload,
+	return PublishMessage(mqttClient, &Message{
+		Topic:    topic,
+		Payload:  payload,
+		QoS:      qos,
+		Retained: retained,
 	})
+}
 
-	token := mqttClient.Publish(topic, qos, retained, payload)
-	completed := token.WaitTimeout(timeout)
+// PublishMessage publishes a message, including its properties.
+func PublishMessage(mqttClient Client, m *Message) error {
+	l := log.WithFields(log.Fields{
+		"topic":    m.Topic,
+		"qos":      m.QoS,
+		"retained": m.Retained,
+		"payload":  string(m.Payload),
+	})
 
-	if !completed {
-		return fmt.Errorf("timeout publishing to mqtt")
-	} else {
-		if token.Error() == nil {
-			l.Trace("published message")
-		}
-		return token.Error()
+	if err := mqttClient.Publish(m); err != nil {
+		return err
 	}
+	l.Trace("published message")
+	return nil
 }
 
-func Subscribe(mqttClient mqtt.Client, topic string, qos byte, cb mqtt.MessageHandler) error {
+func Subscribe(mqttClient Client, topic string, qos byte, cb MessageHandler) error {
 	l := log.WithFields(log.Fields{
 		"topic": topic,
 		"qos":   qos,
 	})
 
-	token := mqttClient.Subscribe(topic, qos, cb)
-	completed := token.WaitTimeout(timeout)
-	if !completed {
-		return fmt.Errorf("timeout subscribing to mqtt")
-	} else {
-		if token.Error() == nil {
-			l.Debug("subscribed")
-		}
-		return token.Error()
+	if err := mqttClient.Subscribe(topic, qos, cb); err != nil {
+		return err
 	}
+	l.Debug("subscribed")
+	return nil
 }
 
-func Unsubscribe(mqttClient mqtt.Client, topics []string) error {
+func Unsubscribe(mqttClient Client, topics []string) error {
 	l := log.WithFields(log.Fields{
 		"topics": topics,
 	})
 
-	token := mqttClient.Unsubscribe(topics...)
-	completed := token.WaitTimeout(timeout)
-	if !completed {
-		return fmt.Errorf("timeout unsubscribing from mqtt")
-	} else {
-		if token.Error() == nil {
-			l.Debug("unsubscribed")
-		}
-		return token.Error()
+	if err := mqttClient.Unsubscribe(topics...); err != nil {
+		return err
 	}
+	l.Debug("unsubscribed")
+	return nil
 }
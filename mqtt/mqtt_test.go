@@ -0,0 +1,87 @@
+package mqtt
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// resubscribed returns the topics and QoS levels resubscribe subscribes to.
+func resubscribed(s *subscriptions) map[string]byte {
+	topics := make(map[string]byte)
+	s.resubscribe(func(topic string, qos byte) error {
+		topics[topic] = qos
+		return nil
+	})
+	return topics
+}
+
+func TestSubscriptions(t *testing.T) {
+	var s subscriptions
+	if topics := resubscribed(&s); len(topics) != 0 {
+		t.Errorf("expected no topics, got %v", topics)
+	}
+
+	s.add("screens/HDMI-A-1@machine/set", 0, func(*Message) {})
+	s.add("screens/VGA-1@machine/set", 0, func(*Message) {})
+	s.add("screens/machine/arrange", 1, func(*Message) {})
+	// subscribing again replaces the subscription.
+	s.add("screens/machine/arrange", 0, func(*Message) {})
+	expected := map[string]byte{
+		"screens/HDMI-A-1@machine/set": 0,
+		"screens/VGA-1@machine/set":    0,
+		"screens/machine/arrange":      0,
+	}
+	if topics := resubscribed(&s); !reflect.DeepEqual(topics, expected) {
+		t.Errorf("expected %v, got %v", expected, topics)
+	}
+
+	// unknown topics are ignored.
+	s.remove("screens/VGA-1@machine/set", "screens/DP-1@machine/set")
+	delete(expected, "screens/VGA-1@machine/set")
+	if topics := resubscribed(&s); !reflect.DeepEqual(topics, expected) {
+		t.Errorf("expected %v, got %v", expected, topics)
+	}
+}
+
+// Failing to resubscribe to a topic doesn't stop resubscribing to the others,
+// and the topic is kept for the next attempt.
+func TestResubscribeFailure(t *testing.T) {
+	var s subscriptions
+	for _, topic := range []string{"a", "b", "c"} {
+		s.add(topic, 0, func(*Message) {})
+	}
+
+	var attempted []string
+	s.resubscribe(func(topic string, _ byte) error {
+		attempted = append(attempted, topic)
+		if topic == "b" {
+			return errors.New("not connected")
+		}
+		return nil
+	})
+	sort.Strings(attempted)
+	if expected := []string{"a", "b", "c"}; !reflect.DeepEqual(attempted, expected) {
+		t.Errorf("expected %v to be attempted, got %v", expected, attempted)
+	}
+	if _, ok := resubscribed(&s)["b"]; !ok {
+		t.Error("expected the failed topic to be kept")
+	}
+}
+
+// Topics can be subscribed to and unsubscribed from while resubscribing, by
+// handlers called for retained messages, for example.
+func TestResubscribeConcurrently(t *testing.T) {
+	var s subscriptions
+	s.add("a", 0, func(*Message) {})
+
+	s.resubscribe(func(topic string, qos byte) error {
+		s.add("b", qos, func(*Message) {})
+		s.remove(topic)
+		return nil
+	})
+	if topics := resubscribed(&s); !reflect.DeepEqual(topics, map[string]byte{"b": 0}) {
+		t.Errorf("unexpected topics: %v", topics)
+	}
+}
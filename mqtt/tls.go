@@ -0,0 +1,119 @@
+package mqtt
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// TLSOptions configures TLS, which is used for ssl://, tls://, mqtts:// and
+// tcps:// (as well as wss://) server URLs.
+type TLSOptions struct {
+	// PEM file with the CA certificates used to verify the server.
+	// Defaults to the system roots.
+	CAFile string
+	// PEM files with the client certificate and key, for mutual TLS.
+	CertFile string
+	KeyFile  string
+	// If set, the server certificate is verified against this name, instead
+	// of the host in the server URL.
+	ServerName string
+}
+
+func (o *TLSOptions) isSet() bool {
+	return *o != TLSOptions{}
+}
+
+// config builds the tls.Config described by o.
+func (o *TLSOptions) config() (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName: o.ServerName,
+	}
+
+	if o.CAFile != "" {
+		caPEM, err := os.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read CA file: %w", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no PEM certificates found in CA file %v", o.CAFile)
+		}
+	}
+
+	if o.CertFile != "" || o.KeyFile != "" {
+		if o.CertFile == "" || o.KeyFile == "" {
+			return nil, fmt.Errorf("client certificate and key need to be set both")
+		}
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return cfg, nil
+}
+
+// usesTLS returns whether the given server URL connects via TLS, the same way
+// the paho clients decide it.
+func usesTLS(serverURL string) bool {
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return false
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "ssl", "tls", "mqtts", "mqtt+ssl", "tcps", "wss":
+		return true
+	}
+	return false
+}
+
+// tlsConfig checks the TLS options against the server URL, and returns the
+// tls.Config to use, or nil for plain connections.
+func tlsConfig(serverURL string, options ConnectOptions) (*tls.Config, error) {
+	if !usesTLS(serverURL) {
+		if options.TLS.isSet() {
+			return nil, fmt.Errorf("TLS is configured, but server url %v doesn't use TLS, use mqtts:// or ssl://", serverURL)
+		}
+		return nil, nil
+	}
+	return options.TLS.config()
+}
+
+// explainConnectError adds a hint about the likely cause to errors during the
+// TLS handshake.
+func explainConnectError(err error, usingTLS bool) error {
+	if !usingTLS {
+		return err
+	}
+
+	var (
+		unknownAuthorityErr   x509.UnknownAuthorityError
+		hostnameErr           x509.HostnameError
+		certificateInvalidErr x509.CertificateInvalidError
+		recordHeaderErr       tls.RecordHeaderError
+	)
+	switch {
+	case errors.As(err, &unknownAuthorityErr):
+		return fmt.Errorf("TLS handshake failed, the server certificate isn't signed by a trusted CA (check the CA file): %w", err)
+	case errors.As(err, &hostnameErr):
+		return fmt.Errorf("TLS handshake failed, the server certificate isn't valid for this host (check the server url or server name): %w", err)
+	case errors.As(err, &certificateInvalidErr):
+		return fmt.Errorf("TLS handshake failed, the server certificate is invalid: %w", err)
+	case errors.As(err, &recordHeaderErr):
+		return fmt.Errorf("TLS handshake failed, the server doesn't seem to speak TLS (check the port): %w", err)
+	// alerts sent by the server aren't exported by crypto/tls.
+	case strings.Contains(err.Error(), "remote error: tls:"):
+		return fmt.Errorf("TLS handshake failed, the server rejected the connection (check the client certificate): %w", err)
+	// the connection is closed if the server doesn't speak TLS.
+	case errors.Is(err, io.EOF) || strings.HasSuffix(err.Error(), ": EOF"):
+		return fmt.Errorf("TLS handshake failed, the server closed the connection (check the port): %w", err)
+	}
+	return err
+}
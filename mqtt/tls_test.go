@@ -0,0 +1,164 @@
+package mqtt
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeCertificate writes a self-signed certificate and its key to dir, and
+// returns the paths of both files.
+func writeCertificate(t *testing.T, dir string) (certFile string, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unable to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "display-agent"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("unable to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("unable to marshal key: %v", err)
+	}
+
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatalf("unable to write certificate: %v", err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatalf("unable to write key: %v", err)
+	}
+	return certFile, keyFile
+}
+
+func TestUsesTLS(t *testing.T) {
+	for serverURL, expected := range map[string]bool{
+		"tcp://broker:1883":   false,
+		"mqtt://broker:1883":  false,
+		"ws://broker:80":      false,
+		"ssl://broker:8883":   true,
+		"TLS://broker:8883":   true,
+		"mqtts://broker:8883": true,
+		"tcps://broker:8883":  true,
+		"wss://broker:443":    true,
+	} {
+		if got := usesTLS(serverURL); got != expected {
+			t.Errorf("%v: expected %v, got %v", serverURL, expected, got)
+		}
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeCertificate(t, dir)
+	notPEM := filepath.Join(dir, "not.pem")
+	if err := os.WriteFile(notPEM, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatalf("unable to write file: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name      string
+		serverURL string
+		tls       TLSOptions
+		// whether a tls.Config is expected
+		expected bool
+		err      string
+	}{
+		{name: "plain", serverURL: "tcp://broker:1883"},
+		{name: "system roots", serverURL: "mqtts://broker:8883", expected: true},
+		{name: "ca", serverURL: "mqtts://broker:8883", tls: TLSOptions{CAFile: certFile}, expected: true},
+		{name: "client certificate", serverURL: "ssl://broker:8883", tls: TLSOptions{CertFile: certFile, KeyFile: keyFile}, expected: true},
+		{name: "server name", serverURL: "ssl://10.0.0.1:8883", tls: TLSOptions{ServerName: "broker"}, expected: true},
+		{name: "plain url", serverURL: "tcp://broker:1883", tls: TLSOptions{CAFile: certFile}, err: "doesn't use TLS"},
+		{name: "missing ca", serverURL: "mqtts://broker:8883", tls: TLSOptions{CAFile: filepath.Join(dir, "missing.pem")}, err: "unable to read CA file"},
+		{name: "invalid ca", serverURL: "mqtts://broker:8883", tls: TLSOptions{CAFile: notPEM}, err: "no PEM certificates"},
+		{name: "certificate only", serverURL: "mqtts://broker:8883", tls: TLSOptions{CertFile: certFile}, err: "need to be set both"},
+		{name: "key only", serverURL: "mqtts://broker:8883", tls: TLSOptions{KeyFile: keyFile}, err: "need to be set both"},
+		{name: "invalid certificate", serverURL: "mqtts://broker:8883", tls: TLSOptions{CertFile: notPEM, KeyFile: keyFile}, err: "unable to load client certificate"},
+	} {
+		cfg, err := tlsConfig(tc.serverURL, ConnectOptions{TLS: tc.tls})
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%v: expected an error containing %q, got %v", tc.name, tc.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: unexpected error: %v", tc.name, err)
+			continue
+		}
+		if (cfg != nil) != tc.expected {
+			t.Errorf("%v: expected a config: %v, got %v", tc.name, tc.expected, cfg)
+			continue
+		}
+		if cfg == nil {
+			continue
+		}
+
+		if cfg.ServerName != tc.tls.ServerName {
+			t.Errorf("%v: expected server name %q, got %q", tc.name, tc.tls.ServerName, cfg.ServerName)
+		}
+		if (cfg.RootCAs != nil) != (tc.tls.CAFile != "") {
+			t.Errorf("%v: expected the CA file to be used: %v", tc.name, tc.tls.CAFile != "")
+		}
+		if (len(cfg.Certificates) != 0) != (tc.tls.CertFile != "") {
+			t.Errorf("%v: expected the client certificate to be used: %v", tc.name, tc.tls.CertFile != "")
+		}
+	}
+}
+
+func TestExplainConnectError(t *testing.T) {
+	for _, tc := range []struct {
+		err error
+		// empty if the error isn't explained
+		hint string
+	}{
+		{err: fmt.Errorf("dial: %w", x509.UnknownAuthorityError{}), hint: "trusted CA"},
+		{err: fmt.Errorf("dial: %w", x509.HostnameError{Certificate: &x509.Certificate{}, Host: "broker"}), hint: "valid for this host"},
+		{err: fmt.Errorf("dial: %w", x509.CertificateInvalidError{Cert: &x509.Certificate{}, Reason: x509.Expired}), hint: "certificate is invalid"},
+		{err: fmt.Errorf("dial: %w", tls.RecordHeaderError{Msg: "first record does not look like a TLS handshake"}), hint: "doesn't seem to speak TLS"},
+		{err: errors.New("remote error: tls: bad certificate"), hint: "rejected the connection"},
+		{err: fmt.Errorf("dial: %w", io.EOF), hint: "closed the connection"},
+		{err: errors.New("read tcp 10.0.0.2:50000->10.0.0.1:8883: EOF"), hint: "closed the connection"},
+		{err: errors.New("connection refused")},
+	} {
+		explained := explainConnectError(tc.err, true)
+		if !errors.Is(explained, tc.err) {
+			t.Errorf("%v: expected the error to be wrapped, got %v", tc.err, explained)
+		}
+		if tc.hint == "" && explained != tc.err {
+			t.Errorf("%v: expected no hint, got %v", tc.err, explained)
+		}
+		if !strings.Contains(explained.Error(), tc.hint) {
+			t.Errorf("%v: expected a hint containing %q, got %v", tc.err, tc.hint, explained)
+		}
+
+		// without TLS, there's nothing to explain.
+		if explained := explainConnectError(tc.err, false); explained != tc.err {
+			t.Errorf("%v: expected the error to be kept without TLS, got %v", tc.err, explained)
+		}
+	}
+}
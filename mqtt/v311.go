@@ -0,0 +1,123 @@
+package mqtt
+
+import (
+	"fmt"
+	"strings"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	log "github.com/sirupsen/logrus"
+)
+
+// v311Client speaks MQTT 3.1.1, using paho.mqtt.golang.
+type v311Client struct {
+	client        mqtt.Client
+	subscriptions subscriptions
+}
+
+func connectV311(serverURL string, options ConnectOptions) (Client, error) {
+	c := &v311Client{}
+
+	// like paho.mqtt.golang, default to plain tcp if no scheme is given.
+	if !strings.Contains(serverURL, "://") {
+		serverURL = "tcp://" + serverURL
+	}
+	tlsCfg, err := tlsConfig(serverURL, options)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := mqtt.NewClientOptions().AddBroker(serverURL)
+	if tlsCfg != nil {
+		opts.SetTLSConfig(tlsCfg)
+	}
+	if options.Username != "" {
+		opts.SetUsername(options.Username)
+		opts.SetPassword(options.Password)
+	}
+	if options.ClientID != "" {
+		opts.SetClientID(options.ClientID)
+		opts.SetCleanSession(false)
+	}
+	if options.WillTopic != "" {
+		opts.SetWill(options.WillTopic, options.WillPayload, 1, true)
+	}
+
+	// Handlers publish and wait for the broker to acknowledge, which can't
+	// happen while paho waits for them to return. They're safe to be called
+	// concurrently, so paho doesn't need to call them in order.
+	opts.SetOrderMatters(false)
+	// paho reconnects with an exponential backoff on its own.
+	opts.SetMaxReconnectInterval(maxReconnectDelay)
+	opts.SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+		log.WithError(err).Warn("lost connection to mqtt")
+	})
+	opts.SetReconnectingHandler(func(mqtt.Client, *mqtt.ClientOptions) {
+		log.Info("reconnecting to mqtt")
+	})
+	opts.SetOnConnectHandler(func(mqtt.Client) {
+		c.subscriptions.resubscribe(c.subscribe)
+		if options.OnConnect != nil {
+			options.OnConnect(c)
+		}
+	})
+	c.client = mqtt.NewClient(opts)
+
+	token := c.client.Connect()
+	completed := token.WaitTimeout(timeout)
+	if !completed {
+		return nil, fmt.Errorf("timeout connecting to mqtt")
+	} else if err := token.Error(); err != nil {
+		return nil, explainConnectError(err, tlsCfg != nil)
+	}
+	return c, nil
+}
+
+func (c *v311Client) Publish(m *Message) error {
+	token := c.client.Publish(m.Topic, m.QoS, m.Retained, m.Payload)
+	completed := token.WaitTimeout(timeout)
+	if !completed {
+		return fmt.Errorf("timeout publishing to mqtt")
+	} else {
+		return token.Error()
+	}
+}
+
+func (c *v311Client) Subscribe(topic string, qos byte, handler MessageHandler) error {
+	c.client.AddRoute(topic, func(_ mqtt.Client, m mqtt.Message) {
+		handler(&Message{
+			Topic:    m.Topic(),
+			Payload:  m.Payload(),
+			QoS:      m.Qos(),
+			Retained: m.Retained(),
+		})
+	})
+	c.subscriptions.add(topic, qos, handler)
+	return c.subscribe(topic, qos)
+}
+
+// subscribe sends the subscription to the broker, messages are dispatched to
+// the route added in Subscribe.
+func (c *v311Client) subscribe(topic string, qos byte) error {
+	token := c.client.Subscribe(topic, qos, nil)
+	completed := token.WaitTimeout(timeout)
+	if !completed {
+		return fmt.Errorf("timeout subscribing to mqtt")
+	} else {
+		return token.Error()
+	}
+}
+
+func (c *v311Client) Unsubscribe(topics ...string) error {
+	c.subscriptions.remove(topics...)
+	token := c.client.Unsubscribe(topics...)
+	completed := token.WaitTimeout(timeout)
+	if !completed {
+		return fmt.Errorf("timeout unsubscribing from mqtt")
+	} else {
+		return token.Error()
+	}
+}
+
+func (c *v311Client) Disconnect() {
+	c.client.Disconnect(250)
+}
@@ -0,0 +1,228 @@
+package mqtt
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+	log "github.com/sirupsen/logrus"
+)
+
+// v5Client speaks MQTT 5, using paho.golang.
+// It reconnects on its own, received messages are dispatched to the handlers
+// by router.
+type v5Client struct {
+	cm            *autopaho.ConnectionManager
+	router        *paho.StandardRouter
+	subscriptions subscriptions
+}
+
+func connectV5(serverURL string, options ConnectOptions) (Client, error) {
+	// like paho.mqtt.golang, default to plain tcp if no scheme is given.
+	if !strings.Contains(serverURL, "://") {
+		serverURL = "tcp://" + serverURL
+	}
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse server url: %w", err)
+	}
+	tlsCfg, err := tlsConfig(serverURL, options)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &v5Client{
+		router: paho.NewStandardRouter(),
+	}
+
+	// autopaho retries on its own, keep the last error to report it if the
+	// initial connection can't be established.
+	var (
+		muConnectErr sync.Mutex
+		connectErr   error
+	)
+
+	backoff := autopaho.NewExponentialBackoff(minReconnectDelay, maxReconnectDelay, 2*minReconnectDelay, 2)
+
+	cfg := autopaho.ClientConfig{
+		ServerUrls:                    []*url.URL{u},
+		TlsCfg:                        tlsCfg,
+		KeepAlive:                     30,
+		CleanStartOnInitialConnection: options.ClientID == "",
+		ReconnectBackoff: func(attempt int) time.Duration {
+			delay := backoff(attempt)
+			if attempt > 0 {
+				log.WithFields(log.Fields{
+					"attempt": attempt,
+					"delay":   delay,
+				}).Info("reconnecting to mqtt")
+			}
+			return delay
+		},
+		OnConnectError: func(err error) {
+			err = explainConnectError(err, tlsCfg != nil)
+			muConnectErr.Lock()
+			connectErr = err
+			muConnectErr.Unlock()
+			log.WithError(err).Warn("unable to connect to mqtt")
+		},
+		ClientConfig: paho.ClientConfig{
+			ClientID: options.ClientID,
+			OnPublishReceived: []func(paho.PublishReceived) (bool, error){
+				func(pr paho.PublishReceived) (bool, error) {
+					c.router.Route(pr.Packet.Packet())
+					return true, nil
+				},
+			},
+			OnClientError: func(err error) {
+				log.WithError(err).Warn("lost connection to mqtt")
+			},
+			OnServerDisconnect: func(d *paho.Disconnect) {
+				log.WithField("reasonCode", d.ReasonCode).Warn("disconnected by the mqtt server")
+			},
+		},
+	}
+	if options.ClientID != "" {
+		cfg.SessionExpiryInterval = uint32(sessionExpiry / time.Second)
+	}
+	if options.Username != "" {
+		cfg.ConnectUsername = options.Username
+		cfg.ConnectPassword = []byte(options.Password)
+	}
+	if options.WillTopic != "" {
+		cfg.WillMessage = &paho.WillMessage{
+			Topic:   options.WillTopic,
+			Payload: []byte(options.WillPayload),
+			QoS:     1,
+			Retain:  true,
+		}
+	}
+	cfg.OnConnectionUp = func(*autopaho.ConnectionManager, *paho.Connack) {
+		c.subscriptions.resubscribe(c.subscribe)
+		if options.OnConnect != nil {
+			options.OnConnect(c)
+		}
+	}
+
+	// The connection manager stays around until Disconnect is called.
+	c.cm, err = autopaho.NewConnection(context.Background(), cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := c.cm.AwaitConnection(ctx); err != nil {
+		c.Disconnect()
+		muConnectErr.Lock()
+		defer muConnectErr.Unlock()
+		if connectErr != nil {
+			return nil, connectErr
+		}
+		return nil, fmt.Errorf("timeout connecting to mqtt")
+	}
+
+	return c, nil
+}
+
+func (c *v5Client) Publish(m *Message) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	_, err := c.cm.Publish(ctx, toPublish(m))
+	return err
+}
+
+// toPublish converts m to a paho publish packet, with properties only if any
+// are set.
+func toPublish(m *Message) *paho.Publish {
+	p := &paho.Publish{
+		Topic:   m.Topic,
+		Payload: m.Payload,
+		QoS:     m.QoS,
+		Retain:  m.Retained,
+	}
+	if m.ResponseTopic != "" || m.CorrelationData != nil || m.MessageExpiry != 0 || len(m.UserProperties) != 0 {
+		p.Properties = &paho.PublishProperties{
+			ResponseTopic:   m.ResponseTopic,
+			CorrelationData: m.CorrelationData,
+		}
+		if m.MessageExpiry != 0 {
+			expiry := uint32((m.MessageExpiry + time.Second - 1) / time.Second)
+			p.Properties.MessageExpiry = &expiry
+		}
+		for k, v := range m.UserProperties {
+			p.Properties.User.Add(k, v)
+		}
+	}
+	return p
+}
+
+// fromPublish converts a received paho publish packet to a Message.
+func fromPublish(p *paho.Publish) *Message {
+	m := &Message{
+		Topic:    p.Topic,
+		Payload:  p.Payload,
+		QoS:      p.QoS,
+		Retained: p.Retain,
+	}
+	if p.Properties != nil {
+		m.ResponseTopic = p.Properties.ResponseTopic
+		m.CorrelationData = p.Properties.CorrelationData
+		if p.Properties.MessageExpiry != nil {
+			m.MessageExpiry = time.Duration(*p.Properties.MessageExpiry) * time.Second
+		}
+		for _, prop := range p.Properties.User {
+			if m.UserProperties == nil {
+				m.UserProperties = make(map[string]string)
+			}
+			m.UserProperties[prop.Key] = prop.Value
+		}
+	}
+	return m
+}
+
+func (c *v5Client) Subscribe(topic string, qos byte, handler MessageHandler) error {
+	// register first, retained messages are sent right after subscribing.
+	c.router.RegisterHandler(topic, func(p *paho.Publish) {
+		handler(fromPublish(p))
+	})
+
+	c.subscriptions.add(topic, qos, handler)
+	return c.subscribe(topic, qos)
+}
+
+// subscribe sends the subscription to the broker, messages are dispatched to
+// the handler registered with router in Subscribe.
+func (c *v5Client) subscribe(topic string, qos byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	_, err := c.cm.Subscribe(ctx, &paho.Subscribe{
+		Subscriptions: []paho.SubscribeOptions{{Topic: topic, QoS: qos}},
+	})
+	return err
+}
+
+func (c *v5Client) Unsubscribe(topics ...string) error {
+	c.subscriptions.remove(topics...)
+	for _, topic := range topics {
+		c.router.UnregisterHandler(topic)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	_, err := c.cm.Unsubscribe(ctx, &paho.Unsubscribe{Topics: topics})
+	return err
+}
+
+func (c *v5Client) Disconnect() {
+	ctx, cancel := context.WithTimeout(context.Background(), 250*time.Millisecond)
+	defer cancel()
+	if err := c.cm.Disconnect(ctx); err != nil {
+		log.WithError(err).Debug("unable to disconnect cleanly")
+	}
+}
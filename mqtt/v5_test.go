@@ -0,0 +1,77 @@
+package mqtt
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.golang/packets"
+	"github.com/eclipse/paho.golang/paho"
+)
+
+// roundtrip sends m over the wire, like it would be received by another
+// client.
+func roundtrip(t *testing.T, m *Message) *Message {
+	var b bytes.Buffer
+	if _, err := toPublish(m).Packet().WriteTo(&b); err != nil {
+		t.Fatalf("unable to write packet: %v", err)
+	}
+	cp, err := packets.ReadPacket(&b)
+	if err != nil {
+		t.Fatalf("unable to read packet: %v", err)
+	}
+	p, ok := cp.Content.(*packets.Publish)
+	if !ok {
+		t.Fatalf("expected a publish packet, got %v", cp)
+	}
+	return fromPublish(paho.PublishFromPacketPublish(p))
+}
+
+func TestPublishProperties(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		m        *Message
+		expected *Message
+	}{
+		{
+			name:     "plain",
+			m:        &Message{Topic: "screens/HDMI-A-1@machine/state", Payload: []byte("{}"), QoS: 1, Retained: true},
+			expected: &Message{Topic: "screens/HDMI-A-1@machine/state", Payload: []byte("{}"), QoS: 1, Retained: true},
+		},
+		{
+			name: "response",
+			m: &Message{
+				Topic:           "screens/HDMI-A-1@machine/set",
+				Payload:         []byte(`{"power": true}`),
+				ResponseTopic:   "dashboard/responses",
+				CorrelationData: []byte("1"),
+				UserProperties:  map[string]string{"sender": "dashboard", "key": "ops"},
+			},
+			expected: &Message{
+				Topic:           "screens/HDMI-A-1@machine/set",
+				Payload:         []byte(`{"power": true}`),
+				ResponseTopic:   "dashboard/responses",
+				CorrelationData: []byte("1"),
+				UserProperties:  map[string]string{"sender": "dashboard", "key": "ops"},
+			},
+		},
+		{
+			// rounded up to full seconds.
+			name:     "expiry",
+			m:        &Message{Topic: "screens/machine/result", Payload: []byte("{}"), MessageExpiry: 1500 * time.Millisecond},
+			expected: &Message{Topic: "screens/machine/result", Payload: []byte("{}"), MessageExpiry: 2 * time.Second},
+		},
+	} {
+		if got := roundtrip(t, tc.m); !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("%v: expected %+v, got %+v", tc.name, tc.expected, got)
+		}
+	}
+}
+
+// Messages without MQTT 5 properties are sent without them.
+func TestPublishWithoutProperties(t *testing.T) {
+	if p := toPublish(&Message{Topic: "screens/machine/availability", Payload: []byte("online")}); p.Properties != nil {
+		t.Errorf("expected no properties, got %+v", p.Properties)
+	}
+}
@@ -0,0 +1,81 @@
+package outputs
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+const (
+	ArrangeLeftToRight = "left-to-right"
+	ArrangeTopToBottom = "top-to-bottom"
+)
+
+// Arrange computes positions for all enabled outputs, placing them next to
+// each other in the given direction, without gaps.
+// Outputs keep their relative order, as determined by their current position.
+// The size each output occupies is derived from its current mode, scale and
+// transform.
+func Arrange(outs []Output, direction string) (map[string]*Position, error) {
+	if direction != ArrangeLeftToRight && direction != ArrangeTopToBottom {
+		return nil, fmt.Errorf("invalid direction %v, must be %v or %v", direction, ArrangeLeftToRight, ArrangeTopToBottom)
+	}
+
+	type entry struct {
+		name          string
+		position      Position
+		width, height int64
+	}
+
+	var entries []*entry
+	for _, o := range outs {
+		state := o.GetState()
+		if state.Enabled == nil || !*state.Enabled || state.Mode == nil {
+			continue
+		}
+
+		e := &entry{
+			name:   *o.GetInfo().Name,
+			width:  state.Mode.Width,
+			height: state.Mode.Height,
+		}
+		if state.Position != nil {
+			e.position = *state.Position
+		}
+		// rotated outputs are higher than wide
+		if state.Transform != nil && (strings.HasSuffix(*state.Transform, "90") || strings.HasSuffix(*state.Transform, "270")) {
+			e.width, e.height = e.height, e.width
+		}
+		if state.Scale != nil && *state.Scale > 0 {
+			e.width = int64(math.Round(float64(e.width) / *state.Scale))
+			e.height = int64(math.Round(float64(e.height) / *state.Scale))
+		}
+		entries = append(entries, e)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if direction == ArrangeLeftToRight && a.position.X != b.position.X {
+			return a.position.X < b.position.X
+		}
+		if direction == ArrangeTopToBottom && a.position.Y != b.position.Y {
+			return a.position.Y < b.position.Y
+		}
+		return a.name < b.name
+	})
+
+	positions := make(map[string]*Position, len(entries))
+	var offset int64
+	for _, e := range entries {
+		if direction == ArrangeLeftToRight {
+			positions[e.name] = &Position{X: offset, Y: 0}
+			offset += e.width
+		} else {
+			positions[e.name] = &Position{X: 0, Y: offset}
+			offset += e.height
+		}
+	}
+
+	return positions, nil
+}
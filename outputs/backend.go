@@ -0,0 +1,146 @@
+package outputs
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Backend discovers the outputs of a display server, and notifies registered
+// handlers when they appear, change or disappear.
+type Backend interface {
+	// Start starts discovering outputs, until ctx is cancelled.
+	// Handlers should be registered before calling Start.
+	Start(ctx context.Context) error
+	// Stopped returns a channel closed once the backend stopped after ctx was
+	// cancelled, and the remove handlers of all its outputs returned.
+	Stopped() <-chan struct{}
+	// Close releases all resources held by the backend.
+	Close()
+
+	// Register a new handler for when an output was added
+	RegisterOutputAdd(func(Output))
+	// Register a new handler for when an output was updated
+	RegisterOutputUpdate(func(Output))
+	// Register a new handler for when an output was removed
+	RegisterOutputRemove(func(Output))
+
+	// Outputs returns all currently known outputs.
+	// It must not be called from within a handler.
+	Outputs() []Output
+	// Scenarios returns the names of all scenarios supported by the backend.
+	Scenarios() []string
+}
+
+// BackendOptions are passed to the constructor of a backend.
+type BackendOptions struct {
+	// How often to poll the display server for changes.
+	// Backends receiving change events use this as a safety net only.
+	RefreshInterval time.Duration
+	// Backend-specific parameters.
+	Params map[string]string
+}
+
+// BackendFactory constructs a new backend.
+type BackendFactory func(opts BackendOptions) (Backend, error)
+
+var backends = make(map[string]BackendFactory)
+
+// RegisterBackend makes a backend available under the given name.
+// It's meant to be called from the init function of the backend package.
+func RegisterBackend(name string, factory BackendFactory) {
+	if _, exists := backends[name]; exists {
+		panic(fmt.Sprintf("backend %v registered twice", name))
+	}
+	backends[name] = factory
+}
+
+// NewBackend constructs the backend registered with the given name.
+func NewBackend(name string, opts BackendOptions) (Backend, error) {
+	factory, ok := backends[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown backend %v, available: %v", name, Backends())
+	}
+	return factory(opts)
+}
+
+// Backends returns the names of all registered backends.
+func Backends() []string {
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Handlers keeps track of the handlers registered with a backend.
+// It's meant to be embedded into Backend implementations.
+type Handlers struct {
+	// Called when the output appeared
+	onAddFns []func(Output)
+	// Called when the output was updated
+	onUpdateFns []func(Output)
+	// Called when the output was removed
+	onRemoveFns []func(Output)
+
+	// closed by NotifyStopped
+	stoppedOnce sync.Once
+	stopped     chan struct{}
+}
+
+// Register a new handler for when an output was added
+func (h *Handlers) RegisterOutputAdd(fn func(Output)) {
+	h.onAddFns = append(h.onAddFns, fn)
+}
+
+// Register a new handler for when an output was updated
+func (h *Handlers) RegisterOutputUpdate(fn func(Output)) {
+	h.onUpdateFns = append(h.onUpdateFns, fn)
+}
+
+// Register a new handler for when an output was removed
+func (h *Handlers) RegisterOutputRemove(fn func(Output)) {
+	h.onRemoveFns = append(h.onRemoveFns, fn)
+}
+
+// NotifyAdd calls all handlers registered for added outputs.
+func (h *Handlers) NotifyAdd(output Output) {
+	for _, fn := range h.onAddFns {
+		fn(output)
+	}
+}
+
+// NotifyUpdate calls all handlers registered for updated outputs.
+func (h *Handlers) NotifyUpdate(output Output) {
+	for _, fn := range h.onUpdateFns {
+		fn(output)
+	}
+}
+
+// NotifyRemove calls all handlers registered for removed outputs.
+func (h *Handlers) NotifyRemove(output Output) {
+	for _, fn := range h.onRemoveFns {
+		fn(output)
+	}
+}
+
+func (h *Handlers) stoppedCh() chan struct{} {
+	h.stoppedOnce.Do(func() {
+		h.stopped = make(chan struct{})
+	})
+	return h.stopped
+}
+
+// Stopped returns a channel closed by NotifyStopped.
+func (h *Handlers) Stopped() <-chan struct{} {
+	return h.stoppedCh()
+}
+
+// NotifyStopped marks the backend as stopped. It must be called once, after
+// the remove handlers of all outputs were called when stopping.
+func (h *Handlers) NotifyStopped() {
+	close(h.stoppedCh())
+}
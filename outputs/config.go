@@ -0,0 +1,98 @@
+package outputs
+
+import (
+	"fmt"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// OutputConfig configures all outputs matching Match.
+type OutputConfig struct {
+	Match Match
+	// If set, used instead of the output name in topics, so they stay the
+	// same even if the display is connected to another port.
+	// If Match hits several current outputs, only the first one uses it.
+	Alias string
+	// If set, started whenever a matching output appears.
+	Scenario *Scenario
+}
+
+// ValidateOutputConfigs checks all matches are valid, and aliases can be used
+// in topics and are unique.
+// Scenarios are validated by whoever defines them.
+func ValidateOutputConfigs(configs []OutputConfig) error {
+	aliases := make(map[string]bool)
+	for i, c := range configs {
+		if err := c.Match.Validate(); err != nil {
+			return fmt.Errorf("invalid match in output config %v: %w", i, err)
+		}
+		if c.Alias == "" {
+			continue
+		}
+		if strings.ContainsAny(c.Alias, "/+#@") {
+			return fmt.Errorf("invalid alias %q", c.Alias)
+		}
+		if aliases[c.Alias] {
+			return fmt.Errorf("duplicate alias %q", c.Alias)
+		}
+		aliases[c.Alias] = true
+	}
+	return nil
+}
+
+// ValidateGroups checks group names can be used in topics, and all matches are
+// valid.
+func ValidateGroups(groups map[string][]Match) error {
+	for name, matches := range groups {
+		if name == "" || strings.ContainsAny(name, "/+#") {
+			return fmt.Errorf("invalid group name %q", name)
+		}
+		for _, m := range matches {
+			if err := m.Validate(); err != nil {
+				return fmt.Errorf("invalid match in group %v: %w", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Policies of the fields of the desired state.
+const (
+	// the desired value is applied again once the observed one diverges
+	PolicyEnforce = "enforce"
+	// diverging values are only reported
+	PolicyReport = "report"
+)
+
+// StateFieldNames are the names of the fields of State, as used in JSON, in
+// the order they're declared in.
+var StateFieldNames = func() []string {
+	t := reflect.TypeOf(State{})
+	names := make([]string, t.NumField())
+	for i := range names {
+		names[i], _, _ = strings.Cut(t.Field(i).Tag.Get("json"), ",")
+	}
+	return names
+}()
+
+// ValidatePolicies checks all policies are for existing fields, and valid.
+func ValidatePolicies(policies map[string]string) error {
+	names := make([]string, 0, len(policies))
+	for name := range policies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		policy := policies[name]
+		if !slices.Contains(StateFieldNames, name) {
+			return fmt.Errorf("unknown field %q, available: %v", name, StateFieldNames)
+		}
+		if policy != PolicyEnforce && policy != PolicyReport {
+			return fmt.Errorf("invalid policy %q for %v, must be %v or %v", policy, name, PolicyEnforce, PolicyReport)
+		}
+	}
+	return nil
+}
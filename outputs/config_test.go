@@ -0,0 +1,43 @@
+package outputs
+
+import "testing"
+
+func TestValidatePolicies(t *testing.T) {
+	for _, tc := range []struct {
+		policies map[string]string
+		valid    bool
+	}{
+		{nil, true},
+		{map[string]string{"scale": PolicyReport, "power": PolicyEnforce}, true},
+		{map[string]string{"max_render_time": PolicyEnforce}, true},
+		{map[string]string{"brightness": PolicyEnforce}, false},
+		{map[string]string{"Scale": PolicyEnforce}, false},
+		{map[string]string{"scale": "ignore"}, false},
+	} {
+		if err := ValidatePolicies(tc.policies); (err == nil) != tc.valid {
+			t.Errorf("expected %v to be valid: %v, got %v", tc.policies, tc.valid, err)
+		}
+	}
+}
+
+func TestValidateGroups(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		group string
+		match Match
+		valid bool
+	}{
+		{"valid", "wall", Match{Name: "HDMI-*"}, true},
+		{"empty name", "", Match{Name: "HDMI-*"}, false},
+		{"slash", "wall/left", Match{Name: "HDMI-*"}, false},
+		{"plus", "wall+", Match{Name: "HDMI-*"}, false},
+		{"hash", "#", Match{Name: "HDMI-*"}, false},
+		{"empty match", "wall", Match{}, false},
+		{"invalid pattern", "wall", Match{Name: "["}, false},
+	} {
+		err := ValidateGroups(map[string][]Match{tc.group: {tc.match}})
+		if (err == nil) != tc.valid {
+			t.Errorf("%v: expected valid: %v, got %v", tc.name, tc.valid, err)
+		}
+	}
+}
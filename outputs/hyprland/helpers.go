@@ -0,0 +1,144 @@
+package hyprland
+
+import (
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/flokli/display-agent/outputs"
+	"github.com/flokli/display-agent/scenario"
+	log "github.com/sirupsen/logrus"
+)
+
+// helper command, invokes hyprctl with args, and returns its output.
+func hyprctl(args ...string) ([]byte, error) {
+	out, err := exec.Command("hyprctl", args...).Output()
+	log := log.WithFields(log.Fields{
+		"out":  string(out),
+		"name": "hyprctl",
+		"args": args,
+	})
+	if err != nil {
+		// keep this log statement, so we see the output somewhere.
+		// callsites usually discard it without logging output.
+		log.Debug("failed running hyprctl")
+		return out, fmt.Errorf("failed running hyprctl: %w", err)
+	}
+	log.Debug("ran hyprctl")
+	return out, nil
+}
+
+// helper command, invokes a hyprctl command that prints "ok" on success.
+// hyprctl exits 0 even if the command failed, so check the output.
+func hyprctlOK(args ...string) error {
+	out, err := hyprctl(args...)
+	if err != nil {
+		return err
+	}
+	if s := strings.TrimSpace(string(out)); s != "ok" {
+		return fmt.Errorf("hyprctl %v: %v", strings.Join(args, " "), s)
+	}
+	return nil
+}
+
+// helper command, invokes `hyprctl keyword monitor $rule`
+func (o *Output) configure(rule string) error {
+	return hyprctlOK("keyword", "monitor", rule)
+}
+
+// monitorRule returns a monitor rule for this output, with mode, position,
+// scale, transform and adaptive sync overridden by the arguments.
+// If mode is nil, the preferred mode of the monitor is used.
+func (o *Output) monitorRule(mode *outputs.Mode, position outputs.Position, scale float64, transform int, vrr bool) string {
+	modeArg := "preferred"
+	if mode != nil {
+		modeArg = fmt.Sprintf("%vx%v@%v",
+			mode.Width, mode.Height,
+			// Refresh is in mHz, hyprland expects Hz.
+			strconv.FormatFloat(mode.Refresh/1000, 'f', 3, 64),
+		)
+	}
+	vrrArg := 0
+	if vrr {
+		vrrArg = 1
+	}
+	return fmt.Sprintf("%v,%v,%vx%v,%v,transform,%v,vrr,%v",
+		o.Name,
+		modeArg,
+		position.X, position.Y,
+		strconv.FormatFloat(scale, 'f', -1, 64),
+		transform,
+		vrrArg,
+	)
+}
+
+// hyprClient describes a window, as returned by `hyprctl -j clients`.
+type hyprClient struct {
+	Address   string `json:"address"`
+	Pid       int    `json:"pid"`
+	Workspace struct {
+		Name string `json:"name"`
+	} `json:"workspace"`
+}
+
+// clients returns all windows.
+func clients() ([]*hyprClient, error) {
+	out, err := hyprctl("-j", "clients")
+	if err != nil {
+		return nil, err
+	}
+	var clients []*hyprClient
+	if err := json.Unmarshal(out, &clients); err != nil {
+		return nil, fmt.Errorf("unable to parse clients: %w", err)
+	}
+	return clients, nil
+}
+
+// Clear implements scenario.Placer.
+// The workspace dedicated to the output is bound to it, so it's created
+// there, moved there if it existed elsewhere, and all windows on it are
+// closed.
+func (h *Hyprland) Clear(outputName string) error {
+	workspace := "name:" + outputName
+	if err := hyprctlOK("keyword", "workspace", workspace+",monitor:"+outputName); err != nil {
+		return fmt.Errorf("unable to bind workspace to output: %w", err)
+	}
+	// fails if the workspace doesn't exist, which is fine.
+	hyprctlOK("dispatch", "moveworkspacetomonitor", workspace, outputName)
+
+	clients, err := clients()
+	if err != nil {
+		return err
+	}
+	for _, client := range clients {
+		// workspace names are reported without the name: prefix.
+		if client.Workspace.Name != outputName {
+			continue
+		}
+		if err := hyprctlOK("dispatch", "closewindow", "address:"+client.Address); err != nil {
+			return fmt.Errorf("unable to close window %v: %w", client.Address, err)
+		}
+	}
+	return nil
+}
+
+// Windows implements scenario.Placer.
+func (h *Hyprland) Windows() ([]scenario.Window, error) {
+	clients, err := clients()
+	if err != nil {
+		return nil, err
+	}
+	windows := make([]scenario.Window, 0, len(clients))
+	for _, client := range clients {
+		windows = append(windows, scenario.Window{ID: client.Address, Pid: client.Pid})
+	}
+	return windows, nil
+}
+
+// Place implements scenario.Placer.
+// The workspace is bound to the output, so it's created there if needed.
+func (h *Hyprland) Place(w scenario.Window, outputName string) error {
+	return hyprctlOK("dispatch", "movetoworkspacesilent", "name:"+outputName+",address:"+w.ID)
+}
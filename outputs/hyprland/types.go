@@ -0,0 +1,531 @@
+package hyprland
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flokli/display-agent/outputs"
+	"github.com/flokli/display-agent/scenario"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// how long to wait before resubscribing to events after the subscription broke
+	resubscribeDelay = 1 * time.Second
+)
+
+// Hyprland contains all hyprland-wide state
+type Hyprland struct {
+	// path to the socket hyprland publishes events on
+	eventSocketPath string
+
+	outputs   map[string]*Output
+	outputsMu sync.Mutex
+	// guards the fields of all outputs. They're only changed with outputsMu
+	// held too, so holding either is enough to read them. Unlike outputsMu,
+	// it's not held while calling handlers, see GetState.
+	stateMu sync.Mutex
+
+	refresher *outputs.RefreshLoop
+
+	// starts the processes of scenarios
+	launcher *scenario.Launcher
+
+	outputs.Handlers
+}
+
+func init() {
+	outputs.RegisterBackend("hyprland", func(opts outputs.BackendOptions) (outputs.Backend, error) {
+		return New(opts.RefreshInterval)
+	})
+}
+
+// eventSocketPathFromEnv returns the path to the hyprland event socket, as
+// exposed to child processes of hyprland.
+func eventSocketPathFromEnv() (string, error) {
+	signature := os.Getenv("HYPRLAND_INSTANCE_SIGNATURE")
+	if signature == "" {
+		return "", fmt.Errorf("HYPRLAND_INSTANCE_SIGNATURE is not set")
+	}
+
+	// newer versions of hyprland place the socket in $XDG_RUNTIME_DIR.
+	if runtimeDir := os.Getenv("XDG_RUNTIME_DIR"); runtimeDir != "" {
+		p := filepath.Join(runtimeDir, "hypr", signature, ".socket2.sock")
+		if _, err := os.Stat(p); err == nil {
+			return p, nil
+		}
+	}
+	return filepath.Join("/tmp/hypr", signature, ".socket2.sock"), nil
+}
+
+func New(refreshInterval time.Duration) (*Hyprland, error) {
+	if _, err := exec.LookPath("hyprctl"); err != nil {
+		return nil, fmt.Errorf("unable to find hyprctl: %w", err)
+	}
+	eventSocketPath, err := eventSocketPathFromEnv()
+	if err != nil {
+		return nil, fmt.Errorf("unable to locate hyprland socket: %w", err)
+	}
+
+	h := &Hyprland{
+		eventSocketPath: eventSocketPath,
+		outputs:         make(map[string]*Output),
+	}
+	h.launcher = scenario.NewLauncher(h)
+	h.refresher = outputs.NewRefreshLoop(refreshInterval, h.refreshOutputs)
+
+	return h, nil
+}
+
+// Start implements Backend.
+// It listens for hyprland monitor events, and refreshes outputs whenever one
+// arrives. Additionally, outputs are refreshed every refreshInterval, as a
+// safety net.
+func (h *Hyprland) Start(ctx context.Context) error {
+	go h.watchEvents(ctx)
+
+	go func() {
+		h.refresher.Run(ctx)
+
+		h.outputsMu.Lock()
+		for outputName, output := range h.outputs {
+			log.WithField("outputName", outputName).Debug("calling cleanup handlers")
+			h.NotifyRemove(output)
+		}
+		h.outputsMu.Unlock()
+
+		h.NotifyStopped()
+	}()
+
+	return nil
+}
+
+// watchEvents reads events from the hyprland event socket, and triggers a
+// refresh for every monitor event received. If the connection breaks (for
+// example because hyprland restarted), it reconnects.
+func (h *Hyprland) watchEvents(ctx context.Context) {
+	for {
+		err := h.readEvents(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		log.WithError(err).Warn("lost hyprland event subscription, resubscribing")
+
+		select {
+		case <-time.After(resubscribeDelay):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (h *Hyprland) readEvents(ctx context.Context) error {
+	conn, err := net.Dial("unix", h.eventSocketPath)
+	if err != nil {
+		return fmt.Errorf("unable to connect to event socket: %w", err)
+	}
+	defer conn.Close()
+
+	// unblock the read below once the context is cancelled
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+	defer stop()
+
+	// Events that happened while we were not subscribed were missed.
+	h.refresher.Trigger()
+
+	// events are sent as EVENT>>DATA lines.
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		event, _, _ := strings.Cut(scanner.Text(), ">>")
+		if strings.HasPrefix(event, "monitor") {
+			log.WithField("event", scanner.Text()).Debug("triggering refresh")
+			h.refresher.Trigger()
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("event socket closed")
+}
+
+// Close implements Backend.
+func (h *Hyprland) Close() {
+	log.Debug("stopping scenarios")
+	h.launcher.StopAll()
+}
+
+// Outputs implements Backend.
+func (h *Hyprland) Outputs() []outputs.Output {
+	h.outputsMu.Lock()
+	defer h.outputsMu.Unlock()
+
+	l := make([]outputs.Output, 0, len(h.outputs))
+	for _, output := range h.outputs {
+		l = append(l, output)
+	}
+	return l
+}
+
+// Scenarios implements Backend.
+func (h *Hyprland) Scenarios() []string {
+	return scenario.Names()
+}
+
+// hyprMonitor describes a monitor, as returned by `hyprctl -j monitors all`.
+type hyprMonitor struct {
+	Name           string   `json:"name"`
+	Make           string   `json:"make"`
+	Model          string   `json:"model"`
+	Serial         string   `json:"serial"`
+	Width          int64    `json:"width"`
+	Height         int64    `json:"height"`
+	RefreshRate    float64  `json:"refreshRate"`
+	X              int64    `json:"x"`
+	Y              int64    `json:"y"`
+	Scale          float64  `json:"scale"`
+	Transform      int      `json:"transform"`
+	DPMSStatus     bool     `json:"dpmsStatus"`
+	Disabled       bool     `json:"disabled"`
+	AvailableModes []string `json:"availableModes"`
+	VRR            bool     `json:"vrr"`
+}
+
+// parseMonitors converts the output of `hyprctl -j monitors all` to outputs.
+func parseMonitors(b []byte) ([]*Output, error) {
+	var monitors []*hyprMonitor
+	if err := json.Unmarshal(b, &monitors); err != nil {
+		return nil, err
+	}
+
+	newOutputs := make([]*Output, 0, len(monitors))
+	for _, m := range monitors {
+		o := &Output{
+			Active: !m.Disabled,
+			CurrentMode: outputs.Mode{
+				Width:  m.Width,
+				Height: m.Height,
+				// sway reports mHz, do the same here.
+				Refresh:            math.Round(m.RefreshRate * 1000),
+				PictureAspectRatio: "none",
+			},
+			Make:      m.Make,
+			Model:     m.Model,
+			Modes:     make([]*outputs.Mode, 0, len(m.AvailableModes)),
+			Name:      m.Name,
+			Power:     m.DPMSStatus,
+			Scale:     m.Scale,
+			Serial:    m.Serial,
+			Transform: outputs.TransformName(m.Transform),
+			X:         m.X,
+			Y:         m.Y,
+		}
+		if m.VRR {
+			o.AdaptiveSync = "enabled"
+		} else {
+			o.AdaptiveSync = "disabled"
+		}
+
+		for _, modeStr := range m.AvailableModes {
+			mode, err := outputs.NewMode(strings.TrimSuffix(modeStr, "Hz"))
+			if err != nil {
+				return nil, fmt.Errorf("unable to parse mode %v: %w", modeStr, err)
+			}
+			mode.Refresh = math.Round(mode.Refresh * 1000)
+			mode.PictureAspectRatio = "none"
+			o.Modes = append(o.Modes, mode)
+		}
+		// The refresh rate of the current mode is more precise than the ones
+		// of available modes, use the matching available mode, so it's found
+		// in Modes.
+		if mode := nearestMode(o.CurrentMode, o.Modes); mode != nil {
+			o.CurrentMode = *mode
+		}
+
+		newOutputs = append(newOutputs, o)
+	}
+
+	return newOutputs, nil
+}
+
+// maxRefreshDeviation is how much the refresh rate of the current mode may
+// deviate from the one of an available mode to be considered the same, in mHz.
+// Available modes are rounded to 10 mHz.
+const maxRefreshDeviation = 10
+
+// nearestMode returns the mode of modes with the same size as mode and the
+// nearest refresh rate, or nil if there's none within maxRefreshDeviation.
+func nearestMode(mode outputs.Mode, modes []*outputs.Mode) *outputs.Mode {
+	var nearest *outputs.Mode
+	for _, m := range modes {
+		if m.Width != mode.Width || m.Height != mode.Height {
+			continue
+		}
+		deviation := math.Abs(m.Refresh - mode.Refresh)
+		if deviation <= maxRefreshDeviation && (nearest == nil || deviation < math.Abs(nearest.Refresh-mode.Refresh)) {
+			nearest = m
+		}
+	}
+	return nearest
+}
+
+// Invoke `hyprctl -j monitors all` and sync the state observed from there with
+// the internal state in all outputs.
+func (h *Hyprland) refreshOutputs() error {
+	h.outputsMu.Lock()
+	defer h.outputsMu.Unlock()
+
+	return h.refreshOutputsLocked()
+}
+
+// refreshOutputsLocked is refreshOutputs, with outputsMu held already.
+func (h *Hyprland) refreshOutputsLocked() error {
+	log.WithField("f", "refreshOutputs").Debug("refreshing outputs")
+
+	out, err := hyprctl("-j", "monitors", "all")
+	if err != nil {
+		return fmt.Errorf("Failed to invoke hyprctl: %w", err)
+	}
+
+	newOutputs, err := parseMonitors(out)
+	if err != nil {
+		return fmt.Errorf("Failed to parse monitors: %w", err)
+	}
+
+	outputs.Sync(&h.Handlers, &h.stateMu, h.outputs, newOutputs, func(o *Output) {
+		o.hyprland = h
+		o.Scenario = scenario.NewBlank()
+	}, func(o *Output) bool {
+		// nothing is shown anymore if the process of the scenario exited.
+		if !h.launcher.Exited(o.Name) {
+			return false
+		}
+		log.WithField("outputName", o.Name).Warn("scenario exited")
+		o.Scenario = scenario.NewBlank()
+		return true
+	})
+
+	return nil
+}
+
+type Output struct {
+	// A handle to the global hyprland object
+	hyprland *Hyprland
+
+	Active      bool
+	CurrentMode outputs.Mode
+	Make        string
+	Model       string
+	Modes       []*outputs.Mode
+	Name        string
+	Power       bool
+	Scale       float64
+	Serial      string
+	Transform   string
+	X           int64
+	Y           int64
+	// one of outputs.AdaptiveSyncValues
+	AdaptiveSync string
+
+	Scenario *outputs.Scenario
+}
+
+// GetInfo implements Output.
+func (o *Output) GetInfo() *outputs.Info {
+	return &outputs.Info{
+		Make:   &o.Make,
+		Model:  &o.Model,
+		Modes:  &o.Modes,
+		Name:   &o.Name,
+		Serial: &o.Serial,
+	}
+}
+
+// GetState implements Output.
+// It returns a copy, as refreshes change the output while the state is used,
+// and outputsMu can't be taken here, as handlers are called with it held.
+func (o *Output) GetState() *outputs.State {
+	o.hyprland.stateMu.Lock()
+	c := *o
+	o.hyprland.stateMu.Unlock()
+	return c.state()
+}
+
+// state returns the state of o, pointing to its fields.
+func (o *Output) state() *outputs.State {
+	return &outputs.State{
+		Enabled:      &o.Active,
+		Mode:         &o.CurrentMode,
+		Power:        &o.Power,
+		Scale:        &o.Scale,
+		Transform:    &o.Transform,
+		Position:     &outputs.Position{X: o.X, Y: o.Y},
+		AdaptiveSync: &o.AdaptiveSync,
+		Scenario:     o.Scenario,
+	}
+}
+
+// SetState implements Output.
+// If a field can't be applied, the fields applied before are rolled back.
+func (o *Output) SetState(newState *outputs.State) (*outputs.State, error) {
+	o.hyprland.outputsMu.Lock()
+	defer o.hyprland.outputsMu.Unlock()
+
+	log.WithFields(newState.LogFields("newState")).Debug("SetState()")
+
+	err := outputs.ApplyWithRollback(o.GetState(), newState, o.apply)
+
+	// return the state after the change, not the one before it.
+	if err := o.hyprland.refreshOutputsLocked(); err != nil {
+		log.WithError(err).Warn("unable to refresh outputs")
+	}
+
+	return o.GetState(), err
+}
+
+// apply applies all fields set in newState, and returns on the first one that
+// fails. All fields configured by monitor rules are applied at once.
+func (o *Output) apply(newState *outputs.State) error {
+	if newState.SubpixelHinting != nil {
+		return &outputs.FieldError{Field: "subpixel_hinting", Err: fmt.Errorf("%w by the hyprland backend", outputs.ErrUnsupported)}
+	}
+	if newState.ScaleFilter != nil {
+		return &outputs.FieldError{Field: "scale_filter", Err: fmt.Errorf("%w by the hyprland backend", outputs.ErrUnsupported)}
+	}
+	if newState.MaxRenderTime != nil {
+		return &outputs.FieldError{Field: "max_render_time", Err: fmt.Errorf("%w by the hyprland backend", outputs.ErrUnsupported)}
+	}
+
+	rule, fields, err := o.ruleFor(newState)
+	if err != nil {
+		return err
+	}
+	if rule != "" {
+		if err := o.configure(rule); err != nil {
+			// the rule is applied as a whole.
+			errs := make([]error, 0, len(fields))
+			for _, field := range fields {
+				errs = append(errs, &outputs.FieldError{Field: field, Err: err})
+			}
+			return errors.Join(errs...)
+		}
+	}
+	if newState.Power != nil {
+		arg := ""
+		if *newState.Power {
+			arg = "on"
+		} else {
+			arg = "off"
+		}
+		if err := hyprctlOK("dispatch", "dpms", arg, o.Name); err != nil {
+			return &outputs.FieldError{Field: "power", Err: err}
+		}
+	}
+	if newState.Scenario != nil {
+		if err := o.setScenario(newState.Scenario.Name, newState.Scenario.Args); err != nil {
+			return &outputs.FieldError{Field: "scenario", Err: err}
+		}
+	}
+	return nil
+}
+
+// ruleFor returns the monitor rule applying the fields of newState configured
+// by monitor rules (enabled, mode, scale, transform, position and adaptive
+// sync), and the names of these fields, or an empty rule if none are set.
+// hyprland configures all of them with a single rule, so the ones not set
+// keep their current values.
+func (o *Output) ruleFor(newState *outputs.State) (string, []string, error) {
+	var fields []string
+	if newState.Enabled != nil {
+		fields = append(fields, "enabled")
+	}
+	if newState.Mode != nil {
+		fields = append(fields, "mode")
+	}
+	if newState.Scale != nil {
+		fields = append(fields, "scale")
+	}
+	if newState.Transform != nil {
+		fields = append(fields, "transform")
+	}
+	if newState.Position != nil {
+		fields = append(fields, "position")
+	}
+	if newState.AdaptiveSync != nil {
+		fields = append(fields, "adaptive_sync")
+	}
+	if len(fields) == 0 {
+		return "", nil, nil
+	}
+
+	// disabled monitors don't keep the other fields.
+	if newState.Enabled != nil && !*newState.Enabled {
+		return o.Name + ",disable", fields, nil
+	}
+
+	// the mode of disabled monitors is reported as 0x0, use the preferred one
+	// instead.
+	var mode *outputs.Mode
+	if newState.Mode != nil {
+		mode = newState.Mode
+	} else if o.CurrentMode.Width != 0 && o.CurrentMode.Height != 0 {
+		mode = &o.CurrentMode
+	}
+
+	position := outputs.Position{X: o.X, Y: o.Y}
+	if newState.Position != nil {
+		position = *newState.Position
+	}
+	scale := o.Scale
+	if newState.Scale != nil {
+		scale = *newState.Scale
+	}
+	vrr := o.AdaptiveSync == "enabled"
+	if newState.AdaptiveSync != nil {
+		vrr = *newState.AdaptiveSync == "enabled"
+	}
+
+	transform, err := outputs.TransformIndex(o.Transform)
+	if err != nil {
+		return "", nil, fmt.Errorf("unable to parse current transform: %w", err)
+	}
+	if newState.Transform != nil {
+		if transform, err = outputs.TransformIndex(*newState.Transform); err != nil {
+			return "", nil, &outputs.FieldError{Field: "transform", Err: err}
+		}
+	}
+
+	return o.monitorRule(mode, position, scale, transform, vrr), fields, nil
+}
+
+func (o *Output) setScenario(name string, args []string) error {
+	log.WithFields(log.Fields{
+		"scenario": name,
+		"args":     args,
+	}).Debug("SetScenario")
+
+	// the windows of the process are moved to the output once they appear.
+	sc, err := o.hyprland.launcher.Show(o.Name, name, args)
+	if err != nil {
+		return err
+	}
+
+	// update the internal state
+	o.hyprland.stateMu.Lock()
+	o.Scenario = sc
+	o.hyprland.stateMu.Unlock()
+
+	return nil
+}
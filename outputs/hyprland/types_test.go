@@ -0,0 +1,184 @@
+package hyprland
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/flokli/display-agent/outputs"
+)
+
+func TestParseMonitors(t *testing.T) {
+	b, err := os.ReadFile("../../test/testdata/hyprctl_monitors_all.txt")
+	if err != nil {
+		t.Fatalf("unable to read fixture: %v", err)
+	}
+	monitors, err := parseMonitors(b)
+	if err != nil {
+		t.Fatalf("unable to parse fixture: %v", err)
+	}
+	if len(monitors) != 3 {
+		t.Fatalf("expected 3 monitors, got %v", len(monitors))
+	}
+
+	for _, tc := range []struct {
+		name      string
+		serial    string
+		transform string
+		scale     float64
+		x         int64
+		modes     int
+	}{
+		{"HDMI-A-1", "CNK9280KND", "180", 1.2, 1050, 11},
+		{"VGA-1", "CNK9280KNF", "90", 1, 0, 7},
+	} {
+		var o *Output
+		for _, m := range monitors {
+			if m.Name == tc.name {
+				o = m
+			}
+		}
+		if o == nil {
+			t.Errorf("%v is missing", tc.name)
+			continue
+		}
+
+		if o.Make != "Hewlett Packard" || o.Model != "HP L2245w" || o.Serial != tc.serial {
+			t.Errorf("unexpected make %q, model %q or serial %q of %v", o.Make, o.Model, o.Serial, tc.name)
+		}
+		if !o.Active || !o.Power || o.AdaptiveSync != "disabled" {
+			t.Errorf("expected %v to be active, powered and without adaptive sync, got %+v", tc.name, o)
+		}
+		if o.Transform != tc.transform || o.Scale != tc.scale || o.X != tc.x || o.Y != 0 {
+			t.Errorf("unexpected transform %v, scale %v or position %v,%v of %v", o.Transform, o.Scale, o.X, o.Y, tc.name)
+		}
+		if len(o.Modes) != tc.modes {
+			t.Errorf("expected %v modes of %v, got %v", tc.modes, tc.name, len(o.Modes))
+		}
+
+		// 59.954 Hz is reported as 59.95 Hz in the available modes.
+		expectedMode := outputs.Mode{Width: 1680, Height: 1050, Refresh: 59950, PictureAspectRatio: "none"}
+		if o.CurrentMode != expectedMode {
+			t.Errorf("expected current mode %v of %v, got %v", expectedMode, tc.name, o.CurrentMode)
+		}
+		if o.Modes[0].Refresh != o.CurrentMode.Refresh {
+			t.Errorf("expected the current mode of %v to be an available mode", tc.name)
+		}
+	}
+}
+
+// Disabled monitors are reported with a mode of 0x0.
+func TestParseMonitorsDisabled(t *testing.T) {
+	o := parseTestMonitor(t, "DP-1")
+	if o.Active {
+		t.Error("expected DP-1 to be disabled")
+	}
+	if o.CurrentMode.Width != 0 || o.CurrentMode.Height != 0 {
+		t.Errorf("expected no current mode, got %v", o.CurrentMode)
+	}
+	if len(o.Modes) != 3 {
+		t.Errorf("expected 3 modes, got %v", len(o.Modes))
+	}
+}
+
+// parseTestMonitor returns the monitor with the given name from the fixture.
+func parseTestMonitor(t *testing.T, name string) *Output {
+	b, err := os.ReadFile("../../test/testdata/hyprctl_monitors_all.txt")
+	if err != nil {
+		t.Fatalf("unable to read fixture: %v", err)
+	}
+	monitors, err := parseMonitors(b)
+	if err != nil {
+		t.Fatalf("unable to parse fixture: %v", err)
+	}
+	for _, m := range monitors {
+		if m.Name == name {
+			return m
+		}
+	}
+	t.Fatalf("%v is missing", name)
+	return nil
+}
+
+func TestRuleFor(t *testing.T) {
+	enabled, disabled := true, false
+	scale, transform := 2.0, "90"
+	on := "enabled"
+
+	for _, tc := range []struct {
+		name   string
+		output string
+		state  outputs.State
+		rule   string
+		fields []string
+	}{
+		{"nothing", "HDMI-A-1", outputs.State{}, "", nil},
+		{
+			"several fields in one rule", "HDMI-A-1",
+			outputs.State{Scale: &scale, Transform: &transform, AdaptiveSync: &on},
+			"HDMI-A-1,1680x1050@59.950,1050x0,2,transform,1,vrr,1",
+			[]string{"scale", "transform", "adaptive_sync"},
+		},
+		{
+			"mode", "VGA-1",
+			outputs.State{Mode: &outputs.Mode{Width: 1280, Height: 1024, Refresh: 75030}},
+			"VGA-1,1280x1024@75.030,0x0,1,transform,1,vrr,0",
+			[]string{"mode"},
+		},
+		{"disable", "VGA-1", outputs.State{Enabled: &disabled, Scale: &scale}, "VGA-1,disable", []string{"enabled", "scale"}},
+		{
+			"enable disabled", "DP-1",
+			outputs.State{Enabled: &enabled},
+			"DP-1,preferred,0x0,1,transform,0,vrr,0",
+			[]string{"enabled"},
+		},
+		{
+			"enable disabled with a mode", "DP-1",
+			outputs.State{Enabled: &enabled, Mode: &outputs.Mode{Width: 1920, Height: 1080, Refresh: 60000}},
+			"DP-1,1920x1080@60.000,0x0,1,transform,0,vrr,0",
+			[]string{"enabled", "mode"},
+		},
+	} {
+		o := parseTestMonitor(t, tc.output)
+		rule, fields, err := o.ruleFor(&tc.state)
+		if err != nil {
+			t.Errorf("%v: unexpected error: %v", tc.name, err)
+			continue
+		}
+		if rule != tc.rule {
+			t.Errorf("%v: expected rule %q, got %q", tc.name, tc.rule, rule)
+		}
+		if !reflect.DeepEqual(fields, tc.fields) {
+			t.Errorf("%v: expected fields %q, got %q", tc.name, tc.fields, fields)
+		}
+	}
+
+	invalid := "sideways"
+	if _, _, err := parseTestMonitor(t, "VGA-1").ruleFor(&outputs.State{Transform: &invalid}); err == nil {
+		t.Error("expected an error for an invalid transform")
+	}
+}
+
+func TestNearestMode(t *testing.T) {
+	modes := []*outputs.Mode{
+		{Width: 1920, Height: 1080, Refresh: 60000},
+		{Width: 1920, Height: 1080, Refresh: 59940},
+		{Width: 1280, Height: 720, Refresh: 60000},
+	}
+
+	for _, tc := range []struct {
+		mode     outputs.Mode
+		expected *outputs.Mode
+	}{
+		{outputs.Mode{Width: 1920, Height: 1080, Refresh: 60000}, modes[0]},
+		{outputs.Mode{Width: 1920, Height: 1080, Refresh: 59997}, modes[0]},
+		{outputs.Mode{Width: 1920, Height: 1080, Refresh: 59943}, modes[1]},
+		{outputs.Mode{Width: 1920, Height: 1080, Refresh: 50000}, nil},
+		{outputs.Mode{Width: 1280, Height: 720, Refresh: 60004}, modes[2]},
+		{outputs.Mode{Width: 1024, Height: 768, Refresh: 60000}, nil},
+	} {
+		if got := nearestMode(tc.mode, modes); got != tc.expected {
+			t.Errorf("expected %v for %v, got %v", tc.expected, tc.mode, got)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package i3
+
+import (
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/flokli/display-agent/scenario"
+	log "github.com/sirupsen/logrus"
+)
+
+// helper command, invokes the given binary with args, and returns its output.
+func run(name string, args ...string) ([]byte, error) {
+	out, err := exec.Command(name, args...).Output()
+	log := log.WithFields(log.Fields{
+		"out":  string(out),
+		"name": name,
+		"args": args,
+	})
+	if err != nil {
+		// keep this log statement, so we see the output somewhere.
+		// callsites usually discard it without logging output.
+		log.Debug("failed running " + name)
+		return out, fmt.Errorf("failed running %v: %w", name, err)
+	}
+	log.Debug("ran " + name)
+	return out, nil
+}
+
+// helper command, runs the i3 command consisting of args via i3-msg.
+func i3cmd(args ...string) error {
+	_, err := run("i3-msg", strings.Join(args, " "))
+	return err
+}
+
+// helper command, invokes `xrandr --output $output ...args`
+func (o *Output) configure(args ...string) error {
+	fullArgs := []string{"--output", o.Name}
+	fullArgs = append(fullArgs, args...)
+	_, err := run("xrandr", fullArgs...)
+	return err
+}
+
+// Clear implements scenario.Placer.
+// It kills all windows on the workspace dedicated to the output. The
+// workspace is moved to the output once a window is placed on it.
+func (i *I3) Clear(outputName string) error {
+	// fails if the workspace doesn't exist, which is fine.
+	i3cmd(fmt.Sprintf("[workspace=%v]", strconv.Quote(outputName)), "kill")
+	return nil
+}
+
+// i3Node is a node of the tree, as returned by `i3-msg -t get_tree`.
+type i3Node struct {
+	// the X11 window, only set for windows
+	Window        int64     `json:"window"`
+	Nodes         []*i3Node `json:"nodes"`
+	FloatingNodes []*i3Node `json:"floating_nodes"`
+}
+
+// Windows implements scenario.Placer.
+// i3 doesn't know about the processes of windows, they're read from the
+// _NET_WM_PID property of the windows, which most clients set.
+func (i *I3) Windows() ([]scenario.Window, error) {
+	out, err := run("i3-msg", "-t", "get_tree")
+	if err != nil {
+		return nil, fmt.Errorf("unable to get tree: %w", err)
+	}
+	var root i3Node
+	if err := json.Unmarshal(out, &root); err != nil {
+		return nil, fmt.Errorf("unable to parse tree: %w", err)
+	}
+
+	var windows []scenario.Window
+	var walk func(n *i3Node)
+	walk = func(n *i3Node) {
+		if n.Window != 0 {
+			id := strconv.FormatInt(n.Window, 10)
+			windows = append(windows, scenario.Window{ID: id, Pid: windowPid(id)})
+		}
+		for _, c := range n.Nodes {
+			walk(c)
+		}
+		for _, c := range n.FloatingNodes {
+			walk(c)
+		}
+	}
+	walk(&root)
+	return windows, nil
+}
+
+// windowPid returns the _NET_WM_PID property of an X11 window, or 0 if it's
+// not set.
+func windowPid(id string) int {
+	out, err := run("xprop", "-id", id, "_NET_WM_PID")
+	if err != nil {
+		return 0
+	}
+	return parseWindowPid(string(out))
+}
+
+// parseWindowPid parses the output of `xprop _NET_WM_PID`, like
+// "_NET_WM_PID(CARDINAL) = 1234". It returns 0 if the property isn't set.
+func parseWindowPid(s string) int {
+	_, value, ok := strings.Cut(s, " = ")
+	if !ok {
+		return 0
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		return 0
+	}
+	return pid
+}
+
+// Place implements scenario.Placer.
+// It moves the window to the workspace of the output, and the workspace to the
+// output, as it's created on the focused output.
+func (i *I3) Place(w scenario.Window, outputName string) error {
+	return i3cmd(fmt.Sprintf("[id=%v]", w.ID), "move", "container", "to", "workspace", strconv.Quote(outputName)+",",
+		"move", "workspace", "to", "output", strconv.Quote(outputName))
+}
+
+// dpmsEnabled returns whether the monitors are currently on, as reported by
+// `xset q`.
+// X11 only knows a single DPMS state, shared by all outputs.
+func dpmsEnabled() (bool, error) {
+	out, err := run("xset", "q")
+	if err != nil {
+		return false, err
+	}
+	return !strings.Contains(string(out), "Monitor is Off") &&
+		!strings.Contains(string(out), "Monitor is in Standby") &&
+		!strings.Contains(string(out), "Monitor is in Suspend"), nil
+}
@@ -0,0 +1,18 @@
+package i3
+
+import "testing"
+
+func TestParseWindowPid(t *testing.T) {
+	for _, tc := range []struct {
+		out      string
+		expected int
+	}{
+		{"_NET_WM_PID(CARDINAL) = 1234\n", 1234},
+		{"_NET_WM_PID:  not found.\n", 0},
+		{"", 0},
+	} {
+		if pid := parseWindowPid(tc.out); pid != tc.expected {
+			t.Errorf("expected %v for %q, got %v", tc.expected, tc.out, pid)
+		}
+	}
+}
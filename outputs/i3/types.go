@@ -0,0 +1,487 @@
+package i3
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/flokli/display-agent/outputs"
+	"github.com/flokli/display-agent/scenario"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// how long to wait before resubscribing to events after the subscription broke
+	resubscribeDelay = 1 * time.Second
+)
+
+// I3 contains all i3-wide state
+type I3 struct {
+	outputs   map[string]*Output
+	outputsMu sync.Mutex
+	// guards the fields of all outputs. They're only changed with outputsMu
+	// held too, so holding either is enough to read them. Unlike outputsMu,
+	// it's not held while calling handlers, see GetState.
+	stateMu sync.Mutex
+	// make, model and serial of all connected outputs, by name.
+	// Protected by outputsMu.
+	identities map[string]identity
+
+	refresher *outputs.RefreshLoop
+
+	// starts the processes of scenarios
+	launcher *scenario.Launcher
+
+	outputs.Handlers
+}
+
+func init() {
+	outputs.RegisterBackend("i3", func(opts outputs.BackendOptions) (outputs.Backend, error) {
+		return New(opts.RefreshInterval)
+	})
+}
+
+func New(refreshInterval time.Duration) (*I3, error) {
+	for _, name := range []string{"i3-msg", "xrandr"} {
+		if _, err := exec.LookPath(name); err != nil {
+			return nil, fmt.Errorf("unable to find %v: %w", name, err)
+		}
+	}
+
+	// only needed to move the windows of scenarios to their outputs.
+	if _, err := exec.LookPath("xprop"); err != nil {
+		log.WithError(err).Warn("unable to find xprop, windows of scenarios open on the focused output")
+	}
+
+	i := &I3{
+		outputs:    make(map[string]*Output),
+		identities: make(map[string]identity),
+	}
+	i.launcher = scenario.NewLauncher(i)
+	i.refresher = outputs.NewRefreshLoop(refreshInterval, i.refreshOutputs)
+
+	return i, nil
+}
+
+// Start implements Backend.
+// It subscribes to i3 output events, and refreshes outputs whenever one
+// arrives. Additionally, outputs are refreshed every refreshInterval, as a
+// safety net.
+func (i *I3) Start(ctx context.Context) error {
+	go i.watchEvents(ctx)
+
+	go func() {
+		i.refresher.Run(ctx)
+
+		i.outputsMu.Lock()
+		for outputName, output := range i.outputs {
+			log.WithField("outputName", outputName).Debug("calling cleanup handlers")
+			i.NotifyRemove(output)
+		}
+		i.outputsMu.Unlock()
+
+		i.NotifyStopped()
+	}()
+
+	return nil
+}
+
+// watchEvents runs `i3-msg -t subscribe -m`, and triggers a refresh for every
+// output event received. If i3-msg exits (for example because i3 restarted),
+// it is started again.
+func (i *I3) watchEvents(ctx context.Context) {
+	for {
+		cmd := exec.CommandContext(ctx, "i3-msg", "-t", "subscribe", "-m", `["output"]`)
+		stdout, err := cmd.StdoutPipe()
+		if err == nil {
+			err = cmd.Start()
+		}
+		if err == nil {
+			// Events that happened while we were not subscribed were missed.
+			i.refresher.Trigger()
+
+			scanner := bufio.NewScanner(stdout)
+			for scanner.Scan() {
+				log.WithField("event", scanner.Text()).Debug("triggering refresh")
+				i.refresher.Trigger()
+			}
+			err = cmd.Wait()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		log.WithError(err).Warn("lost i3 event subscription, resubscribing")
+
+		select {
+		case <-time.After(resubscribeDelay):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Close implements Backend.
+func (i *I3) Close() {
+	log.Debug("stopping scenarios")
+	i.launcher.StopAll()
+}
+
+// Outputs implements Backend.
+func (i *I3) Outputs() []outputs.Output {
+	i.outputsMu.Lock()
+	defer i.outputsMu.Unlock()
+
+	l := make([]outputs.Output, 0, len(i.outputs))
+	for _, output := range i.outputs {
+		l = append(l, output)
+	}
+	return l
+}
+
+// Scenarios implements Backend.
+func (i *I3) Scenarios() []string {
+	return scenario.Names()
+}
+
+// i3Output describes an output, as returned by `i3-msg -t get_outputs`.
+type i3Output struct {
+	Name   string `json:"name"`
+	Active bool   `json:"active"`
+}
+
+// identity is the make, model and serial of an output, read from its EDID.
+type identity struct {
+	Make, Model, Serial string
+}
+
+// queryOutputs combines the outputs reported by i3 with the modes reported by
+// `xrandr --query`.
+func (i *I3) queryOutputs() ([]*Output, error) {
+	out, err := run("i3-msg", "-t", "get_outputs")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to invoke i3-msg: %w", err)
+	}
+	var i3Outputs []*i3Output
+	if err := json.Unmarshal(out, &i3Outputs); err != nil {
+		return nil, fmt.Errorf("Failed to parse i3-msg output: %w", err)
+	}
+
+	out, err = run("xrandr", "--query")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to invoke xrandr: %w", err)
+	}
+	xrandrOutputs, err := parseXrandr(bytes.NewReader(out))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse xrandr output: %w", err)
+	}
+
+	if err := i.updateIdentities(xrandrOutputs); err != nil {
+		return nil, err
+	}
+
+	power, err := dpmsEnabled()
+	if err != nil {
+		log.WithError(err).Warn("unable to query DPMS state, assuming on")
+		power = true
+	}
+
+	return mergeOutputs(i3Outputs, xrandrOutputs, i.identities, power), nil
+}
+
+// updateIdentities reads the identities of connected outputs not seen before
+// from their EDID, and forgets those of disconnected ones.
+// `xrandr --prop` reads the EDIDs of all outputs from the displays, which is
+// slow, so it's only run if a display was plugged in.
+func (i *I3) updateIdentities(xrandrOutputs []*xrandrOutput) error {
+	connected := make(map[string]bool, len(xrandrOutputs))
+	missing := false
+	for _, xo := range xrandrOutputs {
+		if !xo.Connected {
+			continue
+		}
+		connected[xo.Name] = true
+		if _, ok := i.identities[xo.Name]; !ok {
+			missing = true
+		}
+	}
+	// another display might get plugged in next.
+	for name := range i.identities {
+		if !connected[name] {
+			delete(i.identities, name)
+		}
+	}
+	if !missing {
+		return nil
+	}
+
+	out, err := run("xrandr", "--prop")
+	if err != nil {
+		return fmt.Errorf("Failed to invoke xrandr: %w", err)
+	}
+	propOutputs, err := parseXrandr(bytes.NewReader(out))
+	if err != nil {
+		return fmt.Errorf("Failed to parse xrandr output: %w", err)
+	}
+	for _, xo := range propOutputs {
+		if connected[xo.Name] {
+			var id identity
+			id.Make, id.Model, id.Serial = parseEDID(xo.EDID)
+			i.identities[xo.Name] = id
+		}
+	}
+	return nil
+}
+
+// mergeOutputs returns an Output for every connected xrandr output.
+// i3 doesn't know about outputs that are disabled, so these are taken from
+// xrandr only.
+func mergeOutputs(i3Outputs []*i3Output, xrandrOutputs []*xrandrOutput, identities map[string]identity, power bool) []*Output {
+	active := make(map[string]bool, len(i3Outputs))
+	for _, i3o := range i3Outputs {
+		active[i3o.Name] = i3o.Active
+	}
+
+	var newOutputs []*Output
+	for _, xo := range xrandrOutputs {
+		if !xo.Connected {
+			continue
+		}
+
+		o := &Output{
+			Name:      xo.Name,
+			Active:    xo.Enabled,
+			Modes:     xo.Modes,
+			Power:     power,
+			Scale:     xo.Scale(),
+			Transform: xo.Transform(),
+			X:         xo.X,
+			Y:         xo.Y,
+		}
+		if a, ok := active[xo.Name]; ok {
+			o.Active = a
+		}
+		if xo.CurrentMode != nil {
+			o.CurrentMode = *xo.CurrentMode
+		}
+		id := identities[xo.Name]
+		o.Make, o.Model, o.Serial = id.Make, id.Model, id.Serial
+
+		newOutputs = append(newOutputs, o)
+	}
+
+	return newOutputs
+}
+
+// Query i3 and xrandr and sync the state observed from there with the
+// internal state in all outputs.
+func (i *I3) refreshOutputs() error {
+	i.outputsMu.Lock()
+	defer i.outputsMu.Unlock()
+
+	return i.refreshOutputsLocked()
+}
+
+// refreshOutputsLocked is refreshOutputs, with outputsMu held already.
+func (i *I3) refreshOutputsLocked() error {
+	log.WithField("f", "refreshOutputs").Debug("refreshing outputs")
+
+	newOutputs, err := i.queryOutputs()
+	if err != nil {
+		return err
+	}
+
+	outputs.Sync(&i.Handlers, &i.stateMu, i.outputs, newOutputs, func(o *Output) {
+		o.i3 = i
+		o.Scenario = scenario.NewBlank()
+	}, func(o *Output) bool {
+		// nothing is shown anymore if the process of the scenario exited.
+		if !i.launcher.Exited(o.Name) {
+			return false
+		}
+		log.WithField("outputName", o.Name).Warn("scenario exited")
+		o.Scenario = scenario.NewBlank()
+		return true
+	})
+
+	return nil
+}
+
+type Output struct {
+	// A handle to the global i3 object
+	i3 *I3
+
+	Active      bool
+	CurrentMode outputs.Mode
+	Make        string
+	Model       string
+	Modes       []*outputs.Mode
+	Name        string
+	Power       bool
+	Scale       float64
+	Serial      string
+	Transform   string
+	X           int64
+	Y           int64
+
+	Scenario *outputs.Scenario
+}
+
+// GetInfo implements Output.
+func (o *Output) GetInfo() *outputs.Info {
+	return &outputs.Info{
+		Make:   &o.Make,
+		Model:  &o.Model,
+		Modes:  &o.Modes,
+		Name:   &o.Name,
+		Serial: &o.Serial,
+	}
+}
+
+// GetState implements Output.
+// It returns a copy, as refreshes change the output while the state is used,
+// and outputsMu can't be taken here, as handlers are called with it held.
+func (o *Output) GetState() *outputs.State {
+	o.i3.stateMu.Lock()
+	c := *o
+	o.i3.stateMu.Unlock()
+	return c.state()
+}
+
+// state returns the state of o, pointing to its fields.
+func (o *Output) state() *outputs.State {
+	return &outputs.State{
+		Enabled:   &o.Active,
+		Mode:      &o.CurrentMode,
+		Power:     &o.Power,
+		Scale:     &o.Scale,
+		Transform: &o.Transform,
+		Position:  &outputs.Position{X: o.X, Y: o.Y},
+		Scenario:  o.Scenario,
+	}
+}
+
+// SetState implements Output.
+// If a field can't be applied, the fields applied before are rolled back.
+func (o *Output) SetState(newState *outputs.State) (*outputs.State, error) {
+	o.i3.outputsMu.Lock()
+	defer o.i3.outputsMu.Unlock()
+
+	log.WithFields(newState.LogFields("newState")).Debug("SetState()")
+
+	err := outputs.ApplyWithRollback(o.GetState(), newState, o.apply)
+
+	// return the state after the change, not the one before it.
+	if err := o.i3.refreshOutputsLocked(); err != nil {
+		log.WithError(err).Warn("unable to refresh outputs")
+	}
+
+	return o.GetState(), err
+}
+
+// apply applies all fields set in newState one by one, and returns on the
+// first one that fails.
+func (o *Output) apply(newState *outputs.State) error {
+	if newState.AdaptiveSync != nil {
+		return &outputs.FieldError{Field: "adaptive_sync", Err: fmt.Errorf("%w by the i3 backend", outputs.ErrUnsupported)}
+	}
+	if newState.SubpixelHinting != nil {
+		return &outputs.FieldError{Field: "subpixel_hinting", Err: fmt.Errorf("%w by the i3 backend", outputs.ErrUnsupported)}
+	}
+	if newState.ScaleFilter != nil {
+		return &outputs.FieldError{Field: "scale_filter", Err: fmt.Errorf("%w by the i3 backend", outputs.ErrUnsupported)}
+	}
+	if newState.MaxRenderTime != nil {
+		return &outputs.FieldError{Field: "max_render_time", Err: fmt.Errorf("%w by the i3 backend", outputs.ErrUnsupported)}
+	}
+
+	if newState.Enabled != nil {
+		arg := ""
+		if *newState.Enabled {
+			arg = "--auto"
+		} else {
+			arg = "--off"
+		}
+		if err := o.configure(arg); err != nil {
+			return &outputs.FieldError{Field: "enabled", Err: err}
+		}
+	}
+	if newState.Mode != nil {
+		args := []string{"--mode", fmt.Sprintf("%vx%v", newState.Mode.Width, newState.Mode.Height)}
+		if newState.Mode.Refresh != 0 {
+			// Refresh is in mHz, xrandr expects Hz.
+			args = append(args, "--rate", strconv.FormatFloat(newState.Mode.Refresh/1000, 'f', 3, 64))
+		}
+		if err := o.configure(args...); err != nil {
+			return &outputs.FieldError{Field: "mode", Err: err}
+		}
+	}
+	if newState.Power != nil {
+		// X11 only knows a single DPMS state, so this affects all outputs,
+		// and they're all reported with the new state after the next refresh.
+		arg := ""
+		if *newState.Power {
+			arg = "on"
+		} else {
+			arg = "off"
+		}
+		if _, err := run("xset", "dpms", "force", arg); err != nil {
+			return &outputs.FieldError{Field: "power", Err: err}
+		}
+	}
+	if newState.Scale != nil {
+		if *newState.Scale <= 0 {
+			return &outputs.FieldError{Field: "scale", Err: fmt.Errorf("invalid scale %v", *newState.Scale)}
+		}
+		// xrandr scales the framebuffer, so invert the sway-style scale.
+		f := strconv.FormatFloat(1 / *newState.Scale, 'f', -1, 64)
+		if err := o.configure("--scale", f+"x"+f); err != nil {
+			return &outputs.FieldError{Field: "scale", Err: err}
+		}
+	}
+	if newState.Transform != nil {
+		args, err := xrandrTransformArgs(*newState.Transform)
+		if err != nil {
+			return &outputs.FieldError{Field: "transform", Err: err}
+		}
+		if err := o.configure(args...); err != nil {
+			return &outputs.FieldError{Field: "transform", Err: err}
+		}
+	}
+	if newState.Position != nil {
+		if err := o.configure("--pos", fmt.Sprintf("%vx%v", newState.Position.X, newState.Position.Y)); err != nil {
+			return &outputs.FieldError{Field: "position", Err: err}
+		}
+	}
+	if newState.Scenario != nil {
+		if err := o.setScenario(newState.Scenario.Name, newState.Scenario.Args); err != nil {
+			return &outputs.FieldError{Field: "scenario", Err: err}
+		}
+	}
+	return nil
+}
+
+func (o *Output) setScenario(name string, args []string) error {
+	log.WithFields(log.Fields{
+		"scenario": name,
+		"args":     args,
+	}).Debug("SetScenario")
+
+	// the windows of the process are moved to the output once they appear.
+	sc, err := o.i3.launcher.Show(o.Name, name, args)
+	if err != nil {
+		return err
+	}
+
+	// update the internal state
+	o.i3.stateMu.Lock()
+	o.Scenario = sc
+	o.i3.stateMu.Unlock()
+
+	return nil
+}
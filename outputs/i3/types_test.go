@@ -0,0 +1,55 @@
+package i3
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+)
+
+func TestMergeOutputs(t *testing.T) {
+	b, err := os.ReadFile("../../test/testdata/i3msg_get_outputs.txt")
+	if err != nil {
+		t.Fatalf("unable to read fixture: %v", err)
+	}
+	var i3Outputs []*i3Output
+	if err := json.Unmarshal(b, &i3Outputs); err != nil {
+		t.Fatalf("unable to parse fixture: %v", err)
+	}
+
+	var xrandrOutputs []*xrandrOutput
+	for _, xo := range parseXrandrFixture(t, "xrandr_query.txt") {
+		xrandrOutputs = append(xrandrOutputs, xo)
+	}
+
+	identities := map[string]identity{
+		"HDMI-1": {Make: "HWP", Model: "HP L2245w", Serial: "CNK9280KND"},
+	}
+	merged := mergeOutputs(i3Outputs, xrandrOutputs, identities, false)
+
+	byName := make(map[string]*Output, len(merged))
+	for _, o := range merged {
+		byName[o.Name] = o
+	}
+	// xroot-0 is only known to i3, DP-1 is disconnected.
+	if len(byName) != 3 || byName["HDMI-1"] == nil || byName["VGA-1"] == nil || byName["DP-2"] == nil {
+		t.Fatalf("expected HDMI-1, VGA-1 and DP-2, got %v", merged)
+	}
+
+	hdmi := byName["HDMI-1"]
+	if !hdmi.Active || hdmi.Power || hdmi.Transform != "180" || hdmi.X != 1050 || hdmi.Y != 0 {
+		t.Errorf("unexpected HDMI-1: %+v", hdmi)
+	}
+	if hdmi.Make != "HWP" || hdmi.Model != "HP L2245w" || hdmi.Serial != "CNK9280KND" {
+		t.Errorf("expected the identity of HDMI-1 to be set, got %+v", hdmi)
+	}
+	if hdmi.CurrentMode.Width != 1680 || hdmi.CurrentMode.Refresh != 59950 {
+		t.Errorf("unexpected current mode of HDMI-1: %v", hdmi.CurrentMode)
+	}
+
+	if vga := byName["VGA-1"]; !vga.Active || vga.Serial != "" {
+		t.Errorf("unexpected VGA-1: %+v", vga)
+	}
+	if dp2 := byName["DP-2"]; dp2.Active || len(dp2.Modes) != 3 {
+		t.Errorf("expected DP-2 to be inactive, got %+v", dp2)
+	}
+}
@@ -0,0 +1,269 @@
+package i3
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/flokli/display-agent/outputs"
+)
+
+// xrandrOutput describes an output, as reported by `xrandr --query`.
+// EDID is only set by `xrandr --prop`.
+type xrandrOutput struct {
+	Name      string
+	Connected bool
+	Primary   bool
+	// whether the output currently shows (part of) the screen
+	Enabled bool
+	// position and size of the output on the screen, after scaling and rotation.
+	X, Y          int64
+	Width, Height int64
+	Rotation      string
+	Reflection    string
+
+	Modes       []*outputs.Mode
+	CurrentMode *outputs.Mode
+
+	EDID []byte
+}
+
+var (
+	// HDMI-1 connected primary 1920x1080+0+0 left X axis (normal left inverted right x axis y axis) 527mm x 296mm
+	outputLineRe = regexp.MustCompile(`^(\S+) (connected|disconnected|unknown connection)( primary)?(?: (\d+)x(\d+)\+(-?\d+)\+(-?\d+))?(?: (normal|left|inverted|right))?(?: (X axis|Y axis|X and Y axis))? ?(?:\(|$)`)
+	// 1920x1080     60.00*+  50.00    59.94
+	modeLineRe = regexp.MustCompile(`^\s+(\d+)x(\d+)i?\s+(.*)$`)
+)
+
+// parseXrandr parses the output of `xrandr --query` or `xrandr --prop`.
+func parseXrandr(r io.Reader) ([]*xrandrOutput, error) {
+	var xos []*xrandrOutput
+	var current *xrandrOutput
+	// set while reading the hex lines of the EDID property
+	inEDID := false
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if strings.HasPrefix(line, "Screen ") {
+			continue
+		}
+
+		// output lines aren't indented
+		if !strings.HasPrefix(line, " ") && !strings.HasPrefix(line, "\t") {
+			inEDID = false
+
+			m := outputLineRe.FindStringSubmatch(line)
+			if m == nil {
+				return nil, fmt.Errorf("unable to parse output line: %v", line)
+			}
+
+			current = &xrandrOutput{
+				Name:       m[1],
+				Connected:  m[2] == "connected",
+				Primary:    m[3] != "",
+				Enabled:    m[4] != "",
+				Rotation:   m[8],
+				Reflection: m[9],
+			}
+			if current.Rotation == "" {
+				current.Rotation = "normal"
+			}
+			if current.Enabled {
+				current.Width, _ = strconv.ParseInt(m[4], 10, 64)
+				current.Height, _ = strconv.ParseInt(m[5], 10, 64)
+				current.X, _ = strconv.ParseInt(m[6], 10, 64)
+				current.Y, _ = strconv.ParseInt(m[7], 10, 64)
+			}
+			xos = append(xos, current)
+			continue
+		}
+
+		if current == nil {
+			return nil, fmt.Errorf("unexpected line before first output: %v", line)
+		}
+
+		// properties are indented with tabs
+		if strings.HasPrefix(line, "\t") {
+			trimmed := strings.TrimSpace(line)
+			if strings.HasPrefix(line, "\t\t") && inEDID {
+				b, err := hex.DecodeString(trimmed)
+				if err != nil {
+					return nil, fmt.Errorf("unable to decode EDID: %w", err)
+				}
+				current.EDID = append(current.EDID, b...)
+				continue
+			}
+			inEDID = trimmed == "EDID:"
+			continue
+		}
+		inEDID = false
+
+		// modes are indented with spaces
+		m := modeLineRe.FindStringSubmatch(line)
+		if m == nil {
+			// skip the verbose mode info lines (h: …, v: …)
+			continue
+		}
+		width, _ := strconv.ParseInt(m[1], 10, 64)
+		height, _ := strconv.ParseInt(m[2], 10, 64)
+
+		for _, rate := range strings.Fields(m[3]) {
+			isCurrent := strings.Contains(rate, "*")
+			hz, err := strconv.ParseFloat(strings.TrimRight(rate, "*+"), 64)
+			if err != nil {
+				// a lone "+" is separated by a space if the mode isn't current
+				if strings.Trim(rate, "*+") == "" {
+					continue
+				}
+				return nil, fmt.Errorf("unable to parse refresh rate %v: %w", rate, err)
+			}
+
+			mode := &outputs.Mode{
+				Width:  width,
+				Height: height,
+				// sway reports mHz, do the same here.
+				Refresh:            math.Round(hz * 1000),
+				PictureAspectRatio: "none",
+			}
+			current.Modes = append(current.Modes, mode)
+			if isCurrent {
+				current.CurrentMode = mode
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read xrandr output: %w", err)
+	}
+
+	return xos, nil
+}
+
+// xrandrRotations maps xrandr rotations to sway-style transforms.
+var xrandrRotations = map[string]string{
+	"normal":   "normal",
+	"right":    "90",
+	"inverted": "180",
+	"left":     "270",
+}
+
+// Transform returns the sway-style transform of the output.
+// sway's flipped is a reflection across the X axis. One across the Y axis is
+// that, rotated by another 180°, and one across both axes is no reflection,
+// but a rotation by another 180°.
+func (xo *xrandrOutput) Transform() string {
+	rotation := xo.Rotation
+	flipped := false
+	switch xo.Reflection {
+	case "X axis":
+		flipped = true
+	case "Y axis":
+		flipped = true
+		rotation = rotate180(rotation)
+	case "X and Y axis":
+		rotation = rotate180(rotation)
+	}
+
+	transform := xrandrRotations[rotation]
+	if flipped {
+		if transform == "normal" {
+			return "flipped"
+		}
+		return "flipped-" + transform
+	}
+	return transform
+}
+
+// rotate180 returns the xrandr rotation rotated by another 180°.
+func rotate180(rotation string) string {
+	return map[string]string{
+		"normal":   "inverted",
+		"right":    "left",
+		"inverted": "normal",
+		"left":     "right",
+	}[rotation]
+}
+
+// Scale returns the sway-style scale of the output, derived from the size of
+// the current mode and the area the output covers on the screen.
+func (xo *xrandrOutput) Scale() float64 {
+	if xo.CurrentMode == nil || xo.Width == 0 {
+		return 1
+	}
+	width := xo.Width
+	if xo.Rotation == "left" || xo.Rotation == "right" {
+		width = xo.Height
+	}
+	return float64(xo.CurrentMode.Width) / float64(width)
+}
+
+// xrandrTransformArgs maps a sway-style transform to xrandr arguments.
+func xrandrTransformArgs(transform string) ([]string, error) {
+	rotation, flipped := strings.CutPrefix(transform, "flipped")
+	rotation = strings.TrimPrefix(rotation, "-")
+	if rotation == "" {
+		rotation = "normal"
+	}
+
+	xrandrRotation := ""
+	for r, t := range xrandrRotations {
+		if t == rotation {
+			xrandrRotation = r
+		}
+	}
+	if xrandrRotation == "" {
+		return nil, fmt.Errorf("invalid transform: %v", transform)
+	}
+
+	// the inverse of Transform, flipped is a reflection across the X axis.
+	reflect := "normal"
+	if flipped {
+		reflect = "x"
+	}
+
+	return []string{"--rotate", xrandrRotation, "--reflect", reflect}, nil
+}
+
+// parseEDID extracts make, model and serial from an EDID blob.
+// manufacturer is the three-letter PNP ID of the manufacturer.
+func parseEDID(edid []byte) (manufacturer, model, serial string) {
+	if len(edid) < 128 {
+		return "", "", ""
+	}
+
+	id := uint16(edid[8])<<8 | uint16(edid[9])
+	manufacturer = string([]byte{
+		byte('A' - 1 + (id>>10)&0x1f),
+		byte('A' - 1 + (id>>5)&0x1f),
+		byte('A' - 1 + id&0x1f),
+	})
+
+	// the serial number can be stored numerically, or as a descriptor.
+	if s := uint32(edid[12]) | uint32(edid[13])<<8 | uint32(edid[14])<<16 | uint32(edid[15])<<24; s != 0 {
+		serial = strconv.FormatUint(uint64(s), 10)
+	}
+
+	// four 18 byte descriptors, starting at offset 54
+	for i := 54; i+18 <= 126; i += 18 {
+		d := edid[i : i+18]
+		if d[0] != 0 || d[1] != 0 {
+			// detailed timing descriptor
+			continue
+		}
+		text := strings.TrimSpace(strings.SplitN(string(d[5:]), "\n", 2)[0])
+		switch d[3] {
+		case 0xfc:
+			model = text
+		case 0xff:
+			serial = text
+		}
+	}
+
+	return manufacturer, model, serial
+}
@@ -0,0 +1,201 @@
+package i3
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/flokli/display-agent/outputs"
+)
+
+func parseXrandrFixture(t *testing.T, name string) map[string]*xrandrOutput {
+	f, err := os.Open("../../test/testdata/" + name)
+	if err != nil {
+		t.Fatalf("unable to open fixture: %v", err)
+	}
+	defer f.Close()
+
+	xos, err := parseXrandr(f)
+	if err != nil {
+		t.Fatalf("unable to parse %v: %v", name, err)
+	}
+	byName := make(map[string]*xrandrOutput, len(xos))
+	for _, xo := range xos {
+		byName[xo.Name] = xo
+	}
+	return byName
+}
+
+func TestParseXrandr(t *testing.T) {
+	for _, fixture := range []string{"xrandr_query.txt", "xrandr_prop.txt"} {
+		t.Run(fixture, func(t *testing.T) {
+			xos := parseXrandrFixture(t, fixture)
+			if len(xos) != 4 {
+				t.Fatalf("expected 4 outputs, got %v", len(xos))
+			}
+
+			hdmi := xos["HDMI-1"]
+			if !hdmi.Connected || !hdmi.Primary || !hdmi.Enabled {
+				t.Errorf("expected HDMI-1 to be connected, primary and enabled, got %+v", hdmi)
+			}
+			if hdmi.X != 1050 || hdmi.Y != 0 || hdmi.Width != 1680 || hdmi.Height != 1050 {
+				t.Errorf("unexpected geometry of HDMI-1: %+v", hdmi)
+			}
+			if hdmi.Transform() != "180" || hdmi.Scale() != 1 {
+				t.Errorf("unexpected transform %v or scale %v of HDMI-1", hdmi.Transform(), hdmi.Scale())
+			}
+			if len(hdmi.Modes) != 17 {
+				t.Errorf("expected 17 modes of HDMI-1, got %v", len(hdmi.Modes))
+			}
+			expectedMode := outputs.Mode{Width: 1680, Height: 1050, Refresh: 59950, PictureAspectRatio: "none"}
+			if hdmi.CurrentMode == nil || *hdmi.CurrentMode != expectedMode {
+				t.Errorf("expected current mode %v of HDMI-1, got %v", expectedMode, hdmi.CurrentMode)
+			}
+
+			vga := xos["VGA-1"]
+			if vga.Primary || vga.Transform() != "90" || vga.Scale() != 1 {
+				t.Errorf("unexpected VGA-1: %+v", vga)
+			}
+			if len(vga.Modes) != 12 {
+				t.Errorf("expected 12 modes of VGA-1, got %v", len(vga.Modes))
+			}
+
+			if xos["DP-1"].Connected {
+				t.Error("expected DP-1 to be disconnected")
+			}
+
+			dp2 := xos["DP-2"]
+			if !dp2.Connected || dp2.Enabled || dp2.CurrentMode != nil {
+				t.Errorf("expected DP-2 to be connected, but disabled, got %+v", dp2)
+			}
+			expectedModes := []*outputs.Mode{
+				{Width: 1920, Height: 1080, Refresh: 60000, PictureAspectRatio: "none"},
+				{Width: 1920, Height: 1080, Refresh: 50000, PictureAspectRatio: "none"},
+				{Width: 1280, Height: 720, Refresh: 60000, PictureAspectRatio: "none"},
+			}
+			if !reflect.DeepEqual(dp2.Modes, expectedModes) {
+				t.Errorf("unexpected modes of DP-2: %v", dp2.Modes)
+			}
+
+			if fixture == "xrandr_query.txt" && hdmi.EDID != nil {
+				t.Error("expected no EDID in the output of xrandr --query")
+			}
+		})
+	}
+}
+
+func TestParseXrandrInvalid(t *testing.T) {
+	for _, in := range []string{
+		"   1920x1080     60.00*+\n",
+		"HDMI-1 connected\n   1920x1080     sixty\n",
+		"HDMI-1 connected\n\tEDID:\n\t\t00ffzz\n",
+		"HDMI-1 somehow\n",
+	} {
+		if _, err := parseXrandr(strings.NewReader(in)); err == nil {
+			t.Errorf("expected an error parsing %q", in)
+		}
+	}
+}
+
+func TestParseEDID(t *testing.T) {
+	xos := parseXrandrFixture(t, "xrandr_prop.txt")
+
+	for name, expectedSerial := range map[string]string{
+		"HDMI-1": "CNK9280KND",
+		"VGA-1":  "CNK9280KNF",
+	} {
+		manufacturer, model, serial := parseEDID(xos[name].EDID)
+		if manufacturer != "HWP" || model != "HP L2245w" || serial != expectedSerial {
+			t.Errorf("unexpected make %q, model %q or serial %q of %v", manufacturer, model, serial, name)
+		}
+	}
+
+	if manufacturer, model, serial := parseEDID(xos["DP-2"].EDID); manufacturer != "" || model != "" || serial != "" {
+		t.Errorf("expected nothing without an EDID, got %q, %q, %q", manufacturer, model, serial)
+	}
+}
+
+func TestXrandrTransform(t *testing.T) {
+	// xrandr's arguments for reflections, by the name it reports them with
+	reflectArgs := map[string]string{"": "normal", "X axis": "x", "Y axis": "y", "X and Y axis": "xy"}
+
+	for _, tc := range []struct {
+		rotation   string
+		reflection string
+		expected   string
+	}{
+		{"normal", "", "normal"},
+		{"right", "", "90"},
+		{"inverted", "", "180"},
+		{"left", "", "270"},
+		{"normal", "X axis", "flipped"},
+		{"right", "X axis", "flipped-90"},
+		{"inverted", "X axis", "flipped-180"},
+		{"left", "X axis", "flipped-270"},
+		{"normal", "Y axis", "flipped-180"},
+		{"right", "Y axis", "flipped-270"},
+		{"inverted", "Y axis", "flipped"},
+		{"left", "Y axis", "flipped-90"},
+		{"normal", "X and Y axis", "180"},
+		{"right", "X and Y axis", "270"},
+		{"inverted", "X and Y axis", "normal"},
+		{"left", "X and Y axis", "90"},
+	} {
+		xo := &xrandrOutput{Rotation: tc.rotation, Reflection: tc.reflection}
+		transform := xo.Transform()
+		if transform != tc.expected {
+			t.Errorf("expected %v for %v %q, got %v", tc.expected, tc.rotation, tc.reflection, transform)
+			continue
+		}
+
+		// setting the transform read keeps the orientation.
+		args, err := xrandrTransformArgs(transform)
+		if err != nil {
+			t.Errorf("unexpected error for %v: %v", transform, err)
+			continue
+		}
+		set := &xrandrOutput{Rotation: args[1]}
+		for reflection, arg := range reflectArgs {
+			if arg == args[3] {
+				set.Reflection = reflection
+			}
+		}
+		if set.Transform() != transform {
+			t.Errorf("expected setting %v via %v to keep it, got %v", transform, args, set.Transform())
+		}
+	}
+}
+
+func TestXrandrTransformArgs(t *testing.T) {
+	for _, tc := range []struct {
+		transform string
+		expected  []string
+	}{
+		{"normal", []string{"--rotate", "normal", "--reflect", "normal"}},
+		{"90", []string{"--rotate", "right", "--reflect", "normal"}},
+		{"180", []string{"--rotate", "inverted", "--reflect", "normal"}},
+		{"270", []string{"--rotate", "left", "--reflect", "normal"}},
+		{"flipped", []string{"--rotate", "normal", "--reflect", "x"}},
+		{"flipped-90", []string{"--rotate", "right", "--reflect", "x"}},
+		{"flipped-180", []string{"--rotate", "inverted", "--reflect", "x"}},
+		{"flipped-270", []string{"--rotate", "left", "--reflect", "x"}},
+		{"45", nil},
+		{"flipped-45", nil},
+	} {
+		args, err := xrandrTransformArgs(tc.transform)
+		if tc.expected == nil {
+			if err == nil {
+				t.Errorf("expected an error for %v", tc.transform)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected error for %v: %v", tc.transform, err)
+			continue
+		}
+		if !reflect.DeepEqual(args, tc.expected) {
+			t.Errorf("expected %v for %v, got %v", tc.expected, tc.transform, args)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package outputs
+
+import (
+	"fmt"
+	"path"
+)
+
+// Match selects outputs by their name, make, model and serial.
+// Every field is a pattern in the syntax of path.Match, empty fields match
+// everything. An output matches if all non-empty fields match.
+type Match struct {
+	Name   string `json:"name,omitempty"`
+	Make   string `json:"make,omitempty"`
+	Model  string `json:"model,omitempty"`
+	Serial string `json:"serial,omitempty"`
+}
+
+// Validate checks all patterns are well-formed, and at least one is set.
+func (m *Match) Validate() error {
+	if *m == (Match{}) {
+		return fmt.Errorf("%w: empty match", ErrInvalid)
+	}
+	for _, pattern := range []string{m.Name, m.Make, m.Model, m.Serial} {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("%w pattern %q: %v", ErrInvalid, pattern, err)
+		}
+	}
+	return nil
+}
+
+// Matches returns whether the output described by info matches.
+func (m *Match) Matches(info *Info) bool {
+	return matchPattern(m.Name, info.Name) &&
+		matchPattern(m.Make, info.Make) &&
+		matchPattern(m.Model, info.Model) &&
+		matchPattern(m.Serial, info.Serial)
+}
+
+func matchPattern(pattern string, value *string) bool {
+	if pattern == "" {
+		return true
+	}
+	if value == nil {
+		return false
+	}
+	matched, _ := path.Match(pattern, *value)
+	return matched
+}
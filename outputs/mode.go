@@ -1,6 +1,7 @@
 package outputs
 
 import (
+	"encoding/json"
 	"fmt"
 	"strconv"
 	"strings"
@@ -21,6 +22,24 @@ func (m *Mode) String() string {
 	}
 }
 
+// UnmarshalJSON accepts both the object form, and the string form understood
+// by NewMode.
+func (m *Mode) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		mode, err := NewMode(s)
+		if err != nil {
+			return err
+		}
+		*m = *mode
+		return nil
+	}
+
+	// avoid recursing into this function
+	type plainMode Mode
+	return json.Unmarshal(b, (*plainMode)(m))
+}
+
 func NewMode(s string) (*Mode, error) {
 
 	// split an optional freqency
@@ -47,7 +66,7 @@ func NewMode(s string) (*Mode, error) {
 
 	// parse x and y
 	xyItems := strings.SplitN(xyStr, "x", 2)
-	if len(items) != 2 {
+	if len(xyItems) != 2 {
 		return nil, fmt.Errorf("invalid XxY mode")
 	}
 
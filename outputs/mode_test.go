@@ -0,0 +1,51 @@
+package outputs
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestNewMode(t *testing.T) {
+	for _, tc := range []struct {
+		s        string
+		expected *Mode
+	}{
+		{"1920x1080", &Mode{Width: 1920, Height: 1080}},
+		{"1920x1080@60000", &Mode{Width: 1920, Height: 1080, Refresh: 60000}},
+		{"1920x1080@59.94", &Mode{Width: 1920, Height: 1080, Refresh: 59.94}},
+		// used to panic, as the number of items before the @ wasn't checked.
+		{"1920", nil},
+		{"1920@60000", nil},
+		{"", nil},
+		{"1920x", nil},
+		{"1920x1080@", &Mode{Width: 1920, Height: 1080}},
+		{"1920x1080@fast", nil},
+		{"widexhigh", nil},
+	} {
+		mode, err := NewMode(tc.s)
+		if tc.expected == nil {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %v", tc.s, mode)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", tc.s, err)
+		} else if *mode != *tc.expected {
+			t.Errorf("%q: expected %v, got %v", tc.s, tc.expected, mode)
+		}
+	}
+}
+
+func TestModeUnmarshalJSON(t *testing.T) {
+	var m Mode
+	if err := json.Unmarshal([]byte(`"1280x1024@75000"`), &m); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if m != (Mode{Width: 1280, Height: 1024, Refresh: 75000}) {
+		t.Errorf("unexpected mode %v", m)
+	}
+	if err := json.Unmarshal([]byte(`"1280"`), &m); err == nil {
+		t.Error("expected an error for an invalid mode")
+	}
+}
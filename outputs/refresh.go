@@ -0,0 +1,137 @@
+package outputs
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// RefreshLoop refreshes the outputs of a backend every interval, and whenever
+// a refresh is triggered, for example by an event of the display server.
+type RefreshLoop struct {
+	interval time.Duration
+	refresh  func() error
+	// used to request a refresh from Run
+	ch chan struct{}
+}
+
+// NewRefreshLoop returns a RefreshLoop calling refresh.
+func NewRefreshLoop(interval time.Duration, refresh func() error) *RefreshLoop {
+	return &RefreshLoop{
+		interval: interval,
+		refresh:  refresh,
+		ch:       make(chan struct{}, 1),
+	}
+}
+
+// Run refreshes the outputs until ctx is cancelled.
+func (r *RefreshLoop) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-r.ch:
+		case <-ctx.Done():
+			return
+		}
+
+		if err := r.refresh(); err != nil {
+			log.WithError(err).Error("Failed to refresh outputs")
+		}
+	}
+}
+
+// Trigger schedules a refresh of all outputs.
+// Multiple triggers arriving while a refresh is pending are coalesced.
+func (r *RefreshLoop) Trigger() {
+	select {
+	case r.ch <- struct{}{}:
+	default:
+	}
+}
+
+// UpdateFields copies all exported fields observed from the display server
+// from n into o, which is everything but the Scenario. It returns whether any
+// of them changed.
+// Backends use it to update known outputs when refreshing.
+func UpdateFields[T any](o, n *T) bool {
+	ov := reflect.ValueOf(o).Elem()
+	nv := reflect.ValueOf(n).Elem()
+
+	changed := false
+	for i := 0; i < ov.NumField(); i++ {
+		field := ov.Type().Field(i)
+		// the scenario can't be modified from the display server.
+		if !field.IsExported() || field.Name == "Scenario" {
+			continue
+		}
+		if !reflect.DeepEqual(ov.Field(i).Interface(), nv.Field(i).Interface()) {
+			ov.Field(i).Set(nv.Field(i))
+			changed = true
+		}
+	}
+	return changed
+}
+
+// Sync updates known, the outputs of a backend by their names, to observed,
+// the ones reported by the display server, and calls the handlers of h:
+// New outputs are set up by add and added, known ones are updated via
+// UpdateFields, and ones not reported anymore are removed. Known outputs
+// for which changed returns true are updated too, even if no field changed.
+// changed can be nil.
+// Backends call it with their lock held. stateMu is held while known outputs
+// are changed and changed is called, but not while calling the handlers, so
+// they can take it to copy the state of outputs.
+func Sync[T any, P interface {
+	*T
+	Output
+}](h *Handlers, stateMu sync.Locker, known map[string]P, observed []P, add func(P), changed func(P) bool) {
+	seen := make(map[string]bool, len(observed))
+
+	for _, newOutput := range observed {
+		outputName := *newOutput.GetInfo().Name
+		l := log.WithField("outputName", outputName)
+
+		seen[outputName] = true
+
+		// the output already exists…
+		if oldOutput, old := known[outputName]; old {
+			// update attributes with the new values, notify only if something changed.
+			stateMu.Lock()
+			updated := UpdateFields((*T)(oldOutput), (*T)(newOutput))
+			if changed != nil && changed(oldOutput) {
+				updated = true
+			}
+			stateMu.Unlock()
+			if !updated {
+				continue
+			}
+
+			l.Debug("calling update fns")
+			h.NotifyUpdate(oldOutput)
+			continue
+		}
+
+		add(newOutput)
+		known[outputName] = newOutput
+
+		l.Debug("calling add fns")
+		h.NotifyAdd(newOutput)
+	}
+	log.Debug("done looping over all outputs")
+
+	// remove all outputs that weren't reported anymore.
+	for prevOutputName, prevOutput := range known {
+		if !seen[prevOutputName] {
+			delete(known, prevOutputName)
+
+			log.WithField("outputName", prevOutputName).Debug("calling delete fns")
+			h.NotifyRemove(prevOutput)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package outputs
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestUpdateFields(t *testing.T) {
+	type output struct {
+		backend  *int
+		Name     string
+		Modes    []*Mode
+		Power    *bool
+		Scenario *Scenario
+	}
+
+	on, off := true, false
+	scenario := &Scenario{Name: "url"}
+	o := &output{Name: "DP-1", Modes: []*Mode{{Width: 1920, Height: 1080}}, Power: &on, Scenario: scenario}
+	n := &output{backend: new(int), Name: "DP-1", Modes: []*Mode{{Width: 1920, Height: 1080}}, Power: &on}
+
+	if UpdateFields(o, n) {
+		t.Error("expected nothing to change")
+	}
+	if o.backend != nil || o.Scenario != scenario {
+		t.Error("expected unexported fields and the scenario to be kept")
+	}
+
+	n.Power = &off
+	if !UpdateFields(o, n) {
+		t.Error("expected power to change")
+	}
+	if *o.Power {
+		t.Error("expected power to be updated")
+	}
+}
+
+func TestRefreshLoop(t *testing.T) {
+	var refreshes atomic.Int32
+	refreshed := make(chan struct{}, 10)
+	r := NewRefreshLoop(time.Hour, func() error {
+		refreshes.Add(1)
+		refreshed <- struct{}{}
+		return nil
+	})
+
+	// triggers arriving before the loop runs are coalesced.
+	r.Trigger()
+	r.Trigger()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		r.Run(ctx)
+		close(done)
+	}()
+
+	select {
+	case <-refreshed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no refresh after triggering")
+	}
+	cancel()
+	<-done
+
+	if n := refreshes.Load(); n != 1 {
+		t.Errorf("expected a single refresh, got %v", n)
+	}
+}
+
+// syncOutput is a minimal output, as backends implement them.
+type syncOutput struct {
+	backend  *int
+	Name     string
+	Power    bool
+	Scenario *Scenario
+}
+
+func (o *syncOutput) GetInfo() *Info   { return &Info{Name: &o.Name} }
+func (o *syncOutput) GetState() *State { return &State{Power: &o.Power, Scenario: o.Scenario} }
+func (o *syncOutput) SetState(*State) (*State, error) {
+	return nil, ErrUnsupported
+}
+
+func TestSync(t *testing.T) {
+	var h Handlers
+	var added, updated, removed []string
+	h.RegisterOutputAdd(func(o Output) { added = append(added, *o.GetInfo().Name) })
+	h.RegisterOutputUpdate(func(o Output) { updated = append(updated, *o.GetInfo().Name) })
+	h.RegisterOutputRemove(func(o Output) { removed = append(removed, *o.GetInfo().Name) })
+
+	backend := new(int)
+	known := make(map[string]*syncOutput)
+	add := func(o *syncOutput) {
+		o.backend = backend
+		o.Scenario = &Scenario{Name: "blank"}
+	}
+	exited := map[string]bool{}
+	changed := func(o *syncOutput) bool { return exited[o.Name] }
+
+	Sync(&h, &sync.Mutex{}, known, []*syncOutput{{Name: "DP-1"}, {Name: "DP-2"}}, add, changed)
+	if len(added) != 2 || len(updated) != 0 || len(removed) != 0 {
+		t.Fatalf("expected both outputs to be added, got %q %q %q", added, updated, removed)
+	}
+	dp1 := known["DP-1"]
+	if dp1.backend != backend || dp1.Scenario == nil {
+		t.Error("expected new outputs to be set up by add")
+	}
+
+	// DP-1 is changed, DP-2 reported unchanged, but its scenario exited.
+	exited["DP-2"] = true
+	Sync(&h, &sync.Mutex{}, known, []*syncOutput{{Name: "DP-1", Power: true}, {Name: "DP-2"}}, add, changed)
+	if len(updated) != 2 || len(added) != 2 {
+		t.Errorf("expected both outputs to be updated, got %q", updated)
+	}
+	if known["DP-1"] != dp1 || !dp1.Power || dp1.backend != backend {
+		t.Error("expected known outputs to be updated in place")
+	}
+
+	// nothing changed.
+	Sync(&h, &sync.Mutex{}, known, []*syncOutput{{Name: "DP-1", Power: true}, {Name: "DP-2"}}, add, nil)
+	if len(updated) != 2 {
+		t.Errorf("expected no updates, got %q", updated)
+	}
+
+	Sync(&h, &sync.Mutex{}, known, []*syncOutput{{Name: "DP-2"}}, add, changed)
+	if len(removed) != 1 || removed[0] != "DP-1" || len(known) != 1 {
+		t.Errorf("expected DP-1 to be removed, got %q", removed)
+	}
+}
@@ -0,0 +1,104 @@
+package outputs
+
+import (
+	"errors"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// FieldError is returned by Output.SetState if a single field of the state
+// couldn't be applied.
+type FieldError struct {
+	// the name of the field in the JSON representation of State
+	Field string
+	Err   error
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("failed to set %v: %v", e.Field, e.Err)
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+// FieldErrors returns all FieldErrors contained in err, which might be a
+// single FieldError, or multiple ones joined with errors.Join, possibly
+// wrapped.
+func FieldErrors(err error) []*FieldError {
+	switch e := err.(type) {
+	case *FieldError:
+		return []*FieldError{e}
+	case interface{ Unwrap() []error }:
+		var fieldErrs []*FieldError
+		for _, err := range e.Unwrap() {
+			fieldErrs = append(fieldErrs, FieldErrors(err)...)
+		}
+		return fieldErrs
+	case interface{ Unwrap() error }:
+		return FieldErrors(e.Unwrap())
+	}
+	return nil
+}
+
+// Undo returns a sparse state, restoring the values in s for all fields set
+// in applied.
+// The values are copied, as GetState usually returns pointers into the output
+// itself, which change once applied is applied.
+func (s *State) Undo(applied *State) *State {
+	undo := &State{
+		Enabled:         restore(applied.Enabled, s.Enabled),
+		Mode:            restore(applied.Mode, s.Mode),
+		Power:           restore(applied.Power, s.Power),
+		Scale:           restore(applied.Scale, s.Scale),
+		Transform:       restore(applied.Transform, s.Transform),
+		Position:        restore(applied.Position, s.Position),
+		AdaptiveSync:    restore(applied.AdaptiveSync, s.AdaptiveSync),
+		SubpixelHinting: restore(applied.SubpixelHinting, s.SubpixelHinting),
+		ScaleFilter:     restore(applied.ScaleFilter, s.ScaleFilter),
+		MaxRenderTime:   restore(applied.MaxRenderTime, s.MaxRenderTime),
+		Scenario:        restore(applied.Scenario, s.Scenario),
+	}
+	// disabled outputs don't have a mode, there's nothing to restore.
+	if undo.Mode != nil && undo.Mode.Width == 0 {
+		undo.Mode = nil
+	}
+	return undo
+}
+
+// restore returns a copy of prev, if the field was set in applied.
+func restore[T any](applied, prev *T) *T {
+	if applied == nil || prev == nil {
+		return nil
+	}
+	v := *prev
+	return &v
+}
+
+// ApplyWithRollback applies newState by calling apply, which is expected to
+// return a FieldError for every field that failed.
+// If applying fails, all fields set in newState are restored to their values
+// in prevState by calling apply again, so the output is left as it was.
+// Backends apply the scenario last, so it's only restored if setting the
+// scenario itself failed.
+func ApplyWithRollback(prevState, newState *State, apply func(*State) error) error {
+	undo := prevState.Undo(newState)
+
+	err := apply(newState)
+	if err == nil {
+		return nil
+	}
+
+	var fieldErr *FieldError
+	if !errors.As(err, &fieldErr) || fieldErr.Field != "scenario" {
+		undo.Scenario = nil
+	}
+
+	log.WithError(err).Info("rolling back")
+	if rollbackErr := apply(undo); rollbackErr != nil {
+		log.WithError(rollbackErr).Error("unable to roll back")
+	}
+
+	return err
+}
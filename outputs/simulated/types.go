@@ -0,0 +1,454 @@
+package simulated
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/flokli/display-agent/outputs"
+	"github.com/flokli/display-agent/scenario"
+	log "github.com/sirupsen/logrus"
+)
+
+// Simulated is an in-memory backend, for development and tests.
+// It loads outputs from a fixture in the format of `swaymsg -t get_outputs`,
+// applies state changes in memory, records scenario launches, and can
+// simulate hotplugging outputs according to a script.
+type Simulated struct {
+	// all outputs from the fixture, including the currently disconnected ones.
+	fixtureOutputs map[string]*Output
+	script         *Script
+
+	// held while changing outputs and calling the handlers, so they're
+	// called in order. Unlike mu, it's not needed by Outputs, so handlers
+	// can call it.
+	notifyMu sync.Mutex
+
+	mu sync.Mutex
+	// the currently connected outputs
+	outputs  map[string]*Output
+	launches []Launch
+
+	outputs.Handlers
+}
+
+// Launch records a scenario that was started on an output.
+type Launch struct {
+	Time       time.Time
+	OutputName string
+	Scenario   outputs.Scenario
+	// the command that would have been launched, nil if none.
+	Argv []string
+}
+
+// Script describes outputs being plugged and unplugged over time.
+type Script struct {
+	// start over after the last step
+	Repeat bool   `json:"repeat"`
+	Steps  []Step `json:"steps"`
+}
+
+// Step connects or disconnects a single output, after the given time passed
+// since the previous step.
+type Step struct {
+	After Duration `json:"after"`
+	// name of the output to connect
+	Add string `json:"add,omitempty"`
+	// name of the output to disconnect
+	Remove string `json:"remove,omitempty"`
+}
+
+// Duration is a time.Duration, (un)marshalled in the format understood by
+// time.ParseDuration.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func init() {
+	outputs.RegisterBackend("simulated", func(opts outputs.BackendOptions) (outputs.Backend, error) {
+		fixturePath := opts.Params["fixture"]
+		if fixturePath == "" {
+			return nil, fmt.Errorf("the fixture parameter must be set")
+		}
+		fixture, err := os.ReadFile(fixturePath)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read fixture: %w", err)
+		}
+
+		var script *Script
+		if scriptPath := opts.Params["script"]; scriptPath != "" {
+			b, err := os.ReadFile(scriptPath)
+			if err != nil {
+				return nil, fmt.Errorf("unable to read script: %w", err)
+			}
+			if err := json.Unmarshal(b, &script); err != nil {
+				return nil, fmt.Errorf("unable to parse script: %w", err)
+			}
+		}
+
+		return New(fixture, script)
+	})
+}
+
+// New returns a simulated backend, with the outputs described in fixture.
+// script can be nil, in which case all outputs stay connected.
+func New(fixture []byte, script *Script) (*Simulated, error) {
+	var fixtureOutputs []*Output
+	if err := json.Unmarshal(fixture, &fixtureOutputs); err != nil {
+		return nil, fmt.Errorf("unable to parse fixture: %w", err)
+	}
+
+	s := &Simulated{
+		fixtureOutputs: make(map[string]*Output, len(fixtureOutputs)),
+		script:         script,
+		outputs:        make(map[string]*Output),
+	}
+	for _, o := range fixtureOutputs {
+		s.fixtureOutputs[o.Name] = o
+	}
+
+	if script != nil {
+		for _, step := range script.Steps {
+			for _, name := range []string{step.Add, step.Remove} {
+				if _, ok := s.fixtureOutputs[name]; name != "" && !ok {
+					return nil, fmt.Errorf("script refers to unknown output %v", name)
+				}
+			}
+		}
+	}
+
+	return s, nil
+}
+
+// Start implements Backend.
+// It connects all outputs from the fixture, and runs the script, if any.
+func (s *Simulated) Start(ctx context.Context) error {
+	names := make([]string, 0, len(s.fixtureOutputs))
+	for name := range s.fixtureOutputs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		s.Connect(name)
+	}
+
+	go func() {
+		if s.script != nil && len(s.script.Steps) != 0 {
+			s.runScript(ctx)
+		}
+		<-ctx.Done()
+
+		s.notifyMu.Lock()
+		defer s.notifyMu.Unlock()
+		for _, output := range s.Outputs() {
+			log.WithField("outputName", *output.GetInfo().Name).Debug("calling cleanup handlers")
+			s.NotifyRemove(output)
+		}
+
+		s.NotifyStopped()
+	}()
+
+	return nil
+}
+
+func (s *Simulated) runScript(ctx context.Context) {
+	for {
+		for _, step := range s.script.Steps {
+			select {
+			case <-time.After(time.Duration(step.After)):
+			case <-ctx.Done():
+				return
+			}
+			if step.Add != "" {
+				s.Connect(step.Add)
+			}
+			if step.Remove != "" {
+				s.Disconnect(step.Remove)
+			}
+		}
+		if !s.script.Repeat {
+			return
+		}
+	}
+}
+
+// Connect simulates plugging in the output with the given name from the
+// fixture. It starts out with the state described in the fixture.
+func (s *Simulated) Connect(name string) error {
+	s.notifyMu.Lock()
+	defer s.notifyMu.Unlock()
+
+	fixtureOutput, ok := s.fixtureOutputs[name]
+	if !ok {
+		return fmt.Errorf("unknown output %v", name)
+	}
+
+	s.mu.Lock()
+	_, connected := s.outputs[name]
+	s.mu.Unlock()
+	if connected {
+		return nil
+	}
+
+	o := *fixtureOutput
+	o.simulated = s
+	o.Scenario = scenario.NewBlank()
+	s.mu.Lock()
+	s.outputs[name] = &o
+	s.mu.Unlock()
+
+	log.WithField("outputName", name).Debug("calling add fns")
+	s.NotifyAdd(&o)
+
+	return nil
+}
+
+// Disconnect simulates unplugging the output with the given name.
+func (s *Simulated) Disconnect(name string) {
+	s.notifyMu.Lock()
+	defer s.notifyMu.Unlock()
+
+	s.mu.Lock()
+	o, connected := s.outputs[name]
+	delete(s.outputs, name)
+	s.mu.Unlock()
+	if !connected {
+		return
+	}
+
+	log.WithField("outputName", name).Debug("calling delete fns")
+	s.NotifyRemove(o)
+}
+
+// Close implements Backend.
+func (s *Simulated) Close() {}
+
+// Outputs implements Backend.
+func (s *Simulated) Outputs() []outputs.Output {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	l := make([]outputs.Output, 0, len(s.outputs))
+	for _, output := range s.outputs {
+		l = append(l, output)
+	}
+	return l
+}
+
+// Scenarios implements Backend.
+func (s *Simulated) Scenarios() []string {
+	return scenario.Names()
+}
+
+// Launches returns all scenarios started so far.
+func (s *Simulated) Launches() []Launch {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]Launch(nil), s.launches...)
+}
+
+type Output struct {
+	// A handle to the global simulated object
+	simulated *Simulated
+
+	Active      bool            `json:"active"`
+	CurrentMode outputs.Mode    `json:"current_mode"`
+	Make        string          `json:"make"`
+	Model       string          `json:"model"`
+	Modes       []*outputs.Mode `json:"modes"`
+	Name        string          `json:"name"`
+	Power       bool            `json:"power"`
+	Scale       float64         `json:"scale"`
+	Serial      string          `json:"serial"`
+	Transform   string          `json:"transform"`
+	// only the position of rect is used.
+	Rect            outputs.Position `json:"rect"`
+	AdaptiveSync    string           `json:"adaptive_sync_status"`
+	SubpixelHinting string           `json:"subpixel_hinting"`
+	ScaleFilter     string           `json:"scale_filter"`
+	MaxRenderTime   int64            `json:"max_render_time"`
+
+	Scenario *outputs.Scenario
+}
+
+// GetInfo implements Output.
+func (o *Output) GetInfo() *outputs.Info {
+	return &outputs.Info{
+		Make:   &o.Make,
+		Model:  &o.Model,
+		Modes:  &o.Modes,
+		Name:   &o.Name,
+		Serial: &o.Serial,
+	}
+}
+
+// GetState implements Output.
+// Unlike the other backends, outputs can be changed by scripts and tests
+// while the state is used, so it's a copy.
+func (o *Output) GetState() *outputs.State {
+	o.simulated.mu.Lock()
+	c := *o
+	o.simulated.mu.Unlock()
+	return c.state()
+}
+
+// state returns the state of o, pointing to its fields.
+func (o *Output) state() *outputs.State {
+	return &outputs.State{
+		Enabled:         &o.Active,
+		Mode:            &o.CurrentMode,
+		Power:           &o.Power,
+		Scale:           &o.Scale,
+		Transform:       &o.Transform,
+		Position:        &o.Rect,
+		AdaptiveSync:    &o.AdaptiveSync,
+		SubpixelHinting: &o.SubpixelHinting,
+		ScaleFilter:     &o.ScaleFilter,
+		MaxRenderTime:   &o.MaxRenderTime,
+		Scenario:        o.Scenario,
+	}
+}
+
+// SetState implements Output.
+// Changes are validated like a real display server would, and applied in
+// memory. If a field can't be applied, the fields applied before are rolled
+// back.
+func (o *Output) SetState(newState *outputs.State) (*outputs.State, error) {
+	s := o.simulated
+	s.notifyMu.Lock()
+	defer s.notifyMu.Unlock()
+
+	log.WithFields(newState.LogFields("newState")).Debug("SetState()")
+
+	s.mu.Lock()
+	err := newState.Validate()
+	if err == nil {
+		err = outputs.ApplyWithRollback(o.state(), newState, o.apply)
+	}
+	// the output might be changed again, once the lock is released.
+	c := *o
+	// a stale handle of an output disconnected already isn't reported, it
+	// would be added again.
+	current := s.outputs[o.Name] == o
+	s.mu.Unlock()
+
+	// a real display server would report the changes back.
+	if current {
+		s.NotifyUpdate(o)
+	}
+
+	return c.state(), err
+}
+
+// apply applies all fields set in newState one by one, and returns on the
+// first one that fails.
+func (o *Output) apply(newState *outputs.State) error {
+	if newState.Enabled != nil {
+		o.Active = *newState.Enabled
+	}
+	if newState.Mode != nil {
+		m := o.findMode(newState.Mode)
+		if m == nil {
+			return &outputs.FieldError{Field: "mode", Err: fmt.Errorf("unsupported mode %v", newState.Mode)}
+		}
+		o.CurrentMode = *m
+	}
+	if newState.Power != nil {
+		o.Power = *newState.Power
+	}
+	if newState.Scale != nil {
+		if *newState.Scale <= 0 {
+			return &outputs.FieldError{Field: "scale", Err: fmt.Errorf("invalid scale %v", *newState.Scale)}
+		}
+		o.Scale = *newState.Scale
+	}
+	if newState.Transform != nil {
+		if _, err := outputs.TransformIndex(*newState.Transform); err != nil {
+			return &outputs.FieldError{Field: "transform", Err: err}
+		}
+		o.Transform = *newState.Transform
+	}
+	if newState.Position != nil {
+		o.Rect = *newState.Position
+	}
+	if newState.AdaptiveSync != nil {
+		o.AdaptiveSync = *newState.AdaptiveSync
+	}
+	if newState.SubpixelHinting != nil {
+		o.SubpixelHinting = *newState.SubpixelHinting
+	}
+	if newState.ScaleFilter != nil {
+		o.ScaleFilter = *newState.ScaleFilter
+	}
+	if newState.MaxRenderTime != nil {
+		o.MaxRenderTime = *newState.MaxRenderTime
+	}
+	if newState.Scenario != nil {
+		if err := o.setScenario(newState.Scenario.Name, newState.Scenario.Args); err != nil {
+			return &outputs.FieldError{Field: "scenario", Err: err}
+		}
+	}
+	return nil
+}
+
+// findMode returns the mode supported by the output matching m, or nil if
+// there is none.
+// If the mode doesn't specify a refresh rate, any refresh rate matches.
+func (o *Output) findMode(m *outputs.Mode) *outputs.Mode {
+	for _, om := range o.Modes {
+		if om.Width == m.Width && om.Height == m.Height && (m.Refresh == 0 || om.Refresh == m.Refresh) {
+			return om
+		}
+	}
+	return nil
+}
+
+func (o *Output) setScenario(name string, args []string) error {
+	log.WithFields(log.Fields{
+		"scenario": name,
+		"args":     args,
+	}).Debug("SetScenario")
+
+	argv, err := scenario.Command(name, args)
+	if err != nil {
+		return err
+	}
+
+	o.simulated.launches = append(o.simulated.launches, Launch{
+		Time:       time.Now(),
+		OutputName: o.Name,
+		Scenario: outputs.Scenario{
+			Name: name,
+			Args: args,
+		},
+		Argv: argv,
+	})
+
+	// update the internal state
+	o.Scenario = &outputs.Scenario{
+		Name: name,
+		Args: args,
+	}
+
+	return nil
+}
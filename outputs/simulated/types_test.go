@@ -0,0 +1,222 @@
+package simulated
+
+import (
+	"context"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/flokli/display-agent/outputs"
+)
+
+func newTestSimulated(t *testing.T, script *Script) *Simulated {
+	fixture, err := os.ReadFile("../../test/testdata/swaymsg_get_outputs.txt")
+	if err != nil {
+		t.Fatalf("unable to read fixture: %v", err)
+	}
+	s, err := New(fixture, script)
+	if err != nil {
+		t.Fatalf("unable to create backend: %v", err)
+	}
+	return s
+}
+
+func TestNew(t *testing.T) {
+	if _, err := New([]byte("{"), nil); err == nil {
+		t.Error("expected an error for an invalid fixture")
+	}
+
+	fixture, err := os.ReadFile("../../test/testdata/swaymsg_get_outputs.txt")
+	if err != nil {
+		t.Fatalf("unable to read fixture: %v", err)
+	}
+	for _, step := range []Step{{Add: "DP-9"}, {Remove: "DP-9"}} {
+		if _, err := New(fixture, &Script{Steps: []Step{step}}); err == nil {
+			t.Errorf("expected an error for a script referring to an unknown output: %+v", step)
+		}
+	}
+	if _, err := New(fixture, &Script{Steps: []Step{{Remove: "VGA-1"}, {Add: "VGA-1"}}}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+// recorder records the names of the outputs handlers were called with.
+type recorder struct {
+	mu                      sync.Mutex
+	added, updated, removed []string
+}
+
+func (r *recorder) register(s *Simulated) {
+	record := func(l *[]string) func(outputs.Output) {
+		return func(o outputs.Output) {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			*l = append(*l, *o.GetInfo().Name)
+		}
+	}
+	s.RegisterOutputAdd(record(&r.added))
+	s.RegisterOutputUpdate(record(&r.updated))
+	s.RegisterOutputRemove(record(&r.removed))
+}
+
+func (r *recorder) counts() (added, updated, removed int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.added), len(r.updated), len(r.removed)
+}
+
+func TestRunScript(t *testing.T) {
+	steps := []Step{
+		{After: Duration(time.Millisecond), Remove: "VGA-1"},
+		{After: Duration(time.Millisecond), Add: "VGA-1"},
+	}
+
+	for _, repeat := range []bool{false, true} {
+		s := newTestSimulated(t, &Script{Repeat: repeat, Steps: steps})
+		var r recorder
+		r.register(s)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		if err := s.Start(ctx); err != nil {
+			t.Fatalf("unable to start: %v", err)
+		}
+
+		// the script removes VGA-1 once, or over and over again.
+		expectedRemoved := 1
+		if repeat {
+			expectedRemoved = 3
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for added, _, removed := r.counts(); (added < 3 || removed < expectedRemoved) && time.Now().Before(deadline); added, _, removed = r.counts() {
+			time.Sleep(time.Millisecond)
+		}
+		if !repeat {
+			time.Sleep(20 * time.Millisecond)
+		}
+		added, _, removed := r.counts()
+		if repeat && removed < expectedRemoved {
+			t.Errorf("expected the script to repeat, got %v adds and %v removes", added, removed)
+		}
+		if !repeat && (added != 3 || removed != 1) {
+			t.Errorf("expected the script to run once, got %v adds and %v removes", added, removed)
+		}
+
+		// all outputs are removed when stopping.
+		cancel()
+		<-s.Stopped()
+		if added, _, removed := r.counts(); added-removed != 0 {
+			t.Errorf("expected all outputs to be removed, got %v adds and %v removes", added, removed)
+		}
+	}
+}
+
+func TestFindMode(t *testing.T) {
+	s := newTestSimulated(t, nil)
+	o := s.fixtureOutputs["HDMI-A-1"]
+
+	for _, tc := range []struct {
+		mode    outputs.Mode
+		refresh float64
+	}{
+		{outputs.Mode{Width: 1680, Height: 1050, Refresh: 59954}, 59954},
+		// any refresh rate matches if none is given.
+		{outputs.Mode{Width: 1280, Height: 1024}, 75025},
+		{outputs.Mode{Width: 1680, Height: 1050, Refresh: 30000}, 0},
+		{outputs.Mode{Width: 1, Height: 1}, 0},
+	} {
+		m := o.findMode(&tc.mode)
+		if tc.refresh == 0 {
+			if m != nil {
+				t.Errorf("expected no mode for %v, got %v", tc.mode, m)
+			}
+			continue
+		}
+		if m == nil || m.Width != tc.mode.Width || m.Height != tc.mode.Height || m.Refresh != tc.refresh {
+			t.Errorf("expected %vx%v@%v for %v, got %v", tc.mode.Width, tc.mode.Height, tc.refresh, tc.mode, m)
+		}
+	}
+}
+
+// Fields applied before a failing one are rolled back.
+func TestSetStateRollback(t *testing.T) {
+	s := newTestSimulated(t, nil)
+	if err := s.Connect("HDMI-A-1"); err != nil {
+		t.Fatalf("unable to connect: %v", err)
+	}
+	o := s.outputs["HDMI-A-1"]
+
+	disabled := false
+	state, err := o.SetState(&outputs.State{Enabled: &disabled, Mode: &outputs.Mode{Width: 1, Height: 1}})
+	if err == nil {
+		t.Fatal("expected an error for an unsupported mode")
+	}
+	if !*state.Enabled || !o.Active {
+		t.Error("expected the output to be enabled again")
+	}
+
+	scale := 2.0
+	state, err = o.SetState(&outputs.State{Enabled: &disabled, Scale: &scale})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if *state.Enabled || *state.Scale != 2 {
+		t.Errorf("expected the new state to be returned, got %v", state.LogFields(""))
+	}
+}
+
+// Changing an output disconnected already doesn't report an update for it.
+func TestSetStateAfterDisconnect(t *testing.T) {
+	s := newTestSimulated(t, nil)
+	var r recorder
+	r.register(s)
+	if err := s.Connect("HDMI-A-1"); err != nil {
+		t.Fatalf("unable to connect: %v", err)
+	}
+	o := s.outputs["HDMI-A-1"]
+
+	scale := 2.0
+	if _, err := o.SetState(&outputs.State{Scale: &scale}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	s.Disconnect("HDMI-A-1")
+	if _, err := o.SetState(&outputs.State{Scale: &scale}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if added, updated, removed := r.counts(); added != 1 || updated != 1 || removed != 1 {
+		t.Errorf("expected a single update, got %v adds, %v updates and %v removes", added, updated, removed)
+	}
+}
+
+// Handlers are called without holding the lock of the backend, they can
+// query it.
+func TestHandlersCanQueryOutputs(t *testing.T) {
+	s := newTestSimulated(t, nil)
+	var seen []int
+	query := func(outputs.Output) { seen = append(seen, len(s.Outputs())) }
+	s.RegisterOutputAdd(query)
+	s.RegisterOutputUpdate(query)
+	s.RegisterOutputRemove(query)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := s.Connect("HDMI-A-1"); err != nil {
+			t.Errorf("unable to connect: %v", err)
+		}
+		scale := 2.0
+		if _, err := s.outputs["HDMI-A-1"].SetState(&outputs.State{Scale: &scale}); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		s.Disconnect("HDMI-A-1")
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handlers deadlocked")
+	}
+	if len(seen) != 3 || seen[0] != 1 || seen[2] != 0 {
+		t.Errorf("unexpected outputs seen by handlers: %v", seen)
+	}
+}
@@ -1,70 +1,129 @@
 package sway
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
-	"os/exec"
+	"strconv"
+	"strings"
 
+	"github.com/flokli/display-agent/outputs"
+	"github.com/flokli/display-agent/scenario"
 	log "github.com/sirupsen/logrus"
 )
 
-// helper command, invokes swaycmd
-func swaycmd(args ...string) ([]byte, error) {
-	out, err := exec.Command("swaymsg", args...).Output()
-	log := log.WithFields(log.Fields{
-		"out":  string(out),
-		"name": "swaymsg",
-		"args": args,
-	})
+// helper command, runs the sway command consisting of args over IPC.
+func (s *Sway) swaycmd(args ...string) error {
+	cmd := strings.Join(args, " ")
+	log := log.WithField("cmd", cmd)
+	if err := s.ipc.runCommand(cmd); err != nil {
+		// keep this log statement, so we see the error somewhere.
+		// callsites usually discard it without logging.
+		log.WithError(err).Debug("failed running sway command")
+		return fmt.Errorf("failed running sway command: %w", err)
+	}
+	log.Debug("ran sway command")
+	return nil
+}
+
+// helper command, runs all given sway commands with a single message.
+// It returns an error for each command, nil if the command succeeded.
+// Commands that weren't executed at all get errNotExecuted.
+func (s *Sway) swaycmds(cmds []string) ([]error, error) {
+	log := log.WithField("cmds", cmds)
+	results, err := s.ipc.runCommands(cmds)
 	if err != nil {
-		// keep this log statement, so we see the output somewhere.
-		// callsites usually discard it without logging output.
-		log.Debug("failed running swaymsg")
-		return out, fmt.Errorf("failed running swaymsg: %w", err)
+		log.WithError(err).Debug("failed running sway commands")
+		return nil, fmt.Errorf("failed running sway commands: %w", err)
 	}
-	log.Debug("ran swaymsg")
-	return out, nil
+	log.WithField("results", results).Debug("ran sway commands")
+
+	errs := make([]error, len(cmds))
+	for i := range cmds {
+		if i >= len(results) {
+			errs[i] = errNotExecuted
+		} else if !results[i].Success {
+			errs[i] = errors.New(results[i].Error)
+		}
+	}
+	return errs, nil
 }
 
-// helper command, invokes `swaycmd output $output ...args`
-func (o *Output) configure(args ...string) error {
-	fullArgs := []string{"output", o.Name}
-	fullArgs = append(fullArgs, args...)
-	_, err := swaycmd(fullArgs...)
-	return err
+// errNotExecuted is returned for commands sway skipped, as a command before
+// them couldn't be parsed.
+var errNotExecuted = errors.New("not executed, as a previous command failed")
+
+// outputCmd returns the command `output $output ...args`
+func (o *Output) outputCmd(args ...string) string {
+	return strings.Join(append([]string{"output", o.Name}, args...), " ")
 }
 
-func (o *Output) focusWorkspace() error {
-	// select workspace, and make sure it's created.
-	if _, err := swaycmd("workspace", o.Name); err != nil {
-		return fmt.Errorf("Unable to select workspace: %w", err)
+// modeArg formats a mode the way sway expects it, with the refresh rate in Hz.
+func modeArg(m *outputs.Mode) string {
+	if m.Refresh == 0 {
+		return fmt.Sprintf("%vx%v", m.Width, m.Height)
 	}
-	// pin workspace to output
-	if _, err := swaycmd("workspace", o.Name, "output", o.Name); err != nil {
-		return fmt.Errorf("Unable to pin workspace to output: %w", err)
+	// Refresh is in mHz.
+	return fmt.Sprintf("%vx%v@%vHz", m.Width, m.Height, strconv.FormatFloat(m.Refresh/1000, 'f', 3, 64))
+}
+
+// Clear implements scenario.Placer.
+// The workspace dedicated to the output is assigned to it, so it's created
+// there, moved there if it existed elsewhere, and all windows on it are
+// killed.
+func (s *Sway) Clear(outputName string) error {
+	workspace, output := strconv.Quote(outputName), strconv.Quote(outputName)
+	if err := s.swaycmd("workspace", workspace, "output", output); err != nil {
+		return fmt.Errorf("unable to pin workspace to output: %w", err)
 	}
+	// these fail if the workspace doesn't exist, which is fine.
+	s.swaycmd(fmt.Sprintf("[workspace=%v]", workspace), "move", "workspace", "to", "output", output)
+	s.swaycmd(fmt.Sprintf("[workspace=%v]", workspace), "kill")
 	return nil
 }
 
-func (o *Output) empty() error {
-	swaycmd(fmt.Sprintf("[workspace=\"%v\"]", o.Name), "kill")
-	// TODO: this seems to exit 2 if it couldn't find anything?
-	return nil
+// swayNode is a node of the tree, as returned by get_tree.
+type swayNode struct {
+	ID int64 `json:"id"`
+	// only set for windows
+	Pid           int         `json:"pid"`
+	Nodes         []*swayNode `json:"nodes"`
+	FloatingNodes []*swayNode `json:"floating_nodes"`
 }
 
-// Run the given command on the screen.
-func (o *Output) runCommand(cmd string) error {
-	if err := o.focusWorkspace(); err != nil {
-		return fmt.Errorf("unable to focus workspace: %w", err)
+// Windows implements scenario.Placer.
+func (s *Sway) Windows() ([]scenario.Window, error) {
+	out, err := s.ipc.roundtrip(msgGetTree, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get tree: %w", err)
+	}
+	var root swayNode
+	if err := json.Unmarshal(out, &root); err != nil {
+		return nil, fmt.Errorf("unable to parse tree: %w", err)
 	}
 
-	if len(cmd) != 0 {
-		// start the process on the workspace
-		if _, err := swaycmd(fmt.Sprintf("exec %s", cmd)); err != nil {
-			return fmt.Errorf("unable to execute command: %w", err)
+	var windows []scenario.Window
+	var walk func(n *swayNode)
+	walk = func(n *swayNode) {
+		if n.Pid != 0 {
+			windows = append(windows, scenario.Window{ID: strconv.FormatInt(n.ID, 10), Pid: n.Pid})
+		}
+		for _, c := range n.Nodes {
+			walk(c)
+		}
+		for _, c := range n.FloatingNodes {
+			walk(c)
 		}
 	}
+	walk(&root)
+	return windows, nil
+}
 
-	// TODO: wait for a window to have appeared
-
-	return nil
+// Place implements scenario.Placer.
+// It moves the window to the workspace of the output, which is created there,
+// or moved there if it was moved elsewhere since it was pinned.
+func (s *Sway) Place(w scenario.Window, outputName string) error {
+	workspace := strconv.Quote(outputName)
+	return s.swaycmd(fmt.Sprintf("[con_id=%v]", w.ID), "move", "container", "to", "workspace", workspace+",",
+		"move", "workspace", "to", "output", strconv.Quote(outputName))
 }
@@ -0,0 +1,281 @@
+package sway
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// This file implements the client side of the i3/sway IPC protocol, as
+// described in sway-ipc(7).
+// Every message consists of the magic string "i3-ipc", the payload length and
+// the message type (both 32 bit integers in native byte order), followed by the
+// (usually JSON-encoded) payload.
+
+const (
+	ipcMagic   = "i3-ipc"
+	ipcTimeout = 10 * time.Second
+
+	// how long to wait before resubscribing to events after the subscription broke
+	resubscribeDelay = 1 * time.Second
+)
+
+type messageType uint32
+
+const (
+	msgRunCommand messageType = 0
+	msgSubscribe  messageType = 2
+	msgGetOutputs messageType = 3
+	msgGetTree    messageType = 4
+
+	// events have the highest bit set
+	eventMask messageType = 1 << 31
+)
+
+// ipcConn is a connection to the sway IPC socket.
+// It transparently reconnects if the connection broke, for example because
+// sway was restarted.
+type ipcConn struct {
+	socketPath string
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// socketPathFromEnv returns the path to the sway IPC socket, as exposed to
+// child processes of sway.
+func socketPathFromEnv() (string, error) {
+	if p := os.Getenv("SWAYSOCK"); p != "" {
+		return p, nil
+	}
+	return "", fmt.Errorf("SWAYSOCK is not set")
+}
+
+func newIPCConn(socketPath string) *ipcConn {
+	return &ipcConn{
+		socketPath: socketPath,
+	}
+}
+
+func (c *ipcConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close()
+	c.conn = nil
+	return err
+}
+
+// roundtrip sends a message of the given type and returns the payload of the
+// reply.
+// If the connection is broken, it reconnects once and retries, unless sway
+// might have received the message already and it changes something:
+// commands would be run twice otherwise.
+func (c *ipcConn) roundtrip(t messageType, payload []byte) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for attempt := 0; ; attempt++ {
+		if c.conn == nil {
+			conn, err := net.DialTimeout("unix", c.socketPath, ipcTimeout)
+			if err != nil {
+				return nil, fmt.Errorf("unable to connect to sway socket: %w", err)
+			}
+			c.conn = conn
+		}
+
+		reply, sent, err := c.roundtripLocked(t, payload)
+		if err == nil {
+			return reply, nil
+		}
+
+		c.conn.Close()
+		c.conn = nil
+
+		if attempt > 0 || (sent && !t.idempotent()) {
+			return nil, err
+		}
+		log.WithError(err).Warn("sway IPC connection broken, reconnecting")
+	}
+}
+
+// idempotent returns whether sending a message of this type twice does the
+// same as sending it once.
+func (t messageType) idempotent() bool {
+	return t == msgGetOutputs || t == msgGetTree
+}
+
+// roundtripLocked sends a message and reads the reply, and returns whether the
+// message was written to the socket.
+func (c *ipcConn) roundtripLocked(t messageType, payload []byte) ([]byte, bool, error) {
+	if err := c.conn.SetDeadline(time.Now().Add(ipcTimeout)); err != nil {
+		return nil, false, fmt.Errorf("unable to set deadline: %w", err)
+	}
+
+	if err := writeMessage(c.conn, t, payload); err != nil {
+		return nil, false, err
+	}
+
+	replyType, reply, err := readMessage(c.conn)
+	if err != nil {
+		return nil, true, err
+	}
+	if replyType != t {
+		return nil, true, fmt.Errorf("unexpected reply type %v, expected %v", replyType, t)
+	}
+
+	return reply, true, nil
+}
+
+// watch opens a dedicated connection, subscribes to the given events and
+// invokes fn with the type of every event received.
+// It blocks until the connection breaks or ctx is cancelled.
+func (c *ipcConn) watch(ctx context.Context, events []string, fn func(messageType)) error {
+	conn, err := net.DialTimeout("unix", c.socketPath, ipcTimeout)
+	if err != nil {
+		return fmt.Errorf("unable to connect to sway socket: %w", err)
+	}
+	defer conn.Close()
+
+	// unblock the read below once the context is cancelled
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+	defer stop()
+
+	payload, err := json.Marshal(events)
+	if err != nil {
+		return fmt.Errorf("unable to marshal events: %w", err)
+	}
+
+	if err := conn.SetDeadline(time.Now().Add(ipcTimeout)); err != nil {
+		return fmt.Errorf("unable to set deadline: %w", err)
+	}
+	if err := writeMessage(conn, msgSubscribe, payload); err != nil {
+		return err
+	}
+	_, reply, err := readMessage(conn)
+	if err != nil {
+		return err
+	}
+
+	var result commandResult
+	if err := json.Unmarshal(reply, &result); err != nil {
+		return fmt.Errorf("unable to parse subscribe reply: %w", err)
+	}
+	if !result.Success {
+		return fmt.Errorf("unable to subscribe to %v", events)
+	}
+
+	// events may arrive at any time, so don't time out reading them.
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		return fmt.Errorf("unable to clear deadline: %w", err)
+	}
+
+	// Events that happened while we were not subscribed were missed, so
+	// request a refresh once subscribed.
+	fn(msgSubscribe)
+
+	for {
+		t, _, err := readMessage(conn)
+		if err != nil {
+			return err
+		}
+		if t&eventMask == 0 {
+			continue
+		}
+		fn(t)
+	}
+}
+
+func writeMessage(w io.Writer, t messageType, payload []byte) error {
+	var buf bytes.Buffer
+	buf.WriteString(ipcMagic)
+	binary.Write(&buf, binary.NativeEndian, uint32(len(payload)))
+	binary.Write(&buf, binary.NativeEndian, uint32(t))
+	buf.Write(payload)
+
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		return fmt.Errorf("unable to write message: %w", err)
+	}
+	return nil
+}
+
+func readMessage(r io.Reader) (messageType, []byte, error) {
+	header := make([]byte, len(ipcMagic)+8)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, fmt.Errorf("unable to read message header: %w", err)
+	}
+	if string(header[:len(ipcMagic)]) != ipcMagic {
+		return 0, nil, fmt.Errorf("invalid magic in message header")
+	}
+
+	length := binary.NativeEndian.Uint32(header[len(ipcMagic):])
+	t := messageType(binary.NativeEndian.Uint32(header[len(ipcMagic)+4:]))
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, fmt.Errorf("unable to read message payload: %w", err)
+	}
+
+	return t, payload, nil
+}
+
+// commandResult is the reply to a single command sent via msgRunCommand.
+type commandResult struct {
+	Success    bool   `json:"success"`
+	ParseError bool   `json:"parse_error"`
+	Error      string `json:"error"`
+}
+
+// runCommand executes the given sway command (or multiple ones, separated by
+// `;`), and returns an error if any of them failed.
+func (c *ipcConn) runCommand(cmd string) error {
+	results, err := c.runCommands([]string{cmd})
+	if err != nil {
+		return err
+	}
+
+	var errs []string
+	for _, result := range results {
+		if !result.Success {
+			errs = append(errs, result.Error)
+		}
+	}
+	if len(errs) != 0 {
+		return fmt.Errorf("%s", strings.Join(errs, ", "))
+	}
+
+	return nil
+}
+
+// runCommands executes all given sway commands with a single message, and
+// returns the result of each of them.
+// sway stops executing commands after the first one it can't parse, so there
+// might be fewer results than commands.
+func (c *ipcConn) runCommands(cmds []string) ([]commandResult, error) {
+	reply, err := c.roundtrip(msgRunCommand, []byte(strings.Join(cmds, "; ")))
+	if err != nil {
+		return nil, err
+	}
+
+	var results []commandResult
+	if err := json.Unmarshal(reply, &results); err != nil {
+		return nil, fmt.Errorf("unable to parse command reply: %w", err)
+	}
+
+	return results, nil
+}
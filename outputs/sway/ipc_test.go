@@ -0,0 +1,239 @@
+package sway
+
+import (
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// fakeSway serves the sway IPC protocol on a unix socket. handle is called
+// for every message received, with the number of the connection it was
+// received on. If it returns nil, the connection is closed without replying.
+type fakeSway struct {
+	t      *testing.T
+	path   string
+	handle func(conn int, t messageType, payload []byte) []byte
+
+	mu       sync.Mutex
+	listener net.Listener
+	conns    []net.Conn
+	received []string
+}
+
+func newFakeSway(t *testing.T, handle func(conn int, t messageType, payload []byte) []byte) *fakeSway {
+	f := &fakeSway{t: t, path: filepath.Join(t.TempDir(), "sway.sock"), handle: handle}
+	f.listen()
+	t.Cleanup(f.stop)
+	return f
+}
+
+// listen starts accepting connections on the socket.
+func (f *fakeSway) listen() {
+	l, err := net.Listen("unix", f.path)
+	if err != nil {
+		f.t.Fatalf("unable to listen: %v", err)
+	}
+	f.mu.Lock()
+	f.listener = l
+	f.mu.Unlock()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			f.mu.Lock()
+			i := len(f.conns)
+			f.conns = append(f.conns, conn)
+			f.mu.Unlock()
+			go f.serve(i, conn)
+		}
+	}()
+}
+
+// stop closes the socket and all connections, like sway exiting would.
+func (f *fakeSway) stop() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.listener.Close()
+	for _, conn := range f.conns {
+		conn.Close()
+	}
+}
+
+// restart stops, and listens on the same path again, like sway restarting
+// would. Connections are numbered on.
+func (f *fakeSway) restart() {
+	f.stop()
+	f.listen()
+}
+
+func (f *fakeSway) serve(i int, conn net.Conn) {
+	defer conn.Close()
+	for {
+		t, payload, err := readMessage(conn)
+		if err != nil {
+			return
+		}
+		f.mu.Lock()
+		f.received = append(f.received, string(payload))
+		f.mu.Unlock()
+
+		reply := f.handle(i, t, payload)
+		if reply == nil {
+			return
+		}
+		if err := writeMessage(conn, t, reply); err != nil {
+			return
+		}
+	}
+}
+
+func (f *fakeSway) Received() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.received...)
+}
+
+func TestRoundtrip(t *testing.T) {
+	f := newFakeSway(t, func(_ int, _ messageType, payload []byte) []byte {
+		return []byte(`[{"success": true}]`)
+	})
+	c := newIPCConn(f.path)
+	defer c.Close()
+
+	if err := c.runCommand("output HDMI-A-1 scale 2"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := c.runCommand("output HDMI-A-1 scale 1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := f.Received(); len(got) != 2 || got[1] != "output HDMI-A-1 scale 1" {
+		t.Errorf("unexpected messages received: %q", got)
+	}
+}
+
+func TestRoundtripCommandFailed(t *testing.T) {
+	f := newFakeSway(t, func(_ int, _ messageType, _ []byte) []byte {
+		return []byte(`[{"success": false, "error": "Unknown output"}]`)
+	})
+	c := newIPCConn(f.path)
+	defer c.Close()
+
+	err := c.runCommand("output FOO scale 2")
+	if err == nil || err.Error() != "Unknown output" {
+		t.Errorf("expected the error of sway, got %v", err)
+	}
+}
+
+// Once sway received a command, it must not be sent again, even if the reply
+// never arrives: it might have been run already.
+func TestRoundtripNoResendOfCommands(t *testing.T) {
+	f := newFakeSway(t, func(_ int, _ messageType, _ []byte) []byte {
+		return nil
+	})
+	c := newIPCConn(f.path)
+	defer c.Close()
+
+	if err := c.runCommand("exec foot"); err == nil {
+		t.Fatal("expected an error")
+	}
+	if got := f.Received(); len(got) != 1 {
+		t.Errorf("expected the command to be sent once, got %q", got)
+	}
+}
+
+// Queries are sent again on a new connection.
+func TestRoundtripResendsQueries(t *testing.T) {
+	f := newFakeSway(t, func(conn int, _ messageType, _ []byte) []byte {
+		if conn == 0 {
+			return nil
+		}
+		return []byte(`[]`)
+	})
+	c := newIPCConn(f.path)
+	defer c.Close()
+
+	reply, err := c.roundtrip(msgGetOutputs, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(reply) != "[]" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+	if got := f.Received(); len(got) != 2 {
+		t.Errorf("expected the query to be sent twice, got %q", got)
+	}
+}
+
+// If sway restarted since the last message, the connection was closed by
+// sway, and the command is sent on a new connection.
+func TestRoundtripSwayRestarted(t *testing.T) {
+	f := newFakeSway(t, func(_ int, _ messageType, _ []byte) []byte {
+		return []byte(`[{"success": true}]`)
+	})
+	c := newIPCConn(f.path)
+	defer c.Close()
+
+	if err := c.runCommand("output HDMI-A-1 dpms on"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	f.restart()
+
+	if err := c.runCommand("output HDMI-A-1 dpms off"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := f.Received(); len(got) != 2 {
+		t.Errorf("expected both commands to be received once, got %q", got)
+	}
+}
+
+// If sway restarts while handling a message, queries are sent again to the
+// new instance, commands aren't, as they might have been run already.
+func TestRoundtripSwayRestartedMidRequest(t *testing.T) {
+	for _, tc := range []struct {
+		t        messageType
+		payload  string
+		received int
+	}{
+		{msgGetOutputs, "", 2},
+		{msgRunCommand, "output HDMI-A-1 dpms off", 1},
+	} {
+		var f *fakeSway
+		f = newFakeSway(t, func(conn int, _ messageType, _ []byte) []byte {
+			if conn == 0 {
+				f.restart()
+				return nil
+			}
+			return []byte(`[]`)
+		})
+		c := newIPCConn(f.path)
+
+		_, err := c.roundtrip(tc.t, []byte(tc.payload))
+		if tc.received == 2 && err != nil {
+			t.Errorf("%v: unexpected error: %v", tc.t, err)
+		} else if tc.received == 1 && err == nil {
+			t.Errorf("%v: expected an error", tc.t)
+		}
+		if got := f.Received(); len(got) != tc.received {
+			t.Errorf("%v: expected the message to be received %v times, got %q", tc.t, tc.received, got)
+		}
+		c.Close()
+	}
+}
+
+func TestReadMessageInvalidMagic(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		server.Write([]byte("i4-ipc\x00\x00\x00\x00\x00\x00\x00\x00"))
+		server.Close()
+	}()
+
+	if _, _, err := readMessage(client); err == nil {
+		t.Error("expected an error for an invalid magic")
+	}
+}
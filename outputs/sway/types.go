@@ -3,161 +3,165 @@ package sway
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"net/url"
-	"os/exec"
 	"sync"
-
-	// "sync"
 	"time"
 
 	"github.com/flokli/display-agent/outputs"
+	"github.com/flokli/display-agent/scenario"
 	log "github.com/sirupsen/logrus"
 )
 
 // Sway contains all sway-wide state
 type Sway struct {
+	// persistent connection to the sway IPC socket
+	ipc *ipcConn
+
 	outputs   map[string]*Output
 	outputsMu sync.Mutex
+	// guards the fields of all outputs. They're only changed with outputsMu
+	// held too, so holding either is enough to read them. Unlike outputsMu,
+	// it's not held while calling handlers, see GetState.
+	stateMu sync.Mutex
+
+	refresher *outputs.RefreshLoop
 
-	refreshTicker *time.Ticker
+	// starts the processes of scenarios
+	launcher *scenario.Launcher
 
-	// Called when the output appeared
-	onAddFns []func(outputs.Output)
-	// Called when the output was updated
-	onUpdateFns []func(outputs.Output)
-	// Called when the output was removed
-	onRemoveFns []func(outputs.Output)
+	outputs.Handlers
 }
 
-func New(ctx context.Context, refreshInterval time.Duration) *Sway {
+func init() {
+	outputs.RegisterBackend("sway", func(opts outputs.BackendOptions) (outputs.Backend, error) {
+		return New(opts.RefreshInterval)
+	})
+}
+
+func New(refreshInterval time.Duration) (*Sway, error) {
+	socketPath, err := socketPathFromEnv()
+	if err != nil {
+		return nil, fmt.Errorf("unable to locate sway socket: %w", err)
+	}
+
 	s := &Sway{
-		outputs:       make(map[string]*Output),
-		refreshTicker: time.NewTicker(refreshInterval),
+		ipc:     newIPCConn(socketPath),
+		outputs: make(map[string]*Output),
 	}
+	s.launcher = scenario.NewLauncher(s, "SWAYSOCK="+socketPath)
+	s.refresher = outputs.NewRefreshLoop(refreshInterval, s.refreshOutputs)
+
+	return s, nil
+}
+
+// Start implements Backend.
+// It subscribes to sway events, and refreshes outputs whenever one arrives.
+// Additionally, outputs are refreshed every refreshInterval, as a safety net.
+func (s *Sway) Start(ctx context.Context) error {
+	go s.watchEvents(ctx)
 
 	go func() {
-		for {
-			select {
-			case <-s.refreshTicker.C:
-				if err := s.refreshOutputs(); err != nil {
-					log.WithError(err).Error("Failed to refresh outputs")
-				}
-			case <-ctx.Done():
-				for outputName, output := range s.outputs {
-					log.WithField("outputName", outputName).Debug("calling cleanup handlers")
-					for _, removeFn := range s.onRemoveFns {
-						removeFn(output)
-					}
-				}
-			}
+		s.refresher.Run(ctx)
 
+		s.outputsMu.Lock()
+		for outputName, output := range s.outputs {
+			log.WithField("outputName", outputName).Debug("calling cleanup handlers")
+			s.NotifyRemove(output)
 		}
+		s.outputsMu.Unlock()
+
+		s.NotifyStopped()
 	}()
 
-	return s
+	return nil
 }
 
-func (s *Sway) Close() {
-	log.Debug("stopping refresh ticker")
-	s.refreshTicker.Stop()
+// watchEvents subscribes to output and workspace events, and triggers a refresh
+// for every event received. If the subscription breaks (for example because
+// sway restarted), it resubscribes.
+func (s *Sway) watchEvents(ctx context.Context) {
+	for {
+		err := s.ipc.watch(ctx, []string{"output", "workspace"}, func(t messageType) {
+			log.WithField("messageType", t).Debug("triggering refresh")
+			s.refresher.Trigger()
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		log.WithError(err).Warn("lost sway event subscription, resubscribing")
+
+		select {
+		case <-time.After(resubscribeDelay):
+		case <-ctx.Done():
+			return
+		}
+	}
 }
 
-// Register a new handler for when an output was added
-func (o *Sway) RegisterOutputAdd(fn func(outputs.Output)) {
-	o.onAddFns = append(o.onAddFns, fn)
+// Close implements Backend.
+func (s *Sway) Close() {
+	log.Debug("stopping scenarios")
+	s.launcher.StopAll()
+
+	s.ipc.Close()
 }
 
-// Register a new handler for when an output was updated
-func (o *Sway) RegisterOutputUpdate(fn func(outputs.Output)) {
-	o.onUpdateFns = append(o.onUpdateFns, fn)
+// Outputs implements Backend.
+func (s *Sway) Outputs() []outputs.Output {
+	s.outputsMu.Lock()
+	defer s.outputsMu.Unlock()
+
+	l := make([]outputs.Output, 0, len(s.outputs))
+	for _, output := range s.outputs {
+		l = append(l, output)
+	}
+	return l
 }
 
-// Register a new handler for when an output was removed
-func (s *Sway) RegisterOutputRemove(fn func(outputs.Output)) {
-	s.onRemoveFns = append(s.onRemoveFns, fn)
+// Scenarios implements Backend.
+func (s *Sway) Scenarios() []string {
+	return scenario.Names()
 }
 
-// Invoke `swaymsg -t get_outputs` and sync the state observed from there with
+// Send a get_outputs message to sway and sync the state observed from there with
 // the internal state in all outputs. Afterwards, return all (updated) outputs.
 func (s *Sway) refreshOutputs() error {
-	l := log.WithField("f", "refreshOutputs")
-	l.Debug("refreshing outputs")
 	s.outputsMu.Lock()
-	l.Debug("acquired lock")
 	defer s.outputsMu.Unlock()
 
-	out, err := exec.Command("swaymsg", "-t", "get_outputs").Output()
+	return s.refreshOutputsLocked()
+}
+
+// refreshOutputsLocked is refreshOutputs, with outputsMu held already.
+func (s *Sway) refreshOutputsLocked() error {
+	log.WithField("f", "refreshOutputs").Debug("refreshing outputs")
+
+	out, err := s.ipc.roundtrip(msgGetOutputs, nil)
 	if err != nil {
-		return fmt.Errorf("Failed to invoke swaymsg: %w", err)
+		return fmt.Errorf("Failed to get outputs: %w", err)
 	}
 
 	var newOutputs []*Output
 
 	if err := json.Unmarshal(out, &newOutputs); err != nil {
-		return fmt.Errorf("Failed to invoke swaymsg: %w", err)
-	}
-
-	// loop over all outputs returned
-	seenOutputNames := make(map[string]interface{}, len(newOutputs))
-
-	for _, newOutput := range newOutputs {
-		outputName := newOutput.Name
-		l := log.WithField("outputName", outputName)
-
-		seenOutputNames[outputName] = nil
-
-		// the output already exists…
-		if oldOutput, old := s.outputs[outputName]; old {
-			// update attributes with the new values.
-			oldOutput.Active = newOutput.Active
-			oldOutput.CurrentMode = newOutput.CurrentMode
-			oldOutput.Make = newOutput.Make
-			oldOutput.Model = newOutput.Model
-			oldOutput.Modes = newOutput.Modes
-			oldOutput.Name = newOutput.Name
-			oldOutput.Power = newOutput.Power
-			oldOutput.Scale = newOutput.Scale
-			oldOutput.Serial = newOutput.Serial
-			oldOutput.Transform = newOutput.Transform
-			// keep Scenario, this can't be modified from sway
-
-			// TODO: only notify if it's a new output
-			l.Debug("calling update fns")
-			for _, updateFn := range s.onUpdateFns {
-				updateFn(&*oldOutput)
-			}
-
-		} else {
-			// If the output didn't exist, insert into s.outputs.
-			// add the pointer back to here, so the implementation can use it to acquire
-			// a lock.
-			newOutput.sway = s
-			newOutput.Scenario = &outputs.Scenario{
-				Name: "blank",
-				Args: []string{},
-			}
-			s.outputs[outputName] = newOutput
-
-			l.Debug("calling add fns")
-			for _, addFn := range s.onAddFns {
-				addFn(&*newOutput)
-			}
-		}
+		return fmt.Errorf("Failed to parse outputs: %w", err)
 	}
-	log.Debug("done looping over all outputs")
-
-	// loop over all outputs in our global state, remove these that we didn't see.
-	for prevOutputName, prevOutput := range s.outputs {
-		if _, found := seenOutputNames[prevOutputName]; !found {
-			delete(s.outputs, prevOutputName)
 
-			log.Debug("calling delete fns")
-			for _, removeFn := range s.onRemoveFns {
-				removeFn(&*prevOutput)
-			}
+	outputs.Sync(&s.Handlers, &s.stateMu, s.outputs, newOutputs, func(o *Output) {
+		// add the pointer back to here, so the implementation can use it to
+		// acquire a lock.
+		o.sway = s
+		o.Scenario = scenario.NewBlank()
+	}, func(o *Output) bool {
+		// nothing is shown anymore if the process of the scenario exited.
+		if !s.launcher.Exited(o.Name) {
+			return false
 		}
-	}
+		log.WithField("outputName", o.Name).Warn("scenario exited")
+		o.Scenario = scenario.NewBlank()
+		return true
+	})
 
 	return nil
 }
@@ -176,6 +180,12 @@ type Output struct {
 	Scale       float64         `json:"scale"`
 	Serial      string          `json:"serial"`
 	Transform   string          `json:"transform"`
+	// only the position of rect is used.
+	Rect            outputs.Position `json:"rect"`
+	AdaptiveSync    string           `json:"adaptive_sync_status"`
+	SubpixelHinting string           `json:"subpixel_hinting"`
+	ScaleFilter     string           `json:"scale_filter"`
+	MaxRenderTime   int64            `json:"max_render_time"`
 
 	Scenario *outputs.Scenario
 }
@@ -192,130 +202,149 @@ func (o *Output) GetInfo() *outputs.Info {
 }
 
 // GetState implements Output.
+// It returns a copy, as refreshes change the output while the state is used,
+// and outputsMu can't be taken here, as handlers are called with it held.
 func (o *Output) GetState() *outputs.State {
+	o.sway.stateMu.Lock()
+	c := *o
+	o.sway.stateMu.Unlock()
+	return c.state()
+}
+
+// state returns the state of o, pointing to its fields.
+func (o *Output) state() *outputs.State {
 	return &outputs.State{
-		Enabled:   &o.Active,
-		Mode:      &o.CurrentMode,
-		Power:     &o.Power,
-		Scale:     &o.Scale,
-		Transform: &o.Transform,
-		Scenario:  o.Scenario,
+		Enabled:         &o.Active,
+		Mode:            &o.CurrentMode,
+		Power:           &o.Power,
+		Scale:           &o.Scale,
+		Transform:       &o.Transform,
+		Position:        &o.Rect,
+		AdaptiveSync:    &o.AdaptiveSync,
+		SubpixelHinting: &o.SubpixelHinting,
+		ScaleFilter:     &o.ScaleFilter,
+		MaxRenderTime:   &o.MaxRenderTime,
+		Scenario:        o.Scenario,
 	}
 }
 
+// SetState implements Output.
+// If a field can't be applied, all fields are rolled back.
 func (o *Output) SetState(newState *outputs.State) (*outputs.State, error) {
 	o.sway.outputsMu.Lock()
 	defer o.sway.outputsMu.Unlock()
 
-	log.WithFields(log.Fields{
-		"newState.Enabled":   fmt.Sprintf("%v", newState.Enabled),
-		"newState.Mode":      fmt.Sprintf("%v", newState.Mode),
-		"newState.Power":     fmt.Sprintf("%v", newState.Power),
-		"newState.Scale":     fmt.Sprintf("%v", newState.Scale),
-		"newState.Transform": fmt.Sprintf("%v", newState.Transform),
-		"newState.Scenario":  *newState.Scenario,
-	}).Debug("SetState()")
+	log.WithFields(newState.LogFields("newState")).Debug("SetState()")
+
+	err := outputs.ApplyWithRollback(o.GetState(), newState, o.apply)
+
+	// return the state after the change, not the one before it.
+	if err := o.sway.refreshOutputsLocked(); err != nil {
+		log.WithError(err).Warn("unable to refresh outputs")
+	}
+
+	return o.GetState(), err
+}
+
+// apply sends the commands for all fields set in newState to sway with a
+// single message, so they're applied in one go. The scenario is set
+// afterwards.
+func (o *Output) apply(newState *outputs.State) error {
+	var fields, cmds []string
+	add := func(field string, args ...string) {
+		fields = append(fields, field)
+		cmds = append(cmds, o.outputCmd(args...))
+	}
 
 	if newState.Enabled != nil {
-		arg := ""
 		if *newState.Enabled {
-			arg = "enable"
+			add("enabled", "enable")
 		} else {
-			arg = "disable"
-		}
-		if err := o.configure(arg); err != nil {
-			return o.GetState(), fmt.Errorf("failed to set active: %w", err)
+			add("enabled", "disable")
 		}
 	}
 	if newState.Mode != nil {
-		if err := o.configure("mode", newState.Mode.String()); err != nil {
-			return o.GetState(), fmt.Errorf("failed to set mode: %w", err)
-		}
+		add("mode", "mode", modeArg(newState.Mode))
 	}
 	if newState.Power != nil {
-		arg := ""
 		if *newState.Power {
-			arg = "on"
+			add("power", "power", "on")
 		} else {
-			arg = "off"
-		}
-		if err := o.configure("power", arg); err != nil {
-			return o.GetState(), fmt.Errorf("failed to set power: %w", err)
+			add("power", "power", "off")
 		}
 	}
 	if newState.Scale != nil {
-		if err := o.configure("scale", fmt.Sprintf("%v", *newState.Scale)); err != nil {
-			return o.GetState(), fmt.Errorf("failed to set scale: %w", err)
-		}
+		add("scale", "scale", fmt.Sprintf("%v", *newState.Scale))
 	}
 	if newState.Transform != nil {
-		if err := o.configure("transform", fmt.Sprintf("%v", *newState.Transform)); err != nil {
-			return o.GetState(), fmt.Errorf("failed to set transform: %w", err)
+		add("transform", "transform", *newState.Transform)
+	}
+	if newState.Position != nil {
+		add("position", "position", fmt.Sprintf("%v", newState.Position.X), fmt.Sprintf("%v", newState.Position.Y))
+	}
+	if newState.AdaptiveSync != nil {
+		if *newState.AdaptiveSync == "enabled" {
+			add("adaptive_sync", "adaptive_sync", "on")
+		} else {
+			add("adaptive_sync", "adaptive_sync", "off")
 		}
 	}
+	if newState.SubpixelHinting != nil {
+		add("subpixel_hinting", "subpixel", *newState.SubpixelHinting)
+	}
+	if newState.ScaleFilter != nil {
+		add("scale_filter", "scale_filter", *newState.ScaleFilter)
+	}
+	if newState.MaxRenderTime != nil {
+		if *newState.MaxRenderTime == 0 {
+			add("max_render_time", "max_render_time", "off")
+		} else {
+			add("max_render_time", "max_render_time", fmt.Sprintf("%v", *newState.MaxRenderTime))
+		}
+	}
+
+	if len(cmds) != 0 {
+		cmdErrs, err := o.sway.swaycmds(cmds)
+		if err != nil {
+			return err
+		}
+		var errs []error
+		for i, err := range cmdErrs {
+			if err != nil {
+				errs = append(errs, &outputs.FieldError{Field: fields[i], Err: err})
+			}
+		}
+		if len(errs) != 0 {
+			return errors.Join(errs...)
+		}
+	}
+
 	if newState.Scenario != nil {
 		if err := o.setScenario(newState.Scenario.Name, newState.Scenario.Args); err != nil {
-			return o.GetState(), fmt.Errorf("failed to set scenario: %w", err)
+			return &outputs.FieldError{Field: "scenario", Err: err}
 		}
 	}
 
-	return o.GetState(), nil
+	return nil
 }
 
-// SetScenario implements Output.
+// setScenario shows the scenario on the output.
 func (o *Output) setScenario(name string, args []string) error {
 	log.WithFields(log.Fields{
 		"scenario": name,
 		"args":     args,
-	}).Debug("SetScenario", name, args)
-
-	// focus the workspace
-	if err := o.focusWorkspace(); err != nil {
-		return fmt.Errorf("unable to focus workspace: %w", err)
-	}
-
-	// kill all previous windows there, if present
-	if err := o.empty(); err != nil {
-		return fmt.Errorf("unable to empty workspace: %w", err)
-	}
-
-	if name == "url" {
-		if len(args) != 1 {
-			return fmt.Errorf("need to specify exactly 1 arg")
-		}
-		urlStr := args[0]
+	}).Debug("SetScenario")
 
-		// try to parse the URL
-		u, err := url.Parse(urlStr)
-		if err != nil {
-			return fmt.Errorf("unable to parse URL")
-		}
-
-		o.runCommand("chromium --ozone-platform-hint=auto --app=" + u.String())
-	} else if name == "blank" {
-		// We killed all windows before, nothing to execute.
-	} else if name == "video" {
-		if len(args) != 1 {
-			return fmt.Errorf("need to specify exactly 1 arg")
-		}
-		urlStr := args[0]
-
-		// try to parse the URL
-		u, err := url.Parse(urlStr)
-		if err != nil {
-			return fmt.Errorf("unable to parse URL")
-		}
-
-		o.runCommand("mpv --loop " + u.String())
-	} else {
-		return fmt.Errorf("scenario %v unimplemented", name)
+	// the windows of the process are moved to the output once they appear.
+	sc, err := o.sway.launcher.Show(o.Name, name, args)
+	if err != nil {
+		return err
 	}
 
 	// update the internal state
-	o.Scenario = &outputs.Scenario{
-		Name: name,
-		Args: args,
-	}
+	o.sway.stateMu.Lock()
+	o.Scenario = sc
+	o.sway.stateMu.Unlock()
 
 	return nil
 }
@@ -0,0 +1,168 @@
+package sway
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/flokli/display-agent/outputs"
+	"github.com/flokli/display-agent/scenario"
+)
+
+// newTestSway returns a backend talking to a fake sway, serving the outputs
+// from the fixture. Scale commands change the scale of the outputs it serves.
+func newTestSway(t *testing.T) *Sway {
+	fixture, err := os.ReadFile("../../test/testdata/swaymsg_get_outputs.txt")
+	if err != nil {
+		t.Fatalf("unable to read fixture: %v", err)
+	}
+	var swayOutputs []map[string]interface{}
+	if err := json.Unmarshal(fixture, &swayOutputs); err != nil {
+		t.Fatalf("unable to parse fixture: %v", err)
+	}
+
+	scaleCmd := regexp.MustCompile(`^output "?([^ "]+)"? scale (\S+)$`)
+	var mu sync.Mutex
+	f := newFakeSway(t, func(_ int, msg messageType, payload []byte) []byte {
+		mu.Lock()
+		defer mu.Unlock()
+
+		switch msg {
+		case msgGetOutputs:
+			b, _ := json.Marshal(swayOutputs)
+			return b
+		case msgRunCommand:
+			m := scaleCmd.FindStringSubmatch(string(payload))
+			if m == nil {
+				return []byte(`[{"success": false, "error": "unsupported by the fake"}]`)
+			}
+			scale, _ := strconv.ParseFloat(m[2], 64)
+			for _, o := range swayOutputs {
+				if o["name"] == m[1] {
+					o["scale"] = scale
+				}
+			}
+			return []byte(`[{"success": true}]`)
+		}
+		return []byte(`[]`)
+	})
+
+	t.Setenv("SWAYSOCK", f.path)
+	s, err := New(0)
+	if err != nil {
+		t.Fatalf("unable to set up backend: %v", err)
+	}
+	t.Cleanup(s.Close)
+	return s
+}
+
+// SetState returns the state after the change, not the one before it.
+func TestSetStateReturnsNewState(t *testing.T) {
+	s := newTestSway(t)
+	if err := s.refreshOutputs(); err != nil {
+		t.Fatalf("unable to refresh outputs: %v", err)
+	}
+
+	var output outputs.Output
+	for _, o := range s.Outputs() {
+		if *o.GetInfo().Name == "VGA-1" {
+			output = o
+		}
+	}
+	if output == nil {
+		t.Fatal("VGA-1 not found")
+	}
+
+	scale := 2.0
+	newState, err := output.SetState(&outputs.State{Scale: &scale})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if *newState.Scale != 2 {
+		t.Errorf("expected scale 2 to be returned, got %v", *newState.Scale)
+	}
+
+	// refreshing again doesn't change the returned state.
+	scale = 1
+	if _, err := output.SetState(&outputs.State{Scale: &scale}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if *newState.Scale != 2 {
+		t.Errorf("expected the returned state to be a copy, got scale %v", *newState.Scale)
+	}
+}
+
+func TestWindows(t *testing.T) {
+	f := newFakeSway(t, func(_ int, msg messageType, _ []byte) []byte {
+		if msg != msgGetTree {
+			return []byte(`[{"success": true}]`)
+		}
+		return []byte(`{"id": 1, "nodes": [
+			{"id": 4, "nodes": [{"id": 7, "pid": 100, "nodes": []}]},
+			{"id": 5, "nodes": [], "floating_nodes": [{"id": 8, "pid": 200, "nodes": []}]}
+		]}`)
+	})
+	t.Setenv("SWAYSOCK", f.path)
+	s, err := New(0)
+	if err != nil {
+		t.Fatalf("unable to set up backend: %v", err)
+	}
+	defer s.Close()
+
+	windows, err := s.Windows()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []scenario.Window{{ID: "7", Pid: 100}, {ID: "8", Pid: 200}}
+	if !reflect.DeepEqual(windows, expected) {
+		t.Errorf("expected %v, got %v", expected, windows)
+	}
+
+	if err := s.Place(windows[0], "HDMI-A-1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	received := f.Received()
+	if cmd := `[con_id=7] move container to workspace "HDMI-A-1", move workspace to output "HDMI-A-1"`; received[len(received)-1] != cmd {
+		t.Errorf("expected %q, got %q", cmd, received[len(received)-1])
+	}
+}
+
+// The state can be read while refreshes change the output, it's a copy.
+func TestGetStateWhileRefreshing(t *testing.T) {
+	s := newTestSway(t)
+	if err := s.refreshOutputs(); err != nil {
+		t.Fatalf("unable to refresh outputs: %v", err)
+	}
+	output := s.Outputs()[0]
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			scale := float64(1 + i%2)
+			if _, err := output.SetState(&outputs.State{Scale: &scale}); err != nil {
+				t.Errorf("unexpected error: %v", err)
+				return
+			}
+		}
+	}()
+
+	initial := *output.GetState().Scale
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		// let refreshes run in between.
+		time.Sleep(time.Microsecond)
+		if scale := *output.GetState().Scale; scale != initial && scale != 1 && scale != 2 {
+			t.Errorf("unexpected scale %v", scale)
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package outputs
+
+import (
+	"fmt"
+)
+
+// Transforms contains all sway-style transform names, in the order of the
+// wl_output transform enum (which is also used by hyprland).
+var Transforms = []string{"normal", "90", "180", "270", "flipped", "flipped-90", "flipped-180", "flipped-270"}
+
+// TransformName maps a wl_output transform enum value to its sway-style name.
+func TransformName(t int) string {
+	if t < 0 || t >= len(Transforms) {
+		return "normal"
+	}
+	return Transforms[t]
+}
+
+// TransformIndex maps a sway-style transform name to its wl_output transform
+// enum value.
+func TransformIndex(name string) (int, error) {
+	for i, t := range Transforms {
+		if t == name {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid transform: %v", name)
+}
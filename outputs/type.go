@@ -1,6 +1,12 @@
 package outputs
 
-import ()
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
 
 // State describes the current state of an output.
 // it can be also used to set (some) options, in a /set request.
@@ -10,7 +16,46 @@ type State struct {
 	Power     *bool     `json:"power"`
 	Scale     *float64  `json:"scale"`
 	Transform *string   `json:"transform"`
-	Scenario  *Scenario `json:"scenario"`
+	Position  *Position `json:"position"`
+	// one of AdaptiveSyncValues
+	AdaptiveSync *string `json:"adaptive_sync"`
+	// one of SubpixelHintingValues
+	SubpixelHinting *string `json:"subpixel_hinting"`
+	// one of ScaleFilterValues
+	ScaleFilter *string `json:"scale_filter"`
+	// in milliseconds, 0 means off
+	MaxRenderTime *int64    `json:"max_render_time"`
+	Scenario      *Scenario `json:"scenario"`
+}
+
+// UnmarshalTOML accepts the same fields and values as the JSON form, when
+// decoding config files.
+func (s *State) UnmarshalTOML(v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	d := json.NewDecoder(bytes.NewReader(b))
+	// the TOML decoder can't tell about unknown keys anymore.
+	d.DisallowUnknownFields()
+	return d.Decode(s)
+}
+
+// LogFields returns all fields of s, prefixed with prefix, for logging.
+func (s *State) LogFields(prefix string) log.Fields {
+	return log.Fields{
+		prefix + ".Enabled":         fmt.Sprintf("%v", s.Enabled),
+		prefix + ".Mode":            fmt.Sprintf("%v", s.Mode),
+		prefix + ".Power":           fmt.Sprintf("%v", s.Power),
+		prefix + ".Scale":           fmt.Sprintf("%v", s.Scale),
+		prefix + ".Transform":       fmt.Sprintf("%v", s.Transform),
+		prefix + ".Position":        fmt.Sprintf("%v", s.Position),
+		prefix + ".AdaptiveSync":    fmt.Sprintf("%v", s.AdaptiveSync),
+		prefix + ".SubpixelHinting": fmt.Sprintf("%v", s.SubpixelHinting),
+		prefix + ".ScaleFilter":     fmt.Sprintf("%v", s.ScaleFilter),
+		prefix + ".MaxRenderTime":   fmt.Sprintf("%v", s.MaxRenderTime),
+		prefix + ".Scenario":        fmt.Sprintf("%v", s.Scenario),
+	}
 }
 
 // Info describes some (fairly static) info about an output, such as the
@@ -32,6 +77,13 @@ type Output interface {
 	SetState(*State) (*State, error)
 }
 
+// Position describes the position of the top left corner of an output in the
+// global layout, in logical pixels.
+type Position struct {
+	X int64 `json:"x"`
+	Y int64 `json:"y"`
+}
+
 type Scenario struct {
 	Name string   `json:"name"`
 	Args []string `json:"args"`
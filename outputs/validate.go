@@ -0,0 +1,65 @@
+package outputs
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrInvalid is wrapped by errors about values no backend would accept.
+	ErrInvalid = errors.New("invalid value")
+	// ErrUnsupported is wrapped by errors about fields a backend (or the
+	// display server it talks to) doesn't support.
+	ErrUnsupported = errors.New("not supported")
+)
+
+// The values accepted for the string enums in State, in the spelling sway
+// uses when reporting outputs.
+var (
+	AdaptiveSyncValues = []string{"enabled", "disabled"}
+	// "unknown" is only ever reported, it can't be set.
+	SubpixelHintingValues = []string{"rgb", "bgr", "vrgb", "vbgr", "none"}
+	ScaleFilterValues     = []string{"linear", "nearest", "smart"}
+)
+
+// Validate checks all fields set in a (sparse) state for values no backend
+// would accept, so invalid requests can be rejected before touching any
+// output.
+// It returns a FieldError wrapping ErrInvalid for every invalid field.
+func (s *State) Validate() error {
+	var errs []error
+	if s.Mode != nil && (s.Mode.Width <= 0 || s.Mode.Height <= 0 || s.Mode.Refresh < 0) {
+		errs = append(errs, &FieldError{Field: "mode", Err: fmt.Errorf("%w %v", ErrInvalid, s.Mode)})
+	}
+	if s.Scale != nil && *s.Scale <= 0 {
+		errs = append(errs, &FieldError{Field: "scale", Err: fmt.Errorf("%w %v", ErrInvalid, *s.Scale)})
+	}
+	if err := validateEnum("transform", s.Transform, Transforms); err != nil {
+		errs = append(errs, err)
+	}
+	if err := validateEnum("adaptive_sync", s.AdaptiveSync, AdaptiveSyncValues); err != nil {
+		errs = append(errs, err)
+	}
+	if err := validateEnum("subpixel_hinting", s.SubpixelHinting, SubpixelHintingValues); err != nil {
+		errs = append(errs, err)
+	}
+	if err := validateEnum("scale_filter", s.ScaleFilter, ScaleFilterValues); err != nil {
+		errs = append(errs, err)
+	}
+	if s.MaxRenderTime != nil && *s.MaxRenderTime < 0 {
+		errs = append(errs, &FieldError{Field: "max_render_time", Err: fmt.Errorf("%w %v", ErrInvalid, *s.MaxRenderTime)})
+	}
+	return errors.Join(errs...)
+}
+
+func validateEnum(field string, value *string, allowed []string) error {
+	if value == nil {
+		return nil
+	}
+	for _, a := range allowed {
+		if *value == a {
+			return nil
+		}
+	}
+	return &FieldError{Field: field, Err: fmt.Errorf("%w %v, must be one of %v", ErrInvalid, *value, allowed)}
+}
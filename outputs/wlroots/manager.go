@@ -0,0 +1,615 @@
+package wlroots
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// opcodes of the requests and events used, see wayland.xml and
+// wlr-output-management-unstable-v1.xml.
+const (
+	// wl_display
+	displaySync        = 0
+	displayGetRegistry = 1
+
+	displayEventError    = 0
+	displayEventDeleteID = 1
+
+	// wl_registry
+	registryBind = 0
+
+	registryEventGlobal       = 0
+	registryEventGlobalRemove = 1
+
+	// wl_callback
+	callbackEventDone = 0
+
+	// zwlr_output_manager_v1
+	managerCreateConfiguration = 0
+
+	managerEventHead     = 0
+	managerEventDone     = 1
+	managerEventFinished = 2
+
+	// zwlr_output_head_v1
+	headRelease = 0
+
+	headEventName         = 0
+	headEventDescription  = 1
+	headEventPhysicalSize = 2
+	headEventMode         = 3
+	headEventEnabled      = 4
+	headEventCurrentMode  = 5
+	headEventPosition     = 6
+	headEventTransform    = 7
+	headEventScale        = 8
+	headEventFinished     = 9
+	headEventMake         = 10
+	headEventModel        = 11
+	headEventSerialNumber = 12
+	headEventAdaptiveSync = 13
+
+	// zwlr_output_mode_v1
+	modeRelease = 0
+
+	modeEventSize      = 0
+	modeEventRefresh   = 1
+	modeEventPreferred = 2
+	modeEventFinished  = 3
+
+	// zwlr_output_configuration_v1
+	configurationEnableHead  = 0
+	configurationDisableHead = 1
+	configurationApply       = 2
+	configurationTest        = 3
+	configurationDestroy     = 4
+
+	configurationEventSucceeded = 0
+	configurationEventFailed    = 1
+	configurationEventCancelled = 2
+
+	// zwlr_output_configuration_head_v1
+	configurationHeadSetMode         = 0
+	configurationHeadSetCustomMode   = 1
+	configurationHeadSetPosition     = 2
+	configurationHeadSetTransform    = 3
+	configurationHeadSetScale        = 4
+	configurationHeadSetAdaptiveSync = 5
+)
+
+const (
+	managerInterface = "zwlr_output_manager_v1"
+	// the highest version of the protocol we know about
+	managerVersion = 4
+
+	// the first version supporting release requests on heads and modes
+	releaseSinceVersion = 3
+	// the first version supporting adaptive sync
+	adaptiveSyncSinceVersion = 4
+
+	// zwlr_output_head_v1.adaptive_sync_state
+	adaptiveSyncDisabled = 0
+	adaptiveSyncEnabled  = 1
+
+	timeout = 10 * time.Second
+)
+
+var (
+	// errCancelled is returned if the compositor cancelled a configuration,
+	// because the heads changed in the meantime.
+	errCancelled = errors.New("configuration cancelled, outputs changed in the meantime")
+	// errFailed is returned if the compositor rejected a configuration.
+	errFailed = errors.New("configuration rejected by the compositor")
+)
+
+// head describes an output, as advertised by the compositor.
+type head struct {
+	id uint32
+
+	name         string
+	description  string
+	make         string
+	model        string
+	serialNumber string
+	enabled      bool
+	modes        []*mode
+	currentMode  *mode
+	x, y         int32
+	transform    int32
+	scale        fixed
+	// nil if the compositor doesn't announce it
+	adaptiveSync *bool
+	// nil if the compositor doesn't support power management for the head
+	power *bool
+}
+
+// mode describes a mode supported by a head.
+type mode struct {
+	id uint32
+
+	width, height int32
+	// in mHz
+	refresh   int32
+	preferred bool
+}
+
+// session is a single connection to the compositor, with the state received
+// via zwlr_output_manager_v1.
+type session struct {
+	conn *conn
+
+	registryID     uint32
+	managerName    uint32
+	managerID      uint32
+	managerVersion uint32
+
+	// called with a snapshot of all heads whenever the compositor signals a
+	// consistent state, once the initial state was received.
+	onDone func([]*head)
+
+	mu     sync.Mutex
+	ready  bool
+	heads  map[uint32]*head
+	modes  map[uint32]*mode
+	serial uint32
+
+	// the managers of the optional protocols, 0 if the compositor doesn't
+	// support them.
+	powerManagerID    uint32
+	toplevelManagerID uint32
+	// the bound wl_outputs, by the name of their global
+	wlOutputs map[uint32]*wlOutput
+	// called with every toplevel appearing, see watchToplevels.
+	onToplevel func(id uint32)
+}
+
+// connect connects to the compositor at socketPath, binds the output manager
+// and waits for the initial state of all heads.
+func connect(socketPath string, onDone func([]*head)) (*session, error) {
+	c, err := dial(socketPath)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &session{
+		conn:      c,
+		onDone:    onDone,
+		heads:     make(map[uint32]*head),
+		modes:     make(map[uint32]*mode),
+		wlOutputs: make(map[uint32]*wlOutput),
+	}
+	c.setHandler(displayID, s.handleDisplayEvent)
+
+	// find the output manager global, and bind the optional ones
+	s.registryID, err = c.newRequest(s.handleRegistryEvent, displayID, displayGetRegistry, newID{})
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	if err := s.roundtrip(); err != nil {
+		c.Close()
+		return nil, err
+	}
+	if s.managerName == 0 {
+		c.Close()
+		return nil, fmt.Errorf("compositor doesn't support %v", managerInterface)
+	}
+
+	s.managerID, err = c.newRequest(s.handleManagerEvent, s.registryID, registryBind, s.managerName, managerInterface, s.managerVersion, newID{})
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	// receive the initial heads and the names of the wl_outputs, and then the
+	// power modes requested once the names are known.
+	for i := 0; i < 2; i++ {
+		if err := s.roundtrip(); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+
+	s.mu.Lock()
+	s.ready = true
+	s.mu.Unlock()
+
+	return s, nil
+}
+
+func (s *session) handleRegistryEvent(opcode uint16, args *argReader) error {
+	switch opcode {
+	case registryEventGlobal:
+		name := args.Uint()
+		iface := args.String()
+		version := args.Uint()
+		if err := args.Err(); err != nil {
+			return err
+		}
+		switch iface {
+		case managerInterface:
+			s.managerName = name
+			s.managerVersion = min(version, managerVersion)
+		case outputInterface:
+			return s.bindOutput(name, version)
+		case powerManagerInterface:
+			return s.bindPowerManager(name)
+		case toplevelManagerInterface:
+			return s.bindToplevelManager(name, version)
+		}
+	case registryEventGlobalRemove:
+		name := args.Uint()
+		if err := args.Err(); err != nil {
+			return err
+		}
+		return s.removeOutput(name)
+	}
+	return args.Err()
+}
+
+// roundtrip dispatches events until the compositor processed all requests
+// sent so far. It must only be called before run, see wait for the
+// counterpart.
+func (s *session) roundtrip() error {
+	done := false
+	callbackID, err := s.conn.newRequest(func(opcode uint16, args *argReader) error {
+		done = true
+		return nil
+	}, displayID, displaySync, newID{})
+	defer s.conn.removeObject(callbackID)
+	if err != nil {
+		return err
+	}
+	for !done {
+		if err := s.conn.dispatch(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// wait blocks until the compositor processed all requests sent so far, and
+// the events sent in response were dispatched by run.
+func (s *session) wait() error {
+	done := make(chan struct{})
+	callbackID, err := s.conn.newRequest(func(opcode uint16, args *argReader) error {
+		close(done)
+		return nil
+	}, displayID, displaySync, newID{})
+	defer s.conn.removeObject(callbackID)
+	if err != nil {
+		return err
+	}
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("timeout waiting for the compositor")
+	}
+}
+
+// run dispatches events until the connection breaks.
+func (s *session) run() error {
+	for {
+		if err := s.conn.dispatch(); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *session) Close() error {
+	return s.conn.Close()
+}
+
+func (s *session) handleDisplayEvent(opcode uint16, args *argReader) error {
+	switch opcode {
+	case displayEventError:
+		objectID := args.Uint()
+		code := args.Uint()
+		message := args.String()
+		return fmt.Errorf("protocol error on object %v, code %v: %v", objectID, code, message)
+	case displayEventDeleteID:
+		s.conn.removeObject(args.Uint())
+	}
+	return args.Err()
+}
+
+func (s *session) handleManagerEvent(opcode uint16, args *argReader) error {
+	switch opcode {
+	case managerEventHead:
+		h := &head{
+			id: args.Uint(),
+		}
+		s.mu.Lock()
+		s.heads[h.id] = h
+		s.mu.Unlock()
+		s.conn.setHandler(h.id, func(opcode uint16, args *argReader) error {
+			return s.handleHeadEvent(h, opcode, args)
+		})
+	case managerEventDone:
+		s.mu.Lock()
+		s.serial = args.Uint()
+		s.mu.Unlock()
+		s.notify()
+	case managerEventFinished:
+		return fmt.Errorf("output manager finished")
+	}
+	return args.Err()
+}
+
+func (s *session) handleHeadEvent(h *head, opcode uint16, args *argReader) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch opcode {
+	case headEventName:
+		h.name = args.String()
+	case headEventDescription:
+		h.description = args.String()
+	case headEventPhysicalSize:
+	case headEventMode:
+		m := &mode{
+			id: args.Uint(),
+		}
+		s.modes[m.id] = m
+		h.modes = append(h.modes, m)
+		s.conn.setHandler(m.id, func(opcode uint16, args *argReader) error {
+			return s.handleModeEvent(h, m, opcode, args)
+		})
+	case headEventEnabled:
+		h.enabled = args.Int() != 0
+		if !h.enabled {
+			h.currentMode = nil
+		}
+	case headEventCurrentMode:
+		h.currentMode = s.modes[args.Uint()]
+	case headEventPosition:
+		h.x = args.Int()
+		h.y = args.Int()
+	case headEventTransform:
+		h.transform = args.Int()
+	case headEventScale:
+		h.scale = args.Fixed()
+	case headEventFinished:
+		delete(s.heads, h.id)
+		s.conn.removeObject(h.id)
+		if s.managerVersion >= releaseSinceVersion {
+			return s.conn.request(h.id, headRelease)
+		}
+	case headEventMake:
+		h.make = args.String()
+	case headEventModel:
+		h.model = args.String()
+	case headEventSerialNumber:
+		h.serialNumber = args.String()
+	case headEventAdaptiveSync:
+		adaptiveSync := args.Uint() == adaptiveSyncEnabled
+		h.adaptiveSync = &adaptiveSync
+	}
+	return args.Err()
+}
+
+func (s *session) handleModeEvent(h *head, m *mode, opcode uint16, args *argReader) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch opcode {
+	case modeEventSize:
+		m.width = args.Int()
+		m.height = args.Int()
+	case modeEventRefresh:
+		m.refresh = args.Int()
+	case modeEventPreferred:
+		m.preferred = true
+	case modeEventFinished:
+		delete(s.modes, m.id)
+		for i, hm := range h.modes {
+			if hm == m {
+				h.modes = append(h.modes[:i], h.modes[i+1:]...)
+				break
+			}
+		}
+		if h.currentMode == m {
+			h.currentMode = nil
+		}
+		s.conn.removeObject(m.id)
+		if s.managerVersion >= releaseSinceVersion {
+			return s.conn.request(m.id, modeRelease)
+		}
+	}
+	return args.Err()
+}
+
+// notify calls onDone with a snapshot of all heads, once the initial state
+// was received.
+func (s *session) notify() {
+	s.mu.Lock()
+	if !s.ready {
+		s.mu.Unlock()
+		return
+	}
+	heads := s.snapshot()
+	s.mu.Unlock()
+
+	if s.onDone != nil {
+		s.onDone(heads)
+	}
+}
+
+// snapshot returns a copy of all heads, sorted by id.
+// s.mu must be held.
+func (s *session) snapshot() []*head {
+	heads := make([]*head, 0, len(s.heads))
+	for _, h := range s.heads {
+		c := *h
+		if o := s.outputByName(h.name); o != nil && o.power != nil {
+			power := *o.power
+			c.power = &power
+		}
+		c.modes = make([]*mode, len(h.modes))
+		for i, m := range h.modes {
+			mc := *m
+			c.modes[i] = &mc
+			if h.currentMode == m {
+				c.currentMode = &mc
+			}
+		}
+		heads = append(heads, &c)
+	}
+	sort.Slice(heads, func(i, j int) bool {
+		return heads[i].id < heads[j].id
+	})
+	return heads
+}
+
+// headConfig describes the desired configuration of a head.
+// Unset fields are left as they are.
+type headConfig struct {
+	enabled bool
+
+	// either a mode advertised by the head, or a custom mode
+	modeID     uint32
+	customMode *mode
+
+	position     *[2]int32
+	transform    *int32
+	scale        *fixed
+	adaptiveSync *bool
+}
+
+// configure creates a configuration changing the head with the given name to
+// cfg, leaving all other heads as they are.
+// If test is true, the compositor only checks whether it would accept the
+// configuration, without applying it.
+func (s *session) configure(name string, cfg *headConfig, test bool) error {
+	results := make(chan uint16, 1)
+	configID, err := s.sendConfiguration(func(opcode uint16, args *argReader) error {
+		// only the first result is relevant
+		select {
+		case results <- opcode:
+		default:
+		}
+		return nil
+	}, name, cfg)
+	if configID != 0 {
+		defer func() {
+			s.conn.request(configID, configurationDestroy)
+			s.conn.removeObject(configID)
+		}()
+	}
+	if err != nil {
+		return err
+	}
+
+	opcode := uint16(configurationApply)
+	if test {
+		opcode = configurationTest
+	}
+	if err := s.conn.request(configID, opcode); err != nil {
+		return err
+	}
+
+	select {
+	case result := <-results:
+		switch result {
+		case configurationEventSucceeded:
+			return nil
+		case configurationEventFailed:
+			return errFailed
+		default:
+			return errCancelled
+		}
+	case <-time.After(timeout):
+		return fmt.Errorf("timeout waiting for the compositor")
+	}
+}
+
+// sendConfiguration creates a configuration, with handler handling its events, and
+// describes cfg and all other heads in it. It returns the id of the
+// configuration, which is 0 if it couldn't be created.
+func (s *session) sendConfiguration(handler eventHandler, name string, cfg *headConfig) (uint32, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	configID, err := s.conn.newRequest(handler, s.managerID, managerCreateConfiguration, newID{}, s.serial)
+	if err != nil {
+		return 0, err
+	}
+
+	found := false
+	for _, h := range s.snapshot() {
+		if h.name != name {
+			// mention all other heads, with their current state.
+			if h.enabled {
+				if _, err := s.conn.newRequest(ignoreEvents, configID, configurationEnableHead, newID{}, h.id); err != nil {
+					return configID, err
+				}
+			} else if err := s.conn.request(configID, configurationDisableHead, h.id); err != nil {
+				return configID, err
+			}
+			continue
+		}
+		found = true
+
+		if !cfg.enabled {
+			if err := s.conn.request(configID, configurationDisableHead, h.id); err != nil {
+				return configID, err
+			}
+			continue
+		}
+
+		configHeadID, err := s.conn.newRequest(ignoreEvents, configID, configurationEnableHead, newID{}, h.id)
+		if err != nil {
+			return configID, err
+		}
+		if cfg.modeID != 0 {
+			if err := s.conn.request(configHeadID, configurationHeadSetMode, cfg.modeID); err != nil {
+				return configID, err
+			}
+		} else if m := cfg.customMode; m != nil {
+			if err := s.conn.request(configHeadID, configurationHeadSetCustomMode, m.width, m.height, m.refresh); err != nil {
+				return configID, err
+			}
+		}
+		if cfg.position != nil {
+			if err := s.conn.request(configHeadID, configurationHeadSetPosition, cfg.position[0], cfg.position[1]); err != nil {
+				return configID, err
+			}
+		}
+		if cfg.transform != nil {
+			if err := s.conn.request(configHeadID, configurationHeadSetTransform, *cfg.transform); err != nil {
+				return configID, err
+			}
+		}
+		if cfg.scale != nil {
+			if err := s.conn.request(configHeadID, configurationHeadSetScale, *cfg.scale); err != nil {
+				return configID, err
+			}
+		}
+		if cfg.adaptiveSync != nil {
+			if s.managerVersion < adaptiveSyncSinceVersion {
+				return configID, fmt.Errorf("compositor doesn't support adaptive sync")
+			}
+			state := uint32(adaptiveSyncDisabled)
+			if *cfg.adaptiveSync {
+				state = adaptiveSyncEnabled
+			}
+			if err := s.conn.request(configHeadID, configurationHeadSetAdaptiveSync, state); err != nil {
+				return configID, err
+			}
+		}
+	}
+	if !found {
+		return configID, fmt.Errorf("unknown head %v", name)
+	}
+
+	return configID, nil
+}
+
+// ignoreEvents is the handler for objects that don't send events.
+func ignoreEvents(opcode uint16, args *argReader) error {
+	return nil
+}
@@ -0,0 +1,214 @@
+package wlroots
+
+import (
+	"fmt"
+
+	"github.com/flokli/display-agent/outputs"
+)
+
+// Power is changed via the wlr-output-power-management protocol, which
+// refers to outputs by their wl_output. These are bound to learn their name,
+// which is the same as the one of their head.
+
+// opcodes of the requests and events used, see wayland.xml and
+// wlr-output-power-management-unstable-v1.xml.
+const (
+	// wl_output
+	outputRelease = 0
+
+	outputEventName = 4
+
+	// zwlr_output_power_manager_v1
+	powerManagerGetOutputPower = 0
+
+	// zwlr_output_power_v1
+	powerSetMode = 0
+	powerDestroy = 1
+
+	powerEventMode   = 0
+	powerEventFailed = 1
+)
+
+const (
+	outputInterface = "wl_output"
+	// the first version announcing the name of an output, older ones are
+	// ignored.
+	outputVersion = 4
+
+	powerManagerInterface = "zwlr_output_power_manager_v1"
+	powerManagerVersion   = 1
+
+	// zwlr_output_power_v1.mode
+	powerModeOff = 0
+	powerModeOn  = 1
+)
+
+// wlOutput is a bound wl_output.
+type wlOutput struct {
+	id uint32
+
+	// empty until announced
+	name string
+	// the zwlr_output_power_v1 of the output, 0 if the compositor doesn't
+	// support power management for it.
+	powerID uint32
+	// nil until the compositor announced it
+	power *bool
+}
+
+// bindOutput binds the wl_output global with the given name.
+func (s *session) bindOutput(globalName, version uint32) error {
+	if version < outputVersion {
+		return nil
+	}
+
+	o := &wlOutput{}
+	// events are dispatched on this goroutine, so the handler can't run
+	// before o.id is set.
+	id, err := s.conn.newRequest(func(opcode uint16, args *argReader) error {
+		return s.handleOutputEvent(o, opcode, args)
+	}, s.registryID, registryBind, globalName, outputInterface, uint32(outputVersion), newID{})
+	s.mu.Lock()
+	o.id = id
+	s.wlOutputs[globalName] = o
+	s.mu.Unlock()
+
+	return err
+}
+
+// removeOutput releases the wl_output global with the given name, after the
+// compositor removed it.
+func (s *session) removeOutput(globalName uint32) error {
+	s.mu.Lock()
+	o, ok := s.wlOutputs[globalName]
+	delete(s.wlOutputs, globalName)
+	var powerID uint32
+	if ok {
+		powerID = o.powerID
+		o.powerID = 0
+	}
+	s.mu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	if powerID != 0 {
+		s.conn.removeObject(powerID)
+		if err := s.conn.request(powerID, powerDestroy); err != nil {
+			return err
+		}
+	}
+	s.conn.removeObject(o.id)
+	return s.conn.request(o.id, outputRelease)
+}
+
+func (s *session) handleOutputEvent(o *wlOutput, opcode uint16, args *argReader) error {
+	// all other events are described by the head already.
+	if opcode != outputEventName {
+		return nil
+	}
+	name := args.String()
+	if err := args.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	o.name = name
+	if s.powerManagerID == 0 || o.powerID != 0 {
+		return nil
+	}
+	var err error
+	o.powerID, err = s.conn.newRequest(func(opcode uint16, args *argReader) error {
+		return s.handlePowerEvent(o, opcode, args)
+	}, s.powerManagerID, powerManagerGetOutputPower, newID{}, o.id)
+	return err
+}
+
+// outputByName returns the wl_output with the given name, or nil if there's
+// none.
+// s.mu must be held.
+func (s *session) outputByName(name string) *wlOutput {
+	for _, o := range s.wlOutputs {
+		if o.name == name {
+			return o
+		}
+	}
+	return nil
+}
+
+// bindPowerManager binds the zwlr_output_power_manager_v1 global with the
+// given name.
+func (s *session) bindPowerManager(globalName uint32) error {
+	id, err := s.conn.newRequest(ignoreEvents, s.registryID, registryBind, globalName, powerManagerInterface, uint32(powerManagerVersion), newID{})
+	s.mu.Lock()
+	s.powerManagerID = id
+	s.mu.Unlock()
+
+	return err
+}
+
+func (s *session) handlePowerEvent(o *wlOutput, opcode uint16, args *argReader) error {
+	switch opcode {
+	case powerEventMode:
+		power := args.Uint() == powerModeOn
+		if err := args.Err(); err != nil {
+			return err
+		}
+		s.mu.Lock()
+		o.power = &power
+		s.mu.Unlock()
+		s.notify()
+	case powerEventFailed:
+		// the output doesn't support power management, or another client
+		// controls it already.
+		s.mu.Lock()
+		powerID := o.powerID
+		o.powerID = 0
+		o.power = nil
+		s.mu.Unlock()
+		if powerID == 0 {
+			return nil
+		}
+
+		s.conn.removeObject(powerID)
+		if err := s.conn.request(powerID, powerDestroy); err != nil {
+			return err
+		}
+		s.notify()
+	}
+	return args.Err()
+}
+
+// setPower turns the output with the given name on or off, and waits for the
+// compositor to announce the new mode.
+func (s *session) setPower(name string, power bool) error {
+	s.mu.Lock()
+	var powerID uint32
+	if o := s.outputByName(name); o != nil {
+		powerID = o.powerID
+	}
+	s.mu.Unlock()
+	if powerID == 0 {
+		return fmt.Errorf("%w by the compositor", outputs.ErrUnsupported)
+	}
+
+	mode := uint32(powerModeOff)
+	if power {
+		mode = powerModeOn
+	}
+	if err := s.conn.request(powerID, powerSetMode, mode); err != nil {
+		return err
+	}
+	if err := s.wait(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if o := s.outputByName(name); o == nil || o.powerID != powerID {
+		return fmt.Errorf("compositor failed to change the power mode")
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package wlroots
+
+import (
+	"fmt"
+)
+
+// The processes of scenarios are launched by the agent, and the compositor
+// doesn't tell which process a window belongs to. Instead, scenarios are
+// launched one after the other, and the first toplevel appearing after
+// launching one is made fullscreen on its output, via the
+// wlr-foreign-toplevel-management protocol.
+
+// opcodes of the requests and events used, see
+// wlr-foreign-toplevel-management-unstable-v1.xml.
+const (
+	// zwlr_foreign_toplevel_manager_v1
+	toplevelManagerEventToplevel = 0
+
+	// zwlr_foreign_toplevel_handle_v1
+	toplevelDestroy       = 7
+	toplevelSetFullscreen = 8
+
+	toplevelEventDone   = 5
+	toplevelEventClosed = 6
+)
+
+const (
+	toplevelManagerInterface = "zwlr_foreign_toplevel_manager_v1"
+	// the first version supporting set_fullscreen
+	toplevelManagerVersion = 2
+)
+
+// bindToplevelManager binds the zwlr_foreign_toplevel_manager_v1 global with
+// the given name.
+func (s *session) bindToplevelManager(globalName, version uint32) error {
+	if version < toplevelManagerVersion {
+		return nil
+	}
+
+	id, err := s.conn.newRequest(s.handleToplevelManagerEvent, s.registryID, registryBind, globalName, toplevelManagerInterface, uint32(toplevelManagerVersion), newID{})
+	s.mu.Lock()
+	s.toplevelManagerID = id
+	s.mu.Unlock()
+
+	return err
+}
+
+func (s *session) handleToplevelManagerEvent(opcode uint16, args *argReader) error {
+	if opcode != toplevelManagerEventToplevel {
+		return nil
+	}
+	id := args.Uint()
+	if err := args.Err(); err != nil {
+		return err
+	}
+
+	announced := false
+	s.conn.setHandler(id, func(opcode uint16, args *argReader) error {
+		switch opcode {
+		case toplevelEventDone:
+			// the first done event completes the initial state.
+			if announced {
+				return nil
+			}
+			announced = true
+
+			s.mu.Lock()
+			onToplevel := s.onToplevel
+			s.mu.Unlock()
+			if onToplevel != nil {
+				onToplevel(id)
+			}
+		case toplevelEventClosed:
+			s.conn.removeObject(id)
+			return s.conn.request(id, toplevelDestroy)
+		}
+		return nil
+	})
+	return nil
+}
+
+// canPlace returns whether toplevels can be made fullscreen on an output.
+func (s *session) canPlace() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.toplevelManagerID != 0
+}
+
+// watchToplevels returns a channel receiving the first toplevel appearing from
+// now on, until stop is called.
+// Only one caller may watch at a time.
+func (s *session) watchToplevels() (toplevels <-chan uint32, stop func()) {
+	ch := make(chan uint32, 1)
+	s.mu.Lock()
+	s.onToplevel = func(id uint32) {
+		select {
+		case ch <- id:
+		default:
+		}
+	}
+	s.mu.Unlock()
+
+	return ch, func() {
+		s.mu.Lock()
+		s.onToplevel = nil
+		s.mu.Unlock()
+	}
+}
+
+// setFullscreen makes the given toplevel fullscreen on the output with the
+// given name.
+func (s *session) setFullscreen(toplevelID uint32, name string) error {
+	s.mu.Lock()
+	o := s.outputByName(name)
+	s.mu.Unlock()
+	if o == nil {
+		return fmt.Errorf("unknown output %v", name)
+	}
+	return s.conn.request(toplevelID, toplevelSetFullscreen, o.id)
+}
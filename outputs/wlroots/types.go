@@ -0,0 +1,669 @@
+package wlroots
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/flokli/display-agent/outputs"
+	"github.com/flokli/display-agent/scenario"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// how long to wait before reconnecting after the connection broke
+	reconnectDelay = 1 * time.Second
+	// how long to wait for the window of a scenario to appear
+	placeTimeout = 30 * time.Second
+	// how many scenarios can wait to be launched
+	maxPendingPlacements = 16
+)
+
+// Wlroots talks to any compositor implementing the wlr-output-management
+// protocol (sway, river, labwc, Wayfire, …).
+type Wlroots struct {
+	socketPath string
+
+	sessionMu sync.Mutex
+	session   *session
+
+	outputs   map[string]*Output
+	outputsMu sync.Mutex
+	// guards the fields of all outputs. They're only changed with outputsMu
+	// held too, so holding either is enough to read them. Unlike outputsMu,
+	// it's not held while calling handlers, see GetState.
+	stateMu sync.Mutex
+
+	// serializes configuration changes
+	configureMu sync.Mutex
+
+	// how often to check whether the processes of scenarios exited
+	refreshInterval time.Duration
+	// starts the processes of scenarios
+	launcher *scenario.Launcher
+	// scenarios waiting to be launched, see placeScenarios
+	placements chan *placement
+
+	outputs.Handlers
+}
+
+// placement is a scenario to launch on an output.
+type placement struct {
+	outputName string
+	// stops the previous process only if empty
+	argv []string
+}
+
+func init() {
+	outputs.RegisterBackend("wlroots", func(opts outputs.BackendOptions) (outputs.Backend, error) {
+		return New(opts.RefreshInterval)
+	})
+}
+
+func New(refreshInterval time.Duration) (*Wlroots, error) {
+	socketPath, err := socketPathFromEnv()
+	if err != nil {
+		return nil, fmt.Errorf("unable to locate wayland socket: %w", err)
+	}
+
+	return &Wlroots{
+		socketPath:      socketPath,
+		outputs:         make(map[string]*Output),
+		refreshInterval: refreshInterval,
+		launcher:        scenario.NewLauncher(nil),
+		placements:      make(chan *placement, maxPendingPlacements),
+	}, nil
+}
+
+// Start implements Backend.
+// The compositor sends all changes to outputs as events, so there's no need
+// to poll. Only the processes of scenarios are checked every refreshInterval.
+func (w *Wlroots) Start(ctx context.Context) error {
+	go w.placeScenarios(ctx)
+	go w.watchScenarios(ctx)
+
+	go func() {
+		for {
+			err := w.runSession(ctx)
+			if ctx.Err() != nil {
+				break
+			}
+			log.WithError(err).Warn("lost connection to compositor, reconnecting")
+
+			// outputs will be announced again after reconnecting.
+			w.sync(nil)
+
+			select {
+			case <-time.After(reconnectDelay):
+			case <-ctx.Done():
+			}
+			if ctx.Err() != nil {
+				break
+			}
+		}
+
+		w.outputsMu.Lock()
+		for outputName, output := range w.outputs {
+			log.WithField("outputName", outputName).Debug("calling cleanup handlers")
+			w.NotifyRemove(output)
+		}
+		w.outputsMu.Unlock()
+
+		w.NotifyStopped()
+	}()
+
+	return nil
+}
+
+// runSession connects to the compositor, and dispatches events until the
+// connection breaks or ctx is cancelled.
+func (w *Wlroots) runSession(ctx context.Context) error {
+	s, err := connect(w.socketPath, w.sync)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	// unblock run below once the context is cancelled
+	stop := context.AfterFunc(ctx, func() {
+		s.Close()
+	})
+	defer stop()
+
+	w.sessionMu.Lock()
+	w.session = s
+	w.sessionMu.Unlock()
+
+	defer func() {
+		w.sessionMu.Lock()
+		w.session = nil
+		w.sessionMu.Unlock()
+	}()
+
+	// only announce outputs once they can be configured.
+	s.notify()
+
+	return s.run()
+}
+
+// currentSession returns the session connected to the compositor, or nil if
+// there's none.
+func (w *Wlroots) currentSession() *session {
+	w.sessionMu.Lock()
+	defer w.sessionMu.Unlock()
+	return w.session
+}
+
+// Close implements Backend.
+func (w *Wlroots) Close() {
+	log.Debug("stopping scenarios")
+	w.launcher.StopAll()
+
+	w.sessionMu.Lock()
+	defer w.sessionMu.Unlock()
+	if w.session != nil {
+		w.session.Close()
+	}
+}
+
+// Outputs implements Backend.
+func (w *Wlroots) Outputs() []outputs.Output {
+	w.outputsMu.Lock()
+	defer w.outputsMu.Unlock()
+
+	l := make([]outputs.Output, 0, len(w.outputs))
+	for _, output := range w.outputs {
+		l = append(l, output)
+	}
+	return l
+}
+
+// Scenarios implements Backend.
+func (w *Wlroots) Scenarios() []string {
+	return scenario.Names()
+}
+
+// placeScenarios launches the scenarios set on outputs one after the other,
+// until ctx is cancelled. The first toplevel appearing after launching one is
+// made fullscreen on its output.
+func (w *Wlroots) placeScenarios(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case p := <-w.placements:
+			w.place(p)
+		}
+	}
+}
+
+func (w *Wlroots) place(p *placement) {
+	l := log.WithField("outputName", p.outputName)
+
+	var toplevels <-chan uint32
+	s := w.currentSession()
+	if len(p.argv) != 0 && s != nil && s.canPlace() {
+		var stop func()
+		toplevels, stop = s.watchToplevels()
+		defer stop()
+	}
+
+	if err := w.launcher.Launch(p.outputName, p.argv); err != nil {
+		l.WithError(err).Error("unable to launch scenario")
+		w.outputsMu.Lock()
+		if o, ok := w.outputs[p.outputName]; ok {
+			w.resetScenario(o)
+		}
+		w.outputsMu.Unlock()
+		return
+	}
+	if len(p.argv) == 0 {
+		return
+	}
+	if toplevels == nil {
+		l.Warn("compositor doesn't support moving windows, leaving it where it appears")
+		return
+	}
+
+	select {
+	case id := <-toplevels:
+		if err := s.setFullscreen(id, p.outputName); err != nil {
+			l.WithError(err).Warn("unable to move window to output")
+		}
+	case <-time.After(placeTimeout):
+		l.Warn("no window appeared")
+	}
+}
+
+// watchScenarios checks every refreshInterval whether the process of a
+// scenario exited, until ctx is cancelled.
+func (w *Wlroots) watchScenarios(ctx context.Context) {
+	ticker := time.NewTicker(w.refreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		w.outputsMu.Lock()
+		for outputName, o := range w.outputs {
+			if w.launcher.Exited(outputName) {
+				log.WithField("outputName", outputName).Warn("scenario exited")
+				w.resetScenario(o)
+			}
+		}
+		w.outputsMu.Unlock()
+	}
+}
+
+// resetScenario sets the scenario of the output to blank, as nothing is shown
+// on it anymore.
+// outputsMu must be held.
+func (w *Wlroots) resetScenario(o *Output) {
+	w.stateMu.Lock()
+	o.Scenario = scenario.NewBlank()
+	w.stateMu.Unlock()
+	w.NotifyUpdate(o)
+}
+
+// sync syncs the heads announced by the compositor with the internal state in
+// all outputs.
+func (w *Wlroots) sync(heads []*head) {
+	w.outputsMu.Lock()
+	defer w.outputsMu.Unlock()
+
+	newOutputs := make([]*Output, 0, len(heads))
+	for _, h := range heads {
+		newOutputs = append(newOutputs, newOutputFromHead(h))
+	}
+	outputs.Sync(&w.Handlers, &w.stateMu, w.outputs, newOutputs, func(o *Output) {
+		o.wlroots = w
+		o.Scenario = scenario.NewBlank()
+	}, nil)
+}
+
+func newOutputFromHead(h *head) *Output {
+	o := &Output{
+		Active:    h.enabled,
+		Make:      h.make,
+		Model:     h.model,
+		Modes:     make([]*outputs.Mode, 0, len(h.modes)),
+		Name:      h.name,
+		Scale:     h.scale.Float(),
+		Serial:    h.serialNumber,
+		Transform: outputs.TransformName(int(h.transform)),
+		X:         int64(h.x),
+		Y:         int64(h.y),
+		Power:     h.power,
+	}
+	if h.adaptiveSync != nil {
+		if *h.adaptiveSync {
+			o.AdaptiveSync = "enabled"
+		} else {
+			o.AdaptiveSync = "disabled"
+		}
+	}
+	for _, m := range h.modes {
+		o.Modes = append(o.Modes, m.toMode())
+	}
+	if h.currentMode != nil {
+		o.CurrentMode = *h.currentMode.toMode()
+	}
+	return o
+}
+
+func (m *mode) toMode() *outputs.Mode {
+	return &outputs.Mode{
+		Width:  int64(m.width),
+		Height: int64(m.height),
+		// the protocol reports mHz, same as sway.
+		Refresh:            float64(m.refresh),
+		PictureAspectRatio: "none",
+	}
+}
+
+type Output struct {
+	// A handle to the global wlroots object
+	wlroots *Wlroots
+
+	Active      bool
+	CurrentMode outputs.Mode
+	Make        string
+	Model       string
+	Modes       []*outputs.Mode
+	Name        string
+	Scale       float64
+	Serial      string
+	Transform   string
+	X           int64
+	Y           int64
+	// one of outputs.AdaptiveSyncValues, empty if the compositor doesn't
+	// announce it.
+	AdaptiveSync string
+	// nil if the compositor doesn't support power management for the output
+	Power *bool
+
+	Scenario *outputs.Scenario
+}
+
+// GetInfo implements Output.
+func (o *Output) GetInfo() *outputs.Info {
+	return &outputs.Info{
+		Make:   &o.Make,
+		Model:  &o.Model,
+		Modes:  &o.Modes,
+		Name:   &o.Name,
+		Serial: &o.Serial,
+	}
+}
+
+// GetState implements Output.
+// Power is only exposed by compositors implementing the
+// wlr-output-power-management protocol, adaptive sync only by compositors
+// implementing version 4 of wlr-output-management.
+// It returns the state of a snapshot, as the compositor changes the output
+// while the state is used.
+func (o *Output) GetState() *outputs.State {
+	return o.snapshot().state()
+}
+
+// state returns the state of o, pointing to its fields.
+func (o *Output) state() *outputs.State {
+	s := &outputs.State{
+		Enabled:   &o.Active,
+		Mode:      &o.CurrentMode,
+		Power:     o.Power,
+		Scale:     &o.Scale,
+		Transform: &o.Transform,
+		Position:  &outputs.Position{X: o.X, Y: o.Y},
+		Scenario:  o.Scenario,
+	}
+	if o.AdaptiveSync != "" {
+		s.AdaptiveSync = &o.AdaptiveSync
+	}
+	return s
+}
+
+// snapshot returns a copy of the output, which can be read without holding
+// a lock, while the compositor announces changes.
+// It only takes stateMu, so it can be called from handlers.
+func (o *Output) snapshot() *Output {
+	o.wlroots.stateMu.Lock()
+	defer o.wlroots.stateMu.Unlock()
+
+	c := *o
+	if o.Power != nil {
+		power := *o.Power
+		c.Power = &power
+	}
+	return &c
+}
+
+// SetState implements Output.
+// All changes to the configuration of the output are sent as a single
+// configuration, which is tested before being applied, so a configuration the
+// compositor rejects is never applied partially. Power and the scenario are
+// applied afterwards, and if they fail, the configuration is rolled back.
+func (o *Output) SetState(newState *outputs.State) (*outputs.State, error) {
+	w := o.wlroots
+	w.configureMu.Lock()
+	defer w.configureMu.Unlock()
+
+	log.WithFields(newState.LogFields("newState")).Debug("SetState()")
+
+	err := outputs.ApplyWithRollback(o.GetState(), newState, o.apply)
+
+	return o.GetState(), err
+}
+
+// apply applies all fields set in newState, and returns on the first one
+// that fails.
+func (o *Output) apply(newState *outputs.State) error {
+	s := o.wlroots.currentSession()
+	if s == nil {
+		return fmt.Errorf("not connected to compositor")
+	}
+	current := o.snapshot()
+
+	if newState.AdaptiveSync != nil && current.AdaptiveSync == "" {
+		return &outputs.FieldError{Field: "adaptive_sync", Err: fmt.Errorf("%w by the compositor", outputs.ErrUnsupported)}
+	}
+	if newState.SubpixelHinting != nil {
+		return &outputs.FieldError{Field: "subpixel_hinting", Err: fmt.Errorf("%w by the wlroots backend", outputs.ErrUnsupported)}
+	}
+	if newState.ScaleFilter != nil {
+		return &outputs.FieldError{Field: "scale_filter", Err: fmt.Errorf("%w by the wlroots backend", outputs.ErrUnsupported)}
+	}
+	if newState.MaxRenderTime != nil {
+		return &outputs.FieldError{Field: "max_render_time", Err: fmt.Errorf("%w by the wlroots backend", outputs.ErrUnsupported)}
+	}
+
+	if newState.Enabled != nil || newState.Mode != nil || newState.Scale != nil || newState.Transform != nil || newState.Position != nil || newState.AdaptiveSync != nil {
+		cfg, err := current.headConfig(s, newState)
+		if err != nil {
+			return err
+		}
+		if err := o.wlroots.configure(current.Name, cfg); err != nil {
+			if errors.Is(err, errFailed) {
+				err = current.findRejectedField(s, newState, err)
+			}
+			return err
+		}
+		// pick up the new state announced by the compositor.
+		if err := s.wait(); err != nil {
+			return err
+		}
+	}
+
+	if newState.Power != nil {
+		if err := s.setPower(current.Name, *newState.Power); err != nil {
+			return &outputs.FieldError{Field: "power", Err: err}
+		}
+	}
+
+	if newState.Scenario != nil {
+		if err := o.setScenario(newState.Scenario.Name, newState.Scenario.Args); err != nil {
+			return &outputs.FieldError{Field: "scenario", Err: err}
+		}
+	}
+
+	return nil
+}
+
+// setScenario validates the scenario, and queues launching it.
+func (o *Output) setScenario(name string, args []string) error {
+	argv, err := scenario.Command(name, args)
+	if err != nil {
+		return err
+	}
+	// it's launched later, report a missing program right away.
+	if len(argv) != 0 {
+		if _, err := exec.LookPath(argv[0]); err != nil {
+			return err
+		}
+	}
+
+	w := o.wlroots
+	w.outputsMu.Lock()
+	defer w.outputsMu.Unlock()
+
+	select {
+	case w.placements <- &placement{outputName: o.Name, argv: argv}:
+	default:
+		return fmt.Errorf("too many scenarios waiting to be launched")
+	}
+
+	w.stateMu.Lock()
+	o.Scenario = &outputs.Scenario{
+		Name: name,
+		Args: args,
+	}
+	w.stateMu.Unlock()
+	return nil
+}
+
+// headConfig builds the configuration for the head of this output.
+// It's called on a snapshot of the output.
+func (o *Output) headConfig(s *session, newState *outputs.State) (*headConfig, error) {
+	cfg := &headConfig{
+		enabled: o.Active,
+	}
+	if newState.Enabled != nil {
+		cfg.enabled = *newState.Enabled
+	}
+	if newState.Mode != nil {
+		cfg.modeID, cfg.customMode = s.findMode(o.Name, newState.Mode)
+	} else if cfg.enabled && !o.Active {
+		// disabled heads don't have a current mode, so pick one.
+		cfg.modeID = s.preferredMode(o.Name)
+	}
+	if newState.Scale != nil {
+		scale := fixedFromFloat(*newState.Scale)
+		cfg.scale = &scale
+	}
+	if newState.Transform != nil {
+		t, err := outputs.TransformIndex(*newState.Transform)
+		if err != nil {
+			return nil, &outputs.FieldError{Field: "transform", Err: err}
+		}
+		transform := int32(t)
+		cfg.transform = &transform
+	}
+	if newState.Position != nil {
+		cfg.position = &[2]int32{int32(newState.Position.X), int32(newState.Position.Y)}
+	}
+	if newState.AdaptiveSync != nil {
+		adaptiveSync := *newState.AdaptiveSync == "enabled"
+		cfg.adaptiveSync = &adaptiveSync
+	}
+
+	return cfg, nil
+}
+
+// findRejectedField tests all fields set in newState one by one, to find the
+// one the compositor rejected, and returns a FieldError for it.
+// If none of them is rejected on its own, err is returned.
+// It's called on a snapshot of the output.
+func (o *Output) findRejectedField(s *session, newState *outputs.State, err error) error {
+	var fields []*outputs.State
+	var names []string
+	if newState.Enabled != nil {
+		fields, names = append(fields, &outputs.State{Enabled: newState.Enabled}), append(names, "enabled")
+	}
+	if newState.Mode != nil {
+		fields, names = append(fields, &outputs.State{Mode: newState.Mode}), append(names, "mode")
+	}
+	if newState.Scale != nil {
+		fields, names = append(fields, &outputs.State{Scale: newState.Scale}), append(names, "scale")
+	}
+	if newState.Transform != nil {
+		fields, names = append(fields, &outputs.State{Transform: newState.Transform}), append(names, "transform")
+	}
+	if newState.Position != nil {
+		fields, names = append(fields, &outputs.State{Position: newState.Position}), append(names, "position")
+	}
+	if newState.AdaptiveSync != nil {
+		fields, names = append(fields, &outputs.State{AdaptiveSync: newState.AdaptiveSync}), append(names, "adaptive_sync")
+	}
+
+	if len(fields) == 1 {
+		return &outputs.FieldError{Field: names[0], Err: err}
+	}
+	for i, field := range fields {
+		cfg, cfgErr := o.headConfig(s, field)
+		if cfgErr != nil {
+			return cfgErr
+		}
+		if testErr := s.configure(o.Name, cfg, true); errors.Is(testErr, errFailed) {
+			return &outputs.FieldError{Field: names[i], Err: testErr}
+		}
+	}
+	return err
+}
+
+// findMode returns the id of the mode of the given head matching m.
+// If m doesn't specify a refresh rate, the one with the highest refresh rate
+// is picked. If the head doesn't advertise a matching mode, a custom mode is
+// returned instead.
+func (s *session) findMode(name string, m *outputs.Mode) (uint32, *mode) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var best *mode
+	for _, h := range s.heads {
+		if h.name != name {
+			continue
+		}
+		for _, hm := range h.modes {
+			if int64(hm.width) != m.Width || int64(hm.height) != m.Height {
+				continue
+			}
+			if m.Refresh == 0 {
+				if best == nil || hm.refresh > best.refresh {
+					best = hm
+				}
+			} else if math.Abs(float64(hm.refresh)-m.Refresh) < 1 {
+				return hm.id, nil
+			}
+		}
+	}
+	if best != nil {
+		return best.id, nil
+	}
+
+	return 0, &mode{
+		width:   int32(m.Width),
+		height:  int32(m.Height),
+		refresh: int32(m.Refresh),
+	}
+}
+
+// preferredMode returns the id of the preferred mode of the given head, or 0 if
+// there is none.
+func (s *session) preferredMode(name string) uint32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, h := range s.heads {
+		if h.name != name {
+			continue
+		}
+		for _, hm := range h.modes {
+			if hm.preferred {
+				return hm.id
+			}
+		}
+	}
+	return 0
+}
+
+// configure tests the given configuration for the head with the given name,
+// and applies it if the compositor accepts it.
+// If the compositor cancels the configuration because outputs changed in the
+// meantime, it's retried once.
+func (w *Wlroots) configure(name string, cfg *headConfig) error {
+	s := w.currentSession()
+	if s == nil {
+		return fmt.Errorf("not connected to compositor")
+	}
+
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if err = s.configure(name, cfg, true); err == nil {
+			err = s.configure(name, cfg, false)
+		}
+		if !errors.Is(err, errCancelled) {
+			return err
+		}
+		// wait for the compositor to announce the new state
+		time.Sleep(100 * time.Millisecond)
+	}
+	return err
+}
@@ -0,0 +1,715 @@
+package wlroots
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/flokli/display-agent/outputs"
+	"github.com/flokli/display-agent/scenario"
+)
+
+// fakeCompositor serves the parts of the Wayland protocol used by the
+// backend: wl_output, wlr-output-management, wlr-output-power-management and
+// wlr-foreign-toplevel-management.
+// The server side of the connection uses conn too, as requests and events
+// are encoded the same way.
+type fakeCompositor struct {
+	t        *testing.T
+	listener net.Listener
+	path     string
+
+	// returns whether a configuration is rejected
+	reject func(cfg map[string]*fakeHeadConfig) bool
+
+	mu     sync.Mutex
+	conn   *conn
+	heads  []*fakeHead
+	serial uint32
+	nextID uint32
+
+	// the last id of an object created by the client. Only accessed by the
+	// goroutine dispatching requests.
+	lastClientID uint32
+
+	registryID        uint32
+	managerID         uint32
+	toplevelManagerID uint32
+	// the requests sent to toplevels, as "set_fullscreen $output"
+	toplevelRequests []string
+}
+
+type fakeHead struct {
+	id        uint32
+	name      string
+	modes     []*mode
+	enabled   bool
+	current   *mode
+	x, y      int32
+	transform int32
+	scale     fixed
+	power     bool
+
+	// the objects bound by the client
+	outputID uint32
+	powerID  uint32
+}
+
+type fakeHeadConfig struct {
+	enabled   bool
+	mode      *mode
+	x, y      int32
+	transform int32
+	scale     fixed
+}
+
+// the names of the globals announced
+const (
+	fakeGlobalManager = iota + 1
+	fakeGlobalPowerManager
+	fakeGlobalToplevelManager
+	// followed by one wl_output per head
+	fakeGlobalOutputs
+)
+
+func newFakeCompositor(t *testing.T) *fakeCompositor {
+	path := filepath.Join(t.TempDir(), "wayland-0")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	f := &fakeCompositor{
+		t:        t,
+		listener: l,
+		path:     path,
+		reject:   func(map[string]*fakeHeadConfig) bool { return false },
+		serial:   1,
+		// the client creates objects starting after the display
+		lastClientID: displayID,
+		// ids of objects created by the server start here
+		nextID: 0xff000000,
+	}
+	for i, name := range []string{"HDMI-A-1", "DP-1"} {
+		h := &fakeHead{
+			name:    name,
+			enabled: true,
+			x:       int32(i * 1920),
+			scale:   fixedFromFloat(1),
+			power:   true,
+			modes: []*mode{
+				{width: 1920, height: 1080, refresh: 60000, preferred: true},
+				{width: 1920, height: 1080, refresh: 50000},
+				{width: 1280, height: 720, refresh: 60000},
+			},
+		}
+		h.current = h.modes[0]
+		f.heads = append(f.heads, h)
+	}
+
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		f.serve(c)
+	}()
+	return f
+}
+
+func (f *fakeCompositor) newID() uint32 {
+	f.nextID++
+	return f.nextID
+}
+
+// clientID checks that id is the next id of an object created by the client.
+// Like libwayland, ids must arrive in sequence, otherwise the client is
+// disconnected.
+func (f *fakeCompositor) clientID(id uint32) error {
+	if id != f.lastClientID+1 {
+		f.t.Errorf("invalid new id %v, expected %v", id, f.lastClientID+1)
+		return fmt.Errorf("invalid new id %v", id)
+	}
+	f.lastClientID = id
+	return nil
+}
+
+func (f *fakeCompositor) serve(c net.Conn) {
+	f.mu.Lock()
+	f.conn = newConn(c)
+	f.conn.setHandler(displayID, f.handleDisplay)
+	for _, h := range f.heads {
+		h.id = f.newID()
+		for _, m := range h.modes {
+			m.id = f.newID()
+		}
+	}
+	f.mu.Unlock()
+
+	for {
+		if err := f.conn.dispatch(); err != nil {
+			return
+		}
+	}
+}
+
+// disconnect closes the connection to the client.
+func (f *fakeCompositor) disconnect() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.conn.Close()
+}
+
+func (f *fakeCompositor) send(id uint32, opcode uint16, args ...interface{}) {
+	if err := f.conn.request(id, opcode, args...); err != nil {
+		f.t.Logf("unable to send event: %v", err)
+	}
+}
+
+func (f *fakeCompositor) handleDisplay(opcode uint16, args *argReader) error {
+	id := args.Uint()
+	if err := args.Err(); err != nil {
+		return err
+	}
+	if err := f.clientID(id); err != nil {
+		return err
+	}
+	switch opcode {
+	case displaySync:
+		f.send(id, callbackEventDone, uint32(0))
+		f.send(displayID, displayEventDeleteID, id)
+	case displayGetRegistry:
+		f.mu.Lock()
+		f.registryID = id
+		f.mu.Unlock()
+		f.conn.setHandler(id, f.handleRegistry)
+		f.send(id, registryEventGlobal, uint32(fakeGlobalManager), managerInterface, uint32(managerVersion))
+		f.send(id, registryEventGlobal, uint32(fakeGlobalPowerManager), powerManagerInterface, uint32(1))
+		f.send(id, registryEventGlobal, uint32(fakeGlobalToplevelManager), toplevelManagerInterface, uint32(3))
+		for i := range f.heads {
+			f.send(id, registryEventGlobal, uint32(fakeGlobalOutputs+i), outputInterface, uint32(4))
+		}
+	default:
+		return fmt.Errorf("unexpected wl_display request %v", opcode)
+	}
+	return args.Err()
+}
+
+func (f *fakeCompositor) handleRegistry(opcode uint16, args *argReader) error {
+	if opcode != registryBind {
+		return fmt.Errorf("unexpected wl_registry request %v", opcode)
+	}
+	name := args.Uint()
+	iface := args.String()
+	args.Uint()
+	id := args.Uint()
+	if err := args.Err(); err != nil {
+		return err
+	}
+	if err := f.clientID(id); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch {
+	case name == fakeGlobalManager && iface == managerInterface:
+		f.managerID = id
+		f.conn.setHandler(id, f.handleManager)
+		for _, h := range f.heads {
+			f.sendHead(h)
+		}
+		f.send(id, managerEventDone, f.serial)
+	case name == fakeGlobalPowerManager && iface == powerManagerInterface:
+		f.conn.setHandler(id, f.handlePowerManager)
+	case name == fakeGlobalToplevelManager && iface == toplevelManagerInterface:
+		f.toplevelManagerID = id
+		f.conn.setHandler(id, ignoreEvents)
+	case name >= fakeGlobalOutputs && int(name-fakeGlobalOutputs) < len(f.heads) && iface == outputInterface:
+		h := f.heads[name-fakeGlobalOutputs]
+		h.outputID = id
+		f.conn.setHandler(id, ignoreEvents)
+		f.send(id, outputEventName, h.name)
+	default:
+		return fmt.Errorf("unexpected bind of %v to %v", name, iface)
+	}
+	return nil
+}
+
+// sendHead announces a head and its modes.
+// f.mu must be held.
+func (f *fakeCompositor) sendHead(h *fakeHead) {
+	f.send(f.managerID, managerEventHead, h.id)
+	f.send(h.id, headEventName, h.name)
+	f.send(h.id, headEventMake, "Foocorp")
+	f.send(h.id, headEventModel, "Display")
+	f.send(h.id, headEventSerialNumber, "SN-"+h.name)
+	for _, m := range h.modes {
+		f.send(h.id, headEventMode, m.id)
+		f.send(m.id, modeEventSize, m.width, m.height)
+		f.send(m.id, modeEventRefresh, m.refresh)
+		if m.preferred {
+			f.send(m.id, modeEventPreferred)
+		}
+	}
+	f.sendHeadState(h)
+	f.send(h.id, headEventAdaptiveSync, uint32(adaptiveSyncDisabled))
+}
+
+// sendHeadState announces the configurable state of a head.
+// f.mu must be held.
+func (f *fakeCompositor) sendHeadState(h *fakeHead) {
+	enabled := int32(0)
+	if h.enabled {
+		enabled = 1
+	}
+	f.send(h.id, headEventEnabled, enabled)
+	if !h.enabled {
+		return
+	}
+	f.send(h.id, headEventCurrentMode, h.current.id)
+	f.send(h.id, headEventPosition, h.x, h.y)
+	f.send(h.id, headEventTransform, h.transform)
+	f.send(h.id, headEventScale, h.scale)
+}
+
+func (f *fakeCompositor) handleManager(opcode uint16, args *argReader) error {
+	if opcode != managerCreateConfiguration {
+		return fmt.Errorf("unexpected zwlr_output_manager_v1 request %v", opcode)
+	}
+	id := args.Uint()
+	serial := args.Uint()
+	if err := args.Err(); err != nil {
+		return err
+	}
+	if err := f.clientID(id); err != nil {
+		return err
+	}
+
+	cfg := make(map[string]*fakeHeadConfig)
+	f.conn.setHandler(id, func(opcode uint16, args *argReader) error {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		switch opcode {
+		case configurationEnableHead:
+			configHeadID := args.Uint()
+			if err := f.clientID(configHeadID); err != nil {
+				return err
+			}
+			h := f.head(args.Uint())
+			hc := &fakeHeadConfig{enabled: true, mode: h.current, x: h.x, y: h.y, transform: h.transform, scale: h.scale}
+			cfg[h.name] = hc
+			f.conn.setHandler(configHeadID, func(opcode uint16, args *argReader) error {
+				f.mu.Lock()
+				defer f.mu.Unlock()
+				return f.handleHeadConfig(h, hc, opcode, args)
+			})
+		case configurationDisableHead:
+			cfg[f.head(args.Uint()).name] = &fakeHeadConfig{}
+		case configurationTest, configurationApply:
+			switch {
+			case serial != f.serial:
+				f.send(id, configurationEventCancelled)
+			case len(cfg) != len(f.heads) || f.reject(cfg):
+				f.send(id, configurationEventFailed)
+			default:
+				f.send(id, configurationEventSucceeded)
+				if opcode == configurationApply {
+					f.applyConfig(cfg)
+				}
+			}
+		case configurationDestroy:
+			f.conn.removeObject(id)
+		default:
+			return fmt.Errorf("unexpected zwlr_output_configuration_v1 request %v", opcode)
+		}
+		return args.Err()
+	})
+	return nil
+}
+
+func (f *fakeCompositor) handleHeadConfig(h *fakeHead, hc *fakeHeadConfig, opcode uint16, args *argReader) error {
+	switch opcode {
+	case configurationHeadSetMode:
+		id := args.Uint()
+		for _, m := range h.modes {
+			if m.id == id {
+				hc.mode = m
+			}
+		}
+	case configurationHeadSetPosition:
+		hc.x = args.Int()
+		hc.y = args.Int()
+	case configurationHeadSetTransform:
+		hc.transform = args.Int()
+	case configurationHeadSetScale:
+		hc.scale = args.Fixed()
+	default:
+		return fmt.Errorf("unexpected zwlr_output_configuration_head_v1 request %v", opcode)
+	}
+	return args.Err()
+}
+
+// applyConfig applies a configuration, and announces the new state.
+// f.mu must be held.
+func (f *fakeCompositor) applyConfig(cfg map[string]*fakeHeadConfig) {
+	for _, h := range f.heads {
+		hc := cfg[h.name]
+		h.enabled = hc.enabled
+		if hc.enabled {
+			h.current, h.x, h.y, h.transform, h.scale = hc.mode, hc.x, hc.y, hc.transform, hc.scale
+		}
+		f.sendHeadState(h)
+	}
+	f.serial++
+	f.send(f.managerID, managerEventDone, f.serial)
+}
+
+// head returns the head with the given id.
+// f.mu must be held.
+func (f *fakeCompositor) head(id uint32) *fakeHead {
+	for _, h := range f.heads {
+		if h.id == id {
+			return h
+		}
+	}
+	f.t.Errorf("unknown head %v", id)
+	return &fakeHead{}
+}
+
+func (f *fakeCompositor) handlePowerManager(opcode uint16, args *argReader) error {
+	if opcode != powerManagerGetOutputPower {
+		return fmt.Errorf("unexpected zwlr_output_power_manager_v1 request %v", opcode)
+	}
+	id := args.Uint()
+	outputID := args.Uint()
+	if err := args.Err(); err != nil {
+		return err
+	}
+	if err := f.clientID(id); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var h *fakeHead
+	for _, fh := range f.heads {
+		if fh.outputID == outputID {
+			h = fh
+		}
+	}
+	if h == nil {
+		return fmt.Errorf("unknown output %v", outputID)
+	}
+	h.powerID = id
+	f.conn.setHandler(id, func(opcode uint16, args *argReader) error {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		switch opcode {
+		case powerSetMode:
+			h.power = args.Uint() == powerModeOn
+			f.sendPower(h)
+		case powerDestroy:
+			f.conn.removeObject(id)
+		}
+		return args.Err()
+	})
+	f.sendPower(h)
+	return nil
+}
+
+// sendPower announces the power mode of a head.
+// f.mu must be held.
+func (f *fakeCompositor) sendPower(h *fakeHead) {
+	mode := uint32(powerModeOff)
+	if h.power {
+		mode = powerModeOn
+	}
+	f.send(h.powerID, powerEventMode, mode)
+}
+
+// replugOutputs removes and announces the wl_output globals of all heads
+// again, like the compositor does on hotplug. The client binds them again,
+// from the goroutine dispatching events.
+func (f *fakeCompositor) replugOutputs() {
+	f.mu.Lock()
+	registryID := f.registryID
+	heads := len(f.heads)
+	f.mu.Unlock()
+
+	// f.mu isn't held while sending, so binding doesn't wait for it.
+	for i := 0; i < heads; i++ {
+		f.send(registryID, registryEventGlobalRemove, uint32(fakeGlobalOutputs+i))
+		f.send(registryID, registryEventGlobal, uint32(fakeGlobalOutputs+i), outputInterface, uint32(4))
+	}
+}
+
+// addToplevel announces a new toplevel, like a window being mapped.
+func (f *fakeCompositor) addToplevel() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	id := f.newID()
+	f.conn.setHandler(id, func(opcode uint16, args *argReader) error {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		if opcode == toplevelSetFullscreen {
+			outputID := args.Uint()
+			for _, h := range f.heads {
+				if h.outputID == outputID {
+					f.toplevelRequests = append(f.toplevelRequests, "set_fullscreen "+h.name)
+				}
+			}
+		}
+		return args.Err()
+	})
+	f.send(f.toplevelManagerID, toplevelManagerEventToplevel, id)
+	f.send(id, toplevelEventDone)
+}
+
+func (f *fakeCompositor) ToplevelRequests() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.toplevelRequests...)
+}
+
+// startBackend starts the backend against f, and waits for all outputs to be
+// added.
+func startBackend(t *testing.T, f *fakeCompositor) *Wlroots {
+	t.Setenv("WAYLAND_DISPLAY", f.path)
+	w, err := New(time.Hour)
+	if err != nil {
+		t.Fatalf("unable to create backend: %v", err)
+	}
+
+	added := make(chan outputs.Output, len(f.heads))
+	w.RegisterOutputAdd(func(o outputs.Output) {
+		added <- o
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(func() {
+		cancel()
+		w.Close()
+	})
+	if err := w.Start(ctx); err != nil {
+		t.Fatalf("unable to start backend: %v", err)
+	}
+
+	for range f.heads {
+		select {
+		case <-added:
+		case <-time.After(5 * time.Second):
+			t.Fatal("outputs weren't added")
+		}
+	}
+	return w
+}
+
+func outputByName(t *testing.T, w *Wlroots, name string) *Output {
+	w.outputsMu.Lock()
+	defer w.outputsMu.Unlock()
+	o, ok := w.outputs[name]
+	if !ok {
+		t.Fatalf("output %v is missing", name)
+	}
+	return o
+}
+
+func TestOutputs(t *testing.T) {
+	f := newFakeCompositor(t)
+	w := startBackend(t, f)
+
+	var names []string
+	for _, o := range w.Outputs() {
+		names = append(names, *o.GetInfo().Name)
+	}
+	sort.Strings(names)
+	if len(names) != 2 || names[0] != "DP-1" || names[1] != "HDMI-A-1" {
+		t.Fatalf("unexpected outputs %v", names)
+	}
+
+	o := outputByName(t, w, "DP-1").snapshot()
+	if o.Make != "Foocorp" || o.Model != "Display" || o.Serial != "SN-DP-1" {
+		t.Errorf("unexpected make %q, model %q or serial %q", o.Make, o.Model, o.Serial)
+	}
+	if len(o.Modes) != 3 {
+		t.Errorf("expected 3 modes, got %v", o.Modes)
+	}
+
+	state := o.GetState()
+	expectedMode := outputs.Mode{Width: 1920, Height: 1080, Refresh: 60000, PictureAspectRatio: "none"}
+	if !*state.Enabled || *state.Mode != expectedMode || *state.Scale != 1 || *state.Transform != "normal" {
+		t.Errorf("unexpected state %+v", state)
+	}
+	if *state.Position != (outputs.Position{X: 1920, Y: 0}) {
+		t.Errorf("unexpected position %v", *state.Position)
+	}
+	if state.Power == nil || !*state.Power {
+		t.Errorf("expected power to be on, got %v", state.Power)
+	}
+	if state.AdaptiveSync == nil || *state.AdaptiveSync != "disabled" {
+		t.Errorf("expected adaptive sync to be disabled, got %v", state.AdaptiveSync)
+	}
+}
+
+func TestSetState(t *testing.T) {
+	f := newFakeCompositor(t)
+	w := startBackend(t, f)
+	o := outputByName(t, w, "HDMI-A-1")
+
+	mode := outputs.Mode{Width: 1280, Height: 720}
+	transform := "90"
+	power := false
+	state, err := o.SetState(&outputs.State{
+		Mode:      &mode,
+		Transform: &transform,
+		Position:  &outputs.Position{X: 0, Y: 1080},
+		Power:     &power,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// the returned state is the one announced by the compositor afterwards.
+	if state.Mode.Width != 1280 || state.Mode.Refresh != 60000 || *state.Transform != "90" || state.Position.Y != 1080 || *state.Power {
+		t.Errorf("unexpected state %+v", state)
+	}
+
+	f.mu.Lock()
+	h := f.heads[0]
+	if h.current.width != 1280 || h.transform != 1 || h.y != 1080 || h.power {
+		t.Errorf("compositor didn't apply the state: %+v", h)
+	}
+	f.mu.Unlock()
+}
+
+func TestSetStateWhileReplugging(t *testing.T) {
+	f := newFakeCompositor(t)
+	w := startBackend(t, f)
+	o := outputByName(t, w, "HDMI-A-1")
+
+	// both SetState and binding the replugged outputs create objects. Their
+	// ids must still reach the compositor in sequence, which it checks.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			if _, err := o.SetState(&outputs.State{Position: &outputs.Position{X: 0, Y: int64(i)}}); err != nil {
+				t.Errorf("unable to set position: %v", err)
+				return
+			}
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+			f.replugOutputs()
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+func TestSetStateRejected(t *testing.T) {
+	f := newFakeCompositor(t)
+	f.reject = func(cfg map[string]*fakeHeadConfig) bool {
+		return cfg["HDMI-A-1"].scale == fixedFromFloat(2)
+	}
+	w := startBackend(t, f)
+	o := outputByName(t, w, "HDMI-A-1")
+
+	scale := 2.0
+	state, err := o.SetState(&outputs.State{
+		Scale:    &scale,
+		Position: &outputs.Position{X: 100, Y: 100},
+	})
+	var fieldErr *outputs.FieldError
+	if !errors.As(err, &fieldErr) || fieldErr.Field != "scale" || !errors.Is(err, errFailed) {
+		t.Fatalf("expected the scale to be rejected, got %v", err)
+	}
+
+	// nothing is applied.
+	if *state.Scale != 1 || state.Position.X != 0 {
+		t.Errorf("unexpected state %+v", state)
+	}
+	f.mu.Lock()
+	if h := f.heads[0]; h.x != 0 || h.scale != fixedFromFloat(1) {
+		t.Errorf("compositor applied a rejected configuration: %+v", h)
+	}
+	f.mu.Unlock()
+}
+
+func TestSetStateUnsupported(t *testing.T) {
+	f := newFakeCompositor(t)
+	w := startBackend(t, f)
+	o := outputByName(t, w, "HDMI-A-1")
+
+	subpixelHinting := "rgb"
+	_, err := o.SetState(&outputs.State{SubpixelHinting: &subpixelHinting})
+	if !errors.Is(err, outputs.ErrUnsupported) {
+		t.Errorf("expected subpixel hinting to be unsupported, got %v", err)
+	}
+}
+
+func TestScenario(t *testing.T) {
+	if err := scenario.Define("sleep", &scenario.Definition{Command: []string{"sleep", "60"}}); err != nil {
+		t.Fatalf("unable to define scenario: %v", err)
+	}
+
+	f := newFakeCompositor(t)
+	w := startBackend(t, f)
+	o := outputByName(t, w, "DP-1")
+
+	state, err := o.SetState(&outputs.State{Scenario: &outputs.Scenario{Name: "sleep", Args: []string{}}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if state.Scenario.Name != "sleep" {
+		t.Errorf("unexpected scenario %v", state.Scenario)
+	}
+
+	// the window appears some time after launching.
+	deadline := time.Now().Add(5 * time.Second)
+	for len(f.ToplevelRequests()) == 0 && time.Now().Before(deadline) {
+		f.addToplevel()
+		time.Sleep(50 * time.Millisecond)
+	}
+	if got := f.ToplevelRequests(); len(got) != 1 || got[0] != "set_fullscreen DP-1" {
+		t.Errorf("expected the window to be made fullscreen on DP-1 once, got %q", got)
+	}
+}
+
+func TestDisconnect(t *testing.T) {
+	f := newFakeCompositor(t)
+	w := startBackend(t, f)
+
+	removed := make(chan struct{}, 2)
+	w.outputsMu.Lock()
+	w.RegisterOutputRemove(func(outputs.Output) {
+		removed <- struct{}{}
+	})
+	w.outputsMu.Unlock()
+
+	f.disconnect()
+	for i := 0; i < 2; i++ {
+		select {
+		case <-removed:
+		case <-time.After(5 * time.Second):
+			t.Fatal("outputs weren't removed")
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package wlroots
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+)
+
+// This file implements the client side of the Wayland wire protocol, as far
+// as needed to speak the wlr-output-management protocol.
+// Every message consists of the id of the object it's sent to / from, the
+// message size and opcode (packed into a single 32 bit integer), followed by
+// the arguments. All integers are in native byte order.
+// Passing file descriptors is not needed, and not supported.
+
+// the id of the wl_display singleton.
+const displayID = 1
+
+// fixed is a signed 24.8 fixed point number.
+type fixed int32
+
+func fixedFromFloat(f float64) fixed {
+	return fixed(f * 256)
+}
+
+func (f fixed) Float() float64 {
+	return float64(f) / 256
+}
+
+// eventHandler is invoked with the opcode and arguments of every event sent
+// to an object.
+type eventHandler func(opcode uint16, args *argReader) error
+
+// conn is a connection to a Wayland compositor.
+type conn struct {
+	c io.ReadWriteCloser
+
+	// held while writing a request. It also guards nextID, so new ids reach
+	// the compositor in the order they were handed out, as it requires.
+	writeMu sync.Mutex
+	nextID  uint32
+
+	mu       sync.Mutex
+	handlers map[uint32]eventHandler
+}
+
+// newID is the placeholder for the id of the object created by newRequest.
+type newID struct{}
+
+// socketPathFromEnv returns the path to the Wayland socket, as exposed to
+// Wayland clients.
+func socketPathFromEnv() (string, error) {
+	display := os.Getenv("WAYLAND_DISPLAY")
+	if display == "" {
+		display = "wayland-0"
+	}
+	if filepath.IsAbs(display) {
+		return display, nil
+	}
+
+	runtimeDir := os.Getenv("XDG_RUNTIME_DIR")
+	if runtimeDir == "" {
+		return "", fmt.Errorf("XDG_RUNTIME_DIR is not set")
+	}
+	return filepath.Join(runtimeDir, display), nil
+}
+
+func dial(socketPath string) (*conn, error) {
+	c, err := net.Dial("unix", socketPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to wayland socket: %w", err)
+	}
+	return newConn(c), nil
+}
+
+func newConn(c io.ReadWriteCloser) *conn {
+	return &conn{
+		c:        c,
+		nextID:   displayID + 1,
+		handlers: make(map[uint32]eventHandler),
+	}
+}
+
+func (c *conn) Close() error {
+	return c.c.Close()
+}
+
+// setHandler registers h to handle the events of the given object.
+// This is used for objects created by the compositor.
+func (c *conn) setHandler(id uint32, h eventHandler) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.handlers[id] = h
+}
+
+// removeObject stops dispatching events to the given object.
+func (c *conn) removeObject(id uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.handlers, id)
+}
+
+// request sends a request to the given object.
+// args may be of type uint32, int32, fixed or string.
+func (c *conn) request(id uint32, opcode uint16, args ...interface{}) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.write(id, opcode, args)
+}
+
+// newRequest sends a request creating a new object, and registers h to
+// handle its events. The newID{} argument is replaced by the id of the new
+// object, which is returned.
+// The id is allocated and sent while holding writeMu, so concurrent callers
+// can't send their ids out of order.
+func (c *conn) newRequest(h eventHandler, id uint32, opcode uint16, args ...interface{}) (uint32, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	objectID := c.nextID
+	c.nextID++
+	c.setHandler(objectID, h)
+
+	args = slices.Clone(args)
+	for i, arg := range args {
+		if _, ok := arg.(newID); ok {
+			args[i] = objectID
+		}
+	}
+	return objectID, c.write(id, opcode, args)
+}
+
+// write encodes and writes a request.
+// c.writeMu must be held.
+func (c *conn) write(id uint32, opcode uint16, args []interface{}) error {
+	var body bytes.Buffer
+	for _, arg := range args {
+		switch v := arg.(type) {
+		case uint32, int32, fixed:
+			binary.Write(&body, binary.NativeEndian, v)
+		case string:
+			// strings are NUL-terminated, prefixed with their length
+			// (including the NUL byte), and padded to 32 bits.
+			binary.Write(&body, binary.NativeEndian, uint32(len(v)+1))
+			body.WriteString(v)
+			body.Write(make([]byte, 4-len(v)%4))
+		default:
+			return fmt.Errorf("unsupported argument type %T", arg)
+		}
+	}
+
+	var msg bytes.Buffer
+	binary.Write(&msg, binary.NativeEndian, id)
+	binary.Write(&msg, binary.NativeEndian, uint32(8+body.Len())<<16|uint32(opcode))
+	msg.Write(body.Bytes())
+
+	if _, err := c.c.Write(msg.Bytes()); err != nil {
+		return fmt.Errorf("unable to write request: %w", err)
+	}
+	return nil
+}
+
+// dispatch reads a single event and passes it to the handler of the object it
+// was sent to.
+func (c *conn) dispatch() error {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(c.c, header); err != nil {
+		return fmt.Errorf("unable to read event header: %w", err)
+	}
+	id := binary.NativeEndian.Uint32(header)
+	sizeOpcode := binary.NativeEndian.Uint32(header[4:])
+	size := sizeOpcode >> 16
+	opcode := uint16(sizeOpcode & 0xffff)
+	if size < 8 {
+		return fmt.Errorf("invalid event size %v", size)
+	}
+
+	body := make([]byte, size-8)
+	if _, err := io.ReadFull(c.c, body); err != nil {
+		return fmt.Errorf("unable to read event body: %w", err)
+	}
+
+	c.mu.Lock()
+	h, ok := c.handlers[id]
+	c.mu.Unlock()
+	if !ok {
+		// events for objects we already destroyed can still be in flight.
+		return nil
+	}
+
+	return h(opcode, &argReader{b: body})
+}
+
+// argReader decodes the arguments of an event.
+type argReader struct {
+	b   []byte
+	err error
+}
+
+func (r *argReader) Uint() uint32 {
+	if len(r.b) < 4 {
+		r.err = fmt.Errorf("event too short")
+		return 0
+	}
+	v := binary.NativeEndian.Uint32(r.b)
+	r.b = r.b[4:]
+	return v
+}
+
+func (r *argReader) Int() int32 {
+	return int32(r.Uint())
+}
+
+func (r *argReader) Fixed() fixed {
+	return fixed(r.Uint())
+}
+
+func (r *argReader) String() string {
+	length := int(r.Uint())
+	padded := (length + 3) &^ 3
+	if len(r.b) < padded {
+		r.err = fmt.Errorf("event too short")
+		return ""
+	}
+	s := r.b[:length]
+	r.b = r.b[padded:]
+	// strip the terminating NUL byte
+	return string(bytes.TrimSuffix(s, []byte{0}))
+}
+
+// Err returns the first error encountered while decoding arguments.
+func (r *argReader) Err() error {
+	return r.err
+}
@@ -0,0 +1,283 @@
+package scenario
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/flokli/display-agent/outputs"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// how long to wait for the first window of a process to appear
+	placeTimeout = 30 * time.Second
+	// how often to look for it
+	placeInterval = 250 * time.Millisecond
+)
+
+// Window is a window, as reported by the display server.
+type Window struct {
+	// identifies the window to the display server
+	ID string
+	// the process the window belongs to, 0 if unknown
+	Pid int
+}
+
+// Placer moves windows to outputs. It's implemented by backends.
+//
+// The windows of a process open wherever the display server puts new windows,
+// usually on the focused output, which might change while the process starts.
+// Instead of focusing the output before launching, the windows are moved
+// once they appear.
+type Placer interface {
+	// Windows returns all current windows.
+	Windows() ([]Window, error)
+	// Place moves a window to the output with the given name.
+	Place(w Window, outputName string) error
+	// Clear closes all windows shown on the output with the given name.
+	Clear(outputName string) error
+}
+
+// Launcher starts the processes of scenarios, at most one per output.
+// Processes are started by the agent itself, in the environment of the agent
+// (which needs to contain WAYLAND_DISPLAY or DISPLAY), extended by Env.
+type Launcher struct {
+	// additional environment variables, in the form key=value.
+	Env []string
+
+	// If set, the windows of launched processes are moved to their outputs.
+	placer Placer
+
+	mu sync.Mutex
+	// the running processes, keyed by output name
+	cmds map[string]*exec.Cmd
+	// outputs whose process exited on its own
+	exited map[string]bool
+}
+
+// NewLauncher returns a launcher moving the windows of the processes it
+// launches with placer, unless it's nil.
+func NewLauncher(placer Placer, env ...string) *Launcher {
+	return &Launcher{
+		Env:    env,
+		placer: placer,
+		cmds:   make(map[string]*exec.Cmd),
+		exited: make(map[string]bool),
+	}
+}
+
+// Show clears the output, and launches the scenario with the given name and
+// args on it. It returns the scenario now shown.
+func (l *Launcher) Show(outputName string, name string, args []string) (*outputs.Scenario, error) {
+	argv, err := Command(name, args)
+	if err != nil {
+		return nil, err
+	}
+
+	if l.placer != nil {
+		if err := l.placer.Clear(outputName); err != nil {
+			return nil, fmt.Errorf("unable to clear output: %w", err)
+		}
+	}
+	if err := l.Launch(outputName, argv); err != nil {
+		return nil, err
+	}
+
+	return &outputs.Scenario{
+		Name: name,
+		Args: args,
+	}, nil
+}
+
+// Launch stops the process previously launched on the output, and starts
+// argv, with ProfilePlaceholder replaced by the profile directory of the
+// output. If argv is empty, only the previous process is stopped.
+func (l *Launcher) Launch(outputName string, argv []string) error {
+	l.Stop(outputName)
+	if len(argv) == 0 {
+		return nil
+	}
+
+	argv, err := withProfile(argv, outputName)
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Env = append(os.Environ(), l.Env...)
+	// in a process group of its own, so children are stopped too.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("unable to launch %v: %w", argv[0], err)
+	}
+
+	lg := log.WithFields(log.Fields{
+		"outputName": outputName,
+		"argv":       argv,
+		"pid":        cmd.Process.Pid,
+	})
+	lg.Info("launched")
+
+	l.mu.Lock()
+	l.cmds[outputName] = cmd
+	l.mu.Unlock()
+
+	if l.placer != nil {
+		go l.place(outputName, cmd)
+	}
+
+	go func() {
+		err := cmd.Wait()
+		lg.WithError(err).Info("exited")
+
+		l.mu.Lock()
+		// otherwise, it was stopped, or replaced.
+		if l.cmds[outputName] == cmd {
+			delete(l.cmds, outputName)
+			// exiting successfully is expected, for example from browsers
+			// handing the URL to an instance running already.
+			if err != nil {
+				l.exited[outputName] = true
+			}
+		}
+		l.mu.Unlock()
+	}()
+
+	return nil
+}
+
+// withProfile returns argv, with ProfilePlaceholder replaced by the profile
+// directory of the output, which is created if needed.
+func withProfile(argv []string, outputName string) ([]string, error) {
+	usesProfile := false
+	for _, arg := range argv {
+		if strings.Contains(arg, ProfilePlaceholder) {
+			usesProfile = true
+		}
+	}
+	if !usesProfile {
+		return argv, nil
+	}
+
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return nil, fmt.Errorf("unable to locate profile directory: %w", err)
+	}
+	dir := filepath.Join(cacheDir, "display-agent", "profiles", strings.ReplaceAll(outputName, "/", "_"))
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("unable to create profile directory: %w", err)
+	}
+
+	withProfile := make([]string, len(argv))
+	for i, arg := range argv {
+		withProfile[i] = strings.ReplaceAll(arg, ProfilePlaceholder, dir)
+	}
+	return withProfile, nil
+}
+
+// place moves the windows of cmd to its output, once the first of them
+// appeared, or gives up after placeTimeout.
+// Windows belong to cmd if their process is in its process group, so windows
+// of processes handing over to another one, which was running already, are
+// never found.
+func (l *Launcher) place(outputName string, cmd *exec.Cmd) {
+	lg := log.WithFields(log.Fields{
+		"outputName": outputName,
+		"pid":        cmd.Process.Pid,
+	})
+
+	for deadline := time.Now().Add(placeTimeout); time.Now().Before(deadline); time.Sleep(placeInterval) {
+		l.mu.Lock()
+		current := l.cmds[outputName] == cmd
+		l.mu.Unlock()
+		if !current {
+			return
+		}
+
+		windows, err := l.placer.Windows()
+		if err != nil {
+			lg.WithError(err).Warn("unable to list windows")
+			continue
+		}
+
+		placed := false
+		for _, w := range windows {
+			if !inProcessGroup(w.Pid, cmd.Process.Pid) {
+				continue
+			}
+			if err := l.placer.Place(w, outputName); err != nil {
+				lg.WithField("window", w.ID).WithError(err).Warn("unable to move window to output")
+				continue
+			}
+			lg.WithField("window", w.ID).Debug("moved window to output")
+			placed = true
+		}
+		if placed {
+			return
+		}
+	}
+	lg.Warn("no window appeared, not moving it to the output")
+}
+
+// inProcessGroup returns whether the process with the given pid is in the
+// process group pgid.
+func inProcessGroup(pid int, pgid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	if pid == pgid {
+		return true
+	}
+	g, err := syscall.Getpgid(pid)
+	return err == nil && g == pgid
+}
+
+// Stop stops the process launched on the output, if any.
+func (l *Launcher) Stop(outputName string) {
+	l.mu.Lock()
+	cmd, ok := l.cmds[outputName]
+	delete(l.cmds, outputName)
+	delete(l.exited, outputName)
+	l.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	// signal the whole process group.
+	if err := syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM); err != nil {
+		log.WithField("outputName", outputName).WithError(err).Warn("unable to stop process")
+	}
+}
+
+// Exited returns whether the process launched on the output exited
+// unexpectedly, with a non-zero status or by a signal (for example, because
+// it crashed), and forgets about it, so it's only reported once.
+func (l *Launcher) Exited(outputName string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	exited := l.exited[outputName]
+	delete(l.exited, outputName)
+	return exited
+}
+
+// StopAll stops all processes launched.
+func (l *Launcher) StopAll() {
+	l.mu.Lock()
+	outputNames := make([]string, 0, len(l.cmds))
+	for outputName := range l.cmds {
+		outputNames = append(outputNames, outputName)
+	}
+	l.mu.Unlock()
+
+	for _, outputName := range outputNames {
+		l.Stop(outputName)
+	}
+}
@@ -0,0 +1,184 @@
+package scenario
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakePlacer reports a window for every process launched, and one of an
+// unrelated process.
+type fakePlacer struct {
+	l *Launcher
+
+	mu      sync.Mutex
+	cleared []string
+	// window ids, by the output they were moved to
+	placed map[string][]string
+}
+
+func (p *fakePlacer) Windows() ([]Window, error) {
+	windows := []Window{{ID: "agent", Pid: os.Getpid()}}
+
+	p.l.mu.Lock()
+	defer p.l.mu.Unlock()
+	for outputName, cmd := range p.l.cmds {
+		windows = append(windows, Window{ID: outputName, Pid: cmd.Process.Pid})
+	}
+	return windows, nil
+}
+
+func (p *fakePlacer) Place(w Window, outputName string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.placed[outputName] = append(p.placed[outputName], w.ID)
+	return nil
+}
+
+func (p *fakePlacer) Clear(outputName string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.cleared = append(p.cleared, outputName)
+	return nil
+}
+
+func (p *fakePlacer) Placed(outputName string) []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.placed[outputName]
+}
+
+func newTestLauncher(t *testing.T) (*Launcher, *fakePlacer) {
+	p := &fakePlacer{placed: make(map[string][]string)}
+	l := NewLauncher(p)
+	p.l = l
+	t.Cleanup(l.StopAll)
+	return l, p
+}
+
+func TestShow(t *testing.T) {
+	if err := Define("sleep", &Definition{Command: []string{"sleep", "60"}}); err != nil {
+		t.Fatalf("unable to define scenario: %v", err)
+	}
+	l, p := newTestLauncher(t)
+
+	sc, err := l.Show("HDMI-A-1", "sleep", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if sc.Name != "sleep" {
+		t.Errorf("unexpected scenario %v", sc)
+	}
+	if !reflect.DeepEqual(p.cleared, []string{"HDMI-A-1"}) {
+		t.Errorf("expected the output to be cleared, got %q", p.cleared)
+	}
+
+	// only the window of the process launched is moved.
+	deadline := time.Now().Add(5 * time.Second)
+	for len(p.Placed("HDMI-A-1")) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if placed := p.Placed("HDMI-A-1"); !reflect.DeepEqual(placed, []string{"HDMI-A-1"}) {
+		t.Errorf("expected the window of the process to be moved, got %q", placed)
+	}
+
+	if _, err := l.Show("HDMI-A-1", "sleep", []string{"60"}); err == nil {
+		t.Error("expected an error for unexpected args")
+	}
+}
+
+func TestLaunchProfile(t *testing.T) {
+	cacheDir := t.TempDir()
+	t.Setenv("XDG_CACHE_HOME", cacheDir)
+	l := NewLauncher(nil)
+	t.Cleanup(l.StopAll)
+
+	// the profile is passed to sh as $0, which it ignores, unlike sleep.
+	if err := l.Launch("DP-1", []string{"sh", "-c", "sleep 60", ProfilePlaceholder}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	l.mu.Lock()
+	cmd := l.cmds["DP-1"]
+	l.mu.Unlock()
+	if cmd == nil {
+		t.Fatal("expected the process to be running")
+	}
+
+	dir := filepath.Join(cacheDir, "display-agent", "profiles", "DP-1")
+	if expected := []string{"sh", "-c", "sleep 60", dir}; !reflect.DeepEqual(cmd.Args, expected) {
+		t.Errorf("expected %q, got %q", expected, cmd.Args)
+	}
+	if _, err := os.Stat(dir); err != nil {
+		t.Errorf("expected the profile directory to be created: %v", err)
+	}
+}
+
+func TestInProcessGroup(t *testing.T) {
+	l := NewLauncher(nil)
+	t.Cleanup(l.StopAll)
+	if err := l.Launch("DP-1", []string{"sleep", "60"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	l.mu.Lock()
+	pid := l.cmds["DP-1"].Process.Pid
+	l.mu.Unlock()
+
+	if !inProcessGroup(pid, pid) {
+		t.Errorf("expected %v to be in its own process group", pid)
+	}
+	if inProcessGroup(os.Getpid(), pid) {
+		t.Errorf("expected the agent not to be in the process group %v", pid)
+	}
+	if inProcessGroup(0, pid) {
+		t.Error("expected an unknown pid not to be in any process group")
+	}
+}
+
+func TestExited(t *testing.T) {
+	for _, tc := range []struct {
+		argv     []string
+		expected bool
+	}{
+		{[]string{"true"}, false},
+		{[]string{"false"}, true},
+		{[]string{"sh", "-c", "kill -KILL $$"}, true},
+	} {
+		l := NewLauncher(nil)
+		if err := l.Launch("DP-1", tc.argv); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		deadline := time.Now().Add(5 * time.Second)
+		for running(l, "DP-1") && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if exited := l.Exited("DP-1"); exited != tc.expected {
+			t.Errorf("%q: expected Exited to return %v, got %v", tc.argv, tc.expected, exited)
+		}
+		if l.Exited("DP-1") {
+			t.Errorf("%q: expected the exit to be reported once", tc.argv)
+		}
+	}
+
+	// processes stopped by the agent didn't exit on their own.
+	l := NewLauncher(nil)
+	if err := l.Launch("DP-1", []string{"sleep", "60"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	l.Stop("DP-1")
+	time.Sleep(100 * time.Millisecond)
+	if l.Exited("DP-1") {
+		t.Error("expected a stopped process not to be reported as exited")
+	}
+}
+
+func running(l *Launcher, outputName string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, ok := l.cmds[outputName]
+	return ok
+}
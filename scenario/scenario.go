@@ -0,0 +1,196 @@
+// Package scenario turns scenarios into the commands launched for them, and
+// launches them.
+// Commands are always passed as argv, and never go through a shell, so
+// arguments can't inject other commands.
+package scenario
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/flokli/display-agent/outputs"
+)
+
+// Names of the built-in scenarios.
+const (
+	// nothing is shown
+	Blank = "blank"
+	// a website, shown in a browser
+	URL = "url"
+	// a video or stream, played in a loop
+	Video = "video"
+)
+
+// URLPlaceholder is replaced by the URL passed to a scenario, in every
+// element of its Command.
+const URLPlaceholder = "{url}"
+
+// ProfilePlaceholder is replaced by a directory of the output the scenario is
+// launched on, in every element of its Command. Browsers keep their profile
+// there, so every output gets its own browser process.
+const ProfilePlaceholder = "{profile}"
+
+// Definition describes how to launch a scenario.
+type Definition struct {
+	// The argv to launch, nothing is launched if empty.
+	// Each element stays a single argument, even if the URL contains
+	// whitespace. Never pass the URL to a shell, it's not escaped for one.
+	Command []string
+	// URL schemes accepted as the (only) argument.
+	// Scenarios without schemes don't accept any arguments.
+	Schemes []string
+}
+
+var definitions = map[string]*Definition{
+	Blank: {},
+	URL: {
+		// a single argument, chromium doesn't parse anything after the =.
+		// Without a profile of its own, chromium hands the URL over to a
+		// chromium running already, and its window can't be found.
+		Command: []string{"chromium", "--ozone-platform-hint=auto", "--user-data-dir=" + ProfilePlaceholder, "--app=" + URLPlaceholder},
+		Schemes: []string{"http", "https"},
+	},
+	Video: {
+		// -- ensures the URL is never parsed as an option.
+		Command: []string{"mpv", "--loop", "--", URLPlaceholder},
+		Schemes: []string{"http", "https", "rtsp", "rtmp", "srt"},
+	},
+}
+
+// Validate checks the definition launches something if it takes a URL, and
+// uses the URL if it takes one.
+func (d *Definition) Validate() error {
+	usesURL := false
+	for _, arg := range d.Command {
+		if strings.Contains(arg, URLPlaceholder) {
+			usesURL = true
+		}
+	}
+
+	switch {
+	case len(d.Schemes) != 0 && len(d.Command) == 0:
+		return fmt.Errorf("schemes are set, but there's no command")
+	case len(d.Schemes) != 0 && !usesURL:
+		return fmt.Errorf("schemes are set, but the command doesn't contain %v", URLPlaceholder)
+	case len(d.Schemes) == 0 && usesURL:
+		return fmt.Errorf("the command contains %v, but no schemes are set", URLPlaceholder)
+	case len(d.Command) != 0 && strings.Contains(d.Command[0], URLPlaceholder):
+		return fmt.Errorf("the program to launch can't be %v", URLPlaceholder)
+	case len(d.Command) != 0 && strings.Contains(d.Command[0], ProfilePlaceholder):
+		return fmt.Errorf("the program to launch can't be %v", ProfilePlaceholder)
+	}
+	return nil
+}
+
+// Argv validates the arguments, and returns the argv to launch for them, or
+// nil if nothing needs to be launched.
+func (d *Definition) Argv(args []string) ([]string, error) {
+	if len(d.Schemes) == 0 {
+		if len(args) != 0 {
+			return nil, fmt.Errorf("%w: scenario doesn't take arguments", outputs.ErrInvalid)
+		}
+		if len(d.Command) == 0 {
+			return nil, nil
+		}
+		return append([]string(nil), d.Command...), nil
+	}
+
+	if len(args) != 1 {
+		return nil, fmt.Errorf("%w: scenario needs exactly 1 argument", outputs.ErrInvalid)
+	}
+	u, err := parseURL(args[0], d.Schemes)
+	if err != nil {
+		return nil, err
+	}
+
+	// it's replaced after the URL, by the launcher.
+	if strings.Contains(u.String(), ProfilePlaceholder) {
+		return nil, fmt.Errorf("%w URL %q: contains %v", outputs.ErrInvalid, args[0], ProfilePlaceholder)
+	}
+
+	argv := make([]string, len(d.Command))
+	for i, arg := range d.Command {
+		argv[i] = strings.ReplaceAll(arg, URLPlaceholder, u.String())
+	}
+	return argv, nil
+}
+
+// Define adds a scenario, or replaces a built-in one.
+// It's not safe to call concurrently with the other functions, so call it
+// before starting any backend.
+func Define(name string, d *Definition) error {
+	if name == "" {
+		return fmt.Errorf("empty scenario name")
+	}
+	if err := d.Validate(); err != nil {
+		return fmt.Errorf("invalid scenario %v: %w", name, err)
+	}
+	definitions[name] = d
+	return nil
+}
+
+// Lookup returns the definition of a scenario.
+func Lookup(name string) (*Definition, bool) {
+	d, ok := definitions[name]
+	return d, ok
+}
+
+// Names returns the names of all scenarios, sorted.
+func Names() []string {
+	names := make([]string, 0, len(definitions))
+	for name := range definitions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Command validates the arguments of a scenario, and returns the argv to
+// launch for it, or nil if nothing needs to be launched.
+func Command(name string, args []string) ([]string, error) {
+	d, ok := definitions[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown scenario %q", outputs.ErrInvalid, name)
+	}
+
+	argv, err := d.Argv(args)
+	if err != nil {
+		return nil, fmt.Errorf("scenario %v: %w", name, err)
+	}
+	return argv, nil
+}
+
+// NewBlank returns the scenario of outputs nothing is shown on, which is
+// the one of new outputs, and of ones whose process exited.
+func NewBlank() *outputs.Scenario {
+	return &outputs.Scenario{
+		Name: Blank,
+		Args: []string{},
+	}
+}
+
+// parseURL parses an absolute URL with one of the given schemes, and a host.
+func parseURL(s string, schemes []string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("%w URL: %v", outputs.ErrInvalid, err)
+	}
+
+	schemeAllowed := false
+	for _, scheme := range schemes {
+		if u.Scheme == scheme {
+			schemeAllowed = true
+			break
+		}
+	}
+	if !schemeAllowed {
+		return nil, fmt.Errorf("%w URL scheme %q, allowed: %v", outputs.ErrInvalid, u.Scheme, schemes)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("%w URL %q: missing host", outputs.ErrInvalid, s)
+	}
+
+	return u, nil
+}
@@ -0,0 +1,151 @@
+package scenario
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/flokli/display-agent/outputs"
+)
+
+// Commands are never passed to a shell, so shell syntax in URLs stays part of
+// a single argument, and URLs can't be parsed as options.
+func TestCommand(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		scenario string
+		args     []string
+		// the argv expected, nil if an error is expected
+		expected []string
+	}{
+		{
+			name:     "url",
+			scenario: URL,
+			args:     []string{"https://example.com/"},
+			expected: []string{"chromium", "--ozone-platform-hint=auto", "--user-data-dir={profile}", "--app=https://example.com/"},
+		},
+		{
+			name:     "semicolon",
+			scenario: URL,
+			args:     []string{"https://example.com/;reboot"},
+			expected: []string{"chromium", "--ozone-platform-hint=auto", "--user-data-dir={profile}", "--app=https://example.com/;reboot"},
+		},
+		{
+			name:     "command substitution",
+			scenario: URL,
+			args:     []string{"https://example.com/?q=$(reboot)"},
+			expected: []string{"chromium", "--ozone-platform-hint=auto", "--user-data-dir={profile}", "--app=https://example.com/?q=$(reboot)"},
+		},
+		{
+			name:     "backticks",
+			scenario: URL,
+			args:     []string{"https://example.com/`reboot`"},
+			expected: []string{"chromium", "--ozone-platform-hint=auto", "--user-data-dir={profile}", "--app=https://example.com/%60reboot%60"},
+		},
+		{
+			name:     "spaces",
+			scenario: Video,
+			args:     []string{"https://example.com/a video.mp4"},
+			expected: []string{"mpv", "--loop", "--", "https://example.com/a%20video.mp4"},
+		},
+		{
+			name:     "leading dash",
+			scenario: Video,
+			args:     []string{"--script=/tmp/evil.lua"},
+		},
+		{
+			name:     "leading dash before scheme",
+			scenario: URL,
+			args:     []string{"-https://example.com/"},
+		},
+		{
+			name:     "javascript scheme",
+			scenario: URL,
+			args:     []string{"javascript:alert(1)"},
+		},
+		{
+			name:     "file scheme",
+			scenario: Video,
+			args:     []string{"file:///etc/passwd"},
+		},
+		{
+			name:     "empty host",
+			scenario: URL,
+			args:     []string{"https:///etc/passwd"},
+		},
+		{
+			name:     "profile placeholder",
+			scenario: URL,
+			args:     []string{"https://example.com/?dir={profile}"},
+		},
+		{
+			name:     "missing arg",
+			scenario: URL,
+		},
+		{
+			name:     "too many args",
+			scenario: URL,
+			args:     []string{"https://example.com/", "https://example.org/"},
+		},
+		{
+			name:     "blank",
+			scenario: Blank,
+		},
+		{
+			name:     "blank with args",
+			scenario: Blank,
+			args:     []string{"https://example.com/"},
+		},
+		{
+			name:     "unknown scenario",
+			scenario: "shell",
+			args:     []string{"reboot"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			argv, err := Command(tc.scenario, tc.args)
+			if tc.expected == nil {
+				if tc.scenario == Blank && len(tc.args) == 0 {
+					if err != nil || argv != nil {
+						t.Errorf("expected nothing to be launched, got %q, %v", argv, err)
+					}
+					return
+				}
+				if !errors.Is(err, outputs.ErrInvalid) {
+					t.Errorf("expected an invalid value error, got %q, %v", argv, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(argv, tc.expected) {
+				t.Errorf("expected %q, got %q", tc.expected, argv)
+			}
+		})
+	}
+}
+
+func TestDefinitionValidate(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		d     Definition
+		valid bool
+	}{
+		{"nothing", Definition{}, true},
+		{"fixed command", Definition{Command: []string{"firefox", "--kiosk", "https://example.com"}}, true},
+		{"url", Definition{Command: []string{"firefox", URLPlaceholder}, Schemes: []string{"https"}}, true},
+		{"profile", Definition{Command: []string{"firefox", "--profile", ProfilePlaceholder}}, true},
+		{"schemes without command", Definition{Schemes: []string{"https"}}, false},
+		{"schemes without url", Definition{Command: []string{"firefox"}, Schemes: []string{"https"}}, false},
+		{"url without schemes", Definition{Command: []string{"firefox", URLPlaceholder}}, false},
+		{"url as program", Definition{Command: []string{URLPlaceholder}, Schemes: []string{"https"}}, false},
+		{"profile as program", Definition{Command: []string{ProfilePlaceholder + "/firefox"}}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.d.Validate(); (err == nil) != tc.valid {
+				t.Errorf("expected valid to be %v, got %v", tc.valid, err)
+			}
+		})
+	}
+}
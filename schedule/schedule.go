@@ -0,0 +1,178 @@
+// Package schedule describes states applied to outputs at given times, and
+// evaluates when they apply.
+// Times are described by cron expressions, see
+// https://pkg.go.dev/github.com/robfig/cron/v3 for the exact syntax.
+package schedule
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/flokli/display-agent/outputs"
+	"github.com/robfig/cron/v3"
+)
+
+// Schedule is a list of entries, evaluated in a time zone.
+type Schedule struct {
+	// IANA name of the time zone, the local one if empty
+	TimeZone string   `json:"time_zone,omitempty" toml:"time_zone"`
+	Entries  []*Entry `json:"entries" toml:"entries"`
+}
+
+// Entry applies State to outputs whenever Cron matches.
+type Entry struct {
+	// unique within the schedule, used in logs and the published status
+	Name string `json:"name" toml:"name"`
+	// A cron expression with five fields (minute, hour, day of month, month,
+	// day of week), or a descriptor like @daily. If prefixed with
+	// CRON_TZ=$timeZone, it's evaluated in that time zone instead of the one of
+	// the schedule.
+	Cron string `json:"cron" toml:"cron"`
+	// Outputs matching any of these are changed, all if empty.
+	Outputs []outputs.Match `json:"outputs,omitempty" toml:"outputs"`
+	// the (sparse) state applied
+	State outputs.State `json:"state" toml:"state"`
+}
+
+// Matches returns whether the entry applies to the output with the given info.
+func (e *Entry) Matches(info *outputs.Info) bool {
+	if len(e.Outputs) == 0 {
+		return true
+	}
+	for _, m := range e.Outputs {
+		if m.Matches(info) {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks the time zone and all entries.
+func (s *Schedule) Validate() error {
+	_, err := Compile(s)
+	return err
+}
+
+// Plan is a compiled schedule.
+type Plan struct {
+	Schedule *Schedule
+	// the parsed cron expressions of all entries
+	crons []cron.Schedule
+}
+
+// Compile validates the schedule, and parses all cron expressions.
+func Compile(s *Schedule) (*Plan, error) {
+	if s.TimeZone != "" {
+		if _, err := time.LoadLocation(s.TimeZone); err != nil {
+			return nil, fmt.Errorf("invalid time zone: %w", err)
+		}
+	}
+
+	p := &Plan{Schedule: s}
+	names := make(map[string]bool)
+	for i, e := range s.Entries {
+		if e == nil {
+			return nil, fmt.Errorf("entry %v is empty", i)
+		}
+		if e.Name == "" {
+			return nil, fmt.Errorf("entry %v has no name", i)
+		}
+		if names[e.Name] {
+			return nil, fmt.Errorf("duplicate entry %q", e.Name)
+		}
+		names[e.Name] = true
+
+		c, err := s.parse(e.Cron)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cron expression of entry %v: %w", e.Name, err)
+		}
+		p.crons = append(p.crons, c)
+
+		for _, m := range e.Outputs {
+			if err := m.Validate(); err != nil {
+				return nil, fmt.Errorf("invalid match in entry %v: %w", e.Name, err)
+			}
+		}
+		if e.State == (outputs.State{}) {
+			return nil, fmt.Errorf("entry %v doesn't change anything", e.Name)
+		}
+		if err := e.State.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid state of entry %v: %w", e.Name, err)
+		}
+	}
+	return p, nil
+}
+
+// parse parses a cron expression, in the time zone of the schedule unless it
+// sets its own.
+func (s *Schedule) parse(spec string) (cron.Schedule, error) {
+	if s.TimeZone != "" && !strings.HasPrefix(spec, "CRON_TZ=") && !strings.HasPrefix(spec, "TZ=") {
+		spec = "CRON_TZ=" + s.TimeZone + " " + spec
+	}
+	c, err := cron.ParseStandard(spec)
+	if err != nil {
+		return nil, err
+	}
+	// it only fires relative to when it was started, so it never was active
+	// after restarting.
+	if _, ok := c.(cron.ConstantDelaySchedule); ok {
+		return nil, fmt.Errorf("@every isn't supported")
+	}
+	if c.Next(time.Now()).IsZero() {
+		return nil, fmt.Errorf("%q never matches", spec)
+	}
+	return c, nil
+}
+
+// lookbacks are the windows searched for the last time an entry fired, from
+// the shortest to the longest, as cron expressions can only be evaluated
+// forwards. Expressions not matching at least every five years are never
+// found, they're rejected when parsing already.
+var lookbacks = []time.Duration{
+	time.Hour,
+	24 * time.Hour,
+	8 * 24 * time.Hour,
+	32 * 24 * time.Hour,
+	367 * 24 * time.Hour,
+	5 * 367 * 24 * time.Hour,
+}
+
+// Last returns, for every entry, the last time it fired at or before t, or
+// the zero time if it didn't.
+func (p *Plan) Last(t time.Time) []time.Time {
+	last := make([]time.Time, len(p.crons))
+	for i, c := range p.crons {
+		for _, lookback := range lookbacks {
+			for next := c.Next(t.Add(-lookback)); !next.IsZero() && !next.After(t); next = c.Next(next) {
+				last[i] = next
+			}
+			if !last[i].IsZero() {
+				break
+			}
+		}
+	}
+	return last
+}
+
+// Fire is an entry firing at a time.
+type Fire struct {
+	Entry *Entry
+	Time  time.Time
+}
+
+// Next returns the entry firing next after t, or nil if there's none.
+// If several fire at the same time, the first one is returned.
+func (p *Plan) Next(t time.Time) *Fire {
+	var next *Fire
+	for i, c := range p.crons {
+		n := c.Next(t)
+		if n.IsZero() {
+			continue
+		}
+		if next == nil || n.Before(next.Time) {
+			next = &Fire{Entry: p.Schedule.Entries[i], Time: n}
+		}
+	}
+	return next
+}
@@ -0,0 +1,176 @@
+package schedule
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/flokli/display-agent/outputs"
+)
+
+var off = false
+
+// mustLoadLocation loads the time zone with the given name, or skips the test
+// if the time zone database isn't available.
+func mustLoadLocation(t *testing.T, name string) *time.Location {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Skipf("time zone %v not available: %v", name, err)
+	}
+	return loc
+}
+
+func TestCompileRejected(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		schedule *Schedule
+		err      string
+	}{
+		{"invalid time zone", &Schedule{TimeZone: "Mars/Olympus_Mons", Entries: []*Entry{
+			{Name: "night", Cron: "0 22 * * *", State: outputs.State{Power: &off}},
+		}}, "invalid time zone"},
+		{"empty entry", &Schedule{Entries: []*Entry{nil}}, "entry 0 is empty"},
+		{"no name", &Schedule{Entries: []*Entry{
+			{Cron: "0 22 * * *", State: outputs.State{Power: &off}},
+		}}, "has no name"},
+		{"duplicate name", &Schedule{Entries: []*Entry{
+			{Name: "night", Cron: "0 22 * * *", State: outputs.State{Power: &off}},
+			{Name: "night", Cron: "0 23 * * *", State: outputs.State{Power: &off}},
+		}}, `duplicate entry "night"`},
+		{"invalid cron", &Schedule{Entries: []*Entry{
+			{Name: "night", Cron: "0 25 * * *", State: outputs.State{Power: &off}},
+		}}, "invalid cron expression"},
+		{"invalid own time zone", &Schedule{Entries: []*Entry{
+			{Name: "night", Cron: "CRON_TZ=Mars/Olympus_Mons 0 22 * * *", State: outputs.State{Power: &off}},
+		}}, "invalid cron expression"},
+		{"every", &Schedule{Entries: []*Entry{
+			{Name: "night", Cron: "@every 1h", State: outputs.State{Power: &off}},
+		}}, "@every isn't supported"},
+		{"never matching", &Schedule{Entries: []*Entry{
+			{Name: "night", Cron: "0 0 30 2 *", State: outputs.State{Power: &off}},
+		}}, "never matches"},
+		{"invalid match", &Schedule{Entries: []*Entry{
+			{Name: "night", Cron: "0 22 * * *", Outputs: []outputs.Match{{}}, State: outputs.State{Power: &off}},
+		}}, "invalid match"},
+		{"empty state", &Schedule{Entries: []*Entry{
+			{Name: "night", Cron: "0 22 * * *"},
+		}}, "doesn't change anything"},
+	} {
+		_, err := Compile(tc.schedule)
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%v: expected an error containing %q, got %v", tc.name, tc.err, err)
+		}
+	}
+}
+
+func TestLast(t *testing.T) {
+	berlin := mustLoadLocation(t, "Europe/Berlin")
+
+	for _, tc := range []struct {
+		name     string
+		timeZone string
+		cron     string
+		t        time.Time
+		expected time.Time
+	}{
+		{"just fired", "UTC", "0 22 * * *",
+			time.Date(2026, 3, 10, 22, 0, 0, 0, time.UTC),
+			time.Date(2026, 3, 10, 22, 0, 0, 0, time.UTC)},
+		{"hourly", "UTC", "15 * * * *",
+			time.Date(2026, 3, 10, 22, 5, 0, 0, time.UTC),
+			time.Date(2026, 3, 10, 21, 15, 0, 0, time.UTC)},
+		{"yesterday", "UTC", "0 22 * * *",
+			time.Date(2026, 3, 10, 21, 59, 0, 0, time.UTC),
+			time.Date(2026, 3, 9, 22, 0, 0, 0, time.UTC)},
+		{"last week", "UTC", "0 7 * * 1",
+			time.Date(2026, 3, 9, 6, 0, 0, 0, time.UTC),
+			time.Date(2026, 3, 2, 7, 0, 0, 0, time.UTC)},
+		{"last month", "UTC", "@monthly",
+			time.Date(2026, 3, 31, 23, 0, 0, 0, time.UTC),
+			time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)},
+		{"last year", "UTC", "0 0 24 12 *",
+			time.Date(2026, 12, 23, 0, 0, 0, 0, time.UTC),
+			time.Date(2025, 12, 24, 0, 0, 0, 0, time.UTC)},
+		{"leap day", "UTC", "0 0 29 2 *",
+			time.Date(2027, 3, 1, 0, 0, 0, 0, time.UTC),
+			time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		// the night to 2026-03-29 only has 23 hours in Berlin.
+		{"before the DST change", "Europe/Berlin", "0 7 * * *",
+			time.Date(2026, 3, 29, 6, 30, 0, 0, berlin),
+			time.Date(2026, 3, 28, 7, 0, 0, 0, berlin)},
+		{"after the DST change", "Europe/Berlin", "0 7 * * *",
+			time.Date(2026, 3, 29, 7, 30, 0, 0, berlin),
+			time.Date(2026, 3, 29, 7, 0, 0, 0, berlin)},
+		{"own time zone", "Europe/Berlin", "CRON_TZ=UTC 0 7 * * *",
+			time.Date(2026, 3, 29, 9, 30, 0, 0, berlin),
+			time.Date(2026, 3, 29, 7, 0, 0, 0, time.UTC)},
+		{"own time zone without CRON_", "Europe/Berlin", "TZ=UTC 0 7 * * *",
+			time.Date(2026, 3, 29, 9, 30, 0, 0, berlin),
+			time.Date(2026, 3, 29, 7, 0, 0, 0, time.UTC)},
+	} {
+		p, err := Compile(&Schedule{TimeZone: tc.timeZone, Entries: []*Entry{
+			{Name: "entry", Cron: tc.cron, State: outputs.State{Power: &off}},
+		}})
+		if err != nil {
+			t.Fatalf("%v: unexpected error: %v", tc.name, err)
+		}
+		if last := p.Last(tc.t)[0]; !last.Equal(tc.expected) {
+			t.Errorf("%v: expected %v, got %v", tc.name, tc.expected, last)
+		}
+	}
+}
+
+// Entries which fired longer ago than the longest lookback are reported as
+// not fired.
+func TestLastNotFound(t *testing.T) {
+	p, err := Compile(&Schedule{TimeZone: "UTC", Entries: []*Entry{
+		{Name: "night", Cron: "0 22 * * *", State: outputs.State{Power: &off}},
+		{Name: "leap day", Cron: "0 0 29 2 *", State: outputs.State{Power: &off}},
+	}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// 2100 isn't a leap year, the last leap day was 2096-02-29.
+	last := p.Last(time.Date(2103, 3, 1, 0, 0, 0, 0, time.UTC))
+	if !last[0].Equal(time.Date(2103, 2, 28, 22, 0, 0, 0, time.UTC)) || !last[1].IsZero() {
+		t.Errorf("unexpected last times %v", last)
+	}
+}
+
+func TestNext(t *testing.T) {
+	p, err := Compile(&Schedule{TimeZone: "UTC", Entries: []*Entry{
+		{Name: "night", Cron: "0 22 * * *", State: outputs.State{Power: &off}},
+		{Name: "morning", Cron: "0 7 * * *", State: outputs.State{Power: &off}},
+		{Name: "also morning", Cron: "0 7 * * *", State: outputs.State{Power: &off}},
+	}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, tc := range []struct {
+		t        time.Time
+		entry    string
+		expected time.Time
+	}{
+		{time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC), "night", time.Date(2026, 3, 10, 22, 0, 0, 0, time.UTC)},
+		// entries firing at the same time are applied in order, the first
+		// one is returned.
+		{time.Date(2026, 3, 10, 23, 0, 0, 0, time.UTC), "morning", time.Date(2026, 3, 11, 7, 0, 0, 0, time.UTC)},
+		// strictly after t.
+		{time.Date(2026, 3, 10, 22, 0, 0, 0, time.UTC), "morning", time.Date(2026, 3, 11, 7, 0, 0, 0, time.UTC)},
+	} {
+		next := p.Next(tc.t)
+		if next == nil || next.Entry.Name != tc.entry || !next.Time.Equal(tc.expected) {
+			t.Errorf("expected %v at %v after %v, got %+v", tc.entry, tc.expected, tc.t, next)
+		}
+	}
+
+	empty, err := Compile(&Schedule{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if next := empty.Next(time.Now()); next != nil {
+		t.Errorf("expected nothing to fire, got %+v", next)
+	}
+}
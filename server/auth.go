@@ -0,0 +1,60 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/flokli/display-agent/auth"
+	"github.com/flokli/display-agent/mqtt"
+	log "github.com/sirupsen/logrus"
+)
+
+// rejectedResult is published for commands failing authentication, to the
+// result topic the command would have had.
+type rejectedResult struct {
+	// copied from the command, so the sender can tell which one was rejected
+	CorrelationID string `json:"correlation_id,omitempty"`
+	Success       bool   `json:"success"`
+	// human-readable description of why the command was rejected
+	Error string `json:"error"`
+}
+
+// authenticate returns the command received in m on topic.
+// If a Verifier is set, the command needs to be wrapped in an envelope signed
+// by one of its keys. Otherwise, the reason is logged and published to
+// resultTopic, and false is returned.
+func (s *Server) authenticate(m *mqtt.Message, topic string, resultTopic string, l *log.Entry) ([]byte, bool) {
+	if s.Verifier == nil {
+		return m.Payload, true
+	}
+
+	payload, key, err := s.Verifier.Verify(topic, m.Payload)
+	if err != nil {
+		l.WithError(err).Warn("rejected command")
+		s.publishResult(m, resultTopic, &rejectedResult{
+			CorrelationID: correlationID(m.Payload),
+			Error:         fmt.Sprintf("rejected command: %v", err),
+		}, l)
+		return nil, false
+	}
+
+	l.WithField("key", key.Name).Debug("authenticated command")
+	return payload, true
+}
+
+// correlationID returns the correlation id of the command in payload, which
+// might be wrapped in an envelope, or "" if it has none.
+// It isn't authenticated, it's only meant to be sent back.
+func correlationID(payload []byte) string {
+	var e auth.Envelope
+	if err := json.Unmarshal(payload, &e); err == nil && e.Payload != "" {
+		payload = []byte(e.Payload)
+	}
+	var cmd struct {
+		CorrelationID string `json:"correlation_id"`
+	}
+	if err := json.Unmarshal(payload, &cmd); err != nil {
+		return ""
+	}
+	return cmd.CorrelationID
+}
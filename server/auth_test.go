@@ -0,0 +1,137 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/flokli/display-agent/auth"
+	"github.com/flokli/display-agent/mqtt"
+	log "github.com/sirupsen/logrus"
+)
+
+// newTestVerifier returns a verifier accepting commands signed with the
+// returned key.
+func newTestVerifier(t *testing.T) (*auth.Verifier, ed25519.PrivateKey) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("unable to generate key: %v", err)
+	}
+	key, err := auth.ParseKey("ed25519:" + base64.StdEncoding.EncodeToString(pub))
+	if err != nil {
+		t.Fatalf("unable to parse key: %v", err)
+	}
+	return auth.NewVerifier([]*auth.Key{key}), priv
+}
+
+// Rejections are published to the result topic, never to the response topic
+// the (unsigned) message asks for.
+func TestAuthenticateRejected(t *testing.T) {
+	b := newFakeBroker()
+	s := New("machine", "screens", nil)
+	s.mqttClient = b
+	s.Verifier, _ = newTestVerifier(t)
+
+	m := &mqtt.Message{
+		Topic:         "screens/machine/set",
+		Payload:       []byte(`{"power": false}`),
+		ResponseTopic: "elsewhere",
+	}
+	if _, ok := s.authenticate(m, m.Topic, "screens/machine/result", log.NewEntry(log.StandardLogger())); ok {
+		t.Fatal("expected an unsigned command to be rejected")
+	}
+
+	if published := b.Published("elsewhere"); len(published) != 0 {
+		t.Errorf("expected nothing to be published to the response topic, got %q", published)
+	}
+	published := b.Published("screens/machine/result")
+	if len(published) != 1 || !strings.Contains(published[0], "unsigned command") {
+		t.Errorf("expected the rejection to be published to the result topic, got %q", published)
+	}
+}
+
+// Rejections carry the correlation id and data of the command, like results
+// of accepted ones.
+func TestAuthenticateRejectedCorrelation(t *testing.T) {
+	b := newFakeBroker()
+	s := New("machine", "screens", nil)
+	s.mqttClient = b
+	s.Verifier, _ = newTestVerifier(t)
+	_, otherKey := newTestVerifier(t)
+	l := log.NewEntry(log.StandardLogger())
+
+	command := []byte(`{"power": false, "correlation_id": "1"}`)
+	signed, err := auth.SignEd25519(otherKey, "screens/machine/set", command)
+	if err != nil {
+		t.Fatalf("unable to sign command: %v", err)
+	}
+
+	for _, payload := range [][]byte{command, signed, []byte("garbage")} {
+		m := &mqtt.Message{
+			Topic:           "screens/machine/set",
+			Payload:         payload,
+			CorrelationData: []byte("data"),
+		}
+		if _, ok := s.authenticate(m, m.Topic, "screens/machine/result", l); ok {
+			t.Fatalf("expected %s to be rejected", payload)
+		}
+
+		var result rejectedResult
+		published := b.Published("screens/machine/result")
+		if err := json.Unmarshal([]byte(published[len(published)-1]), &result); err != nil {
+			t.Fatalf("unable to parse result: %v", err)
+		}
+		expected := "1"
+		if string(payload) == "garbage" {
+			expected = ""
+		}
+		if result.Success || result.CorrelationID != expected {
+			t.Errorf("expected %s to be rejected with correlation id %q, got %+v", payload, expected, result)
+		}
+		if last := b.published[len(b.published)-1]; string(last.CorrelationData) != "data" {
+			t.Errorf("expected the correlation data to be sent back, got %q", last.CorrelationData)
+		}
+	}
+}
+
+// The response topic isn't signed, results of accepted commands are published
+// to the result topic as well.
+func TestAuthenticatedResponseTopic(t *testing.T) {
+	b := newFakeBroker()
+	s := New("machine", "screens", nil)
+	s.mqttClient = b
+	l := log.NewEntry(log.StandardLogger())
+
+	// without authentication, the response topic is used.
+	m := &mqtt.Message{
+		Topic:         "screens/machine/set",
+		Payload:       []byte(`{"power": false}`),
+		ResponseTopic: "elsewhere",
+	}
+	s.publishResult(m, "screens/machine/result", &setResult{Success: true}, l)
+	if published := b.Published("elsewhere"); len(published) != 1 {
+		t.Errorf("expected the result to be published to the response topic, got %q", published)
+	}
+
+	var priv ed25519.PrivateKey
+	s.Verifier, priv = newTestVerifier(t)
+	envelope, err := auth.SignEd25519(priv, m.Topic, m.Payload)
+	if err != nil {
+		t.Fatalf("unable to sign command: %v", err)
+	}
+	m.Payload = envelope
+	if _, ok := s.authenticate(m, m.Topic, "screens/machine/result", l); !ok {
+		t.Fatal("expected a signed command to be accepted")
+	}
+	s.publishResult(m, "screens/machine/result", &setResult{Success: true}, l)
+
+	if published := b.Published("elsewhere"); len(published) != 1 {
+		t.Errorf("expected nothing more to be published to the response topic, got %q", published)
+	}
+	if published := b.Published("screens/machine/result"); len(published) != 1 {
+		t.Errorf("expected the result to be published to the result topic, got %q", published)
+	}
+}
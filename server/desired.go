@@ -0,0 +1,197 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/flokli/display-agent/outputs"
+	log "github.com/sirupsen/logrus"
+)
+
+// The state set by commands is remembered per display, not per output, and
+// applied again whenever the display reappears (on whichever output), and, if
+// StateFile is set, after restarting.
+
+// displayKey identifies a display.
+type displayKey struct {
+	Make   string `json:"make"`
+	Model  string `json:"model"`
+	Serial string `json:"serial"`
+	// Displays without a serial can't be told apart, they're identified by
+	// the output they're connected to instead.
+	Output string `json:"output,omitempty"`
+}
+
+func getDisplayKey(info *outputs.Info) displayKey {
+	if !hasSerial(*info.Serial) {
+		return displayKey{
+			Make:   *info.Make,
+			Model:  *info.Model,
+			Output: *info.Name,
+		}
+	}
+	return displayKey{
+		Make:   *info.Make,
+		Model:  *info.Model,
+		Serial: *info.Serial,
+	}
+}
+
+// placeholderSerials are reported instead of a serial by display servers (or
+// displays) not knowing it, in lower case.
+var placeholderSerials = map[string]bool{
+	"":           true,
+	"unknown":    true,
+	"0":          true,
+	"0x00000000": true,
+}
+
+// hasSerial returns whether serial is an actual serial, which tells the
+// display apart from others of the same make and model.
+func hasSerial(serial string) bool {
+	return !placeholderSerials[strings.ToLower(strings.TrimSpace(serial))]
+}
+
+// desiredEntry is an entry of the state file.
+type desiredEntry struct {
+	displayKey
+	State *outputs.State `json:"state"`
+}
+
+// rememberDesired remembers the fields set in state as desired for the display
+// connected to output, and persists them.
+func (s *Server) rememberDesired(output outputs.Output, state *outputs.State) {
+	if *state == (outputs.State{}) {
+		return
+	}
+
+	key := getDisplayKey(output.GetInfo())
+
+	// the file is written while holding the lock, so writes don't overtake
+	// each other.
+	s.muDesired.Lock()
+	defer s.muDesired.Unlock()
+
+	if s.desired[key] == nil {
+		s.desired[key] = &outputs.State{}
+	}
+	mergeState(s.desired[key], state)
+	// the display is observed as desired once the command succeeded.
+	delete(s.reconcileStatus, key)
+
+	if err := s.saveDesired(); err != nil {
+		log.WithError(err).Error("unable to save desired state")
+	}
+}
+
+// restoreState applies the default scenario and the desired state of the
+// display connected to a new output.
+// It must not be called from handlers, as backends hold their locks while
+// calling them.
+func (s *Server) restoreState(output outputs.Output) {
+	info := output.GetInfo()
+	l := log.WithField("outputName", *info.Name)
+
+	var state outputs.State
+	if sc := s.outputConfig(output).Scenario; sc != nil {
+		state.Scenario = sc
+	}
+	s.muDesired.Lock()
+	if desired, ok := s.desired[getDisplayKey(info)]; ok {
+		mergeState(&state, desired)
+	}
+	s.muDesired.Unlock()
+
+	removeUnchanged(&state, output.GetState())
+	if state == (outputs.State{}) {
+		return
+	}
+
+	stateJSON, err := json.Marshal(&state)
+	if err != nil {
+		l.WithError(err).Error("unable to marshal state json")
+		return
+	}
+	l = l.WithField("state", string(stateJSON))
+
+	if _, err := output.SetState(&state); err != nil {
+		l.WithError(err).Error("unable to restore state")
+		return
+	}
+	l.Info("restored state")
+}
+
+// loadDesired reads the desired states from StateFile, if it exists.
+func (s *Server) loadDesired() error {
+	b, err := os.ReadFile(s.StateFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("unable to read state file: %w", err)
+	}
+
+	var entries []desiredEntry
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return fmt.Errorf("unable to parse state file: %w", err)
+	}
+
+	s.muDesired.Lock()
+	defer s.muDesired.Unlock()
+	for _, e := range entries {
+		if e.State != nil {
+			s.desired[e.displayKey] = e.State
+		}
+	}
+	return nil
+}
+
+// saveDesired writes all desired states to StateFile, if set.
+// muDesired needs to be held.
+func (s *Server) saveDesired() error {
+	if s.StateFile == "" {
+		return nil
+	}
+
+	entries := make([]desiredEntry, 0, len(s.desired))
+	for key, state := range s.desired {
+		entries = append(entries, desiredEntry{displayKey: key, State: state})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i].displayKey, entries[j].displayKey
+		if a.Make != b.Make {
+			return a.Make < b.Make
+		}
+		if a.Model != b.Model {
+			return a.Model < b.Model
+		}
+		if a.Serial != b.Serial {
+			return a.Serial < b.Serial
+		}
+		return a.Output < b.Output
+	})
+
+	b, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to marshal state file: %w", err)
+	}
+
+	if err := replaceFile(s.StateFile, b); err != nil {
+		return fmt.Errorf("unable to write state file: %w", err)
+	}
+	return nil
+}
+
+// replaceFile writes b to a temporary file first, and renames it to path, so
+// path is never truncated.
+func replaceFile(path string, b []byte) error {
+	tmpFile := path + ".tmp"
+	if err := os.WriteFile(tmpFile, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, path)
+}
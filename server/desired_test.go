@@ -0,0 +1,82 @@
+package server
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/flokli/display-agent/outputs"
+)
+
+func TestGetDisplayKey(t *testing.T) {
+	for _, tc := range []struct {
+		serial   string
+		expected displayKey
+	}{
+		{"CNK9280KND", displayKey{Make: "HP", Model: "L2245w", Serial: "CNK9280KND"}},
+		{"", displayKey{Make: "HP", Model: "L2245w", Output: "HDMI-A-1"}},
+		{"  ", displayKey{Make: "HP", Model: "L2245w", Output: "HDMI-A-1"}},
+		{"Unknown", displayKey{Make: "HP", Model: "L2245w", Output: "HDMI-A-1"}},
+		{"unknown", displayKey{Make: "HP", Model: "L2245w", Output: "HDMI-A-1"}},
+		{"0", displayKey{Make: "HP", Model: "L2245w", Output: "HDMI-A-1"}},
+		{"0x00000000", displayKey{Make: "HP", Model: "L2245w", Output: "HDMI-A-1"}},
+		{"0x0101", displayKey{Make: "HP", Model: "L2245w", Serial: "0x0101"}},
+	} {
+		output := newStaticOutput("HDMI-A-1")
+		displayMake, model, serial := "HP", "L2245w", tc.serial
+		output.info.Make, output.info.Model, output.info.Serial = &displayMake, &model, &serial
+
+		if k := getDisplayKey(output.GetInfo()); k != tc.expected {
+			t.Errorf("expected %+v for serial %q, got %+v", tc.expected, tc.serial, k)
+		}
+	}
+}
+
+// recordingOutput records the states set.
+type recordingOutput struct {
+	*staticOutput
+
+	mu  sync.Mutex
+	set []outputs.State
+}
+
+func (o *recordingOutput) SetState(state *outputs.State) (*outputs.State, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.set = append(o.set, *state)
+	return o.GetState(), nil
+}
+
+func (o *recordingOutput) Set() []outputs.State {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return append([]outputs.State(nil), o.set...)
+}
+
+// All remembered fields are restored, not only the enforced ones.
+func TestRestoreState(t *testing.T) {
+	s := New("machine", "screens", nil)
+	output := &recordingOutput{staticOutput: newStaticOutput("HDMI-A-1")}
+	enabled, power, scale := true, false, 1.0
+	output.state.Enabled, output.state.Power, output.state.Scale = &enabled, &power, &scale
+
+	desiredPower, desiredScale, maxRenderTime := true, 2.0, int64(5)
+	s.rememberDesired(output, &outputs.State{
+		Enabled:       &enabled,
+		Power:         &desiredPower,
+		Scale:         &desiredScale,
+		MaxRenderTime: &maxRenderTime,
+	})
+
+	s.restoreState(output)
+	states := output.Set()
+	if len(states) != 1 {
+		t.Fatalf("expected the state to be set once, got %v", states)
+	}
+	set := states[0]
+	if set.Power == nil || !*set.Power || set.Scale == nil || *set.Scale != 2 || set.MaxRenderTime == nil || *set.MaxRenderTime != 5 {
+		t.Errorf("expected power, scale and max_render_time to be restored, got %v", set.LogFields(""))
+	}
+	if set.Enabled != nil {
+		t.Error("expected unchanged fields not to be set")
+	}
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/flokli/display-agent/mqtt"
+)
+
+// fakeBroker is an in-memory mqtt.Client, routing published messages to the
+// handlers subscribed to their topics, and keeping retained messages like a
+// broker would.
+type fakeBroker struct {
+	mu            sync.Mutex
+	subscriptions map[string]mqtt.MessageHandler
+	retained      map[string][]byte
+	// all messages published, in order
+	published []*mqtt.Message
+	// all topics subscribed to, in order
+	subscribed []string
+}
+
+func newFakeBroker() *fakeBroker {
+	return &fakeBroker{
+		subscriptions: make(map[string]mqtt.MessageHandler),
+		retained:      make(map[string][]byte),
+	}
+}
+
+// Publish implements mqtt.Client.
+// Handlers are called synchronously, like they'd be called after a
+// roundtrip to the broker.
+func (b *fakeBroker) Publish(m *mqtt.Message) error {
+	b.mu.Lock()
+	b.published = append(b.published, m)
+	if m.Retained {
+		if len(m.Payload) == 0 {
+			delete(b.retained, m.Topic)
+		} else {
+			b.retained[m.Topic] = m.Payload
+		}
+	}
+	var handlers []mqtt.MessageHandler
+	for filter, handler := range b.subscriptions {
+		if topicMatches(filter, m.Topic) {
+			handlers = append(handlers, handler)
+		}
+	}
+	b.mu.Unlock()
+
+	for _, handler := range handlers {
+		handler(m)
+	}
+	return nil
+}
+
+// Subscribe implements mqtt.Client.
+func (b *fakeBroker) Subscribe(topic string, _ byte, handler mqtt.MessageHandler) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subscriptions[topic] = handler
+	b.subscribed = append(b.subscribed, topic)
+	return nil
+}
+
+// Unsubscribe implements mqtt.Client.
+func (b *fakeBroker) Unsubscribe(topics ...string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, topic := range topics {
+		delete(b.subscriptions, topic)
+	}
+	return nil
+}
+
+// Disconnect implements mqtt.Client.
+func (b *fakeBroker) Disconnect() {}
+
+// Retained returns the retained message of topic, or nil if there's none.
+func (b *fakeBroker) Retained(topic string) []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.retained[topic]
+}
+
+// Published returns the payloads of all messages published to topic, in
+// order.
+func (b *fakeBroker) Published(topic string) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var payloads []string
+	for _, m := range b.published {
+		if m.Topic == topic {
+			payloads = append(payloads, string(m.Payload))
+		}
+	}
+	return payloads
+}
+
+// Subscribed returns whether topic is currently subscribed to, and how often
+// it was subscribed to in total.
+func (b *fakeBroker) Subscribed(topic string) (bool, int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	n := 0
+	for _, t := range b.subscribed {
+		if t == topic {
+			n++
+		}
+	}
+	_, ok := b.subscriptions[topic]
+	return ok, n
+}
+
+// topicMatches returns whether topic matches filter, which might contain +
+// and # wildcards.
+func topicMatches(filter string, topic string) bool {
+	f, t := strings.Split(filter, "/"), strings.Split(topic, "/")
+	for i := range f {
+		if f[i] == "#" {
+			return true
+		}
+		if i >= len(t) || f[i] != "+" && f[i] != t[i] {
+			return false
+		}
+	}
+	return len(f) == len(t)
+}
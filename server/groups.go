@@ -0,0 +1,126 @@
+package server
+
+import (
+	"sort"
+
+	"github.com/flokli/display-agent/mqtt"
+	"github.com/flokli/display-agent/outputs"
+	log "github.com/sirupsen/logrus"
+)
+
+// outputGroups returns the names of all groups the output belongs to.
+func (s *Server) outputGroups(output outputs.Output) []string {
+	info := output.GetInfo()
+
+	var groups []string
+	for name, matches := range s.Groups {
+		for _, m := range matches {
+			if m.Matches(info) {
+				groups = append(groups, name)
+				break
+			}
+		}
+	}
+	sort.Strings(groups)
+	return groups
+}
+
+// joinGroups subscribes to the set topics of all groups of a new output,
+// unless another output already belongs to them.
+func (s *Server) joinGroups(output outputs.Output) {
+	for _, group := range s.outputGroups(output) {
+		s.muOutputs.Lock()
+		s.groupRefs[group]++
+		first := s.groupRefs[group] == 1
+		s.muOutputs.Unlock()
+
+		if first {
+			s.subscribeGroupSetTopic(group)
+		}
+	}
+}
+
+// leaveGroups unsubscribes from the set topics of all groups of a removed
+// output, unless other outputs still belong to them.
+func (s *Server) leaveGroups(output outputs.Output) {
+	for _, group := range s.outputGroups(output) {
+		s.muOutputs.Lock()
+		s.groupRefs[group]--
+		last := s.groupRefs[group] == 0
+		if last {
+			delete(s.groupRefs, group)
+		}
+		s.muOutputs.Unlock()
+
+		if last {
+			topic := s.getTopicPrefixForGroup(group) + "/set"
+			if err := mqtt.Unsubscribe(s.mqttClient, []string{topic}); err != nil {
+				log.WithField("topic", topic).WithError(err).Warn("unable to unsubscribe")
+			}
+		}
+	}
+}
+
+// groupMembers returns the names of the current outputs, keyed by the groups
+// they belong to.
+func (s *Server) groupMembers() map[string][]string {
+	s.muOutputs.Lock()
+	defer s.muOutputs.Unlock()
+
+	members := make(map[string][]string)
+	for name, output := range s.outputs {
+		for _, group := range s.outputGroups(output) {
+			members[group] = append(members[group], name)
+		}
+	}
+	for _, names := range members {
+		sort.Strings(names)
+	}
+	return members
+}
+
+func (s *Server) subscribeGroupSetTopic(group string) {
+	topic := s.getTopicPrefixForGroup(group) + "/set"
+	if err := mqtt.Subscribe(s.mqttClient, topic, 0, func(m *mqtt.Message) {
+		l := log.WithFields(log.Fields{
+			"payload": m.Payload,
+			"topic":   topic,
+			"sender":  m.UserProperties[senderProperty],
+		})
+		l.Debug("received message")
+
+		resultTopic := s.getTopicPrefixForMachine() + "/result"
+		payload, ok := s.authenticate(m, topic, resultTopic, l)
+		if !ok {
+			return
+		}
+		result := s.handleGroupSetCmd(payload, group)
+		if !result.Success {
+			l.WithField("error", result.Error).Error("unable to handle setCmd")
+		}
+		s.publishResult(m, resultTopic, result, l)
+	}); err != nil {
+		log.WithField("topic", topic).WithError(err).Error("unable to subscribe to group set topic")
+	}
+}
+
+// handleGroupSetCmd applies the state in payload to all outputs of a group.
+func (s *Server) handleGroupSetCmd(payload []byte, group string) *machineSetResult {
+	var members []outputs.Output
+	for _, output := range s.backend.Outputs() {
+		for _, g := range s.outputGroups(output) {
+			if g == group {
+				members = append(members, output)
+				break
+			}
+		}
+	}
+
+	result := s.handleMultiSetCmd(payload, members)
+	result.Group = group
+	return result
+}
+
+func (s *Server) getTopicPrefixForGroup(group string) string {
+	return s.TopicPrefix + "/group/" + group
+}
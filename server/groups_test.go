@@ -0,0 +1,93 @@
+package server
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/flokli/display-agent/mqtt"
+	"github.com/flokli/display-agent/outputs"
+)
+
+// The set topic of a group is subscribed to once its first output is added,
+// and unsubscribed from once its last one is removed.
+func TestGroupRefs(t *testing.T) {
+	s := New("machine", "screens", nil)
+	b := newFakeBroker()
+	s.mqttClient = b
+	s.Groups = map[string][]outputs.Match{
+		"hdmi": {{Name: "HDMI-*"}},
+		"all":  {{Name: "*"}},
+	}
+	hdmi1, hdmi2, vga := newStaticOutput("HDMI-A-1"), newStaticOutput("HDMI-A-2"), newStaticOutput("VGA-1")
+
+	expect := func(group string, subscribed bool, subscribes int) {
+		t.Helper()
+		ok, n := b.Subscribed("screens/group/" + group + "/set")
+		if ok != subscribed || n != subscribes {
+			t.Errorf("expected %v to be subscribed: %v, %v times, got %v, %v times", group, subscribed, subscribes, ok, n)
+		}
+	}
+
+	s.joinGroups(vga)
+	expect("all", true, 1)
+	expect("hdmi", false, 0)
+
+	s.joinGroups(hdmi1)
+	s.joinGroups(hdmi2)
+	expect("all", true, 1)
+	expect("hdmi", true, 1)
+
+	s.leaveGroups(hdmi1)
+	expect("hdmi", true, 1)
+	s.leaveGroups(hdmi2)
+	expect("hdmi", false, 1)
+	expect("all", true, 1)
+	if _, ok := s.groupRefs["hdmi"]; ok {
+		t.Error("expected groups without outputs to be forgotten about")
+	}
+
+	s.leaveGroups(vga)
+	expect("all", false, 1)
+
+	// joining again subscribes again.
+	s.joinGroups(hdmi1)
+	expect("hdmi", true, 2)
+}
+
+// States sent to a group are only applied to its outputs.
+func TestGroupSet(t *testing.T) {
+	_, b, _ := runTestServer(t, func(s *Server) {
+		s.Groups = map[string][]outputs.Match{"hdmi": {{Name: "HDMI-*"}}}
+	})
+
+	if err := b.Publish(&mqtt.Message{
+		Topic:   "screens/group/hdmi/set",
+		Payload: []byte(`{"correlation_id": "1", "scale": 2}`),
+	}); err != nil {
+		t.Fatalf("unable to publish: %v", err)
+	}
+
+	published := b.Published("screens/machine/result")
+	if len(published) == 0 {
+		t.Fatal("no result published")
+	}
+	var result machineSetResult
+	if err := json.Unmarshal([]byte(published[len(published)-1]), &result); err != nil {
+		t.Fatalf("unable to parse result: %v", err)
+	}
+	var names []string
+	for name := range result.Outputs {
+		names = append(names, name)
+	}
+	if !result.Success || result.Group != "hdmi" || !reflect.DeepEqual(names, []string{"HDMI-A-1"}) {
+		t.Errorf("expected the command to succeed for HDMI-A-1 only, got %+v", result)
+	}
+
+	if state := publishedState(t, b, "HDMI-A-1"); state.Scale == nil || *state.Scale != 2 {
+		t.Errorf("expected HDMI-A-1 to be scaled, got %v", formatState(state))
+	}
+	if state := publishedState(t, b, "VGA-1"); state.Scale == nil || *state.Scale == 2 {
+		t.Errorf("expected VGA-1 to be unchanged, got %v", formatState(state))
+	}
+}
@@ -0,0 +1,257 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/flokli/display-agent/outputs"
+	log "github.com/sirupsen/logrus"
+)
+
+// This file implements Home Assistant MQTT discovery, see
+// https://www.home-assistant.io/integrations/mqtt/#mqtt-discovery.
+// For every output, a device with a few entities is announced, all of them
+// reading from the state topic and writing to the set topic of the output.
+
+// haDevice groups all entities of an output.
+type haDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer,omitempty"`
+	Model        string   `json:"model,omitempty"`
+	SerialNumber string   `json:"serial_number,omitempty"`
+}
+
+// haEntity is the discovery config of a single entity.
+// Only the fields needed by the entities below are supported.
+type haEntity struct {
+	Name              string   `json:"name"`
+	UniqueID          string   `json:"unique_id"`
+	Device            haDevice `json:"device"`
+	Icon              string   `json:"icon,omitempty"`
+	EntityCategory    string   `json:"entity_category,omitempty"`
+	AvailabilityTopic string   `json:"availability_topic"`
+	StateTopic        string   `json:"state_topic"`
+	CommandTopic      string   `json:"command_topic"`
+	ValueTemplate     string   `json:"value_template"`
+	CommandTemplate   string   `json:"command_template,omitempty"`
+
+	// switch
+	StateOn    string `json:"state_on,omitempty"`
+	StateOff   string `json:"state_off,omitempty"`
+	PayloadOn  string `json:"payload_on,omitempty"`
+	PayloadOff string `json:"payload_off,omitempty"`
+
+	// select
+	Options []string `json:"options,omitempty"`
+
+	// number
+	Min  float64 `json:"min,omitempty"`
+	Max  float64 `json:"max,omitempty"`
+	Step float64 `json:"step,omitempty"`
+	Mode string  `json:"mode,omitempty"`
+}
+
+// haComponent is an entity, together with the Home Assistant component
+// handling it.
+type haComponent struct {
+	// switch, select, number, text
+	Component string
+	// unique per output
+	ObjectID string
+	Entity   *haEntity
+}
+
+var haInvalidIDChars = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+// haID turns s into something usable as a node or object id in discovery
+// topics.
+func haID(s string) string {
+	return haInvalidIDChars.ReplaceAllString(s, "_")
+}
+
+// homeAssistantComponents returns all entities announced for the given
+// output.
+func (s *Server) homeAssistantComponents(output outputs.Output) []*haComponent {
+	info := output.GetInfo()
+	outputName := *info.Name
+	topicPrefix := s.getTopicPrefixForOutput(output)
+
+	// group by make/model/serial, so the same display is recognized when
+	// connected to a different output or machine.
+	// Without a serial, this isn't unique, so fall back to the output.
+	deviceID := strings.Join([]string{*info.Make, *info.Model, *info.Serial}, "_")
+	serial := *info.Serial
+	if !hasSerial(serial) {
+		deviceID = outputName + "@" + s.MachineID
+		serial = ""
+	}
+	device := haDevice{
+		Identifiers:  []string{"display-agent_" + haID(deviceID)},
+		Name:         strings.TrimSpace(*info.Make + " " + *info.Model + " (" + outputName + ")"),
+		Manufacturer: *info.Make,
+		Model:        *info.Model,
+		SerialNumber: serial,
+	}
+
+	// Outputs might report the same mode several times, with different
+	// picture aspect ratios, which aren't shown.
+	var modes []string
+	seenModes := make(map[string]bool)
+	if info.Modes != nil {
+		for _, m := range *info.Modes {
+			if mode := m.String(); !seenModes[mode] {
+				seenModes[mode] = true
+				modes = append(modes, mode)
+			}
+		}
+	}
+
+	entity := func(name, objectID string) *haEntity {
+		return &haEntity{
+			Name:              name,
+			UniqueID:          haID(s.MachineID + "_" + outputName + "_" + objectID),
+			Device:            device,
+			AvailabilityTopic: s.getAvailabilityTopic(),
+			StateTopic:        topicPrefix + "/state",
+			CommandTopic:      topicPrefix + "/set",
+		}
+	}
+
+	power := entity("Power", "power")
+	power.Icon = "mdi:monitor"
+	power.ValueTemplate = "{{ 'ON' if value_json.power else 'OFF' }}"
+	power.StateOn, power.StateOff = "ON", "OFF"
+	power.PayloadOn, power.PayloadOff = `{"power": true}`, `{"power": false}`
+
+	enabled := entity("Enabled", "enabled")
+	enabled.Icon = "mdi:monitor-off"
+	enabled.EntityCategory = "config"
+	enabled.ValueTemplate = "{{ 'ON' if value_json.enabled else 'OFF' }}"
+	enabled.StateOn, enabled.StateOff = "ON", "OFF"
+	enabled.PayloadOn, enabled.PayloadOff = `{"enabled": true}`, `{"enabled": false}`
+
+	// modes are rendered like outputs.Mode.String, so they match the
+	// options, and are also accepted when setting them.
+	mode := entity("Mode", "mode")
+	mode.Icon = "mdi:monitor-screenshot"
+	mode.EntityCategory = "config"
+	mode.ValueTemplate = "{{ value_json.mode.width }}x{{ value_json.mode.height }}{{ '@' ~ value_json.mode.refresh if value_json.mode.refresh else '' }}"
+	mode.CommandTemplate = `{"mode": {{ value | tojson }}}`
+	mode.Options = modes
+
+	transform := entity("Transform", "transform")
+	transform.Icon = "mdi:screen-rotation"
+	transform.EntityCategory = "config"
+	transform.ValueTemplate = "{{ value_json.transform }}"
+	transform.CommandTemplate = `{"transform": {{ value | tojson }}}`
+	transform.Options = outputs.Transforms
+
+	scale := entity("Scale", "scale")
+	scale.Icon = "mdi:magnify-plus-outline"
+	scale.EntityCategory = "config"
+	scale.ValueTemplate = "{{ value_json.scale }}"
+	scale.CommandTemplate = `{"scale": {{ value }}}`
+	scale.Min, scale.Max, scale.Step = 0.25, 4, 0.05
+	scale.Mode = "box"
+
+	// the scenario is rendered as its name, followed by its arg, if any.
+	// Scenarios take a single arg at most, everything after the first space
+	// is passed as it, even if it contains spaces itself.
+	scenario := entity("Scenario", "scenario")
+	scenario.Icon = "mdi:play-box-outline"
+	scenario.ValueTemplate = "{{ ([value_json.scenario.name] + value_json.scenario.args) | join(' ') }}"
+	scenario.CommandTemplate = `{% set items = value.strip().split(' ', 1) %}{"scenario": {"name": {{ items[0] | tojson }}, "args": {{ items[1:] | tojson }}}}`
+
+	components := []*haComponent{
+		{Component: "switch", ObjectID: "power", Entity: power},
+		{Component: "switch", ObjectID: "enabled", Entity: enabled},
+		{Component: "select", ObjectID: "transform", Entity: transform},
+		{Component: "number", ObjectID: "scale", Entity: scale},
+		{Component: "text", ObjectID: "scenario", Entity: scenario},
+	}
+	// a select needs at least one option.
+	if len(modes) != 0 {
+		components = append(components, &haComponent{Component: "select", ObjectID: "mode", Entity: mode})
+	}
+	return components
+}
+
+// getHomeAssistantConfigTopic returns the topic the discovery config of an
+// entity is published to.
+func (s *Server) getHomeAssistantConfigTopic(outputName string, c *haComponent) string {
+	return strings.Join([]string{
+		s.HomeAssistantDiscoveryPrefix,
+		c.Component,
+		haID(s.MachineID),
+		haID(outputName + "_" + c.ObjectID),
+		"config",
+	}, "/")
+}
+
+// publishHomeAssistantDiscovery publishes the discovery configs of all
+// entities of a given output, if Home Assistant discovery is enabled.
+// Configs of entities published before, but not announced anymore (like the
+// mode once no modes are known), are cleared.
+func (s *Server) publishHomeAssistantDiscovery(output outputs.Output) error {
+	if s.HomeAssistantDiscoveryPrefix == "" {
+		return nil
+	}
+
+	outputName := *output.GetInfo().Name
+	l := log.WithField("outputName", outputName)
+
+	s.muHomeAssistant.Lock()
+	defer s.muHomeAssistant.Unlock()
+
+	previous := s.haTopics[outputName]
+	topics := make(map[string]bool)
+	s.haTopics[outputName] = topics
+	var errs []error
+	for _, c := range s.homeAssistantComponents(output) {
+		topic := s.getHomeAssistantConfigTopic(outputName, c)
+		configJSON, err := json.Marshal(c.Entity)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("unable to marshal discovery config: %w", err))
+			continue
+		}
+		// tracked before publishing, the retained message might have been
+		// stored by the broker even if publishing failed.
+		topics[topic] = true
+		if err := s.publishRetained(topic, configJSON); err != nil {
+			errs = append(errs, fmt.Errorf("unable to publish discovery config: %w", err))
+		}
+	}
+
+	for topic := range previous {
+		if topics[topic] {
+			continue
+		}
+		if err := s.clearRetained(topic); err != nil {
+			l.WithError(err).Warn("unable to clear discovery config")
+			// tried again next time.
+			topics[topic] = true
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// clearHomeAssistantDiscovery removes the discovery configs published for a
+// given output, which makes Home Assistant remove its entities.
+func (s *Server) clearHomeAssistantDiscovery(output outputs.Output) {
+	outputName := *output.GetInfo().Name
+
+	s.muHomeAssistant.Lock()
+	defer s.muHomeAssistant.Unlock()
+
+	for topic := range s.haTopics[outputName] {
+		if err := s.clearRetained(topic); err != nil {
+			log.WithField("outputName", outputName).WithError(err).Warn("unable to clear discovery config")
+		}
+	}
+	delete(s.haTopics, outputName)
+}
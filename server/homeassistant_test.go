@@ -0,0 +1,111 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/flokli/display-agent/outputs"
+)
+
+// staticOutput is an output which can't be changed.
+type staticOutput struct {
+	info  outputs.Info
+	state outputs.State
+}
+
+func (o *staticOutput) GetInfo() *outputs.Info   { return &o.info }
+func (o *staticOutput) GetState() *outputs.State { return &o.state }
+func (o *staticOutput) SetState(*outputs.State) (*outputs.State, error) {
+	return nil, outputs.ErrUnsupported
+}
+
+func newStaticOutput(name string, modes ...*outputs.Mode) *staticOutput {
+	empty := ""
+	return &staticOutput{info: outputs.Info{
+		Make: &empty, Model: &empty, Serial: &empty,
+		Name:  &name,
+		Modes: &modes,
+	}}
+}
+
+func TestHomeAssistantModeOptions(t *testing.T) {
+	s := New("machine", "screens", nil)
+	output := newStaticOutput("HDMI-A-1",
+		&outputs.Mode{Width: 1920, Height: 1080, Refresh: 60000, PictureAspectRatio: "none"},
+		&outputs.Mode{Width: 1920, Height: 1080, Refresh: 60000, PictureAspectRatio: "16:9"},
+		&outputs.Mode{Width: 1280, Height: 720},
+	)
+
+	var mode *haEntity
+	for _, c := range s.homeAssistantComponents(output) {
+		if c.ObjectID == "mode" {
+			mode = c.Entity
+		}
+	}
+	if mode == nil {
+		t.Fatal("no mode entity")
+	}
+
+	expected := []string{"1920x1080@60000", "1280x720"}
+	if !reflect.DeepEqual(mode.Options, expected) {
+		t.Errorf("expected options %q, got %q", expected, mode.Options)
+	}
+}
+
+// Displays without a serial are announced per output to Home Assistant.
+func TestHomeAssistantDeviceWithoutSerial(t *testing.T) {
+	s := New("machine", "screens", nil)
+	output := newStaticOutput("HDMI-A-1")
+	serial := "Unknown"
+	output.info.Serial = &serial
+
+	device := s.homeAssistantComponents(output)[0].Entity.Device
+	if device.Identifiers[0] != "display-agent_HDMI-A-1_machine" {
+		t.Errorf("unexpected identifiers %q", device.Identifiers)
+	}
+	if device.SerialNumber != "" {
+		t.Errorf("expected no serial number, got %q", device.SerialNumber)
+	}
+}
+
+// Configs published for an output are cleared once they aren't announced
+// anymore, and all of them once the output is removed.
+func TestHomeAssistantDiscoveryTopics(t *testing.T) {
+	b := newFakeBroker()
+	s := New("machine", "screens", nil)
+	s.mqttClient = b
+	s.HomeAssistantDiscoveryPrefix = "homeassistant"
+	output := newStaticOutput("HDMI-A-1", &outputs.Mode{Width: 1920, Height: 1080, Refresh: 60000})
+	modeTopic := "homeassistant/select/machine/HDMI-A-1_mode/config"
+	powerTopic := "homeassistant/switch/machine/HDMI-A-1_power/config"
+
+	if err := s.publishHomeAssistantDiscovery(output); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if b.Retained(modeTopic) == nil || b.Retained(powerTopic) == nil {
+		t.Fatal("expected the mode and power configs to be published")
+	}
+
+	// without modes, there's no mode entity.
+	*output.info.Modes = nil
+	if err := s.publishHomeAssistantDiscovery(output); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if b.Retained(modeTopic) != nil {
+		t.Error("expected the mode config to be cleared")
+	}
+	if b.Retained(powerTopic) == nil {
+		t.Error("expected the power config to be kept")
+	}
+
+	// configs published before are cleared, even if not announced anymore.
+	*output.info.Modes = []*outputs.Mode{{Width: 1920, Height: 1080, Refresh: 60000}}
+	if err := s.publishHomeAssistantDiscovery(output); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	*output.info.Modes = nil
+	s.clearHomeAssistantDiscovery(output)
+	if b.Retained(modeTopic) != nil || b.Retained(powerTopic) != nil {
+		t.Error("expected all configs to be cleared")
+	}
+}
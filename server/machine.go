@@ -0,0 +1,186 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/flokli/display-agent/mqtt"
+	"github.com/flokli/display-agent/outputs"
+	log "github.com/sirupsen/logrus"
+)
+
+// machineInfo is published to the machine info topic.
+type machineInfo struct {
+	Hostname string `json:"hostname"`
+	Version  string `json:"version"`
+	Backend  string `json:"backend"`
+	// when the agent started. Unlike an uptime, it doesn't change with every
+	// publish, so unchanged info isn't published again.
+	StartedAt time.Time `json:"started_at"`
+	// names of all current outputs
+	Outputs []string `json:"outputs"`
+	// aliases used in the topics of the current outputs, keyed by their names
+	Aliases map[string]string `json:"aliases,omitempty"`
+	// names of the current outputs, keyed by the groups they belong to
+	Groups    map[string][]string `json:"groups"`
+	Scenarios []string            `json:"scenarios"`
+}
+
+// machineSetResult is published to the machine result topic for every message
+// received on the machine-wide, group or broadcast set topic, and the arrange
+// topic.
+type machineSetResult struct {
+	// copied from the set command
+	CorrelationID string `json:"correlation_id,omitempty"`
+	// the group the command was sent to, if any
+	Group string `json:"group,omitempty"`
+	// whether the state could be applied to all outputs
+	Success bool `json:"success"`
+	// human-readable description of what went wrong
+	Error string `json:"error,omitempty"`
+	// the results of the individual outputs, keyed by their names
+	Outputs map[string]*setResult `json:"outputs"`
+}
+
+// publishMachineInfo publishes info about the agent itself.
+func (s *Server) publishMachineInfo() error {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return fmt.Errorf("unable to get hostname: %w", err)
+	}
+
+	// s.backend.Outputs can't be used here, this is called from handlers.
+	s.muOutputs.Lock()
+	outputNames := make([]string, 0, len(s.outputs))
+	var aliases map[string]string
+	for name, output := range s.outputs {
+		outputNames = append(outputNames, name)
+		if alias := s.getOutputTopicName(output); alias != name {
+			if aliases == nil {
+				aliases = make(map[string]string)
+			}
+			aliases[name] = alias
+		}
+	}
+	s.muOutputs.Unlock()
+	sort.Strings(outputNames)
+
+	info := &machineInfo{
+		Hostname:  hostname,
+		Version:   s.Version,
+		Backend:   s.BackendName,
+		StartedAt: s.started.Truncate(time.Second),
+		Outputs:   outputNames,
+		Aliases:   aliases,
+		Groups:    s.groupMembers(),
+		Scenarios: s.backend.Scenarios(),
+	}
+
+	infoJSON, err := json.Marshal(info)
+	if err != nil {
+		return fmt.Errorf("unable to marshal machine info json: %w", err)
+	}
+	if err := s.publishRetained(s.getTopicPrefixForMachine()+"/info", infoJSON); err != nil {
+		return fmt.Errorf("unable to publish machine info: %w", err)
+	}
+
+	return nil
+}
+
+// handleMultiSetCmd applies the state in payload to all given outputs, and
+// returns the results of all of them.
+func (s *Server) handleMultiSetCmd(payload []byte, outs []outputs.Output) *machineSetResult {
+	r := &machineSetResult{
+		Success: true,
+		Outputs: make(map[string]*setResult),
+	}
+
+	// only to get the correlation id, the state is parsed for every output.
+	var cmd setCmd
+	if err := json.Unmarshal(payload, &cmd); err != nil {
+		r.Success = false
+		r.Error = fmt.Sprintf("failed to parse set payload: %v", err)
+		return r
+	}
+	r.CorrelationID = cmd.CorrelationID
+
+	var failed []string
+	for _, output := range outs {
+		name := *output.GetInfo().Name
+		result := s.handleSetCmd(payload, output)
+		r.Outputs[name] = result
+		if !result.Success {
+			failed = append(failed, name)
+		}
+	}
+
+	if len(failed) != 0 {
+		sort.Strings(failed)
+		r.Success = false
+		r.Error = fmt.Sprintf("unable to set state of %v", failed)
+	}
+	return r
+}
+
+// subscribeMachineSetTopics subscribes to the machine-wide and broadcast set
+// topics.
+func (s *Server) subscribeMachineSetTopics() {
+	for _, topic := range []string{
+		s.getTopicPrefixForMachine() + "/set",
+		s.TopicPrefix + "/all/set",
+	} {
+		topic := topic
+		if err := mqtt.Subscribe(s.mqttClient, topic, 0, func(m *mqtt.Message) {
+			l := log.WithFields(log.Fields{
+				"payload": m.Payload,
+				"topic":   topic,
+				"sender":  m.UserProperties[senderProperty],
+			})
+			l.Debug("received message")
+
+			resultTopic := s.getTopicPrefixForMachine() + "/result"
+			payload, ok := s.authenticate(m, topic, resultTopic, l)
+			if !ok {
+				return
+			}
+			result := s.handleMultiSetCmd(payload, s.backend.Outputs())
+			if !result.Success {
+				l.WithField("error", result.Error).Error("unable to handle setCmd")
+			}
+			s.publishResult(m, resultTopic, result, l)
+		}); err != nil {
+			log.WithField("topic", topic).WithError(err).Error("unable to subscribe to set topic")
+		}
+	}
+}
+
+// publishResult publishes the result of a command received in m, to the
+// response topic of m if set, or the given topic otherwise.
+// The response topic isn't signed, it's ignored if commands are
+// authenticated. Otherwise, anybody could make the agent publish to any topic.
+func (s *Server) publishResult(m *mqtt.Message, topic string, result interface{}, l *log.Entry) {
+	resultJSON, err := json.Marshal(result)
+	if err != nil {
+		l.WithError(err).Error("unable to marshal result")
+		return
+	}
+
+	// With MQTT 5, the sender can ask for the result to be sent to a response
+	// topic of its choice.
+	resultMsg := &mqtt.Message{
+		Topic:           topic,
+		Payload:         resultJSON,
+		CorrelationData: m.CorrelationData,
+		MessageExpiry:   resultExpiry,
+		UserProperties:  map[string]string{senderProperty: s.getSenderID()},
+	}
+	if m.ResponseTopic != "" && s.Verifier == nil {
+		resultMsg.Topic = m.ResponseTopic
+	}
+	if err := mqtt.PublishMessage(s.mqttClient, resultMsg); err != nil {
+		l.WithError(err).Warn("unable to publish result")
+	}
+}
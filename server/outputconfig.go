@@ -0,0 +1,67 @@
+package server
+
+import (
+	"github.com/flokli/display-agent/outputs"
+	log "github.com/sirupsen/logrus"
+)
+
+// outputConfig returns the first config matching the output, or an empty one.
+func (s *Server) outputConfig(output outputs.Output) *outputs.OutputConfig {
+	info := output.GetInfo()
+	for i := range s.OutputConfigs {
+		if s.OutputConfigs[i].Match.Matches(info) {
+			return &s.OutputConfigs[i]
+		}
+	}
+	return &outputs.OutputConfig{}
+}
+
+// assignTopicName decides the name used in the topics of a new output: its
+// alias, or its name if it has none.
+// A match can hit several displays, which can't share their topics. If
+// another current output uses the alias already, the name is used instead.
+func (s *Server) assignTopicName(output outputs.Output) {
+	name := *output.GetInfo().Name
+	alias := s.outputConfig(output).Alias
+
+	s.muTopicNames.Lock()
+	defer s.muTopicNames.Unlock()
+
+	topicName := name
+	if alias != "" {
+		topicName = alias
+		for otherName, otherTopicName := range s.topicNames {
+			if otherName != name && otherTopicName == alias {
+				log.WithFields(log.Fields{
+					"outputName":      name,
+					"alias":           alias,
+					"otherOutputName": otherName,
+				}).Warn("alias used by another output already, using the output name")
+				topicName = name
+				break
+			}
+		}
+	}
+	s.topicNames[name] = topicName
+}
+
+// releaseTopicName forgets the topic name of a removed output, so its alias
+// can be used by others.
+func (s *Server) releaseTopicName(output outputs.Output) {
+	s.muTopicNames.Lock()
+	defer s.muTopicNames.Unlock()
+	delete(s.topicNames, *output.GetInfo().Name)
+}
+
+// getOutputTopicName returns the name used in the topics of the output, see
+// assignTopicName.
+func (s *Server) getOutputTopicName(output outputs.Output) string {
+	name := *output.GetInfo().Name
+
+	s.muTopicNames.Lock()
+	defer s.muTopicNames.Unlock()
+	if topicName, ok := s.topicNames[name]; ok {
+		return topicName
+	}
+	return name
+}
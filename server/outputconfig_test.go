@@ -0,0 +1,55 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/flokli/display-agent/mqtt"
+	"github.com/flokli/display-agent/outputs"
+)
+
+// An alias matching several outputs is only used by one of them, the others
+// keep their own topics.
+func TestAliasUsedOnce(t *testing.T) {
+	backend, b, _ := runTestServer(t, func(s *Server) {
+		s.OutputConfigs = []outputs.OutputConfig{{Match: outputs.Match{Name: "*"}, Alias: "screen"}}
+	})
+
+	if b.Retained("screens/screen@machine/state") == nil {
+		t.Fatal("expected the state to be published under the alias")
+	}
+	var aliased, other string
+	for _, name := range []string{"HDMI-A-1", "VGA-1"} {
+		if b.Retained("screens/"+name+"@machine/state") == nil {
+			aliased = name
+		} else {
+			other = name
+		}
+	}
+	if aliased == "" || other == "" {
+		t.Fatalf("expected exactly one output to use the alias, got %q and %q", aliased, other)
+	}
+
+	// removing the other output leaves the topics of the aliased one alone.
+	backend.Disconnect(other)
+	if b.Retained("screens/screen@machine/state") == nil {
+		t.Error("expected the state under the alias to stay")
+	}
+	if err := b.Publish(&mqtt.Message{
+		Topic:   "screens/screen@machine/set",
+		Payload: []byte(`{"correlation_id": "1", "scale": 2}`),
+	}); err != nil {
+		t.Fatalf("unable to publish: %v", err)
+	}
+	if result := lastResult(t, b, "screens/screen@machine/result"); !result.Success {
+		t.Errorf("expected the command to succeed, got %+v", result)
+	}
+
+	// once the aliased output is gone, the alias is free again.
+	backend.Disconnect(aliased)
+	if err := backend.Connect(other); err != nil {
+		t.Fatalf("unable to connect %v: %v", other, err)
+	}
+	if b.Retained("screens/screen@machine/state") == nil || b.Retained("screens/"+other+"@machine/state") != nil {
+		t.Errorf("expected %v to use the alias now", other)
+	}
+}
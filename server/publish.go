@@ -0,0 +1,152 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/flokli/display-agent/mqtt"
+	"github.com/flokli/display-agent/outputs"
+	log "github.com/sirupsen/logrus"
+)
+
+// Retained topics are published whenever they might have changed. An update
+// of an output might only change its state, but not its info, and the
+// heartbeat publishes everything. To not flood the broker, the last payload
+// published to every retained topic is kept, and only changed payloads are
+// published.
+
+// retainedTopic is the last payload published to a retained topic.
+// Its lock is held while publishing, so the payload kept is always the one
+// published last.
+type retainedTopic struct {
+	mu sync.Mutex
+	// nil if unknown
+	payload []byte
+}
+
+// retainedTopic returns the retainedTopic of topic, adding it if needed.
+func (s *Server) retainedTopic(topic string) *retainedTopic {
+	s.muPublished.Lock()
+	defer s.muPublished.Unlock()
+
+	t, ok := s.published[topic]
+	if !ok {
+		t = &retainedTopic{}
+		s.published[topic] = t
+	}
+	return t
+}
+
+// publishRetained publishes payload retained to topic, unless it's what was
+// published there last.
+func (s *Server) publishRetained(topic string, payload []byte) error {
+	t := s.retainedTopic(topic)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.payload != nil && bytes.Equal(t.payload, payload) {
+		return nil
+	}
+	if err := mqtt.Publish(s.mqttClient, topic, 0, true, payload); err != nil {
+		return err
+	}
+	t.payload = payload
+	return nil
+}
+
+// clearRetained removes the retained message of topic, by publishing an empty
+// retained message.
+func (s *Server) clearRetained(topic string) error {
+	t := s.retainedTopic(topic)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// the topic might not be published again, like the ones of removed
+	// outputs, so it's forgotten about.
+	t.payload = nil
+	s.muPublished.Lock()
+	if s.published[topic] == t {
+		delete(s.published, topic)
+	}
+	s.muPublished.Unlock()
+
+	return mqtt.Publish(s.mqttClient, topic, 0, true, []byte{})
+}
+
+// forgetPublished forgets about all payloads published, so everything is
+// published again next time.
+func (s *Server) forgetPublished() {
+	s.muPublished.Lock()
+	topics := make([]*retainedTopic, 0, len(s.published))
+	for _, t := range s.published {
+		topics = append(topics, t)
+	}
+	s.muPublished.Unlock()
+
+	for _, t := range topics {
+		t.mu.Lock()
+		t.payload = nil
+		t.mu.Unlock()
+	}
+}
+
+// whileCurrent calls fn, unless output was removed already. Outputs are
+// removed from s.outputs before their data is cleared, and clearing waits for
+// fn to return, so whatever fn publishes for output can't outlive it.
+// It's meant for publishing outside of the add handler, like for updates,
+// which might still arrive for outputs removed already.
+func (s *Server) whileCurrent(output outputs.Output, fn func()) {
+	s.muClearing.RLock()
+	defer s.muClearing.RUnlock()
+
+	s.muOutputs.Lock()
+	current := s.outputs[*output.GetInfo().Name] == output
+	s.muOutputs.Unlock()
+
+	if current {
+		fn()
+	}
+}
+
+// republishAll publishes availability, machine info, the data of all outputs
+// and the schedule status again, even if unchanged.
+func (s *Server) republishAll() {
+	s.forgetPublished()
+
+	if err := mqtt.Publish(s.mqttClient, s.getAvailabilityTopic(), 1, true, availabilityOnline); err != nil {
+		log.WithError(err).Warn("unable to publish availability")
+	}
+	if err := s.publishMachineInfo(); err != nil {
+		log.WithError(err).Warn("unable to publish machine info")
+	}
+	for _, output := range s.currentOutputs() {
+		s.whileCurrent(output, func() {
+			if err := s.publishOutputData(output); err != nil {
+				log.WithError(err).Warn("unable to publish output data")
+			}
+			if err := s.publishHomeAssistantDiscovery(output); err != nil {
+				log.WithError(err).Warn("unable to publish Home Assistant discovery")
+			}
+		})
+	}
+	s.wakeSchedule()
+}
+
+// heartbeat republishes everything every HeartbeatInterval, until ctx is
+// cancelled.
+func (s *Server) heartbeat(ctx context.Context) {
+	ticker := time.NewTicker(s.HeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			log.Debug("heartbeat")
+			s.republishAll()
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPublishRetained(t *testing.T) {
+	b := newFakeBroker()
+	s := New("machine", "screens", nil)
+	s.mqttClient = b
+
+	for _, payload := range []string{"a", "a", "b"} {
+		if err := s.publishRetained("topic", []byte(payload)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	// cleared topics are published again, even with the same payload.
+	if err := s.clearRetained("topic"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := s.published["topic"]; ok {
+		t.Error("expected cleared topics to be forgotten about")
+	}
+	if err := s.publishRetained("topic", []byte("b")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	s.forgetPublished()
+	if err := s.publishRetained("topic", []byte("b")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []string{"a", "b", "", "b", "b"}
+	if got := b.Published("topic"); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %q to be published, got %q", expected, got)
+	}
+}
+
+// Nothing is published for outputs removed already, which would restore
+// their cleared data.
+func TestWhileCurrent(t *testing.T) {
+	s := New("machine", "screens", nil)
+	output := newStaticOutput("HDMI-A-1")
+
+	called := false
+	s.whileCurrent(output, func() { called = true })
+	if called {
+		t.Error("expected fn not to be called for an unknown output")
+	}
+
+	s.outputs["HDMI-A-1"] = output
+	s.whileCurrent(output, func() {
+		called = true
+		// outputs can still be added and removed, but not cleared.
+		if len(s.currentOutputs()) != 1 {
+			t.Error("expected the output to be current")
+		}
+		if s.muClearing.TryLock() {
+			t.Error("expected clearing to wait for fn")
+		}
+	})
+	if !called {
+		t.Error("expected fn to be called for a current output")
+	}
+}
@@ -0,0 +1,254 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"slices"
+	"time"
+
+	"github.com/flokli/display-agent/outputs"
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultPolicies are the policies of all fields not set in
+// Server.Policies. Fields not listed here are only reported.
+var defaultPolicies = map[string]string{
+	"mode":      outputs.PolicyEnforce,
+	"transform": outputs.PolicyEnforce,
+	"scale":     outputs.PolicyEnforce,
+	"scenario":  outputs.PolicyEnforce,
+}
+
+// If reconciling keeps failing, it's retried less and less often, up to this
+// interval.
+const maxReconcileBackoff = 30 * time.Minute
+
+// policy returns the policy of the field with the given name.
+func (s *Server) policy(name string) string {
+	if policy, ok := s.Policies[name]; ok {
+		return policy
+	}
+	if policy, ok := defaultPolicies[name]; ok {
+		return policy
+	}
+	return outputs.PolicyReport
+}
+
+// enforced returns only the fields of state with outputs.PolicyEnforce.
+func (s *Server) enforced(state *outputs.State) *outputs.State {
+	var names []string
+	for _, name := range outputs.StateFieldNames {
+		if s.policy(name) == outputs.PolicyEnforce {
+			names = append(names, name)
+		}
+	}
+	return onlyFields(state, names)
+}
+
+// mergeState sets all fields set in src in dst.
+func mergeState(dst *outputs.State, src *outputs.State) {
+	dv, sv := reflect.ValueOf(dst).Elem(), reflect.ValueOf(src).Elem()
+	for i := range outputs.StateFieldNames {
+		if !sv.Field(i).IsNil() {
+			dv.Field(i).Set(sv.Field(i))
+		}
+	}
+}
+
+// onlyFields returns a copy of state with only the fields with the given
+// names set.
+func onlyFields(state *outputs.State, names []string) *outputs.State {
+	var only outputs.State
+	sv, ov := reflect.ValueOf(state).Elem(), reflect.ValueOf(&only).Elem()
+	for i, name := range outputs.StateFieldNames {
+		if slices.Contains(names, name) {
+			ov.Field(i).Set(sv.Field(i))
+		}
+	}
+	return &only
+}
+
+// drift returns the names of all fields set in desired, but observed
+// differently.
+// Fields not observed, as the backend doesn't support them, never drift.
+func drift(desired *outputs.State, observed *outputs.State) []string {
+	dv, ov := reflect.ValueOf(desired).Elem(), reflect.ValueOf(observed).Elem()
+
+	names := []string{}
+	for i, name := range outputs.StateFieldNames {
+		d, o := dv.Field(i), ov.Field(i)
+		if d.IsNil() || o.IsNil() {
+			continue
+		}
+		if !fieldEqual(d.Interface(), o.Interface()) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// fieldEqual compares the desired and observed value of a field.
+// Modes without a refresh rate match any refresh rate, and scales are
+// compared with some tolerance, as some display servers only keep them as
+// float32.
+func fieldEqual(desired interface{}, observed interface{}) bool {
+	switch d := desired.(type) {
+	case *outputs.Mode:
+		o := observed.(*outputs.Mode)
+		return d.Width == o.Width && d.Height == o.Height && (d.Refresh == 0 || d.Refresh == o.Refresh)
+	case *float64:
+		return math.Abs(*d-*observed.(*float64)) < 1e-6
+	case *outputs.Scenario:
+		o := observed.(*outputs.Scenario)
+		return d.Name == o.Name && (len(d.Args) == 0 && len(o.Args) == 0 || reflect.DeepEqual(d.Args, o.Args))
+	default:
+		return reflect.DeepEqual(desired, observed)
+	}
+}
+
+// reconcileStatus keeps track of attempts to correct the drift of a display.
+type reconcileStatus struct {
+	// attempts since the display was last observed as desired
+	attempts int
+	// number of reconciliations to skip before the next attempt
+	skip int
+}
+
+// desiredReport is published to the desired topic of every output.
+type desiredReport struct {
+	// the state set by commands, fields not set aren't desired
+	State *outputs.State `json:"state"`
+	// the state set by the active entries of the schedule, taking precedence
+	Scheduled *outputs.State `json:"scheduled,omitempty"`
+	// names of the fields observed differently
+	Drift []string `json:"drift"`
+	// attempts to correct the drift so far
+	Attempts int `json:"attempts,omitempty"`
+}
+
+// desiredState returns a copy of the desired state of the display connected to
+// output, and the status of reconciling it.
+func (s *Server) desiredState(output outputs.Output) (*outputs.State, reconcileStatus) {
+	key := getDisplayKey(output.GetInfo())
+
+	s.muDesired.Lock()
+	defer s.muDesired.Unlock()
+
+	var desired outputs.State
+	if d, ok := s.desired[key]; ok {
+		mergeState(&desired, d)
+	}
+	return &desired, s.reconcileStatus[key]
+}
+
+// targetState returns the state an output is reconciled towards: desired, with
+// the fields set by the active entries of the schedule taking precedence, like
+// when the display reappears. Otherwise, reconciling would revert every
+// scheduled change of a field set by a command before.
+func targetState(desired *outputs.State, scheduled *outputs.State) *outputs.State {
+	var target outputs.State
+	mergeState(&target, desired)
+	mergeState(&target, scheduled)
+	return &target
+}
+
+// publishDesired publishes the desired state of an output, and how the
+// observed state differs from it.
+func (s *Server) publishDesired(output outputs.Output) error {
+	desired, status := s.desiredState(output)
+	scheduled := s.scheduledState(output)
+	report := &desiredReport{
+		State:    desired,
+		Drift:    drift(targetState(desired, scheduled), output.GetState()),
+		Attempts: status.attempts,
+	}
+	if *scheduled != (outputs.State{}) {
+		report.Scheduled = scheduled
+	}
+
+	reportJSON, err := json.Marshal(report)
+	if err != nil {
+		return fmt.Errorf("unable to marshal desired state json: %w", err)
+	}
+	if err := s.publishRetained(s.getTopicPrefixForOutput(output)+"/desired", reportJSON); err != nil {
+		return fmt.Errorf("unable to publish desired state: %w", err)
+	}
+	return nil
+}
+
+// reconcileLoop reconciles all outputs every ReconcileInterval, until ctx is
+// cancelled.
+func (s *Server) reconcileLoop(ctx context.Context) {
+	ticker := time.NewTicker(s.ReconcileInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, output := range s.currentOutputs() {
+				s.reconcile(output)
+			}
+		}
+	}
+}
+
+// reconcile applies the target value of all enforced fields observed
+// differently again, see targetState.
+func (s *Server) reconcile(output outputs.Output) {
+	info := output.GetInfo()
+	l := log.WithField("outputName", *info.Name)
+
+	desired, _ := s.desiredState(output)
+	target := targetState(desired, s.scheduledState(output))
+	drifting := drift(s.enforced(target), output.GetState())
+
+	if s.shouldReconcile(getDisplayKey(info), len(drifting) != 0) {
+		l = l.WithField("fields", drifting)
+		if _, err := output.SetState(onlyFields(target, drifting)); err != nil {
+			l.WithError(err).Error("unable to correct drift")
+		} else {
+			l.Info("corrected drift")
+		}
+	}
+
+	s.whileCurrent(output, func() {
+		if err := s.publishDesired(output); err != nil {
+			l.WithError(err).Warn("unable to publish desired state")
+		}
+	})
+}
+
+// shouldReconcile updates the reconcile status of a display, and returns
+// whether to attempt correcting its drift now.
+// If that keeps failing, or the drift keeps coming back, attempts are backed
+// off exponentially.
+func (s *Server) shouldReconcile(key displayKey, drifting bool) bool {
+	s.muDesired.Lock()
+	defer s.muDesired.Unlock()
+
+	if !drifting {
+		delete(s.reconcileStatus, key)
+		return false
+	}
+
+	status := s.reconcileStatus[key]
+	if status.skip > 0 {
+		status.skip--
+		s.reconcileStatus[key] = status
+		return false
+	}
+
+	// wait twice as long after every attempt.
+	status.attempts++
+	status.skip = 1<<min(status.attempts-1, 16) - 1
+	if maxSkip := max(int(maxReconcileBackoff/s.ReconcileInterval)-1, 0); status.skip > maxSkip {
+		status.skip = maxSkip
+	}
+	s.reconcileStatus[key] = status
+	return true
+}
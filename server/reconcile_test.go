@@ -0,0 +1,156 @@
+package server
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/flokli/display-agent/outputs"
+)
+
+func TestFieldEqual(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		desired  interface{}
+		observed interface{}
+		expected bool
+	}{
+		{"same mode", &outputs.Mode{Width: 1920, Height: 1080, Refresh: 60000}, &outputs.Mode{Width: 1920, Height: 1080, Refresh: 60000}, true},
+		{"any refresh", &outputs.Mode{Width: 1920, Height: 1080}, &outputs.Mode{Width: 1920, Height: 1080, Refresh: 50000}, true},
+		{"other refresh", &outputs.Mode{Width: 1920, Height: 1080, Refresh: 60000}, &outputs.Mode{Width: 1920, Height: 1080, Refresh: 50000}, false},
+		{"other size", &outputs.Mode{Width: 1280, Height: 1024}, &outputs.Mode{Width: 1920, Height: 1080, Refresh: 60000}, false},
+		{"float32 scale", ptr(1.1), ptr(float64(float32(1.1))), true},
+		{"other scale", ptr(1.0), ptr(1.5), false},
+		{"scenario without args", &outputs.Scenario{Name: "blank"}, &outputs.Scenario{Name: "blank", Args: []string{}}, true},
+		{"same args", &outputs.Scenario{Name: "url", Args: []string{"https://example.com"}}, &outputs.Scenario{Name: "url", Args: []string{"https://example.com"}}, true},
+		{"other args", &outputs.Scenario{Name: "url", Args: []string{"https://example.com"}}, &outputs.Scenario{Name: "url", Args: []string{"https://example.org"}}, false},
+		{"missing args", &outputs.Scenario{Name: "url", Args: []string{"https://example.com"}}, &outputs.Scenario{Name: "url"}, false},
+		{"other scenario", &outputs.Scenario{Name: "blank"}, &outputs.Scenario{Name: "url"}, false},
+		{"same transform", ptr("90"), ptr("90"), true},
+		{"other transform", ptr("90"), ptr("normal"), false},
+		{"other position", &outputs.Position{X: 0}, &outputs.Position{X: 1920}, false},
+	} {
+		if got := fieldEqual(tc.desired, tc.observed); got != tc.expected {
+			t.Errorf("%v: expected %v, got %v", tc.name, tc.expected, got)
+		}
+	}
+}
+
+func TestDrift(t *testing.T) {
+	desired := &outputs.State{
+		Mode:      &outputs.Mode{Width: 1280, Height: 1024},
+		Scale:     ptr(2.0),
+		Transform: ptr("90"),
+		Power:     ptr(false),
+		// not observed, as the backend doesn't support it
+		SubpixelHinting: ptr("rgb"),
+	}
+	observed := &outputs.State{
+		Mode:      &outputs.Mode{Width: 1280, Height: 1024, Refresh: 60000},
+		Scale:     ptr(1.0),
+		Transform: ptr("90"),
+		Power:     ptr(true),
+		// not desired
+		Enabled: ptr(true),
+	}
+
+	if got := drift(desired, observed); !reflect.DeepEqual(got, []string{"power", "scale"}) {
+		t.Errorf("expected power and scale to drift, got %v", got)
+	}
+	if got := drift(&outputs.State{}, observed); got == nil || len(got) != 0 {
+		t.Errorf("expected no drift without a desired state, got %#v", got)
+	}
+}
+
+func TestEnforced(t *testing.T) {
+	s := New("machine", "screens", nil)
+	s.Policies = map[string]string{"scale": outputs.PolicyReport, "power": outputs.PolicyEnforce}
+
+	state := &outputs.State{
+		Mode:     &outputs.Mode{Width: 1280, Height: 1024},
+		Power:    ptr(false),
+		Scale:    ptr(2.0),
+		Position: &outputs.Position{X: 1920},
+		Scenario: &outputs.Scenario{Name: "blank"},
+	}
+	expected := &outputs.State{
+		Mode:     state.Mode,
+		Power:    state.Power,
+		Scenario: state.Scenario,
+	}
+	if got := s.enforced(state); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", formatState(expected), formatState(got))
+	}
+}
+
+// Attempts are backed off exponentially while drifting, up to
+// maxReconcileBackoff, and start over once the drift is gone.
+func TestShouldReconcile(t *testing.T) {
+	s := New("machine", "screens", nil)
+	s.ReconcileInterval = time.Minute
+	key := displayKey{Make: "HP", Model: "L2245w", Serial: "CNK9280KND"}
+
+	var attempts []int
+	for i := 1; i <= 100; i++ {
+		if s.shouldReconcile(key, true) {
+			attempts = append(attempts, i)
+		}
+	}
+	// the backoff is capped at 30 reconciliations.
+	if expected := []int{1, 2, 4, 8, 16, 32, 62, 92}; !reflect.DeepEqual(attempts, expected) {
+		t.Errorf("expected attempts at %v, got %v", expected, attempts)
+	}
+
+	if s.shouldReconcile(key, false) {
+		t.Error("expected no attempt without drift")
+	}
+	if _, ok := s.reconcileStatus[key]; ok {
+		t.Error("expected the status to be reset without drift")
+	}
+	if !s.shouldReconcile(key, true) {
+		t.Error("expected an attempt right away once drifting again")
+	}
+}
+
+// Only the enforced fields drifting are corrected, but all drifting fields
+// are reported.
+func TestReconcile(t *testing.T) {
+	s := New("machine", "screens", nil)
+	b := newFakeBroker()
+	s.mqttClient = b
+	s.ReconcileInterval = time.Minute
+
+	output := &recordingOutput{staticOutput: newStaticOutput("HDMI-A-1")}
+	s.outputs["HDMI-A-1"] = output
+	output.state.Mode = &outputs.Mode{Width: 1920, Height: 1080, Refresh: 60000}
+	output.state.Power = ptr(true)
+	output.state.Scale = ptr(1.0)
+
+	s.rememberDesired(output, &outputs.State{
+		Mode:  &outputs.Mode{Width: 1280, Height: 1024},
+		Power: ptr(false),
+		Scale: ptr(1.0),
+	})
+
+	s.reconcile(output)
+
+	set := output.Set()
+	expected := outputs.State{Mode: &outputs.Mode{Width: 1280, Height: 1024}}
+	if len(set) != 1 || !reflect.DeepEqual(set[0], expected) {
+		t.Fatalf("expected only the mode to be corrected, got %v", set)
+	}
+
+	var report desiredReport
+	if err := json.Unmarshal(b.Retained("screens/HDMI-A-1@machine/desired"), &report); err != nil {
+		t.Fatalf("unable to parse desired report: %v", err)
+	}
+	if !reflect.DeepEqual(report.Drift, []string{"mode", "power"}) || report.Attempts != 1 {
+		t.Errorf("expected mode and power to drift after one attempt, got %+v", report)
+	}
+}
+
+// ptr returns a pointer to v.
+func ptr[T any](v T) *T {
+	return &v
+}
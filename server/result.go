@@ -0,0 +1,78 @@
+package server
+
+import (
+	"errors"
+
+	"github.com/flokli/display-agent/outputs"
+)
+
+// setCmd is the payload of the set topic: a (sparse) state, optionally with a
+// correlation id, which is sent back in the result.
+type setCmd struct {
+	outputs.State
+	CorrelationID string `json:"correlation_id,omitempty"`
+}
+
+// Error codes used in results.
+const (
+	// the value isn't valid, no backend would accept it
+	errorCodeInvalid = "invalid"
+	// the backend or display server doesn't support the field
+	errorCodeUnsupported = "unsupported"
+	// applying the value failed
+	errorCodeFailed = "failed"
+)
+
+// setResult is published to the result topic for every message received on
+// the set topic.
+type setResult struct {
+	// copied from the set command
+	CorrelationID string `json:"correlation_id,omitempty"`
+	Success       bool   `json:"success"`
+	// human-readable description of what went wrong
+	Error string `json:"error,omitempty"`
+	// errors for individual fields, keyed by the field name
+	Errors map[string]*fieldResult `json:"errors,omitempty"`
+	// the state after applying the set command
+	State *outputs.State `json:"state"`
+}
+
+type fieldResult struct {
+	// one of the error codes above
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func newSetResult(correlationID string, state *outputs.State, err error) *setResult {
+	r := &setResult{
+		CorrelationID: correlationID,
+		Success:       err == nil,
+		State:         state,
+	}
+	if err == nil {
+		return r
+	}
+
+	r.Error = err.Error()
+	for _, fieldErr := range outputs.FieldErrors(err) {
+		if r.Errors == nil {
+			r.Errors = make(map[string]*fieldResult)
+		}
+		r.Errors[fieldErr.Field] = &fieldResult{
+			Code:    errorCode(fieldErr.Err),
+			Message: fieldErr.Err.Error(),
+		}
+	}
+	return r
+}
+
+func errorCode(err error) string {
+	switch {
+	case errors.Is(err, outputs.ErrInvalid):
+		return errorCodeInvalid
+	case errors.Is(err, outputs.ErrUnsupported):
+		return errorCodeUnsupported
+	default:
+		return errorCodeFailed
+	}
+}
@@ -0,0 +1,404 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/flokli/display-agent/mqtt"
+	"github.com/flokli/display-agent/outputs"
+	"github.com/flokli/display-agent/schedule"
+	log "github.com/sirupsen/logrus"
+)
+
+// Whenever entries of the schedule fire, their states are applied to the
+// outputs they match, like commands sent to their set topics.
+// After starting, changing the schedule, or the clock going backwards, the
+// states of all entries are applied again, in the order they fired last, so
+// outputs end up the way the schedule has them at that time. The same happens
+// to outputs appearing, after their desired state was restored, so the
+// schedule wins. It's only done by the schedule loop, so states are never
+// applied twice, or out of order.
+// If StateFile is set, a schedule set via the schedule topic is persisted next
+// to it, and used again after restarting.
+
+// scheduleCmd is the payload of the schedule topic.
+type scheduleCmd struct {
+	schedule.Schedule
+	CorrelationID string `json:"correlation_id,omitempty"`
+}
+
+// scheduleResult is published to the machine result topic for every message
+// received on the schedule topic.
+type scheduleResult struct {
+	// copied from the schedule command
+	CorrelationID string `json:"correlation_id,omitempty"`
+	Success       bool   `json:"success"`
+	// human-readable description of what went wrong
+	Error string `json:"error,omitempty"`
+}
+
+// scheduleStatus is published to the schedule status topic.
+type scheduleStatus struct {
+	Schedule *schedule.Schedule `json:"schedule"`
+	// the entry fired last, if any
+	Active *scheduledChange `json:"active"`
+	// the entry firing next, if any
+	Next *scheduledChange `json:"next"`
+}
+
+type scheduledChange struct {
+	Entry string    `json:"entry"`
+	Time  time.Time `json:"time"`
+}
+
+// configuredSchedule returns Schedule, or an empty one if it's not set.
+func (s *Server) configuredSchedule() *schedule.Schedule {
+	if s.Schedule == nil {
+		return &schedule.Schedule{}
+	}
+	return s.Schedule
+}
+
+// currentPlan returns the plan of the schedule currently used.
+func (s *Server) currentPlan() *schedule.Plan {
+	s.muSchedule.Lock()
+	defer s.muSchedule.Unlock()
+	return s.plan
+}
+
+// wakeSchedule makes the schedule loop evaluate the schedule, and publish its
+// status again.
+func (s *Server) wakeSchedule() {
+	select {
+	case s.scheduleWake <- struct{}{}:
+	default:
+	}
+}
+
+// subscribeScheduleTopic subscribes to the machine-wide schedule topic.
+func (s *Server) subscribeScheduleTopic() {
+	topic := s.getTopicPrefixForMachine() + "/schedule"
+	if err := mqtt.Subscribe(s.mqttClient, topic, 0, func(m *mqtt.Message) {
+		l := log.WithFields(log.Fields{
+			"payload": m.Payload,
+			"topic":   topic,
+			"sender":  m.UserProperties[senderProperty],
+		})
+		l.Debug("received message")
+
+		resultTopic := s.getTopicPrefixForMachine() + "/result"
+		payload, ok := s.authenticate(m, topic, resultTopic, l)
+		if !ok {
+			return
+		}
+		result := s.handleScheduleCmd(payload)
+		if !result.Success {
+			l.WithField("error", result.Error).Error("unable to handle scheduleCmd")
+		}
+		s.publishResult(m, resultTopic, result, l)
+	}); err != nil {
+		log.WithField("topic", topic).WithError(err).Error("unable to subscribe to schedule topic")
+	}
+}
+
+// handleScheduleCmd replaces the schedule with the one in payload, or the
+// configured one if payload is empty.
+func (s *Server) handleScheduleCmd(payload []byte) *scheduleResult {
+	var cmd scheduleCmd
+	sched := s.configuredSchedule()
+	if len(payload) != 0 {
+		if err := json.Unmarshal(payload, &cmd); err != nil {
+			return &scheduleResult{Error: fmt.Sprintf("failed to parse schedule payload: %v", err)}
+		}
+		sched = &cmd.Schedule
+	}
+
+	plan, err := schedule.Compile(sched)
+	if err != nil {
+		return &scheduleResult{
+			CorrelationID: cmd.CorrelationID,
+			Error:         fmt.Sprintf("invalid schedule: %v", err),
+		}
+	}
+
+	// the configured schedule isn't persisted, it's used anyways.
+	var persisted *schedule.Schedule
+	if len(payload) != 0 {
+		persisted = sched
+	}
+
+	// the file is written while holding the lock, so writes don't overtake
+	// each other.
+	s.muSchedule.Lock()
+	s.plan = plan
+	if err := s.saveSchedule(persisted); err != nil {
+		log.WithError(err).Error("unable to save schedule")
+	}
+	s.muSchedule.Unlock()
+	s.wakeSchedule()
+
+	return &scheduleResult{CorrelationID: cmd.CorrelationID, Success: true}
+}
+
+// scheduleFile returns the file the schedule set via the schedule topic is
+// persisted in, next to StateFile (state.schedule.json for state.json), or an
+// empty string if StateFile isn't set.
+func (s *Server) scheduleFile() string {
+	if s.StateFile == "" {
+		return ""
+	}
+	ext := filepath.Ext(s.StateFile)
+	return strings.TrimSuffix(s.StateFile, ext) + ".schedule" + ext
+}
+
+// loadSchedule uses the schedule persisted in scheduleFile, if it exists.
+func (s *Server) loadSchedule() error {
+	path := s.scheduleFile()
+	if path == "" {
+		return nil
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("unable to read schedule file: %w", err)
+	}
+
+	var sched schedule.Schedule
+	if err := json.Unmarshal(b, &sched); err != nil {
+		return fmt.Errorf("unable to parse schedule file: %w", err)
+	}
+	plan, err := schedule.Compile(&sched)
+	if err != nil {
+		return fmt.Errorf("invalid schedule in schedule file: %w", err)
+	}
+
+	s.muSchedule.Lock()
+	s.plan = plan
+	s.muSchedule.Unlock()
+	return nil
+}
+
+// saveSchedule persists sched in scheduleFile, or removes it if sched is nil.
+// muSchedule needs to be held.
+func (s *Server) saveSchedule(sched *schedule.Schedule) error {
+	path := s.scheduleFile()
+	if path == "" {
+		return nil
+	}
+
+	if sched == nil {
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("unable to remove schedule file: %w", err)
+		}
+		return nil
+	}
+
+	b, err := json.MarshalIndent(sched, "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to marshal schedule file: %w", err)
+	}
+	if err := replaceFile(path, b); err != nil {
+		return fmt.Errorf("unable to write schedule file: %w", err)
+	}
+	return nil
+}
+
+// scheduleLoop applies the states of entries whenever they fire, and to
+// outputs received on scheduleAdd, until ctx is cancelled.
+func (s *Server) scheduleLoop(ctx context.Context) {
+	var (
+		// the plan evaluated last, and when its entries fired last then
+		plan *schedule.Plan
+		last []time.Time
+		// the outputs received on scheduleAdd, by their names
+		added = make(map[string]outputs.Output)
+	)
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case output := <-s.scheduleAdd:
+			added[*output.GetInfo().Name] = output
+			// otherwise, it's applied by the first evaluation.
+			if plan != nil {
+				s.applyScheduled(output, allFired(plan, last))
+			}
+			continue
+		case <-s.scheduleWake:
+			if !timer.Stop() {
+				<-timer.C
+			}
+		case <-timer.C:
+		}
+
+		now := s.now()
+		current := s.currentPlan()
+		fired := current.Last(now)
+
+		var apply []schedule.Fire
+		if current == plan && !wentBackwards(last, fired) {
+			// only entries which fired since.
+			for i, t := range fired {
+				if t.After(last[i]) {
+					apply = append(apply, schedule.Fire{Entry: current.Schedule.Entries[i], Time: t})
+				}
+			}
+			sortFires(apply)
+		} else {
+			if current == plan {
+				log.Info("clock went backwards, applying the schedule again")
+			}
+			apply = allFired(current, fired)
+		}
+		plan, last = current, fired
+
+		// outputs not added yet get all fired entries once they are.
+		stillAdded := make(map[string]outputs.Output)
+		for _, output := range s.currentOutputs() {
+			outputName := *output.GetInfo().Name
+			if added[outputName] == output {
+				stillAdded[outputName] = output
+				s.applyScheduled(output, apply)
+			}
+		}
+		added = stillAdded
+
+		next := current.Next(now)
+		if err := s.publishScheduleStatus(current, fired, next); err != nil {
+			log.WithError(err).Warn("unable to publish schedule status")
+		}
+
+		// wake up for the next change, but at least every minute, as the timer
+		// doesn't notice the clock changing.
+		wait := time.Minute
+		if next != nil && next.Time.Sub(now) < wait {
+			wait = next.Time.Sub(now)
+		}
+		timer.Reset(wait)
+	}
+}
+
+// wentBackwards returns whether any entry fired last earlier than before, which
+// only happens if the clock went backwards.
+func wentBackwards(before []time.Time, after []time.Time) bool {
+	for i := range after {
+		if after[i].Before(before[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// allFired returns all entries of plan which fired, given when they fired
+// last, in the order they fired.
+func allFired(plan *schedule.Plan, last []time.Time) []schedule.Fire {
+	var fires []schedule.Fire
+	for i, t := range last {
+		if !t.IsZero() {
+			fires = append(fires, schedule.Fire{Entry: plan.Schedule.Entries[i], Time: t})
+		}
+	}
+	sortFires(fires)
+	return fires
+}
+
+// sortFires sorts fires by when they fired, keeping the order of the schedule
+// for entries firing at the same time.
+func sortFires(fires []schedule.Fire) {
+	sort.SliceStable(fires, func(i, j int) bool {
+		return fires[i].Time.Before(fires[j].Time)
+	})
+}
+
+// firedState returns the states of all fired entries matching info merged, in
+// the given order, so later ones win, and the names of these entries.
+func firedState(info *outputs.Info, fires []schedule.Fire) (*outputs.State, []string) {
+	var state outputs.State
+	var names []string
+	for _, f := range fires {
+		if f.Entry.Matches(info) {
+			mergeState(&state, &f.Entry.State)
+			names = append(names, f.Entry.Name)
+		}
+	}
+	return &state, names
+}
+
+// scheduledState returns the state the schedule currently has for output: the
+// states of all entries of the current schedule which fired so far, merged
+// like they're applied.
+func (s *Server) scheduledState(output outputs.Output) *outputs.State {
+	plan := s.currentPlan()
+	if plan == nil {
+		return &outputs.State{}
+	}
+	state, _ := firedState(output.GetInfo(), allFired(plan, plan.Last(s.now())))
+	return state
+}
+
+// applyScheduled applies the states of all fired entries matching output, in
+// the given order, so later ones win.
+// Unlike commands, they aren't remembered as desired, so they're not restored
+// once the schedule moves on. While they're active, reconciling enforces them
+// instead of the desired state, see reconcile.
+func (s *Server) applyScheduled(output outputs.Output, fires []schedule.Fire) {
+	info := output.GetInfo()
+
+	state, names := firedState(info, fires)
+	if len(names) == 0 {
+		return
+	}
+	cmd := setCmd{State: *state}
+
+	l := log.WithFields(log.Fields{
+		"outputName": *info.Name,
+		"entries":    names,
+	})
+	if result := s.setState(&cmd, output); !result.Success {
+		l.WithField("error", result.Error).Error("unable to apply schedule")
+		return
+	}
+	l.Info("applied schedule")
+}
+
+// publishScheduleStatus publishes the schedule, the entry fired last and the
+// one firing next, or clears it if the schedule is empty.
+func (s *Server) publishScheduleStatus(plan *schedule.Plan, last []time.Time, next *schedule.Fire) error {
+	topic := s.getTopicPrefixForMachine() + "/schedule/status"
+	if len(plan.Schedule.Entries) == 0 {
+		// an empty retained message clears it, and unlike clearRetained, it's
+		// only published once.
+		return s.publishRetained(topic, []byte{})
+	}
+
+	status := &scheduleStatus{Schedule: plan.Schedule}
+	for i, t := range last {
+		// entries firing at the same time are applied in order, the later
+		// one wins.
+		if !t.IsZero() && (status.Active == nil || !t.Before(status.Active.Time)) {
+			status.Active = &scheduledChange{Entry: plan.Schedule.Entries[i].Name, Time: t}
+		}
+	}
+	if next != nil {
+		status.Next = &scheduledChange{Entry: next.Entry.Name, Time: next.Time}
+	}
+
+	statusJSON, err := json.Marshal(status)
+	if err != nil {
+		return fmt.Errorf("unable to marshal schedule status json: %w", err)
+	}
+	return s.publishRetained(topic, statusJSON)
+}
@@ -0,0 +1,275 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/flokli/display-agent/outputs"
+	"github.com/flokli/display-agent/schedule"
+)
+
+// A schedule set via the schedule topic is used again after restarting, until
+// it's reset.
+func TestSchedulePersisted(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+	s := New("machine", "screens", nil)
+	s.StateFile = stateFile
+
+	result := s.handleScheduleCmd([]byte(`{"entries": [{"name": "night", "cron": "0 22 * * *", "state": {"power": false}}]}`))
+	if !result.Success {
+		t.Fatalf("unexpected error: %v", result.Error)
+	}
+	if s.scheduleFile() != filepath.Join(filepath.Dir(stateFile), "state.schedule.json") {
+		t.Errorf("unexpected schedule file %v", s.scheduleFile())
+	}
+
+	restarted := New("machine", "screens", nil)
+	restarted.StateFile = stateFile
+	if err := restarted.loadSchedule(); err != nil {
+		t.Fatalf("unable to load schedule: %v", err)
+	}
+	if entries := restarted.currentPlan().Schedule.Entries; len(entries) != 1 || entries[0].Name != "night" {
+		t.Errorf("expected the schedule to be restored, got %v", entries)
+	}
+
+	if result := s.handleScheduleCmd(nil); !result.Success {
+		t.Fatalf("unexpected error: %v", result.Error)
+	}
+	if _, err := os.Stat(s.scheduleFile()); !os.IsNotExist(err) {
+		t.Errorf("expected the schedule file to be removed, got %v", err)
+	}
+}
+
+// waitForEvaluation makes the schedule loop evaluate the schedule, and waits
+// until it published its status again.
+func waitForEvaluation(t *testing.T, s *Server, b *fakeBroker) {
+	topic := "screens/machine/schedule/status"
+	before := len(b.Published(topic))
+	// the status is unchanged, it's only published again once forgotten.
+	s.forgetPublished()
+	s.wakeSchedule()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(b.Published(topic)) == before && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if len(b.Published(topic)) == before {
+		t.Fatal("schedule wasn't evaluated")
+	}
+}
+
+// waitForSet waits until n states were set on output, and returns them.
+func waitForSet(t *testing.T, output *recordingOutput, n int) []outputs.State {
+	deadline := time.Now().Add(5 * time.Second)
+	for len(output.Set()) < n && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	set := output.Set()
+	if len(set) != n {
+		t.Fatalf("expected %v states to be set, got %v", n, set)
+	}
+	return set
+}
+
+// New outputs get the schedule once, from the schedule loop, after their
+// state was restored.
+func TestScheduleAppliedToAddedOutputs(t *testing.T) {
+	s := New("machine", "screens", nil)
+	b := newFakeBroker()
+	s.mqttClient = b
+	power := false
+	plan, err := schedule.Compile(&schedule.Schedule{Entries: []*schedule.Entry{
+		{Name: "newyear", Cron: "0 0 1 1 *", State: outputs.State{Power: &power}},
+	}})
+	if err != nil {
+		t.Fatalf("invalid schedule: %v", err)
+	}
+	s.plan = plan
+
+	output := &recordingOutput{staticOutput: newStaticOutput("HDMI-A-1")}
+	s.outputs["HDMI-A-1"] = output
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.scheduleLoop(ctx)
+
+	// the output isn't changed until its state was restored.
+	waitForEvaluation(t, s, b)
+	if set := output.Set(); len(set) != 0 {
+		t.Fatalf("expected the output not to be changed before it was added, got %v", set)
+	}
+
+	s.scheduleAdd <- output
+	set := waitForSet(t, output, 1)
+	if set[0].Power == nil || *set[0].Power {
+		t.Errorf("expected the output to be turned off, got %v", set[0].LogFields(""))
+	}
+
+	// evaluating the schedule again doesn't apply it again.
+	waitForEvaluation(t, s, b)
+	if set := output.Set(); len(set) != 1 {
+		t.Errorf("expected the schedule to be applied once, got %v", set)
+	}
+}
+
+func TestWentBackwards(t *testing.T) {
+	t0 := time.Date(2026, 3, 10, 7, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		name     string
+		before   []time.Time
+		after    []time.Time
+		expected bool
+	}{
+		{"unchanged", []time.Time{t0, {}}, []time.Time{t0, {}}, false},
+		{"fired", []time.Time{t0, {}}, []time.Time{t0.Add(24 * time.Hour), t0.Add(time.Hour)}, false},
+		{"earlier", []time.Time{t0, t0}, []time.Time{t0, t0.Add(-24 * time.Hour)}, true},
+		{"not fired anymore", []time.Time{t0}, []time.Time{{}}, true},
+	} {
+		if got := wentBackwards(tc.before, tc.after); got != tc.expected {
+			t.Errorf("%v: expected %v, got %v", tc.name, tc.expected, got)
+		}
+	}
+}
+
+// Only entries which fired since are applied, but all of them again once the
+// clock went backwards.
+func TestScheduleClockJump(t *testing.T) {
+	s := New("machine", "screens", nil)
+	b := newFakeBroker()
+	s.mqttClient = b
+	on, off := true, false
+	plan, err := schedule.Compile(&schedule.Schedule{TimeZone: "UTC", Entries: []*schedule.Entry{
+		{Name: "morning", Cron: "0 7 * * *", State: outputs.State{Power: &on}},
+		{Name: "night", Cron: "0 22 * * *", State: outputs.State{Power: &off, Scenario: &outputs.Scenario{Name: "blank"}}},
+	}})
+	if err != nil {
+		t.Fatalf("invalid schedule: %v", err)
+	}
+	s.plan = plan
+
+	var muNow sync.Mutex
+	now := time.Date(2026, 3, 10, 23, 0, 0, 0, time.UTC)
+	s.now = func() time.Time {
+		muNow.Lock()
+		defer muNow.Unlock()
+		return now
+	}
+	setNow := func(t time.Time) {
+		muNow.Lock()
+		defer muNow.Unlock()
+		now = t
+	}
+
+	output := &recordingOutput{staticOutput: newStaticOutput("HDMI-A-1")}
+	s.outputs["HDMI-A-1"] = output
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.scheduleLoop(ctx)
+
+	// both fired, night last.
+	s.scheduleAdd <- output
+	set := waitForSet(t, output, 1)
+	if set[0].Power == nil || *set[0].Power || set[0].Scenario == nil {
+		t.Fatalf("expected the night to be applied, got %v", set[0].LogFields(""))
+	}
+
+	// only the morning fired since.
+	setNow(time.Date(2026, 3, 11, 8, 0, 0, 0, time.UTC))
+	waitForEvaluation(t, s, b)
+	set = waitForSet(t, output, 2)
+	if set[1].Power == nil || !*set[1].Power || set[1].Scenario != nil {
+		t.Fatalf("expected only the morning to be applied, got %v", set[1].LogFields(""))
+	}
+
+	// back to the night before, everything is applied again.
+	setNow(time.Date(2026, 3, 10, 23, 0, 0, 0, time.UTC))
+	waitForEvaluation(t, s, b)
+	set = waitForSet(t, output, 3)
+	if set[2].Power == nil || *set[2].Power || set[2].Scenario == nil {
+		t.Errorf("expected the night to be applied again, got %v", set[2].LogFields(""))
+	}
+}
+
+// Scheduled states are applied, but not remembered as desired.
+func TestScheduledNotDesired(t *testing.T) {
+	s := New("machine", "screens", nil)
+	s.mqttClient = newFakeBroker()
+	output := &recordingOutput{staticOutput: newStaticOutput("HDMI-A-1")}
+	s.outputs["HDMI-A-1"] = output
+
+	power := true
+	s.rememberDesired(output, &outputs.State{Power: &power})
+
+	off := false
+	s.applyScheduled(output, []schedule.Fire{
+		{Entry: &schedule.Entry{Name: "night", State: outputs.State{Power: &off}}, Time: time.Now()},
+	})
+
+	if set := output.Set(); len(set) != 1 || set[0].Power == nil || *set[0].Power {
+		t.Fatalf("expected the output to be turned off, got %v", set)
+	}
+	if desired, _ := s.desiredState(output); desired == nil || desired.Power == nil || !*desired.Power {
+		t.Errorf("expected the desired state to be unchanged, got %v", desired)
+	}
+	if published := s.mqttClient.(*fakeBroker).Published("screens/HDMI-A-1@machine/desired"); len(published) != 0 {
+		t.Errorf("expected the desired state not to be published, got %q", published)
+	}
+}
+
+// Reconciling keeps the state of the active schedule entries, instead of
+// reverting it to the desired state set by commands before.
+func TestReconcileScheduled(t *testing.T) {
+	s := New("machine", "screens", nil)
+	s.mqttClient = newFakeBroker()
+	s.ReconcileInterval = time.Minute
+	plan, err := schedule.Compile(&schedule.Schedule{Entries: []*schedule.Entry{
+		{Name: "newyear", Cron: "0 0 1 1 *", State: outputs.State{Scenario: &outputs.Scenario{Name: "url", Args: []string{"https://example.com"}}}},
+	}})
+	if err != nil {
+		t.Fatalf("invalid schedule: %v", err)
+	}
+	s.plan = plan
+
+	output := &recordingOutput{staticOutput: newStaticOutput("HDMI-A-1")}
+	s.outputs["HDMI-A-1"] = output
+	scale := 1.0
+	output.state.Scale = &scale
+	output.state.Scenario = &outputs.Scenario{Name: "url", Args: []string{"https://example.com"}}
+
+	desiredScale := 2.0
+	s.rememberDesired(output, &outputs.State{
+		Scale:    &desiredScale,
+		Scenario: &outputs.Scenario{Name: "blank"},
+	})
+
+	// only the scale drifts, the scenario is the scheduled one.
+	s.reconcile(output)
+	set := output.Set()
+	if len(set) != 1 || set[0].Scale == nil || *set[0].Scale != 2 || set[0].Scenario != nil {
+		t.Fatalf("expected only the scale to be corrected, got %v", set)
+	}
+
+	// once the scenario drifts from the scheduled one, that one is applied
+	// again.
+	output.state.Scale = &desiredScale
+	output.state.Scenario = &outputs.Scenario{Name: "blank"}
+	s.reconcile(output)
+	set = output.Set()
+	if len(set) != 2 || set[1].Scenario == nil || set[1].Scenario.Name != "url" || set[1].Scale != nil {
+		t.Fatalf("expected the scheduled scenario to be applied again, got %v", set)
+	}
+
+	var report desiredReport
+	if err := json.Unmarshal(s.mqttClient.(*fakeBroker).Retained("screens/HDMI-A-1@machine/desired"), &report); err != nil {
+		t.Fatalf("unable to parse desired report: %v", err)
+	}
+	if report.State.Scenario.Name != "blank" || report.Scheduled == nil || report.Scheduled.Scenario.Name != "url" {
+		t.Errorf("expected the desired and scheduled scenario to be reported, got %+v", report)
+	}
+}
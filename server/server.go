@@ -3,46 +3,220 @@ package server
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"reflect"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	pahomqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/flokli/display-agent/auth"
 	"github.com/flokli/display-agent/mqtt"
 	"github.com/flokli/display-agent/outputs"
-	"github.com/flokli/display-agent/outputs/sway"
+	"github.com/flokli/display-agent/schedule"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/coreos/go-systemd/daemon"
 )
 
+const (
+	availabilityOnline  = "online"
+	availabilityOffline = "offline"
+
+	// MQTT 5 user property carrying the identity of whoever sent a message.
+	senderProperty = "sender"
+	// results nobody received within this time are dropped by the broker.
+	resultExpiry = 5 * time.Minute
+	// how long Close waits for the backend to stop
+	stopTimeout = 10 * time.Second
+)
+
+// connect connects to the broker, replaced by tests.
+var connect = mqtt.Connect
+
 type Server struct {
 	MachineID   string
 	TopicPrefix string
-	mqttClient  pahomqtt.Client
-	swayConn    *sway.Sway
-
-	muNumOutputs sync.Mutex
-	numOutputs   uint
+	// If set, Home Assistant discovery configs are published below this
+	// prefix (usually "homeassistant").
+	HomeAssistantDiscoveryPrefix string
+	// Protocol version, TLS and credentials used to connect to the broker.
+	// The will and OnConnect are set by Run.
+	MQTTOptions mqtt.ConnectOptions
+	// Published in the machine info.
+	Version     string
+	BackendName string
+	// Outputs matching any of the matches of a group can be controlled via
+	// the set topic of the group. Check outputs.ValidateGroups before.
+	Groups map[string][]outputs.Match
+	// Aliases and default scenarios of outputs, the first matching entry
+	// applies. Check outputs.ValidateOutputConfigs before.
+	OutputConfigs []outputs.OutputConfig
+	// If set, the state set by commands is persisted in this file, and
+	// applied again after restarting.
+	StateFile string
+	// If set, the desired state is compared with the observed one in this
+	// interval, and drifting fields are corrected according to Policies.
+	ReconcileInterval time.Duration
+	// Policies of the fields of the desired state, by their JSON names.
+	// Fields not set use defaultPolicies. Check outputs.ValidatePolicies before.
+	Policies map[string]string
+	// Applied to the outputs at the given times, until replaced via the
+	// schedule topic. Check Validate before.
+	Schedule *schedule.Schedule
+	// If set, all retained topics are published again in this interval, even
+	// if unchanged.
+	HeartbeatInterval time.Duration
+	// If set, commands need to be signed by one of its keys, all others are
+	// rejected.
+	Verifier *auth.Verifier
+
+	mqttClient mqtt.Client
+	backend    outputs.Backend
+	started    time.Time
+	// the goroutines started by Run, waited for by Close
+	loops sync.WaitGroup
+
+	// all current outputs, keyed by their names
+	muOutputs sync.Mutex
+	outputs   map[string]outputs.Output
+	// number of current outputs belonging to each group
+	groupRefs map[string]int
+
+	// the name used in the topics of every current output, keyed by its
+	// name, see assignTopicName
+	muTopicNames sync.Mutex
+	topicNames   map[string]string
+
+	// held while clearing the data of removed outputs, and read by
+	// whileCurrent while publishing it
+	muClearing sync.RWMutex
+
+	// the last payload published to every retained topic
+	muPublished sync.Mutex
+	published   map[string]*retainedTopic
+
+	// the Home Assistant discovery config topics published for every output,
+	// keyed by its name
+	muHomeAssistant sync.Mutex
+	haTopics        map[string]map[string]bool
+
+	// the state set by commands, and the status of reconciling it, keyed by
+	// display
+	muDesired       sync.Mutex
+	desired         map[displayKey]*outputs.State
+	reconcileStatus map[displayKey]reconcileStatus
+
+	// the schedule currently used, a channel to wake up its loop, and one to
+	// pass it new outputs once their state was restored
+	muSchedule   sync.Mutex
+	plan         *schedule.Plan
+	scheduleWake chan struct{}
+	scheduleAdd  chan outputs.Output
+	// the clock the schedule is evaluated with, replaced in tests
+	now func() time.Time
 }
 
-func New(machineID string, topicPrefix string) *Server {
+func New(machineID string, topicPrefix string, backend outputs.Backend) *Server {
 	return &Server{
-		MachineID:   machineID,
-		TopicPrefix: topicPrefix,
-		numOutputs:  0,
+		MachineID:       machineID,
+		TopicPrefix:     topicPrefix,
+		backend:         backend,
+		started:         time.Now(),
+		outputs:         make(map[string]outputs.Output),
+		groupRefs:       make(map[string]int),
+		topicNames:      make(map[string]string),
+		published:       make(map[string]*retainedTopic),
+		haTopics:        make(map[string]map[string]bool),
+		desired:         make(map[displayKey]*outputs.State),
+		reconcileStatus: make(map[displayKey]reconcileStatus),
+		scheduleWake:    make(chan struct{}, 1),
+		scheduleAdd:     make(chan outputs.Output),
+		now:             time.Now,
+	}
+}
+
+// currentOutputs returns all current outputs.
+// Unlike s.backend.Outputs, it can be called from handlers.
+func (s *Server) currentOutputs() []outputs.Output {
+	s.muOutputs.Lock()
+	defer s.muOutputs.Unlock()
+
+	outs := make([]outputs.Output, 0, len(s.outputs))
+	for _, output := range s.outputs {
+		outs = append(outs, output)
 	}
+	return outs
 }
 
+// Close waits for the backend and all loops to stop after the context passed
+// to Run was cancelled, marks the agent as offline and closes the backend.
+// The published output data was cleared when the backend removed the outputs.
 func (s *Server) Close() {
-	log.Debug("closing swayConn")
-	s.swayConn.Close()
+	log.Debug("waiting for backend to stop")
+	select {
+	case <-s.backend.Stopped():
+	case <-time.After(stopTimeout):
+		log.Warn("backend didn't stop in time")
+	}
+	s.loops.Wait()
+
+	if s.mqttClient != nil {
+		if err := mqtt.Publish(s.mqttClient, s.getAvailabilityTopic(), 1, true, availabilityOffline); err != nil {
+			log.WithError(err).Warn("unable to publish availability")
+		}
+		log.Debug("disconnecting from mqtt")
+		s.mqttClient.Disconnect()
+	}
+
+	log.Debug("closing backend")
+	s.backend.Close()
 }
 
 func (s *Server) Run(ctx context.Context, mqttServerURL string) error {
+	if s.StateFile != "" {
+		// not fatal, the state is only restored for convenience.
+		if err := s.loadDesired(); err != nil {
+			log.WithError(err).Error("unable to load desired state, starting over")
+		}
+	}
+
+	plan, err := schedule.Compile(s.configuredSchedule())
+	if err != nil {
+		return fmt.Errorf("invalid schedule: %w", err)
+	}
+	s.plan = plan
+	// not fatal, the configured schedule is used then.
+	if err := s.loadSchedule(); err != nil {
+		log.WithError(err).Error("unable to load schedule, using the configured one")
+	}
+
 	// setup mqtt
-	mqttClient, err := mqtt.Connect(mqttServerURL)
+	mqttOptions := s.MQTTOptions
+	// a stable client id, so the broker keeps our session across reconnects.
+	if mqttOptions.ClientID == "" {
+		mqttOptions.ClientID = "display-agent-" + s.MachineID
+	}
+	// let the broker mark us as offline if the connection breaks.
+	mqttOptions.WillTopic = s.getAvailabilityTopic()
+	mqttOptions.WillPayload = availabilityOffline
+	// The broker might have lost retained messages (or published the will)
+	// while we were disconnected, publish everything again.
+	// Outputs are published once they're added, which happens after the
+	// initial connection.
+	// OnConnect runs in a goroutine of the client, for every connection.
+	var reconnect atomic.Bool
+	mqttOptions.OnConnect = func(c mqtt.Client) {
+		if reconnect.Swap(true) {
+			s.republishAll()
+			return
+		}
+
+		if err := mqtt.Publish(c, s.getAvailabilityTopic(), 1, true, availabilityOnline); err != nil {
+			log.WithError(err).Warn("unable to publish availability")
+		}
+	}
+	mqttClient, err := connect(mqttServerURL, mqttOptions)
 	if err != nil {
 		log.Error("unable to connect to MQTT")
 		return fmt.Errorf("unable to connect to mqtt: %w", err)
@@ -50,53 +224,93 @@ func (s *Server) Run(ctx context.Context, mqttServerURL string) error {
 	s.mqttClient = mqttClient
 
 	log.WithFields(log.Fields{
-		"machineID":   s.MachineID,
-		"topicPrefix": s.TopicPrefix,
+		"machineID":       s.MachineID,
+		"topicPrefix":     s.TopicPrefix,
+		"protocolVersion": s.MQTTOptions.ProtocolVersion,
 	}).Info("Server started")
 
-	swayConn := sway.New(ctx, 1*time.Second)
-	s.swayConn = swayConn
+	if err := s.publishMachineInfo(); err != nil {
+		log.WithError(err).Warn("unable to publish machine info")
+	}
 
-	// what to do if there's a new output.
-	swayConn.RegisterOutputAdd(func(output outputs.Output) {
-		firstNewOutput := false
-		s.muNumOutputs.Lock()
-		// If we previously had no outputs and now have one, mark as ready.
-		if s.numOutputs == 0 {
-			firstNewOutput = true
+	// subscribe to the machine-wide and broadcast set topics
+	s.subscribeMachineSetTopics()
+
+	// subscribe to the machine-wide arrange topic
+	arrangeTopic := s.getTopicPrefixForMachine() + "/arrange"
+	if err := mqtt.Subscribe(s.mqttClient, arrangeTopic, 0, func(m *mqtt.Message) {
+		l := log.WithFields(log.Fields{
+			"payload": m.Payload,
+			"topic":   arrangeTopic,
+			"sender":  m.UserProperties[senderProperty],
+		})
+		l.Debug("received message")
+
+		resultTopic := s.getTopicPrefixForMachine() + "/result"
+		payload, ok := s.authenticate(m, arrangeTopic, resultTopic, l)
+		if !ok {
+			return
 		}
-		s.numOutputs = s.numOutputs + 1
-		s.muNumOutputs.Unlock()
+		result := s.handleArrangeCmd(payload)
+		if !result.Success {
+			l.WithField("error", result.Error).Error("unable to handle arrangeCmd")
+		}
+		s.publishResult(m, resultTopic, result, l)
+	}); err != nil {
+		log.WithField("topic", arrangeTopic).WithError(err).Error("unable to subscribe to arrange topic")
+	}
 
+	// subscribe to the machine-wide schedule topic
+	s.subscribeScheduleTopic()
+
+	// what to do if there's a new output.
+	s.backend.RegisterOutputAdd(func(output outputs.Output) {
 		outputName := *output.GetInfo().Name
 		l := log.WithField("outputName", outputName)
 
+		s.muOutputs.Lock()
+		// If we previously had no outputs and now have one, mark as ready.
+		firstNewOutput := len(s.outputs) == 0
+		s.outputs[outputName] = output
+		s.muOutputs.Unlock()
+
+		s.assignTopicName(output)
+
 		// subscribe to the MQTT set topic
-		topic := s.getTopicPrefixForOutputName(outputName) + "/set"
-		err := mqtt.Subscribe(s.mqttClient, topic, 0, func(c pahomqtt.Client, m pahomqtt.Message) {
+		topicPrefix := s.getTopicPrefixForOutput(output)
+		topic := topicPrefix + "/set"
+		err := mqtt.Subscribe(s.mqttClient, topic, 0, func(m *mqtt.Message) {
 			l := l.WithFields(log.Fields{
-				"message_id": m.MessageID(),
-				"payload":    m.Payload(),
-				"topic":      topic,
+				"payload": m.Payload,
+				"topic":   topic,
+				"sender":  m.UserProperties[senderProperty],
 			})
 			l.Debug("received message")
 
-			if m.Topic() != topic {
+			if m.Topic != topic {
 				// This should only happen if the broker sends us unsolicited messages,
 				// and/or the client doesn't properly route them to the right callbacks.
 				log.Warn("discarded unrelated message")
 				return
 			}
 
-			if err := handleSetCmd(m.Payload(), output); err != nil {
-				log.WithError(err).Error("unable to handle setCmd")
+			resultTopic := topicPrefix + "/result"
+			payload, ok := s.authenticate(m, topic, resultTopic, l)
+			if !ok {
+				return
 			}
-
+			result := s.handleSetCmd(payload, output)
+			if !result.Success {
+				l.WithField("error", result.Error).Error("unable to handle setCmd")
+			}
+			s.publishResult(m, resultTopic, result, l)
 		})
 		if err != nil {
 			l.WithField("topic", topic).WithError(err).Error("unable to subscribe to set topic")
 		}
 
+		s.joinGroups(output)
+
 		// mark as ready if this was the first output for which we published state, info
 		// and subscribed to the set topic.
 		if firstNewOutput {
@@ -108,50 +322,105 @@ func (s *Server) Run(ctx context.Context, mqttServerURL string) error {
 		} else {
 			daemon.SdNotify(false, "WATCHDOG=1")
 		}
+		if err := s.publishHomeAssistantDiscovery(output); err != nil {
+			log.WithError(err).Warn("unable to publish Home Assistant discovery")
+		}
+		if err := s.publishMachineInfo(); err != nil {
+			log.WithError(err).Warn("unable to publish machine info")
+		}
+
+		s.goLoop(func() {
+			s.restoreState(output)
+			select {
+			case s.scheduleAdd <- output:
+			case <-ctx.Done():
+			}
+		})
 	})
 
-	swayConn.RegisterOutputUpdate(func(output outputs.Output) {
-		if err := s.publishOutputData(output); err != nil {
-			log.WithError(err).Warn("unable to publish output data")
-		} else {
-			daemon.SdNotify(false, "WATCHDOG=1")
-		}
+	s.backend.RegisterOutputUpdate(func(output outputs.Output) {
+		// updates might still arrive for outputs removed already, which would
+		// restore their cleared data.
+		s.whileCurrent(output, func() {
+			if err := s.publishOutputData(output); err != nil {
+				log.WithError(err).Warn("unable to publish output data")
+			} else {
+				daemon.SdNotify(false, "WATCHDOG=1")
+			}
+			// the available modes might have changed.
+			if err := s.publishHomeAssistantDiscovery(output); err != nil {
+				log.WithError(err).Warn("unable to publish Home Assistant discovery")
+			}
+		})
 	})
 
 	// what to do if the output is removed
-	swayConn.RegisterOutputRemove(func(output outputs.Output) {
-		s.muNumOutputs.Lock()
-		s.numOutputs = s.numOutputs - 1
-		s.muNumOutputs.Unlock()
-
+	s.backend.RegisterOutputRemove(func(output outputs.Output) {
 		outputName := *output.GetInfo().Name
 		l := log.WithField("outputName", outputName)
+
+		s.muOutputs.Lock()
+		delete(s.outputs, outputName)
+		s.muOutputs.Unlock()
+
 		// unsubscribe from the MQTT set topic
-		err := mqtt.Unsubscribe(s.mqttClient, []string{s.getTopicPrefixForOutputName(outputName) + "/set"})
+		err := mqtt.Unsubscribe(s.mqttClient, []string{s.getTopicPrefixForOutput(output) + "/set"})
 		if err != nil {
 			l.WithError(err).Warn("unable to unsubscribe")
 		}
 
-		// publish an empty string to the topics state and info
-		if err := mqtt.Publish(s.mqttClient, s.getTopicPrefixForOutputName(outputName)+"/state", 0, false, []byte("{}")); err != nil {
-			l.WithError(err).Warn("unable to publish empty string for state")
+		s.leaveGroups(output)
+
+		// publishes of the output in progress finish before, see whileCurrent.
+		s.muClearing.Lock()
+		s.clearOutputData(output)
+
+		// Outputs are also removed when shutting down. Keep them in Home
+		// Assistant in that case, they're marked unavailable.
+		if ctx.Err() == nil {
+			s.clearHomeAssistantDiscovery(output)
 		}
-		if err := mqtt.Publish(s.mqttClient, s.getTopicPrefixForOutputName(outputName)+"/info", 0, false, []byte("{}")); err != nil {
-			l.WithError(err).Warn("unable to publish empty string for info")
+		s.muClearing.Unlock()
+
+		s.releaseTopicName(output)
+
+		if err := s.publishMachineInfo(); err != nil {
+			l.WithError(err).Warn("unable to publish machine info")
 		}
 	})
 
+	if s.HeartbeatInterval > 0 {
+		s.goLoop(func() { s.heartbeat(ctx) })
+	}
+	if s.ReconcileInterval > 0 {
+		s.goLoop(func() { s.reconcileLoop(ctx) })
+	}
+	s.goLoop(func() { s.scheduleLoop(ctx) })
+
+	if err := s.backend.Start(ctx); err != nil {
+		return fmt.Errorf("unable to start backend: %w", err)
+	}
+
 	log.Info("server.Run() finished")
 
 	return nil
 }
 
+// goLoop runs fn in a new goroutine, waited for by Close.
+func (s *Server) goLoop(fn func()) {
+	s.loops.Add(1)
+	go func() {
+		defer s.loops.Done()
+		fn()
+	}()
+}
+
 // publishOutputData publishes all info about a given output to the mqtt broker.
 func (s *Server) publishOutputData(output outputs.Output) error {
 	state := output.GetState()
 	info := output.GetInfo()
 
-	topicPrefix := s.getTopicPrefixForOutputName(*info.Name)
+	topicPrefix := s.getTopicPrefixForOutput(output)
 
 	stateJSON, err := json.Marshal(&state)
 	if err != nil {
@@ -163,53 +432,231 @@ func (s *Server) publishOutputData(output outputs.Output) error {
 		return fmt.Errorf("unable to marshal info json: %w", err)
 	}
 
-	if err := mqtt.Publish(s.mqttClient, topicPrefix+"/state", 0, false, string(stateJSON)); err != nil {
+	if err := s.publishRetained(topicPrefix+"/state", stateJSON); err != nil {
 		return fmt.Errorf("unable to publish state: %w", err)
 	}
-	if err := mqtt.Publish(s.mqttClient, topicPrefix+"/info", 0, false, string(infoJSON)); err != nil {
+	if err := s.publishRetained(topicPrefix+"/info", infoJSON); err != nil {
 		return fmt.Errorf("unable to publish info: %w", err)
 	}
 
-	return nil
+	return s.publishDesired(output)
+}
+
+// clearOutputData removes the retained state, info and desired state of a
+// given output from
+// the mqtt broker, by publishing an empty retained message.
+func (s *Server) clearOutputData(output outputs.Output) {
+	l := log.WithField("outputName", *output.GetInfo().Name)
+	topicPrefix := s.getTopicPrefixForOutput(output)
+
+	if err := s.clearRetained(topicPrefix + "/state"); err != nil {
+		l.WithError(err).Warn("unable to clear state")
+	}
+	if err := s.clearRetained(topicPrefix + "/info"); err != nil {
+		l.WithError(err).Warn("unable to clear info")
+	}
+	if err := s.clearRetained(topicPrefix + "/desired"); err != nil {
+		l.WithError(err).Warn("unable to clear desired state")
+	}
 }
 
-// decode the mqtt set command and update the output.
-func handleSetCmd(payload []byte, output outputs.Output) error {
+// decode the mqtt set command, update the output, and return the result.
+// If it succeeded, the state is remembered as desired.
+func (s *Server) handleSetCmd(payload []byte, output outputs.Output) *setResult {
 	// Parse payload into (sparse) state
-	var setState *outputs.State
-	if err := json.Unmarshal(payload, &setState); err != nil {
-		return fmt.Errorf("failed to parse set payload: %w", err)
+	var cmd setCmd
+	if err := json.Unmarshal(payload, &cmd); err != nil {
+		return newSetResult("", output.GetState(), fmt.Errorf("failed to parse set payload: %w", err))
+	}
+	return s.applySetCmd(&cmd, output)
+}
+
+// applySetCmd validates and applies a parsed set command.
+// If it succeeded, the state is remembered as desired.
+func (s *Server) applySetCmd(cmd *setCmd, output outputs.Output) *setResult {
+	result := s.setState(cmd, output)
+	if result.Success {
+		// the command before deduplication, fields already set are desired too.
+		s.setDesired(output, &cmd.State)
+	}
+	return result
+}
+
+// setState validates and applies a parsed set command, without remembering
+// it as desired.
+func (s *Server) setState(cmd *setCmd, output outputs.Output) *setResult {
+	if err := cmd.State.Validate(); err != nil {
+		return newSetResult(cmd.CorrelationID, output.GetState(), fmt.Errorf("invalid set payload: %w", err))
 	}
 
 	// Dedup settings that are already set the way they should be.
-	currentState := output.GetState()
+	changes := cmd.State
+	removeUnchanged(&changes, output.GetState())
+
+	newState, err := output.SetState(&changes)
+	if err != nil {
+		return newSetResult(cmd.CorrelationID, newState, fmt.Errorf("unable to set state: %w", err))
+	}
+	return newSetResult(cmd.CorrelationID, newState, nil)
+}
+
+// setDesired remembers state as desired for output, and publishes it.
+func (s *Server) setDesired(output outputs.Output, state *outputs.State) {
+	s.rememberDesired(output, state)
+	s.whileCurrent(output, func() {
+		if err := s.publishDesired(output); err != nil {
+			log.WithField("outputName", *output.GetInfo().Name).WithError(err).Warn("unable to publish desired state")
+		}
+	})
+}
+
+// sameMode returns whether mode is the current one.
+// Modes set as a string don't have a picture aspect ratio, they match any.
+func sameMode(mode *outputs.Mode, current *outputs.Mode) bool {
+	return mode.Width == current.Width && mode.Height == current.Height && mode.Refresh == current.Refresh &&
+		(mode.PictureAspectRatio == "" || mode.PictureAspectRatio == current.PictureAspectRatio)
+}
 
-	if setState.Enabled != nil && *setState.Enabled == *currentState.Enabled {
-		setState.Enabled = nil
+// removeUnchanged unsets all fields of state which are already set in
+// current.
+// Fields a backend doesn't support are unset in current, and kept.
+func removeUnchanged(state *outputs.State, current *outputs.State) {
+	if state.Enabled != nil && current.Enabled != nil && *state.Enabled == *current.Enabled {
+		state.Enabled = nil
+	}
+	if state.Mode != nil && current.Mode != nil && sameMode(state.Mode, current.Mode) {
+		state.Mode = nil
+	}
+	if state.Power != nil && current.Power != nil && *state.Power == *current.Power {
+		state.Power = nil
+	}
+	if state.Scale != nil && current.Scale != nil && *state.Scale == *current.Scale {
+		state.Scale = nil
 	}
-	if setState.Mode != nil && *setState.Mode == *currentState.Mode {
-		setState.Mode = nil
+	if state.Transform != nil && current.Transform != nil && *state.Transform == *current.Transform {
+		state.Transform = nil
 	}
-	if setState.Power != nil && *setState.Power == *currentState.Power {
-		setState.Power = nil
+	if state.Position != nil && current.Position != nil && *state.Position == *current.Position {
+		state.Position = nil
 	}
-	if setState.Scale != nil && *setState.Scale == *currentState.Scale {
-		setState.Scale = nil
+	if state.AdaptiveSync != nil && current.AdaptiveSync != nil && *state.AdaptiveSync == *current.AdaptiveSync {
+		state.AdaptiveSync = nil
 	}
-	if setState.Transform != nil && *setState.Transform == *currentState.Transform {
-		setState.Scale = nil
+	if state.SubpixelHinting != nil && current.SubpixelHinting != nil && *state.SubpixelHinting == *current.SubpixelHinting {
+		state.SubpixelHinting = nil
 	}
-	if setState.Scenario != nil {
-		if setState.Scenario.Name == currentState.Scenario.Name && reflect.DeepEqual(setState.Scenario.Args, currentState.Scenario.Args) {
-			setState.Scenario = nil
+	if state.ScaleFilter != nil && current.ScaleFilter != nil && *state.ScaleFilter == *current.ScaleFilter {
+		state.ScaleFilter = nil
+	}
+	if state.MaxRenderTime != nil && current.MaxRenderTime != nil && *state.MaxRenderTime == *current.MaxRenderTime {
+		state.MaxRenderTime = nil
+	}
+	if state.Scenario != nil && current.Scenario != nil {
+		if state.Scenario.Name == current.Scenario.Name && reflect.DeepEqual(state.Scenario.Args, current.Scenario.Args) {
+			state.Scenario = nil
 		}
 	}
+}
+
+// arrangeCmd is the payload of the arrange topic.
+type arrangeCmd struct {
+	// one of outputs.ArrangeLeftToRight, outputs.ArrangeTopToBottom
+	Direction string `json:"direction"`
+	// sent back in the result
+	CorrelationID string `json:"correlation_id,omitempty"`
+}
 
-	output.SetState(setState)
+// decode the mqtt arrange command, move all enabled outputs next to each
+// other, and return the results of all moved outputs.
+// If moving one of them fails, the ones already moved are moved back, so
+// they don't overlap. Otherwise, the positions are remembered as desired.
+func (s *Server) handleArrangeCmd(payload []byte) *machineSetResult {
+	r := &machineSetResult{
+		Success: true,
+		Outputs: make(map[string]*setResult),
+	}
 
-	return nil
+	var cmd arrangeCmd
+	if err := json.Unmarshal(payload, &cmd); err != nil {
+		r.Success = false
+		r.Error = fmt.Sprintf("failed to parse arrange payload: %v", err)
+		return r
+	}
+	r.CorrelationID = cmd.CorrelationID
+
+	outs := s.backend.Outputs()
+	positions, err := outputs.Arrange(outs, cmd.Direction)
+	if err != nil {
+		r.Success = false
+		r.Error = err.Error()
+		return r
+	}
+
+	type move struct {
+		output   outputs.Output
+		previous *outputs.Position
+	}
+	var moved []move
+	for _, output := range outs {
+		name := *output.GetInfo().Name
+		position, ok := positions[name]
+		if !ok {
+			continue
+		}
+
+		// copied, backends might return a pointer to their current position.
+		var previous *outputs.Position
+		if current := output.GetState().Position; current != nil {
+			p := *current
+			previous = &p
+		}
+		result := s.setState(&setCmd{State: outputs.State{Position: position}, CorrelationID: cmd.CorrelationID}, output)
+		r.Outputs[name] = result
+		if !result.Success {
+			r.Success = false
+			r.Error = fmt.Sprintf("unable to move %v", name)
+			break
+		}
+		moved = append(moved, move{output: output, previous: previous})
+	}
+
+	if !r.Success {
+		for i := len(moved) - 1; i >= 0; i-- {
+			m := moved[i]
+			name := *m.output.GetInfo().Name
+			if m.previous == nil {
+				continue
+			}
+			result := s.setState(&setCmd{State: outputs.State{Position: m.previous}, CorrelationID: cmd.CorrelationID}, m.output)
+			if !result.Success {
+				log.WithField("outputName", name).WithField("error", result.Error).Error("unable to move output back")
+				r.Outputs[name] = result
+				continue
+			}
+			r.Outputs[name] = newSetResult(cmd.CorrelationID, result.State, errors.New("moved back"))
+		}
+		return r
+	}
+
+	for _, m := range moved {
+		s.setDesired(m.output, &outputs.State{Position: positions[*m.output.GetInfo().Name]})
+	}
+	return r
+}
+
+func (s *Server) getTopicPrefixForOutput(output outputs.Output) string {
+	return s.TopicPrefix + "/" + s.getOutputTopicName(output) + "@" + s.MachineID
+}
+
+func (s *Server) getTopicPrefixForMachine() string {
+	return s.TopicPrefix + "/" + s.MachineID
+}
+
+func (s *Server) getAvailabilityTopic() string {
+	return s.getTopicPrefixForMachine() + "/availability"
 }
 
-func (s *Server) getTopicPrefixForOutputName(name string) string {
-	return s.TopicPrefix + "/" + name + "@" + s.MachineID
+// getSenderID returns the identity sent along with results.
+func (s *Server) getSenderID() string {
+	return "display-agent@" + s.MachineID
 }
@@ -0,0 +1,376 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/flokli/display-agent/mqtt"
+	"github.com/flokli/display-agent/outputs"
+	"github.com/flokli/display-agent/outputs/simulated"
+)
+
+// testFixture returns the fixture of the simulated backend.
+// Both of its outputs show the same display, VGA-1 gets another serial, so
+// the state set for one output isn't restored on the other one.
+func testFixture(t *testing.T) []byte {
+	b, err := os.ReadFile("../test/testdata/swaymsg_get_outputs.txt")
+	if err != nil {
+		t.Fatalf("unable to read fixture: %v", err)
+	}
+	var fixture []map[string]interface{}
+	if err := json.Unmarshal(b, &fixture); err != nil {
+		t.Fatalf("unable to parse fixture: %v", err)
+	}
+	for _, output := range fixture {
+		if output["name"] == "VGA-1" {
+			output["serial"] = "CNK9280KNE"
+		}
+	}
+	if b, err = json.Marshal(fixture); err != nil {
+		t.Fatalf("unable to marshal fixture: %v", err)
+	}
+	return b
+}
+
+// runTestServer runs a server with the simulated backend, connected to a
+// fake broker. stop shuts it down, it's called once the test is done too.
+// configure is called before running the server.
+func runTestServer(t *testing.T, configure ...func(*Server)) (backend *simulated.Simulated, b *fakeBroker, stop func()) {
+	backend, err := simulated.New(testFixture(t), nil)
+	if err != nil {
+		t.Fatalf("unable to create backend: %v", err)
+	}
+
+	b = newFakeBroker()
+	connect = func(_ string, options mqtt.ConnectOptions) (mqtt.Client, error) {
+		options.OnConnect(b)
+		return b, nil
+	}
+	t.Cleanup(func() { connect = mqtt.Connect })
+
+	s := New("machine", "screens", backend)
+	for _, c := range configure {
+		c(s)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := s.Run(ctx, "tcp://broker:1883"); err != nil {
+		cancel()
+		t.Fatalf("unable to run server: %v", err)
+	}
+
+	stopped := false
+	stop = func() {
+		if stopped {
+			return
+		}
+		stopped = true
+		cancel()
+		s.Close()
+	}
+	t.Cleanup(stop)
+	return backend, b, stop
+}
+
+// publishedState returns the state retained for the output with the given
+// name.
+func publishedState(t *testing.T, b *fakeBroker, outputName string) *outputs.State {
+	var state outputs.State
+	if err := json.Unmarshal(b.Retained("screens/"+outputName+"@machine/state"), &state); err != nil {
+		t.Fatalf("unable to parse published state of %v: %v", outputName, err)
+	}
+	return &state
+}
+
+// formatState returns state as JSON, for error messages.
+func formatState(state *outputs.State) string {
+	b, _ := json.Marshal(state)
+	return string(b)
+}
+
+// lastResult returns the last result published to topic.
+func lastResult(t *testing.T, b *fakeBroker, topic string) *setResult {
+	published := b.Published(topic)
+	if len(published) == 0 {
+		t.Fatalf("no result published to %v", topic)
+	}
+
+	var result setResult
+	if err := json.Unmarshal([]byte(published[len(published)-1]), &result); err != nil {
+		t.Fatalf("unable to parse result: %v", err)
+	}
+	return &result
+}
+
+func TestRun(t *testing.T) {
+	_, b, stop := runTestServer(t)
+
+	if got := string(b.Retained("screens/machine/availability")); got != availabilityOnline {
+		t.Errorf("expected to be online, got %q", got)
+	}
+	if b.Retained("screens/machine/info") == nil {
+		t.Error("expected the machine info to be published")
+	}
+	for _, outputName := range []string{"HDMI-A-1", "VGA-1"} {
+		if state := publishedState(t, b, outputName); state.Enabled == nil || !*state.Enabled {
+			t.Errorf("unexpected state published for %v: %v", outputName, formatState(state))
+		}
+		if b.Retained("screens/"+outputName+"@machine/info") == nil {
+			t.Errorf("expected the info of %v to be published", outputName)
+		}
+	}
+
+	// the outputs are cleared, and the agent marked offline.
+	stop()
+	if got := string(b.Retained("screens/machine/availability")); got != availabilityOffline {
+		t.Errorf("expected to be offline, got %q", got)
+	}
+	for _, outputName := range []string{"HDMI-A-1", "VGA-1"} {
+		if b.Retained("screens/"+outputName+"@machine/state") != nil {
+			t.Errorf("expected the state of %v to be cleared", outputName)
+		}
+	}
+}
+
+// Updates of outputs removed already don't publish their cleared data again.
+func TestUpdateAfterRemove(t *testing.T) {
+	backend, b, _ := runTestServer(t, func(s *Server) {
+		s.HomeAssistantDiscoveryPrefix = "homeassistant"
+	})
+	powerTopic := "homeassistant/switch/machine/HDMI-A-1_power/config"
+	if b.Retained(powerTopic) == nil {
+		t.Fatal("expected the Home Assistant discovery to be published")
+	}
+
+	var output outputs.Output
+	for _, o := range backend.Outputs() {
+		if *o.GetInfo().Name == "HDMI-A-1" {
+			output = o
+		}
+	}
+	backend.Disconnect("HDMI-A-1")
+	backend.NotifyUpdate(output)
+
+	for _, topic := range []string{"screens/HDMI-A-1@machine/state", "screens/HDMI-A-1@machine/info", powerTopic} {
+		if b.Retained(topic) != nil {
+			t.Errorf("expected %v to stay cleared", topic)
+		}
+	}
+}
+
+func TestRunSetCmd(t *testing.T) {
+	backend, b, _ := runTestServer(t)
+	topicPrefix := "screens/HDMI-A-1@machine"
+
+	if err := b.Publish(&mqtt.Message{
+		Topic:   topicPrefix + "/set",
+		Payload: []byte(`{"correlation_id": "1", "scale": 2, "mode": "1280x1024", "scenario": {"name": "blank"}}`),
+	}); err != nil {
+		t.Fatalf("unable to publish: %v", err)
+	}
+
+	result := lastResult(t, b, topicPrefix+"/result")
+	if !result.Success || result.CorrelationID != "1" {
+		t.Fatalf("expected the command to succeed, got %+v", result)
+	}
+	if *result.State.Scale != 2 || result.State.Mode.Width != 1280 {
+		t.Errorf("expected the new state in the result, got %v", formatState(result.State))
+	}
+	if state := publishedState(t, b, "HDMI-A-1"); *state.Scale != 2 || state.Mode.Width != 1280 {
+		t.Errorf("expected the new state to be published, got %v", formatState(state))
+	}
+	if launches := backend.Launches(); len(launches) == 0 || launches[len(launches)-1].Scenario.Name != "blank" {
+		t.Errorf("expected the scenario to be launched, got %v", launches)
+	}
+	if state := publishedState(t, b, "VGA-1"); *state.Scale != 1 {
+		t.Errorf("expected other outputs to be unchanged, got %v", formatState(state))
+	}
+
+	// invalid fields are rejected as a whole, nothing is applied.
+	if err := b.Publish(&mqtt.Message{
+		Topic:   topicPrefix + "/set",
+		Payload: []byte(`{"correlation_id": "2", "scale": 1, "mode": "1x1"}`),
+	}); err != nil {
+		t.Fatalf("unable to publish: %v", err)
+	}
+
+	result = lastResult(t, b, topicPrefix+"/result")
+	if result.Success || result.CorrelationID != "2" || result.Errors["mode"] == nil {
+		t.Fatalf("expected the mode to be rejected, got %+v", result)
+	}
+	if state := publishedState(t, b, "HDMI-A-1"); *state.Scale != 2 {
+		t.Errorf("expected the scale to be unchanged, got %v", formatState(state))
+	}
+
+	// unparseable commands are rejected too.
+	if err := b.Publish(&mqtt.Message{Topic: topicPrefix + "/set", Payload: []byte(`{`)}); err != nil {
+		t.Fatalf("unable to publish: %v", err)
+	}
+	if result := lastResult(t, b, topicPrefix+"/result"); result.Success || result.Error == "" {
+		t.Errorf("expected an error for an invalid payload, got %+v", result)
+	}
+}
+
+func TestRunArrangeCmd(t *testing.T) {
+	_, b, _ := runTestServer(t)
+
+	if err := b.Publish(&mqtt.Message{
+		Topic:   "screens/machine/arrange",
+		Payload: []byte(`{"correlation_id": "1", "direction": "top-to-bottom"}`),
+	}); err != nil {
+		t.Fatalf("unable to publish: %v", err)
+	}
+
+	published := b.Published("screens/machine/result")
+	if len(published) == 0 {
+		t.Fatal("no result published")
+	}
+	var result machineSetResult
+	if err := json.Unmarshal([]byte(published[len(published)-1]), &result); err != nil {
+		t.Fatalf("unable to parse result: %v", err)
+	}
+	if !result.Success || result.CorrelationID != "1" || len(result.Outputs) != 2 {
+		t.Fatalf("expected both outputs to be arranged, got %+v", result)
+	}
+
+	// HDMI-A-1 was right of VGA-1, it's now above it.
+	if state := publishedState(t, b, "HDMI-A-1"); *state.Position != (outputs.Position{X: 0, Y: 0}) {
+		t.Errorf("expected HDMI-A-1 to be moved, got %v", formatState(state))
+	}
+	vga := publishedState(t, b, "VGA-1")
+	if vga.Position.X != 0 || vga.Position.Y == 0 {
+		t.Errorf("expected VGA-1 to be moved, got %v", formatState(vga))
+	}
+
+	// the positions are desired, like set via the set topic.
+	for outputName, position := range map[string]*outputs.Position{"HDMI-A-1": {X: 0, Y: 0}, "VGA-1": vga.Position} {
+		var desired desiredReport
+		if err := json.Unmarshal(b.Retained("screens/"+outputName+"@machine/desired"), &desired); err != nil {
+			t.Fatalf("unable to parse desired state: %v", err)
+		}
+		if desired.State == nil || desired.State.Position == nil || *desired.State.Position != *position {
+			t.Errorf("expected the position of %v to be desired, got %v", outputName, formatState(desired.State))
+		}
+	}
+}
+
+// failingBackend returns its outputs sorted by name, failing to move the one
+// named fail.
+type failingBackend struct {
+	*simulated.Simulated
+	fail string
+}
+
+func (b *failingBackend) Outputs() []outputs.Output {
+	outs := b.Simulated.Outputs()
+	sort.Slice(outs, func(i, j int) bool { return *outs[i].GetInfo().Name < *outs[j].GetInfo().Name })
+	for i, output := range outs {
+		if *output.GetInfo().Name == b.fail {
+			outs[i] = &immovableOutput{output}
+		}
+	}
+	return outs
+}
+
+type immovableOutput struct {
+	outputs.Output
+}
+
+func (o *immovableOutput) SetState(state *outputs.State) (*outputs.State, error) {
+	if state.Position != nil {
+		return o.GetState(), &outputs.FieldError{Field: "position", Err: errors.New("stuck")}
+	}
+	return o.Output.SetState(state)
+}
+
+// Outputs already moved are moved back if moving another one fails.
+func TestArrangeCmdRollback(t *testing.T) {
+	sim, err := simulated.New(testFixture(t), nil)
+	if err != nil {
+		t.Fatalf("unable to create backend: %v", err)
+	}
+	for _, name := range []string{"HDMI-A-1", "VGA-1"} {
+		if err := sim.Connect(name); err != nil {
+			t.Fatalf("unable to connect %v: %v", name, err)
+		}
+	}
+	backend := &failingBackend{Simulated: sim, fail: "VGA-1"}
+	s := New("machine", "screens", backend)
+
+	result := s.handleArrangeCmd([]byte(`{"direction": "top-to-bottom"}`))
+	if result.Success || result.Outputs["VGA-1"] == nil || result.Outputs["VGA-1"].Errors["position"] == nil {
+		t.Fatalf("expected moving VGA-1 to fail, got %+v", result)
+	}
+	hdmi := result.Outputs["HDMI-A-1"]
+	if hdmi == nil || hdmi.Success || *hdmi.State.Position != (outputs.Position{X: 1050, Y: 0}) {
+		t.Errorf("expected HDMI-A-1 to be moved back, got %v", formatState(hdmi.State))
+	}
+	for _, output := range sim.Outputs() {
+		if desired, _ := s.desiredState(output); desired != nil && desired.Position != nil {
+			t.Errorf("expected no position to be desired for %v", *output.GetInfo().Name)
+		}
+	}
+
+	if result := s.handleArrangeCmd([]byte(`{"direction": "diagonal"}`)); result.Success || result.Error == "" {
+		t.Errorf("expected an invalid direction to be rejected, got %+v", result)
+	}
+}
+
+// Fields already set are unset, others kept, and no field is unset because of
+// another one being unchanged.
+func TestRemoveUnchanged(t *testing.T) {
+	current := outputs.State{
+		Scale:     ptr(2.0),
+		Transform: ptr("90"),
+		Power:     ptr(true),
+		Scenario:  &outputs.Scenario{Name: "url", Args: []string{"https://example.com"}},
+	}
+
+	// used to unset the scale instead of the transform.
+	state := outputs.State{Scale: ptr(1.0), Transform: ptr("90")}
+	removeUnchanged(&state, &current)
+	if !reflect.DeepEqual(state, outputs.State{Scale: ptr(1.0)}) {
+		t.Errorf("expected only the transform to be unset, got %v", formatState(&state))
+	}
+
+	state = outputs.State{
+		Scale:     ptr(2.0),
+		Transform: ptr("180"),
+		Power:     ptr(true),
+		Scenario:  &outputs.Scenario{Name: "url", Args: []string{"https://example.org"}},
+		// not supported by the backend
+		AdaptiveSync: ptr("enabled"),
+	}
+	removeUnchanged(&state, &current)
+	expected := outputs.State{
+		Transform:    ptr("180"),
+		Scenario:     &outputs.Scenario{Name: "url", Args: []string{"https://example.org"}},
+		AdaptiveSync: ptr("enabled"),
+	}
+	if !reflect.DeepEqual(state, expected) {
+		t.Errorf("expected %v, got %v", formatState(&expected), formatState(&state))
+	}
+}
+
+func TestRemoveUnchangedStringMode(t *testing.T) {
+	var state outputs.State
+	if err := json.Unmarshal([]byte(`{"mode": "1920x1080@60000"}`), &state); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	current := outputs.State{Mode: &outputs.Mode{Width: 1920, Height: 1080, Refresh: 60000, PictureAspectRatio: "none"}}
+
+	removeUnchanged(&state, &current)
+	if state.Mode != nil {
+		t.Errorf("expected the mode to be unset, got %v", state.Mode)
+	}
+
+	state.Mode = &outputs.Mode{Width: 1920, Height: 1080, Refresh: 60000, PictureAspectRatio: "16:9"}
+	removeUnchanged(&state, &current)
+	if state.Mode == nil {
+		t.Error("expected a different picture aspect ratio to be kept")
+	}
+}